@@ -0,0 +1,297 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// exportManifestName is the name of the manifest describing an export, the first entry of its archive.
+const exportManifestName = ".export.json"
+
+// exportVersion is the version of the export format written by [exportState].
+const exportVersion = 1
+
+// exportManifest describes an export archive.
+type exportManifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Files     bool      `json:"files"` // Files reports whether the archive holds the content of stored files, besides their metadata.
+}
+
+// adminMain implements the admin subcommand, operating on the upload directory of a stopped server.
+func adminMain(args []string) int {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s admin export|import [flags]\n", os.Args[0])
+	}
+
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+
+	switch args[0] {
+	case "export":
+		return exportMain(args[1:])
+	case "import":
+		return importMain(args[1:])
+	default:
+		usage()
+		return 2
+	}
+}
+
+// exportMain implements the admin export subcommand.
+func exportMain(args []string) int {
+	fs := flag.NewFlagSet("admin export", flag.ExitOnError)
+	dir := fs.String("dir", "/tmp", "The upload directory to export (default: '/tmp').")
+	out := fs.String("o", "", "The archive to write, '-' writes to standard output (default: required).")
+	files := fs.Bool("files", false, "Include the content of stored files, not only their metadata (default: false).")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s admin export [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *out == "" {
+		fs.Usage()
+		return 2
+	}
+
+	w := os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+
+	n, err := exportState(w, *dir, *files)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %d files from %s\n", n, *dir)
+	return 0
+}
+
+// importMain implements the admin import subcommand.
+func importMain(args []string) int {
+	fs := flag.NewFlagSet("admin import", flag.ExitOnError)
+	dir := fs.String("dir", "/tmp", "The upload directory to import into (default: '/tmp').")
+	overwrite := fs.Bool("overwrite", false, "Overwrite existing files instead of failing (default: false).")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s admin import [flags] archive\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	r := os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+
+	n, err := importState(r, *dir, *overwrite)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import failed after %d files: %v\n", n, err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "imported %d files into %s\n", n, *dir)
+	return 0
+}
+
+// exportable reports whether the file at rel, relative to the upload directory, belongs in an export.
+// Metadata and bucket configurations always do, the content of stored and deleted files and their attachments only if files
+// is set. In-flight upload sessions, temporary files and anything else found in the upload directory never do.
+func exportable(rel string, files bool) bool {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	name, dir := parts[len(parts)-1], parts[:len(parts)-1]
+
+	if len(dir) > 0 && dir[0] == sessionsDir || slices.Contains(dir, transactionsDir) || strings.HasSuffix(name, ".tmp") {
+		return false
+	}
+	if slices.Contains(dir, metadataDir) {
+		return true
+	}
+
+	// Files are stored in the upload directory and the directories of buckets, or in their trash
+	if len(dir) >= 2 && dir[0] == bucketsDir {
+		if len(dir) == 2 && name == bucketConfigFile {
+			return true
+		}
+		dir = dir[2:]
+	}
+	if len(dir) > 0 && dir[0] == trashDir {
+		dir = dir[1:]
+	}
+	if len(dir) == 2 && dir[0] == attachmentsDir {
+		return files && validFileName(dir[1]) && validFileName(name)
+	}
+	return files && len(dir) == 0 && validFileName(name)
+}
+
+// exportState writes the state of the upload directory dir to w as a gzip compressed tar archive,
+// returning the number of files exported.
+func exportState(w io.Writer, dir string, files bool) (int, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifest, err := json.Marshal(exportManifest{Version: exportVersion, CreatedAt: time.Now().UTC(), Files: files})
+	if err != nil {
+		return 0, err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: exportManifestName, Mode: 0o644, Size: int64(len(manifest)), ModTime: time.Now()})
+	if err == nil {
+		_, err = tw.Write(manifest)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || !exportable(rel, files) {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(tw, f, hdr.Size); err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return n, err
+	}
+	return n, gz.Close()
+}
+
+// importState restores the state exported by [exportState] read from r into the upload directory dir,
+// returning the number of files imported. Existing files are only replaced if overwrite is set.
+func importState(r io.Reader, dir string, overwrite bool) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return 0, err
+	}
+	if hdr.Name != exportManifestName {
+		return 0, errors.New("not an export archive: missing manifest")
+	}
+
+	var manifest exportManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return 0, fmt.Errorf("reading manifest: %w", err)
+	}
+	if manifest.Version != exportVersion {
+		return 0, fmt.Errorf("unsupported export version %d", manifest.Version)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return n, fmt.Errorf("invalid path %q in archive", hdr.Name)
+		}
+
+		path := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return n, err
+		}
+
+		f, err := os.OpenFile(path, flags, fs.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return n, err
+		}
+		_, err = io.Copy(f, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return n, fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+
+		os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+		n++
+	}
+
+	return n, nil
+}
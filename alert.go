@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Gabriel-Ladzaretti/go-multipart/internal/httpx"
+)
+
+// alertMinRequests is the number of requests a window must see for its error rate to be alerted on,
+// so a single failure on an idle server does not page anyone.
+const alertMinRequests = 20
+
+// alertRecentErrors is the number of recent failed requests sent along with alerts.
+const alertRecentErrors = 10
+
+// alertPayload is the body of alert webhooks. Its text field makes it a valid Slack incoming webhook message.
+type alertPayload struct {
+	Text         string    `json:"text"`
+	Alert        string    `json:"alert"`  // Alert is "error_rate" or "disk_usage".
+	Status       string    `json:"status"` // Status is "firing" when the threshold is crossed, "resolved" once back under.
+	Value        float64   `json:"value"`
+	Threshold    float64   `json:"threshold"`
+	Host         string    `json:"host"`
+	Time         time.Time `json:"time"`
+	RecentErrors []string  `json:"recent_errors,omitempty"` // RecentErrors describes the last failed requests.
+	Details      []string  `json:"details,omitempty"`       // Details lists what one-off alerts are about, e.g. corrupted files.
+}
+
+// Alerter notifies a webhook when the rate of server errors or the disk usage of the upload directory
+// crosses their thresholds, and again once they are back under. It is meant for small deployments
+// without external monitoring, every replica alerting on its own requests.
+type Alerter struct {
+	webhook   string
+	client    *http.Client
+	window    time.Duration
+	errorRate float64 // errorRate is the fraction of 5xx responses in a window alerted on, 0 disables it.
+	diskUsage float64 // diskUsage is the fraction of the disk used alerted on, 0 disables it.
+	dir       string
+	logger    *log.Logger
+
+	mu       sync.Mutex
+	requests int
+	errors   int
+	recent   []string        // recent describes the last failed requests, oldest first.
+	firing   map[string]bool // firing holds the alerts that fired and are not resolved yet.
+}
+
+// newAlerter creates the alerter configured by config, posting alerts with outbound, or nil if alerting is disabled.
+func newAlerter(config Config, outbound *Outbound, logger *log.Logger) (*Alerter, error) {
+	if config.alertWebhook == "" {
+		return nil, nil
+	}
+	if config.alertWindow <= 0 {
+		return nil, fmt.Errorf("invalid alert window %v", config.alertWindow)
+	}
+
+	return &Alerter{
+		webhook:   config.alertWebhook,
+		client:    outbound.client(10 * time.Second),
+		window:    config.alertWindow,
+		errorRate: config.alertErrorRate,
+		diskUsage: config.alertDiskUsage / 100,
+		dir:       config.dir,
+		logger:    logger,
+		firing:    make(map[string]bool),
+	}, nil
+}
+
+// middleware counts the requests served by next and their server errors.
+func (a *Alerter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := httpx.NewStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+
+		a.requests++
+		if rec.Status < 500 {
+			return
+		}
+		a.errors++
+		a.recent = append(a.recent, fmt.Sprintf("%s %s %s %s %d",
+			time.Now().UTC().Format(time.RFC3339), httpx.RequestIDFromContext(r.Context()), r.Method, r.URL.Path, rec.Status))
+		if len(a.recent) > alertRecentErrors {
+			a.recent = a.recent[1:]
+		}
+	})
+}
+
+// run checks the thresholds at the end of every window until ctx is done.
+func (a *Alerter) run(ctx context.Context) {
+	ticker := time.NewTicker(a.window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		a.check(ctx)
+	}
+}
+
+// check evaluates the window that just ended, starting a new one, and the disk usage.
+func (a *Alerter) check(ctx context.Context) {
+	a.mu.Lock()
+	requests, errors := a.requests, a.errors
+	recent := append([]string(nil), a.recent...)
+	a.requests, a.errors = 0, 0
+	a.mu.Unlock()
+
+	// A firing alert is resolved by quiet windows too
+	if a.errorRate > 0 && (requests >= alertMinRequests || a.firing["error_rate"]) {
+		rate := 0.0
+		if requests > 0 {
+			rate = float64(errors) / float64(requests)
+		}
+		a.update(ctx, "error_rate", rate, a.errorRate, recent,
+			fmt.Sprintf("%d of %d requests failed with a server error in the last %v (%.1f%%)", errors, requests, a.window, rate*100))
+	}
+
+	if a.diskUsage > 0 {
+		used, total, err := diskUsage(a.dir)
+		if err != nil {
+			a.logger.Printf("Error checking disk usage: %v", err)
+			return
+		}
+		usage := float64(used) / float64(total)
+		a.update(ctx, "disk_usage", usage, a.diskUsage, nil,
+			fmt.Sprintf("The upload directory disk is %.1f%% full, %d MB free", usage*100, (total-used)>>20))
+	}
+}
+
+// update fires the alert if value crossed threshold, or resolves it if it fired and value is back under.
+func (a *Alerter) update(ctx context.Context, alert string, value, threshold float64, recent []string, summary string) {
+	crossed := value >= threshold
+	if crossed == a.firing[alert] {
+		return
+	}
+	a.firing[alert] = crossed
+
+	status := "resolved"
+	if crossed {
+		status = "firing"
+	} else {
+		recent = nil
+	}
+
+	a.send(ctx, alertPayload{
+		Alert:        alert,
+		Status:       status,
+		Value:        value,
+		Threshold:    threshold,
+		RecentErrors: recent,
+	}, summary)
+}
+
+// event sends a one-off alert, which is never resolved, e.g. for corruption found by the [Scrubber].
+func (a *Alerter) event(ctx context.Context, alert, summary string, details []string) {
+	a.send(ctx, alertPayload{Alert: alert, Status: "firing", Value: float64(len(details)), Details: details}, summary)
+}
+
+// send completes payload with summary, the host and time and posts it to the webhook, logging failures.
+func (a *Alerter) send(ctx context.Context, payload alertPayload, summary string) {
+	host, _ := os.Hostname()
+	payload.Text = fmt.Sprintf("[%s] usrv on %s: %s", payload.Status, host, summary)
+	payload.Host = host
+	payload.Time = time.Now().UTC()
+
+	a.logger.Printf("Alert %s %s: %s", payload.Alert, payload.Status, summary)
+	if err := a.notify(ctx, payload); err != nil {
+		a.logger.Printf("Error sending alert: %v", err)
+	}
+}
+
+// notify posts payload to the webhook.
+func (a *Alerter) notify(ctx context.Context, payload alertPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("alert webhook: %s", resp.Status)
+	}
+	return nil
+}
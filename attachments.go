@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// attachmentsDir is the directory, relative to the upload directory, where the auxiliary documents
+// attached to stored files are kept, in one directory per file named after it.
+const attachmentsDir = ".attachments"
+
+// Attachment describes an auxiliary document attached to a stored file, such as its SBOM or
+// provenance attestation. Attachments are listed in the [Metadata] of their file, keyed by kind.
+type Attachment struct {
+	Size        int64     `json:"size" xml:"size"`
+	ContentType string    `json:"content_type,omitempty" xml:"content_type,omitempty"`
+	SHA256      string    `json:"sha256" xml:"sha256"`
+	UploadedAt  time.Time `json:"uploaded_at" xml:"uploaded_at"`
+}
+
+// attachmentsPath returns the path of the directory holding the attachments of the file name stored in baseDir.
+func attachmentsPath(baseDir, name string) string {
+	return filepath.Join(baseDir, attachmentsDir, name)
+}
+
+// moveAttachments renames the attachments of the file name, if any, from the fromDir to the toDir upload directory.
+func moveAttachments(fromDir, toDir, name string) error {
+	if _, err := os.Stat(attachmentsPath(fromDir, name)); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	err := createIn(filepath.Join(toDir, attachmentsDir), func() error {
+		return os.Rename(attachmentsPath(fromDir, name), attachmentsPath(toDir, name))
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// attachmentParams returns the validated file name and attachment kind of r, writing an error response if either is invalid.
+func attachmentParams(w http.ResponseWriter, r *http.Request) (name, kind string, ok bool) {
+	name, kind = r.PathValue("name"), r.PathValue("kind")
+	if !validFileName(name) {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return "", "", false
+	}
+	if kind != "" && !validFileName(kind) {
+		http.Error(w, "Invalid attachment kind", http.StatusBadRequest)
+		return "", "", false
+	}
+	return name, kind, true
+}
+
+// fileMetadata loads the metadata of the stored file name, falling back to the file itself if it has none.
+// Files archived to the cold tier keep their metadata, so they need not be restored.
+func fileMetadata(baseDir, name string) (Metadata, error) {
+	meta, err := readMetadata(baseDir, name)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return meta, err
+	}
+
+	fi, err := os.Stat(filepath.Join(baseDir, name))
+	if err != nil {
+		return meta, err
+	}
+	return Metadata{Name: name, Size: fi.Size(), UploadedAt: fi.ModTime().UTC()}, nil
+}
+
+// putAttachment handles PUT /files/{name}/attachments/{kind}, storing the request body as the attachment
+// of the given kind of the file name, replacing any previous one. Attachments are limited to maxSize bytes,
+// 0 meaning unlimited.
+func putAttachment(logger *log.Logger, baseDir string, maxSize int64, fsync FsyncPolicy, indexes *FileIndexes) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, kind, ok := attachmentParams(w, r)
+		if !ok {
+			return
+		}
+
+		meta, err := fileMetadata(baseDir, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error reading metadata: %v", err)
+			http.Error(w, "Could not store attachment", http.StatusInternalServerError)
+			return
+		}
+
+		dir := attachmentsPath(baseDir, name)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			logger.Printf("Error creating attachments directory: %v", err)
+			http.Error(w, "Could not store attachment", http.StatusInternalServerError)
+			return
+		}
+
+		tmp, err := os.CreateTemp(dir, "."+kind+"-*.tmp")
+		if err != nil {
+			logger.Printf("Error creating attachment: %v", err)
+			http.Error(w, "Could not store attachment", http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		body := io.Reader(r.Body)
+		if maxSize > 0 {
+			body = http.MaxBytesReader(w, r.Body, maxSize)
+		}
+
+		h := sha256.New()
+		n, err := io.Copy(io.MultiWriter(tmp, h), body)
+		if err != nil {
+			logger.Printf("Error writing attachment: %v", err)
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, fmt.Sprintf("Attachment exceeds %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, "Could not store attachment", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if err := fsync.sync(tmp, dir); err != nil {
+			logger.Printf("Error syncing attachment: %v", err)
+			http.Error(w, "Could not store attachment", http.StatusInternalServerError)
+			return
+		}
+
+		if err := os.Rename(tmp.Name(), filepath.Join(dir, kind)); err != nil {
+			logger.Printf("Error storing attachment: %v", err)
+			http.Error(w, "Could not store attachment", http.StatusInternalServerError)
+			return
+		}
+
+		if meta.Attachments == nil {
+			meta.Attachments = make(map[string]Attachment)
+		}
+		meta.Attachments[kind] = Attachment{
+			Size:        n,
+			ContentType: r.Header.Get("Content-Type"),
+			SHA256:      hex.EncodeToString(h.Sum(nil)),
+			UploadedAt:  time.Now().UTC(),
+		}
+		if err := writeMetadata(baseDir, meta, indexes); err != nil {
+			logger.Printf("Error writing metadata: %v", err)
+			http.Error(w, "Could not store attachment", http.StatusInternalServerError)
+			return
+		}
+
+		infof(logger, "Attachment stored successfully: %s/%s\n", name, kind)
+		fmt.Fprintf(w, "Attachment stored successfully: %s/%s\n", name, kind)
+	})
+}
+
+// getAttachment handles GET /files/{name}/attachments/{kind}, serving the attachment of the given kind of the file name.
+func getAttachment(logger *log.Logger, baseDir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, kind, ok := attachmentParams(w, r)
+		if !ok {
+			return
+		}
+
+		meta, err := readMetadata(baseDir, name)
+		a, found := meta.Attachments[kind]
+		if errors.Is(err, fs.ErrNotExist) || err == nil && !found {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error reading metadata: %v", err)
+			http.Error(w, "Could not open attachment", http.StatusInternalServerError)
+			return
+		}
+
+		f, err := os.Open(filepath.Join(attachmentsPath(baseDir, name), kind))
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error opening attachment: %v", err)
+			http.Error(w, "Could not open attachment", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		if a.ContentType != "" {
+			w.Header().Set("Content-Type", a.ContentType)
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeContent(w, r, kind, a.UploadedAt, f)
+	})
+}
+
+// listAttachments handles GET /files/{name}/attachments, responding with the attachments of the file name keyed by kind,
+// or listed in an XML <attachments> document for clients preferring XML.
+func listAttachments(logger *log.Logger, baseDir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, _, ok := attachmentParams(w, r)
+		if !ok {
+			return
+		}
+
+		meta, err := fileMetadata(baseDir, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error reading metadata: %v", err)
+			http.Error(w, "Could not list attachments", http.StatusInternalServerError)
+			return
+		}
+
+		attachments := meta.Attachments
+		if attachments == nil {
+			attachments = map[string]Attachment{}
+		}
+
+		list := newXMLAttachmentList(attachments)
+		if list == nil {
+			list = &xmlAttachmentList{}
+		}
+		writeNegotiated(w, r, attachments, list)
+	})
+}
+
+// deleteAttachment handles DELETE /files/{name}/attachments/{kind}, removing the attachment of the given kind of the file name.
+func deleteAttachment(logger *log.Logger, baseDir string, indexes *FileIndexes) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, kind, ok := attachmentParams(w, r)
+		if !ok {
+			return
+		}
+
+		meta, err := readMetadata(baseDir, name)
+		if _, found := meta.Attachments[kind]; errors.Is(err, fs.ErrNotExist) || err == nil && !found {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error reading metadata: %v", err)
+			http.Error(w, "Could not delete attachment", http.StatusInternalServerError)
+			return
+		}
+
+		delete(meta.Attachments, kind)
+		if err := writeMetadata(baseDir, meta, indexes); err != nil {
+			logger.Printf("Error writing metadata: %v", err)
+			http.Error(w, "Could not delete attachment", http.StatusInternalServerError)
+			return
+		}
+
+		err = os.Remove(filepath.Join(attachmentsPath(baseDir, name), kind))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Printf("Error deleting attachment: %v", err)
+		}
+		// The directory is only removed once empty
+		os.Remove(attachmentsPath(baseDir, name))
+
+		infof(logger, "Attachment deleted successfully: %s/%s\n", name, kind)
+		fmt.Fprintf(w, "Attachment deleted successfully: %s/%s\n", name, kind)
+	})
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Gabriel-Ladzaretti/go-multipart/internal/httpx"
+)
+
+// tarpitMaxBodySize is the maximum number of request body bytes the tarpit
+// reads while collecting details of an unauthorized upload attempt.
+const tarpitMaxBodySize = 1 << 20
+
+// errUnauthenticated reports a request an [Authenticator] does not accept.
+var errUnauthenticated = errors.New("unauthenticated")
+
+// Authenticator authenticates a request. It returns the request to pass on, which may differ from r,
+// or [errUnauthenticated] if it does not accept r. Other errors report a request that could not be
+// authenticated for now, e.g. with [errMemoryBudgetExhausted].
+type Authenticator func(r *http.Request) (*http.Request, error)
+
+// NewAuthMiddleware creates a middleware that passes requests accepted by any of
+// the authenticators to the wrapped handler. All other requests are served by unauthorized,
+// unless an authenticator failed otherwise, which is responded to with 503 Service Unavailable.
+func NewAuthMiddleware(unauthorized http.Handler, authenticators ...Authenticator) httpx.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, authenticate := range authenticators {
+				authenticated, err := authenticate(r)
+				if errors.Is(err, errUnauthenticated) {
+					continue
+				}
+				if err != nil {
+					retryAfter(w, time.Second)
+					http.Error(w, "Server is busy, retry later", http.StatusServiceUnavailable)
+					return
+				}
+
+				// The server only closes the body it read the request with, not one an authenticator replaced it with
+				defer authenticated.Body.Close()
+				next.ServeHTTP(w, authenticated)
+				return
+			}
+
+			unauthorized.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bearerTokenAuthenticator returns an [Authenticator] accepting requests
+// carrying token in their Authorization header.
+func bearerTokenAuthenticator(token string) Authenticator {
+	return func(r *http.Request) (*http.Request, error) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			return r, errUnauthenticated
+		}
+		return r, nil
+	}
+}
+
+// unauthorized returns an HTTP handler responding with 401 Unauthorized.
+func unauthorized() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="usrv"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// tarpit returns an HTTP handler for unauthorized upload attempts that logs
+// the full request details, stalls for delay and then fakes a successful upload, answered like real
+// ones with 201 Created, a Location header pointing at where the file would be stored and the success template if
+// set. The uploaded content is read up to [tarpitMaxBodySize] bytes and discarded.
+func tarpit(logger *log.Logger, delay time.Duration, success ResponseTemplate) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := httpx.RequestIDFromContext(r.Context())
+
+		r.Body = io.NopCloser(io.LimitReader(r.Body, tarpitMaxBodySize))
+
+		var filenames []string
+		if mr, err := r.MultipartReader(); err == nil {
+			for {
+				part, err := mr.NextPart()
+				if err != nil {
+					break
+				}
+				if part.FileName() != "" {
+					filenames = append(filenames, part.FileName())
+				}
+				io.Copy(io.Discard, part)
+			}
+		}
+		io.Copy(io.Discard, r.Body)
+
+		logger.Printf("Tarpit: %s unauthorized %s %s from %s; files: %q; headers: %v",
+			requestID, r.Method, r.URL, r.RemoteAddr, filenames, r.Header)
+
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+
+		// Only names real uploads would be stored under end up in the response
+		filename := "upload"
+		if len(filenames) > 0 && validFileName(filenames[0]) {
+			filename = filenames[0]
+		}
+
+		filesURL := "/files/"
+		if bucket := r.PathValue("bucket"); validBucketName(bucket) {
+			filesURL = "/buckets/" + bucket + "/files/"
+		}
+		w.Header().Set("Location", requestOrigin(r)+filesURL+url.PathEscape(filename))
+
+		file := Metadata{Name: filename, UploadedAt: time.Now().UTC(), RequestID: requestID}
+		ok, err := success.write(w, uploadResponse{RequestID: requestID, Status: http.StatusCreated, File: file, Files: []Metadata{file}})
+		if err != nil {
+			logger.Printf("Error writing upload response: %v", err)
+		}
+		if !ok {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, "File uploaded successfully: %s\n", filename)
+		}
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTarpitFakesCreated(t *testing.T) {
+	_, url := newTestServer(t, "-auth-token", "secret", "-tarpit", "-tarpit-delay", "0", "-trusted-proxies", "127.0.0.1")
+
+	var body strings.Builder
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("upload", "report 1.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("content"))
+	mw.Close()
+
+	req, err := http.NewRequest(http.MethodPost, url+"/upload", strings.NewReader(body.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "files.example.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+	if got, want := resp.Header.Get("Location"), "https://files.example.com/files/report%201.pdf"; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+}
+
+func TestTarpitOnlyUploads(t *testing.T) {
+	_, url := newTestServer(t, "-auth-token", "secret", "-tarpit", "-tarpit-delay", "0")
+
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodPost, "/upload", http.StatusCreated},
+		{http.MethodPost, "/upload/json", http.StatusCreated},
+		{http.MethodPost, "/upload/batch", http.StatusCreated},
+		{http.MethodPost, "/uploads", http.StatusCreated},
+		{http.MethodGet, "/files/a.txt", http.StatusUnauthorized},
+		{http.MethodDelete, "/files/a.txt", http.StatusUnauthorized},
+		{http.MethodPatch, "/files/a.txt", http.StatusUnauthorized},
+		{http.MethodGet, "/search?q=a", http.StatusUnauthorized},
+		{http.MethodGet, "/manifest", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, url+tt.path, strings.NewReader("content"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestTarpitLocationOmitsInvalidNames(t *testing.T) {
+	_, url := newTestServer(t, "-auth-token", "secret", "-tarpit", "-tarpit-delay", "0")
+
+	var body strings.Builder
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("upload", ".htaccess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("content"))
+	mw.Close()
+
+	req, err := http.NewRequest(http.MethodPost, url+"/upload", strings.NewReader(body.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if got, want := resp.Header.Get("Location"), url+"/files/upload"; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+}
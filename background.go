@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+)
+
+// IOPriority is the I/O scheduling priority of background jobs. It implements [flag.Value].
+type IOPriority string
+
+const (
+	IOPriorityIdle   IOPriority = "idle"   // IOPriorityIdle only gets disk time when no other process needs it.
+	IOPriorityLow    IOPriority = "low"    // IOPriorityLow is the lowest best-effort priority.
+	IOPriorityNormal IOPriority = "normal" // IOPriorityNormal leaves the priority unchanged.
+)
+
+func (p *IOPriority) String() string {
+	return string(*p)
+}
+
+func (p *IOPriority) Set(v string) error {
+	switch IOPriority(v) {
+	case IOPriorityIdle, IOPriorityLow, IOPriorityNormal:
+		*p = IOPriority(v)
+		return nil
+	default:
+		return fmt.Errorf("unknown I/O priority %q, expected one of idle, low or normal", v)
+	}
+}
+
+// JobRunner runs the passes of background maintenance jobs, such as trash purges, cold tier
+// migrations and backups, at a lowered CPU and I/O priority and with bounded concurrency,
+// so they do not compete with live uploads for the disk.
+type JobRunner struct {
+	slots  chan struct{} // slots bounds the passes running at once, nil if unbounded.
+	nice   int
+	io     IOPriority
+	logger *log.Logger
+}
+
+// newJobRunner creates the job runner configured by config.
+func newJobRunner(config Config, logger *log.Logger) *JobRunner {
+	j := &JobRunner{nice: config.backgroundNice, io: config.backgroundIOPriority, logger: logger}
+	if config.backgroundConcurrency > 0 {
+		j.slots = make(chan struct{}, config.backgroundConcurrency)
+	}
+	return j
+}
+
+// Do runs the pass fn once a slot is free, waiting for it to return. fn runs on an OS thread of its own
+// whose priority is lowered, and which exits with fn, so the priority does not leak to other goroutines.
+// Work fn hands off to other goroutines runs at normal priority. A nil JobRunner runs fn as is.
+func (j *JobRunner) Do(fn func()) {
+	if j == nil {
+		fn()
+		return
+	}
+
+	if j.slots != nil {
+		j.slots <- struct{}{}
+		defer func() { <-j.slots }()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		// Never unlocked, so the thread is terminated when the goroutine exits
+		runtime.LockOSThread()
+		if err := lowerThreadPriority(j.nice, j.io); err != nil {
+			j.logger.Printf("Error lowering background job priority: %v", err)
+		}
+		fn()
+	}()
+	<-done
+}
@@ -0,0 +1,38 @@
+package main
+
+import "syscall"
+
+// I/O priority classes and scope of ioprio_set(2).
+const (
+	ioprioClassBE    = 2
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+	ioprioWhoProcess = 1
+)
+
+// lowerThreadPriority sets the nice level and I/O priority of the calling thread, which must be locked
+// to its goroutine. On Linux both apply to the thread alone. A nice level of 0 leaves the CPU priority unchanged.
+func lowerThreadPriority(nice int, io IOPriority) error {
+	tid := syscall.Gettid()
+
+	if nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice); err != nil {
+			return err
+		}
+	}
+
+	var prio int
+	switch io {
+	case IOPriorityIdle:
+		prio = ioprioClassIdle << ioprioClassShift
+	case IOPriorityLow:
+		prio = ioprioClassBE<<ioprioClassShift | 7
+	default:
+		return nil
+	}
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio)); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// lowerThreadPriority is not supported on this platform, where priorities apply to the whole process.
+func lowerThreadPriority(nice int, io IOPriority) error {
+	return nil
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Name pattern of the snapshots written by [Backup], which sort by time.
+const (
+	snapshotPrefix = "usrv-"
+	snapshotSuffix = ".tar.gz"
+)
+
+// backupSyncStateFile is the file, relative to the backup directory, recording the files synced to the
+// secondary storage, so restarts do not sync everything again.
+const backupSyncStateFile = ".synced.json"
+
+// Backup metrics, published through [expvar].
+var (
+	backupRuns        = expvar.NewInt("backup_runs")         // backupRuns counts backup runs.
+	backupErrors      = expvar.NewInt("backup_errors")       // backupErrors counts failed backup runs.
+	backupLastSuccess = expvar.NewInt("backup_last_success") // backupLastSuccess is the Unix time of the last successful backup.
+	backupSyncedFiles = expvar.NewInt("backup_synced_files") // backupSyncedFiles counts files synced to the secondary storage.
+)
+
+// BackupStatus is the outcome of the last backups, see [Backup.Status].
+type BackupStatus struct {
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	LastSnapshot string     `json:"last_snapshot,omitempty"`
+	SyncedFiles  int        `json:"synced_files"` // SyncedFiles is the number of files synced by the last run.
+}
+
+// Backup periodically snapshots the metadata of an upload directory, see [exportState],
+// and optionally syncs the upload directory to an S3 compatible bucket.
+// A nil *Backup is valid and never backs anything up.
+type Backup struct {
+	baseDir  string
+	dir      string        // dir is the directory snapshots are written to.
+	keep     int           // keep is the number of snapshots kept.
+	interval time.Duration // interval is the time between backups.
+	store    *s3Client     // store is the secondary storage the upload directory is synced to, nil if disabled.
+	prefix   string        // prefix is prepended to the paths of synced files to form their object keys.
+	logger   *log.Logger
+
+	mu     sync.Mutex
+	status BackupStatus
+	synced map[string]string // synced maps the paths of synced files to their size and modification time.
+}
+
+// newBackup returns the backup of the upload directory configured by config, reaching S3 with outbound, or nil if
+// backups are disabled.
+func newBackup(config Config, outbound *Outbound, logger *log.Logger) (*Backup, error) {
+	if config.backupInterval == 0 {
+		return nil, nil
+	}
+
+	if config.backupDir == "" {
+		return nil, errors.New("backups require a backup directory")
+	}
+	if err := os.MkdirAll(config.backupDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	b := &Backup{
+		baseDir:  config.dir,
+		dir:      config.backupDir,
+		keep:     max(config.backupKeep, 1),
+		interval: config.backupInterval,
+		prefix:   config.backupS3Prefix,
+		logger:   logger,
+		synced:   make(map[string]string),
+	}
+
+	if config.backupS3Bucket != "" {
+		store, err := newS3Client(config.tierS3Endpoint, config.tierS3Region, config.backupS3Bucket, outbound)
+		if err != nil {
+			return nil, err
+		}
+		b.store = store
+
+		data, err := os.ReadFile(filepath.Join(b.dir, backupSyncStateFile))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			if err := json.Unmarshal(data, &b.synced); err != nil {
+				return nil, fmt.Errorf("reading backup sync state: %w", err)
+			}
+		}
+	}
+
+	return b, nil
+}
+
+// Status returns the outcome of the last backups, nil if backups are disabled.
+func (b *Backup) Status() *BackupStatus {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := b.status
+	return &status
+}
+
+// backup takes a snapshot and syncs the upload directory, if enabled.
+func (b *Backup) backup(ctx context.Context) error {
+	now := time.Now().UTC()
+
+	snapshot, err := b.snapshot(now)
+	if err != nil {
+		return fmt.Errorf("taking snapshot: %w", err)
+	}
+
+	b.mu.Lock()
+	b.status.LastSnapshot = snapshot
+	b.mu.Unlock()
+
+	if b.store == nil {
+		return nil
+	}
+
+	if err := b.store.put(ctx, b.prefix+"snapshots/"+snapshot, filepath.Join(b.dir, snapshot)); err != nil {
+		return fmt.Errorf("uploading snapshot: %w", err)
+	}
+
+	n, err := b.sync(ctx)
+
+	b.mu.Lock()
+	b.status.SyncedFiles = n
+	b.mu.Unlock()
+
+	if err != nil {
+		return fmt.Errorf("syncing files: %w", err)
+	}
+	return nil
+}
+
+// snapshot writes a snapshot of the metadata of the upload directory taken at now to the backup directory,
+// removing old snapshots beyond the number kept. It returns the name of the snapshot.
+func (b *Backup) snapshot(now time.Time) (string, error) {
+	name := snapshotPrefix + now.Format("20060102T150405Z") + snapshotSuffix
+
+	tmp, err := os.CreateTemp(b.dir, "."+name+".*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = exportState(tmp, b.baseDir, false)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(b.dir, name)); err != nil {
+		return "", err
+	}
+
+	snapshots, err := filepath.Glob(filepath.Join(b.dir, snapshotPrefix+"*"+snapshotSuffix))
+	if err != nil {
+		return name, err
+	}
+	slices.Sort(snapshots)
+	for _, old := range snapshots[:max(len(snapshots)-b.keep, 0)] {
+		if err := os.Remove(old); err != nil {
+			b.logger.Printf("Error removing old snapshot: %v", err)
+		}
+	}
+
+	return name, nil
+}
+
+// sync uploads the files of the upload directory that changed since they were last synced to the secondary
+// storage, returning the number of files uploaded. Files removed locally are kept in the secondary storage.
+func (b *Backup) sync(ctx context.Context) (int, error) {
+	n := 0
+	var errs []error
+
+	err := filepath.WalkDir(b.baseDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.baseDir, path)
+		if err != nil || !exportable(rel, true) {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel = filepath.ToSlash(rel)
+		version := fmt.Sprintf("%d:%d", fi.Size(), fi.ModTime().UnixNano())
+		if b.synced[rel] == version {
+			return nil
+		}
+
+		if err := b.store.put(ctx, b.prefix+"files/"+rel, path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", rel, err))
+			return nil
+		}
+
+		b.synced[rel] = version
+		backupSyncedFiles.Add(1)
+		n++
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if n > 0 {
+		if err := b.saveSyncState(); err != nil {
+			errs = append(errs, fmt.Errorf("saving sync state: %w", err))
+		}
+	}
+
+	return n, errors.Join(errs...)
+}
+
+// replica opens the copy of the file at rel, relative to the upload directory, in the secondary storage.
+// The caller must close it.
+func (b *Backup) replica(ctx context.Context, rel string) (io.ReadCloser, error) {
+	if b == nil || b.store == nil {
+		return nil, errors.New("backups are not synced to a secondary storage")
+	}
+	return b.store.get(ctx, b.prefix+"files/"+filepath.ToSlash(rel))
+}
+
+// saveSyncState persists the record of the synced files.
+func (b *Backup) saveSyncState() error {
+	data, err := json.Marshal(b.synced)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(b.dir, backupSyncStateFile)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// run backs up the upload directory every interval, in passes run by jobs, until ctx is done.
+func (b *Backup) run(ctx context.Context, jobs *JobRunner) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for {
+		backupRuns.Add(1)
+		var err error
+		jobs.Do(func() { err = b.backup(ctx) })
+
+		now := time.Now().UTC()
+		b.mu.Lock()
+		b.status.LastRun = &now
+		if err != nil {
+			b.status.LastError = err.Error()
+		} else {
+			b.status.LastError = ""
+			b.status.LastSuccess = &now
+		}
+		snapshot := b.status.LastSnapshot
+		b.mu.Unlock()
+
+		if err != nil {
+			backupErrors.Add(1)
+			b.logger.Printf("Error backing up: %v", err)
+		} else {
+			backupLastSuccess.Set(now.Unix())
+			infof(b.logger, "Backup completed successfully: %s", snapshot)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// statusResponse is the JSON document served by [statusz].
+type statusResponse struct {
+	StartedAt time.Time     `json:"started_at"`
+	Backup    *BackupStatus `json:"backup,omitempty"`
+}
+
+// startedAt is the time the process started at.
+var startedAt = time.Now().UTC()
+
+// statusz returns an HTTP handler serving the status of the server's background jobs, its backup, as JSON.
+func statusz(backup *Backup) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(statusResponse{
+			StartedAt: startedAt,
+			Backup:    backup.Status(),
+		})
+	})
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"path"
+	"sync"
+	"time"
+)
+
+// batchFileResult is the outcome of one file of a batch upload.
+type batchFileResult struct {
+	Index  int    `json:"index" xml:"index,attr"` // Index is the position of the file in the batch, from 0.
+	Name   string `json:"name" xml:"name"`        // Name is the file name sent, or the one the file is stored under once validators renamed it.
+	Status int    `json:"status" xml:"status"`    // Status is the HTTP status the file would have been answered with on its own.
+	Size   int64  `json:"size,omitempty" xml:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty" xml:"sha256,omitempty"`
+	URL    string `json:"url,omitempty" xml:"url,omitempty"`
+	Error  string `json:"error,omitempty" xml:"error,omitempty"`
+}
+
+// batchManifest is the response to a batch upload, listing the outcome of every file read in the order they were sent.
+type batchManifest struct {
+	XMLName   xml.Name          `json:"-" xml:"batch"`
+	RequestID string            `json:"request_id" xml:"request_id,attr"`
+	Stored    int               `json:"stored" xml:"stored"`
+	Failed    int               `json:"failed" xml:"failed"`
+	Error     string            `json:"error,omitempty" xml:"error,omitempty"` // Error reports why the batch could not be read to its end, the files after it being missing.
+	Files     []batchFileResult `json:"files" xml:"file"`
+}
+
+// batchReader reads the files of a batch upload one at a time, returning io.EOF after the last one.
+type batchReader func() (*spooledFile, error)
+
+// uploadBatch handles uploads of many files in one request, sent as a multipart body, of which every file
+// part is kept, or as a tar archive, optionally gzip compressed, of which every regular file is kept under its base
+// name. Files are read one at a time and stored by a pool of workers as they arrive, each like the only file of an
+// upload, see [storeUpload], sharing the metadata, encryption, expiry and download limit headers of the request.
+// A file failing does not fail the others; the response is a [batchManifest] of the outcome of each file.
+// Batches of more than maxFiles files, unless 0, are cut short.
+func uploadBatch(workers, maxFiles int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uc := uploadContextFrom(r.Context())
+		logger, publish := uc.Logger, uc.publish
+
+		meta, err := parseMetaHeaders(r.Header, uc.Limits.MaxMetaHeaders, uc.Limits.MaxMetaSize)
+		if err != nil {
+			logger.Printf("Error parsing upload metadata: %v", err)
+			uc.respondError(w, fmt.Sprintf("Invalid upload metadata: %v", err), http.StatusBadRequest)
+			return
+		}
+		enc, err := parseEncryptionHeaders(r.Header)
+		if err != nil {
+			logger.Printf("Error parsing upload encryption: %v", err)
+			uc.respondError(w, fmt.Sprintf("Invalid upload encryption: %v", err), http.StatusBadRequest)
+			return
+		}
+		uc.Meta, uc.Encryption = meta, enc
+
+		if uc.Expiry, err = parseExpiresAfter(r.Header.Get(expiresAfterHeader)); err != nil {
+			uc.respondError(w, fmt.Sprintf("Invalid upload expiry: %v", err), http.StatusBadRequest)
+			return
+		}
+		if uc.MaxDownloads, err = parseMaxDownloads(r.Header.Get(maxDownloadsHeader)); err != nil {
+			uc.respondError(w, fmt.Sprintf("Invalid upload download limit: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		next, err := newBatchReader(r, uc.Limits)
+		if err != nil {
+			uc.respondError(w, err.Error(), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		type job struct {
+			index int
+			file  *spooledFile
+		}
+		jobs := make(chan job, workers)
+		var (
+			mu      sync.Mutex
+			results []batchFileResult
+			stored  []Metadata
+			wg      sync.WaitGroup
+		)
+
+		for range workers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := range jobs {
+					// Every file gets its own copy of the upload, as validators may change its metadata
+					fileUpload := uc.in(uc.Storage.Dir)
+					fileUpload.Stages = nil
+
+					result := batchFileResult{Index: j.index, Name: j.file.Filename, Status: http.StatusCreated}
+					m, err := storeUpload(fileUpload, j.file)
+					j.file.Remove()
+					if err != nil {
+						se := err.(*storeError)
+						result.Status, result.Error = se.Status, se.Message
+						publish(Event{Type: EventUploadFailed, Filename: j.file.Filename, Error: err.Error()})
+					} else {
+						result.Name, result.Size, result.SHA256, result.URL = m.Name, m.Size, m.SHA256, uc.fileURL(m.Name)
+						publish(Event{Type: EventUploadCompleted, Filename: m.Name, Size: m.Size})
+					}
+
+					mu.Lock()
+					results[j.index] = result
+					if err == nil {
+						stored = append(stored, m)
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+
+		publish(Event{Type: EventUploadStarted})
+		var readErr error
+		for index := 0; ; index++ {
+			f, err := next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				readErr = err
+				break
+			}
+			if maxFiles > 0 && index == maxFiles {
+				f.Remove()
+				readErr = fmt.Errorf("batch exceeds %d files", maxFiles)
+				break
+			}
+
+			mu.Lock()
+			results = append(results, batchFileResult{})
+			mu.Unlock()
+			jobs <- job{index, f}
+		}
+		close(jobs)
+		wg.Wait()
+
+		manifest := batchManifest{RequestID: uc.RequestID, Files: results}
+		for _, result := range results {
+			if result.Error == "" {
+				manifest.Stored++
+			} else {
+				manifest.Failed++
+			}
+		}
+
+		status := http.StatusOK
+		if readErr != nil {
+			logger.Printf("Error reading batch upload: %v", readErr)
+			manifest.Error = readErr.Error()
+			status = http.StatusBadRequest
+			switch {
+			case errors.Is(readErr, errMemoryBudgetExhausted):
+				retryAfter(w, max(uc.Limits.Memory.wait, time.Second))
+				status = http.StatusServiceUnavailable
+			case errors.Is(readErr, errFileTooLarge):
+				manifest.Error = fmt.Sprintf("file exceeds %d bytes", uc.Limits.MaxSize)
+				status = http.StatusRequestEntityTooLarge
+			}
+		}
+		infof(logger, "Batch upload %s: %d files stored, %d failed", uc.RequestID, manifest.Stored, manifest.Failed)
+
+		uc.notifyCallback(stored...)
+		if status == http.StatusOK {
+			uc.transferHeaders(w, nil)
+		}
+		if uc.Responder != nil {
+			uc.Responder.respond(w, uploadResponse{RequestID: uc.RequestID, Status: status, Files: stored, Error: manifest.Error, Meta: uc.Meta, Batch: &manifest})
+			return
+		}
+		if uc.XML {
+			writeXML(w, status, manifest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(manifest)
+	})
+}
+
+// newBatchReader returns the reader of the files of the batch upload r, by the content type of its body, holding
+// up to the MaxMemory bytes of limits of each file in memory, within their memory budget. Files larger than the
+// MaxSize of limits fail with [errFileTooLarge], and multipart bodies are held to their part header size.
+func newBatchReader(r *http.Request, limits UploadLimits) (batchReader, error) {
+	ctx, maxMemory, budget := r.Context(), limits.MaxMemory, limits.Memory
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	switch mediaType {
+	case "multipart/form-data", "multipart/mixed":
+		mr, headers, err := newMultipartReader(r, limits.Multipart.MaxPartHeaderSize)
+		if err != nil {
+			return nil, err
+		}
+		return func() (*spooledFile, error) {
+			for {
+				part, err := headers.nextPart(mr)
+				if err != nil {
+					return nil, err
+				}
+				if size := headerSize(part.Header); size > limits.Multipart.MaxPartHeaderSize {
+					return nil, &multipartLimitError{fmt.Sprintf("part headers of %d bytes exceed %d bytes", size, limits.Multipart.MaxPartHeaderSize)}
+				}
+				if part.FileName() == "" {
+					// Its content is not part of the headers of the next part
+					if _, err := io.Copy(io.Discard, part); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				return spoolReserved(ctx, budget, part, &spooledFile{Filename: partFileName(part), Header: part.Header}, maxMemory, limits.MaxSize, maxMemory+1)
+			}
+		}, nil
+
+	case "application/x-tar", "application/gzip", "application/x-gzip":
+		var body io.Reader = r.Body
+		if mediaType != "application/x-tar" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				return nil, err
+			}
+			body = zr
+		}
+		tr := tar.NewReader(body)
+		return func() (*spooledFile, error) {
+			for {
+				hdr, err := tr.Next()
+				if err != nil {
+					return nil, err
+				}
+				if hdr.Typeflag != tar.TypeReg {
+					continue
+				}
+				f := &spooledFile{Filename: path.Base(hdr.Name), Header: textproto.MIMEHeader{}}
+				return spoolReserved(ctx, budget, tr, f, maxMemory, limits.MaxSize, min(maxMemory+1, hdr.Size))
+			}
+		}, nil
+	}
+
+	return nil, fmt.Errorf("content type %q is neither multipart nor a tar archive", mediaType)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// benchChunkSize is the size of the random content the bodies of benchmark uploads repeat.
+const benchChunkSize = 1 << 20
+
+// benchRun is the result of uploading files of one size with one concurrency level for the benchmark duration.
+type benchRun struct {
+	size        int64
+	concurrency int
+	latencies   []time.Duration // latencies are the durations of the successful uploads.
+	errors      int
+	elapsed     time.Duration
+}
+
+// throughput returns the bytes of files uploaded successfully per second.
+func (r benchRun) throughput() float64 {
+	return float64(r.size) * float64(len(r.latencies)) / r.elapsed.Seconds()
+}
+
+// percentile returns the pth percentile of the upload latencies, 0 if no upload succeeded.
+func (r benchRun) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(r.latencies))*p+0.5) - 1
+	return r.latencies[max(0, min(i, len(r.latencies)-1))]
+}
+
+// benchMain load tests a running server by uploading files of each size in sizes with each concurrency level,
+// and reports their throughput and latency percentiles. It fails if the results regress past the thresholds.
+func benchMain(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:3000", "Base URL of the server to load test (default: 'http://localhost:3000').")
+	endpoint := fs.String("upload-endpoint", "/upload", "The upload endpoint of the server (default: '/upload').")
+	formField := fs.String("form-field", "upload", "The name of the form field files are sent in (default: 'upload').")
+	authToken := fs.String("auth-token", "", "Bearer token sent with uploads (default: none).")
+	sizeList := fs.String("sizes", "1KB,1MB,16MB", "Comma separated list of the sizes of uploaded files, with a B, KB, MB or GB suffix (default: '1KB,1MB,16MB').")
+	concurrencyList := fs.String("concurrency", "1,8,32", "Comma separated list of the numbers of concurrent uploads (default: '1,8,32').")
+	duration := fs.Duration("duration", 10*time.Second, "How long files of each size are uploaded for with each concurrency level (default: '10s').")
+	cleanup := fs.Bool("cleanup", true, "Delete the uploaded files afterwards (default: true).")
+	maxP99 := fs.Duration("max-p99", 0, "Fail if the 99th percentile latency of any run exceeds it, 0 disables the check (default: 0).")
+	minThroughput := fs.Float64("min-throughput", 0, "Fail if the throughput of any run, in MB/s, falls below it, 0 disables the check (default: 0).")
+	maxErrorRate := fs.Float64("max-error-rate", 0, "Fail if the fraction of failed uploads of any run exceeds it (default: 0).")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s bench [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	base, err := url.Parse(*target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid target: %v\n", err)
+		return 2
+	}
+
+	var sizes []int64
+	for _, s := range strings.Split(*sizeList, ",") {
+		size, err := parseBenchSize(strings.TrimSpace(s))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -sizes: %v\n", err)
+			return 2
+		}
+		sizes = append(sizes, size)
+	}
+	var levels []int
+	for _, s := range strings.Split(*concurrencyList, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid -concurrency: %q is not a positive number\n", s)
+			return 2
+		}
+		levels = append(levels, n)
+	}
+
+	chunk := make([]byte, benchChunkSize)
+	rand.Read(chunk)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = slices.Max(levels)
+	b := &bencher{
+		client:    &http.Client{Transport: transport},
+		url:       base.ResolveReference(&url.URL{Path: *endpoint}).String(),
+		formField: *formField,
+		authToken: *authToken,
+		chunk:     chunk,
+	}
+
+	// Rows are printed as runs complete, in fixed width columns
+	const row = "%6s %11v %8v %7v %10v %9v %10v %10v %10v %10v\n"
+	fmt.Printf(row, "size", "concurrency", "uploads", "errors", "uploads/s", "MB/s", "p50", "p90", "p99", "max")
+	var failures []string
+	for _, size := range sizes {
+		for _, concurrency := range levels {
+			r := b.run(size, concurrency, *duration)
+			fmt.Printf(row, formatBenchSize(size), concurrency, len(r.latencies), r.errors,
+				fmt.Sprintf("%.1f", float64(len(r.latencies))/r.elapsed.Seconds()), fmt.Sprintf("%.2f", r.throughput()/(1<<20)),
+				r.percentile(0.5).Round(time.Microsecond), r.percentile(0.9).Round(time.Microsecond),
+				r.percentile(0.99).Round(time.Microsecond), r.percentile(1).Round(time.Microsecond))
+
+			name := fmt.Sprintf("%s x %d", formatBenchSize(size), concurrency)
+			if p99 := r.percentile(0.99); *maxP99 > 0 && p99 > *maxP99 {
+				failures = append(failures, fmt.Sprintf("%s: p99 %v exceeds %v", name, p99.Round(time.Microsecond), *maxP99))
+			}
+			if mbs := r.throughput() / (1 << 20); *minThroughput > 0 && mbs < *minThroughput {
+				failures = append(failures, fmt.Sprintf("%s: throughput %.2f MB/s is below %g MB/s", name, mbs, *minThroughput))
+			}
+			if total := len(r.latencies) + r.errors; total == 0 || float64(r.errors)/float64(total) > *maxErrorRate {
+				failures = append(failures, fmt.Sprintf("%s: %d of %d uploads failed", name, r.errors, total))
+			}
+		}
+	}
+
+	if *cleanup {
+		b.cleanup(base)
+	}
+
+	if len(failures) > 0 {
+		fmt.Fprintln(os.Stderr, "performance regressed:")
+		for _, f := range failures {
+			fmt.Fprintf(os.Stderr, "  %s\n", f)
+		}
+		return 1
+	}
+	return 0
+}
+
+// bencher uploads files to the upload endpoint at url.
+type bencher struct {
+	client    *http.Client
+	url       string
+	formField string
+	authToken string
+	chunk     []byte // chunk is the random content the files repeat.
+
+	seq      atomic.Int64 // seq numbers uploads, making their names and contents unique.
+	mu       sync.Mutex
+	uploaded []string // uploaded are the names of the stored files.
+}
+
+// run uploads files of size bytes with concurrency uploads in flight for d.
+func (b *bencher) run(size int64, concurrency int, d time.Duration) benchRun {
+	r := benchRun{size: size, concurrency: concurrency}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	deadline := start.Add(d)
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				began := time.Now()
+				err := b.upload(size)
+				took := time.Since(began)
+
+				mu.Lock()
+				if err != nil {
+					r.errors++
+				} else {
+					r.latencies = append(r.latencies, took)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	r.elapsed = time.Since(start)
+
+	slices.Sort(r.latencies)
+	return r
+}
+
+// upload uploads a file of size bytes, unique so it is never coalesced with another one.
+func (b *bencher) upload(size int64) error {
+	n := b.seq.Add(1)
+	name := fmt.Sprintf("bench-%d-%d.bin", os.Getpid(), n)
+
+	var head bytes.Buffer
+	mw := multipart.NewWriter(&head)
+	if _, err := mw.CreateFormFile(b.formField, name); err != nil {
+		return err
+	}
+	tail := "\r\n--" + mw.Boundary() + "--\r\n"
+
+	prefix := []byte(strconv.FormatInt(n, 10) + "\n")
+	content := io.MultiReader(bytes.NewReader(prefix), &repeatReader{chunk: b.chunk})
+	body := io.MultiReader(&head, io.LimitReader(content, size), strings.NewReader(tail))
+
+	req, err := http.NewRequest(http.MethodPost, b.url, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(head.Len()) + size + int64(len(tail))
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if b.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+b.authToken)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("upload: %s", resp.Status)
+	}
+
+	b.mu.Lock()
+	b.uploaded = append(b.uploaded, name)
+	b.mu.Unlock()
+	return nil
+}
+
+// cleanup deletes the files uploaded to the server at base.
+func (b *bencher) cleanup(base *url.URL) {
+	var errs []error
+	for _, name := range b.uploaded {
+		req, err := http.NewRequest(http.MethodDelete, base.ResolveReference(&url.URL{Path: "/files/" + name}).String(), nil)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if b.authToken != "" {
+			req.Header.Set("Authorization", "Bearer "+b.authToken)
+		}
+
+		resp, err := b.client.Do(req)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			errs = append(errs, fmt.Errorf("deleting %s: %s", name, resp.Status))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		fmt.Fprintf(os.Stderr, "cleanup: %v\n", err)
+	}
+}
+
+// repeatReader reads chunk over and over.
+type repeatReader struct {
+	chunk []byte
+	off   int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.chunk[r.off:])
+	r.off = (r.off + n) % len(r.chunk)
+	return n, nil
+}
+
+// parseBenchSize parses a size such as "16MB", with the binary multipliers of policy rules.
+func parseBenchSize(s string) (int64, error) {
+	digits := strings.TrimRight(s, "BbKkMmGgTt")
+	n, err := strconv.ParseInt(digits, 10, 64)
+	unit, ok := policySizeUnits[strings.ToLower(s[len(digits):])]
+	if err != nil || !ok || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * unit, nil
+}
+
+// formatBenchSize formats size with the largest unit dividing it.
+func formatBenchSize(size int64) string {
+	for _, u := range []struct {
+		suffix string
+		n      int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}} {
+		if size%u.n == 0 {
+			return strconv.FormatInt(size/u.n, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(size, 10) + "B"
+}
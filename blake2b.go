@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// blake2bBlockSize is the block size of BLAKE2b in bytes.
+const blake2bBlockSize = 128
+
+// blake2bIV is the BLAKE2b initialization vector, shared with SHA-512.
+var blake2bIV = [8]uint64{
+	0x6a09e667f3bcc908, 0xbb67ae8584caa73b, 0x3c6ef372fe94f82b, 0xa54ff53a5f1d36f1,
+	0x510e527fade682d1, 0x9b05688c2b3e6c1f, 0x1f83d9abfb41bd6b, 0x5be0cd19137e2179,
+}
+
+// blake2bSigma holds the message word permutations of the BLAKE2b rounds.
+var blake2bSigma = [10][16]byte{
+	{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15},
+	{14, 10, 4, 8, 9, 15, 13, 6, 1, 12, 0, 2, 11, 7, 5, 3},
+	{11, 8, 12, 0, 5, 2, 15, 13, 10, 14, 3, 6, 7, 1, 9, 4},
+	{7, 9, 3, 1, 13, 12, 11, 14, 2, 6, 5, 10, 4, 0, 15, 8},
+	{9, 0, 5, 7, 2, 4, 10, 15, 14, 1, 11, 12, 6, 8, 3, 13},
+	{2, 12, 6, 10, 0, 11, 8, 3, 4, 13, 7, 5, 15, 14, 1, 9},
+	{12, 5, 1, 15, 14, 13, 4, 10, 0, 7, 6, 3, 9, 2, 8, 11},
+	{13, 11, 7, 14, 12, 1, 3, 9, 5, 0, 15, 4, 8, 6, 2, 10},
+	{6, 15, 14, 9, 11, 3, 0, 8, 12, 2, 13, 7, 1, 4, 10, 5},
+	{10, 2, 8, 4, 7, 6, 1, 5, 15, 11, 9, 14, 3, 12, 13, 0},
+}
+
+// blake2b512 is an unkeyed BLAKE2b-512 hash, see RFC 7693. It is needed by minisign signatures,
+// and is not worth a dependency on golang.org/x/crypto.
+type blake2b512 struct {
+	h      [8]uint64
+	t      [2]uint64 // t counts the bytes hashed so far.
+	buf    [blake2bBlockSize]byte
+	bufLen int
+}
+
+// newBLAKE2b512 returns a new BLAKE2b-512 hash.
+func newBLAKE2b512() hash.Hash {
+	d := &blake2b512{}
+	d.Reset()
+	return d
+}
+
+func (d *blake2b512) Size() int      { return 64 }
+func (d *blake2b512) BlockSize() int { return blake2bBlockSize }
+
+func (d *blake2b512) Reset() {
+	d.h = blake2bIV
+	d.h[0] ^= 0x01010000 ^ 64 // digest length 64, no key, fanout and depth 1
+	d.t = [2]uint64{}
+	d.bufLen = 0
+}
+
+func (d *blake2b512) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// The last block is compressed differently, so a full buffer is held back until more data comes
+		if d.bufLen == blake2bBlockSize {
+			d.compress(d.buf[:], false)
+			d.bufLen = 0
+		}
+		c := copy(d.buf[d.bufLen:], p)
+		d.bufLen += c
+		p = p[c:]
+	}
+	return n, nil
+}
+
+func (d *blake2b512) Sum(b []byte) []byte {
+	c := *d
+	clear(c.buf[c.bufLen:])
+	c.compress(c.buf[:], true)
+
+	out := make([]byte, 0, 64)
+	for _, v := range c.h {
+		out = binary.LittleEndian.AppendUint64(out, v)
+	}
+	return append(b, out...)
+}
+
+// compress mixes the buffered block into the state, counting its bytes first.
+func (d *blake2b512) compress(block []byte, last bool) {
+	d.t[0] += uint64(d.bufLen)
+	if d.t[0] < uint64(d.bufLen) {
+		d.t[1]++
+	}
+
+	var m [16]uint64
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint64(block[i*8:])
+	}
+
+	var v [16]uint64
+	copy(v[:8], d.h[:])
+	copy(v[8:], blake2bIV[:])
+	v[12] ^= d.t[0]
+	v[13] ^= d.t[1]
+	if last {
+		v[14] = ^v[14]
+	}
+
+	g := func(a, b, c, e int, x, y uint64) {
+		v[a] += v[b] + x
+		v[e] = bits.RotateLeft64(v[e]^v[a], -32)
+		v[c] += v[e]
+		v[b] = bits.RotateLeft64(v[b]^v[c], -24)
+		v[a] += v[b] + y
+		v[e] = bits.RotateLeft64(v[e]^v[a], -16)
+		v[c] += v[e]
+		v[b] = bits.RotateLeft64(v[b]^v[c], -63)
+	}
+
+	for i := range 12 {
+		s := &blake2bSigma[i%10]
+		g(0, 4, 8, 12, m[s[0]], m[s[1]])
+		g(1, 5, 9, 13, m[s[2]], m[s[3]])
+		g(2, 6, 10, 14, m[s[4]], m[s[5]])
+		g(3, 7, 11, 15, m[s[6]], m[s[7]])
+		g(0, 5, 10, 15, m[s[8]], m[s[9]])
+		g(1, 6, 11, 12, m[s[10]], m[s[11]])
+		g(2, 7, 8, 13, m[s[12]], m[s[13]])
+		g(3, 4, 9, 14, m[s[14]], m[s[15]])
+	}
+
+	for i := range d.h {
+		d.h[i] ^= v[i] ^ v[i+8]
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Gabriel-Ladzaretti/go-multipart/internal/httpx"
+)
+
+// bucketsDir is the directory, relative to the upload directory, where buckets are kept.
+// Each bucket is a directory laid out like the upload directory itself, holding its configuration
+// in [bucketConfigFile].
+const bucketsDir = ".buckets"
+
+// bucketConfigFile is the file, relative to the directory of a bucket, holding its configuration.
+const bucketConfigFile = ".bucket.json"
+
+// maxBucketConfigSize is the maximum size in bytes of the bucket configuration accepted by [putBucket].
+const maxBucketConfigSize = 1 << 16
+
+// Authentication policies of buckets.
+const (
+	bucketAuthServer = "server" // Requests are authenticated like any other, with the server credentials.
+	bucketAuthToken  = "token"  // Requests must carry the bucket's own bearer token.
+	bucketAuthPublic = "public" // Requests are not authenticated.
+)
+
+// duration is a [time.Duration] encoded in JSON and XML as a string such as "168h".
+type duration time.Duration
+
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = duration(v)
+	return nil
+}
+
+// Bucket is a namespace of files with its own configuration.
+type Bucket struct {
+	Name             string    `json:"name" xml:"name"`
+	Retention        duration  `json:"retention" xml:"retention"`                                     // Retention is how long deleted files are kept for restoring, 0 deletes files immediately.
+	Quota            int64     `json:"quota,omitempty" xml:"quota,omitempty"`                         // Quota is the number of bytes that may be stored in the bucket, 0 means unlimited.
+	Auth             string    `json:"auth" xml:"auth"`                                               // Auth is the authentication policy of the bucket's files, see bucketAuthServer and friends.
+	Token            string    `json:"token,omitempty" xml:"token,omitempty"`                         // Token is the bearer token of the "token" authentication policy.
+	RequireSignature bool      `json:"require_signature,omitempty" xml:"require_signature,omitempty"` // RequireSignature rejects uploads without a valid detached signature, see [verifyUploadSignature].
+	CreatedAt        time.Time `json:"created_at" xml:"created_at"`
+}
+
+// Buckets are the buckets of an upload directory.
+type Buckets struct {
+	dir    string
+	logger *log.Logger
+}
+
+func newBuckets(baseDir string, logger *log.Logger) *Buckets {
+	return &Buckets{dir: filepath.Join(baseDir, bucketsDir), logger: logger}
+}
+
+// validBucketName reports whether name can be used as a bucket name: 3 to 63 lower case letters,
+// digits and hyphens, starting and ending with a letter or digit.
+func validBucketName(name string) bool {
+	if len(name) < 3 || len(name) > 63 || name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// path returns the directory holding the files of bucket name.
+func (b *Buckets) path(name string) string {
+	return filepath.Join(b.dir, name)
+}
+
+// get returns the configuration of bucket name.
+func (b *Buckets) get(name string) (Bucket, error) {
+	var bucket Bucket
+
+	data, err := os.ReadFile(filepath.Join(b.path(name), bucketConfigFile))
+	if err != nil {
+		return bucket, err
+	}
+
+	err = json.Unmarshal(data, &bucket)
+	return bucket, err
+}
+
+// put creates bucket, or replaces the configuration of an existing bucket of the same name.
+func (b *Buckets) put(bucket Bucket) error {
+	dir := b.path(bucket.Name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(bucket)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(dir, bucketConfigFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, bucketConfigFile))
+}
+
+// list returns the configuration of all buckets.
+func (b *Buckets) list() ([]Bucket, error) {
+	entries, err := os.ReadDir(b.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var buckets []Bucket
+	for _, entry := range entries {
+		if !entry.IsDir() || !validBucketName(entry.Name()) {
+			continue
+		}
+
+		bucket, err := b.get(entry.Name())
+		if err != nil {
+			b.logger.Printf("Error reading configuration of bucket %s: %v", entry.Name(), err)
+			continue
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	return buckets, nil
+}
+
+// usage returns the number of bytes stored in bucket name, not counting deleted files.
+func (b *Buckets) usage(name string) (int64, error) {
+	var total int64
+	err := listFiles(b.logger, b.path(name), func(m Metadata) bool {
+		total += m.Size
+		return true
+	})
+	return total, err
+}
+
+// empty reports whether bucket name holds no files, not counting deleted files.
+func (b *Buckets) empty(name string) (bool, error) {
+	empty := true
+	err := listFiles(b.logger, b.path(name), func(Metadata) bool {
+		empty = false
+		return false
+	})
+	return empty, err
+}
+
+// runTrashPurger purges the expired trash of all buckets periodically, in passes run by jobs, until ctx is done,
+// pruning the trash emptied with pruner.
+func (b *Buckets) runTrashPurger(ctx context.Context, jobs *JobRunner, pruner *DirPruner) {
+	ticker := time.NewTicker(maxTrashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		buckets, err := b.list()
+		if err != nil {
+			b.logger.Printf("Error listing buckets: %v", err)
+		}
+		jobs.Do(func() {
+			for _, bucket := range buckets {
+				if bucket.Retention <= 0 {
+					continue
+				}
+				if err := purgeTrash(b.logger, b.path(bucket.Name), time.Duration(bucket.Retention), pruner); err != nil {
+					b.logger.Printf("Error purging trash of bucket %s: %v", bucket.Name, err)
+				}
+			}
+		})
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// redacted returns bucket without its token, for responses.
+func (bucket Bucket) redacted() Bucket {
+	if bucket.Token != "" {
+		bucket.Token = redact(bucket.Token)
+	}
+	return bucket
+}
+
+// putBucket handles PUT /buckets/{bucket}, creating the bucket or updating its configuration with the
+// JSON document of the request. Fields left out of the document keep their current values, or for new
+// buckets, default to the server configuration.
+func putBucket(logger *log.Logger, buckets *Buckets, defaultRetention time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("bucket")
+		if !validBucketName(name) {
+			http.Error(w, "Invalid bucket name", http.StatusBadRequest)
+			return
+		}
+
+		bucket, err := buckets.get(name)
+		created := errors.Is(err, fs.ErrNotExist)
+		if created {
+			bucket = Bucket{Name: name, Retention: duration(defaultRetention), Auth: bucketAuthServer, CreatedAt: time.Now().UTC()}
+		} else if err != nil {
+			logger.Printf("Error reading bucket configuration: %v", err)
+			http.Error(w, "Could not read bucket", http.StatusInternalServerError)
+			return
+		}
+
+		createdAt := bucket.CreatedAt
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBucketConfigSize)).Decode(&bucket); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid bucket configuration: %v", err), http.StatusBadRequest)
+			return
+		}
+		bucket.Name, bucket.CreatedAt = name, createdAt
+
+		var invalid error
+		switch {
+		case bucket.Retention < 0:
+			invalid = errors.New("retention must not be negative")
+		case bucket.Quota < 0:
+			invalid = errors.New("quota must not be negative")
+		case bucket.Auth != bucketAuthServer && bucket.Auth != bucketAuthToken && bucket.Auth != bucketAuthPublic:
+			invalid = fmt.Errorf("auth must be one of %q, %q or %q", bucketAuthServer, bucketAuthToken, bucketAuthPublic)
+		case bucket.Auth == bucketAuthToken && bucket.Token == "":
+			invalid = errors.New("token is required by the token auth policy")
+		}
+		if invalid != nil {
+			http.Error(w, fmt.Sprintf("Invalid bucket configuration: %v", invalid), http.StatusBadRequest)
+			return
+		}
+
+		if err := buckets.put(bucket); err != nil {
+			logger.Printf("Error saving bucket configuration: %v", err)
+			http.Error(w, "Could not save bucket", http.StatusInternalServerError)
+			return
+		}
+
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+
+		infof(logger, "Bucket saved successfully: %s\n", name)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(bucket.redacted())
+	})
+}
+
+// getBucket handles GET /buckets/{bucket}, responding with the bucket's configuration as JSON.
+func getBucket(logger *log.Logger, buckets *Buckets) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("bucket")
+		if !validBucketName(name) {
+			http.NotFound(w, r)
+			return
+		}
+
+		bucket, err := buckets.get(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error reading bucket configuration: %v", err)
+			http.Error(w, "Could not read bucket", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bucket.redacted())
+	})
+}
+
+// listBuckets handles GET /buckets, responding with the configuration of all buckets as a JSON array,
+// or an XML <buckets> document for clients preferring XML.
+func listBuckets(logger *log.Logger, buckets *Buckets) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list, err := buckets.list()
+		if err != nil {
+			logger.Printf("Error listing buckets: %v", err)
+			http.Error(w, "Could not list buckets", http.StatusInternalServerError)
+			return
+		}
+
+		results := []Bucket{}
+		for _, bucket := range list {
+			results = append(results, bucket.redacted())
+		}
+
+		writeNegotiated(w, r, results, xmlBuckets{Buckets: results})
+	})
+}
+
+// deleteBucket handles DELETE /buckets/{bucket}, removing an empty bucket along with its trash and its indexes.
+// The buckets directory is pruned by pruner once the last bucket is deleted.
+func deleteBucket(logger *log.Logger, buckets *Buckets, pruner *DirPruner, indexes *FileIndexes) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("bucket")
+		if !validBucketName(name) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if _, err := buckets.get(name); errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+
+		empty, err := buckets.empty(name)
+		if err != nil {
+			logger.Printf("Error listing bucket files: %v", err)
+			http.Error(w, "Could not delete bucket", http.StatusInternalServerError)
+			return
+		}
+		if !empty {
+			http.Error(w, "Bucket is not empty", http.StatusConflict)
+			return
+		}
+
+		if err := os.RemoveAll(buckets.path(name)); err != nil {
+			logger.Printf("Error deleting bucket: %v", err)
+			http.Error(w, "Could not delete bucket", http.StatusInternalServerError)
+			return
+		}
+		pruner.prune(buckets.dir)
+		indexes.reset(buckets.path(name))
+
+		infof(logger, "Bucket deleted successfully: %s\n", name)
+		fmt.Fprintf(w, "Bucket deleted successfully: %s\n", name)
+	})
+}
+
+// inBucket serves requests to /buckets/{bucket}/... with the handler newHandler creates for the
+// bucket and its directory. Requests are authenticated according to the bucket's policy, and
+// requests with a body are rejected with 507 Insufficient Storage once the bucket's quota is used up.
+// Buckets without their own authentication are protected by protect.
+func inBucket(logger *log.Logger, buckets *Buckets, protect httpx.Middleware, newHandler func(bucket Bucket, dir string) http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("bucket")
+		if !validBucketName(name) {
+			http.NotFound(w, r)
+			return
+		}
+
+		bucket, err := buckets.get(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error reading bucket configuration: %v", err)
+			http.Error(w, "Could not read bucket", http.StatusInternalServerError)
+			return
+		}
+
+		h := newHandler(bucket, buckets.path(name))
+
+		if bucket.Quota > 0 && r.ContentLength != 0 {
+			next := h
+			h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				used, err := buckets.usage(name)
+				if err != nil {
+					logger.Printf("Error computing bucket usage: %v", err)
+				} else if used+max(r.ContentLength, 0) > bucket.Quota {
+					http.Error(w, fmt.Sprintf("Bucket quota of %d bytes exceeded", bucket.Quota), http.StatusInsufficientStorage)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		}
+
+		switch bucket.Auth {
+		case bucketAuthPublic:
+		case bucketAuthToken:
+			h = NewAuthMiddleware(unauthorized(), bearerTokenAuthenticator(bucket.Token))(h)
+		default:
+			h = protect(h)
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Gabriel-Ladzaretti/go-multipart/internal/httpx"
+)
+
+// callbackTimeout bounds the delivery of an upload callback.
+const callbackTimeout = 10 * time.Second
+
+// parseCallbackAllowlist parses the comma separated list of URL prefixes upload callbacks may be sent to.
+func parseCallbackAllowlist(list string) ([]*url.URL, error) {
+	var allowlist []*url.URL
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+			return nil, fmt.Errorf("%q is not an http or https URL prefix", s)
+		}
+		allowlist = append(allowlist, u)
+	}
+	return allowlist, nil
+}
+
+// callbackAllowed reports whether the callback URL u lies under one of the prefixes of allowlist: it has the
+// same scheme and host, and its path is the prefix's path or lies under it.
+func callbackAllowed(allowlist []*url.URL, u *url.URL) bool {
+	for _, prefix := range allowlist {
+		if u.Scheme != prefix.Scheme || !strings.EqualFold(u.Host, prefix.Host) {
+			continue
+		}
+		p := strings.TrimSuffix(prefix.Path, "/")
+		if u.Path == p || strings.HasPrefix(u.Path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// NewCallbackMiddleware creates a middleware setting the callback of the uploads of the requests passed to next
+// from their callback query parameter, see [UploadContext.notifyCallback]. Requests must carry an [UploadContext].
+// Uploads asking for a callback to a URL outside the comma separated allowlist of URL prefixes are rejected with
+// 400 Bad Request, so are all uploads asking for one if the allowlist is empty.
+func NewCallbackMiddleware(allowlist string) httpx.Middleware {
+	prefixes, _ := parseCallbackAllowlist(allowlist) // validated with the config
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			callback := r.URL.Query().Get("callback")
+			if callback == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			uc := uploadContextFrom(r.Context())
+			u, err := url.Parse(callback)
+			if err != nil || u.User != nil || !callbackAllowed(prefixes, u) {
+				uc.Logger.Printf("Upload callback %s rejected", redactURL(callback))
+				uc.respondError(w, "Callback URL is not allowed", http.StatusBadRequest)
+				return
+			}
+			uc.Callback = u.String()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// uploadCallback is the body of upload callbacks.
+type uploadCallback struct {
+	Type      string     `json:"type"`
+	Time      time.Time  `json:"time"`
+	RequestID string     `json:"request_id"`
+	Files     []Metadata `json:"files"`
+}
+
+// notifyCallback posts the stored files of the upload to its callback as JSON in the background, if it has one.
+// Delivery is attempted once, failures are logged.
+func (u *UploadContext) notifyCallback(files ...Metadata) {
+	if u.Callback == "" {
+		return
+	}
+
+	body, err := json.Marshal(uploadCallback{Type: EventUploadCompleted, Time: time.Now(), RequestID: u.RequestID, Files: files})
+	if err != nil {
+		u.Logger.Printf("Error encoding upload callback: %v", err)
+		return
+	}
+
+	// Redirects are not followed, they could lead off the allowlist
+	client := u.Storage.Outbound.client(callbackTimeout)
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	callback, logger := u.Callback, u.Logger
+	go func() {
+		if err := postCallback(client, callback, body); err != nil {
+			logger.Printf("Error delivering upload callback to %s: %v", redactURL(callback), err)
+		}
+	}()
+}
+
+// postCallback posts the callback body to url with client.
+func postCallback(client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("callback: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/Gabriel-Ladzaretti/go-multipart/internal/httpx"
+)
+
+// chaosMaxDisconnectRead is the maximum number of request body bytes read
+// before a connection is dropped by the chaos middleware.
+const chaosMaxDisconnectRead = 1 << 20
+
+// chaosErrorStatuses are the server errors injected by the chaos middleware.
+var chaosErrorStatuses = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// NewChaosMiddleware creates a middleware for testing client retry logic.
+// Each request is delayed by a random latency of up to maxLatency, then fails
+// with a random 5xx error with probability errorRate, or has its connection dropped
+// after reading part of the request body with probability disconnectRate.
+// Requests to skipPaths are passed through untouched.
+func NewChaosMiddleware(logger *log.Logger, maxLatency time.Duration, errorRate, disconnectRate float64, skipPaths ...string) httpx.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(skipPaths, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if maxLatency > 0 {
+				select {
+				case <-time.After(rand.N(maxLatency)):
+				case <-r.Context().Done():
+					return
+				}
+			}
+
+			p := rand.Float64()
+			switch {
+			case p < errorRate:
+				status := chaosErrorStatuses[rand.IntN(len(chaosErrorStatuses))]
+				logger.Printf("Chaos: %s failing with %d", httpx.RequestIDFromContext(r.Context()), status)
+				http.Error(w, http.StatusText(status), status)
+			case p < errorRate+disconnectRate:
+				n := rand.Int64N(chaosMaxDisconnectRead)
+				logger.Printf("Chaos: %s disconnecting after %d body bytes", httpx.RequestIDFromContext(r.Context()), n)
+				io.CopyN(io.Discard, r.Body, n)
+				panic(http.ErrAbortHandler)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
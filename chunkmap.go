@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// chunkMapsDir is the directory, relative to the upload directory, caching the chunk maps of stored files,
+// one document per file named after it.
+const chunkMapsDir = ".chunks"
+
+// Chunk sizes of chunk maps, in bytes.
+const (
+	defaultChunkSize = 8 << 20
+	minChunkSize     = 64 << 10
+	maxChunkSize     = 1 << 30
+)
+
+// Chunk is a range of a stored file, with the checksum of its content.
+type Chunk struct {
+	Offset int64  `json:"offset" xml:"offset,attr"`
+	Length int64  `json:"length" xml:"length,attr"`
+	SHA256 string `json:"sha256" xml:"sha256,attr"`
+}
+
+// ChunkMap splits a stored file into chunks of ChunkSize bytes, the last one possibly shorter, so clients can
+// download ranges of it in parallel and verify each one.
+type ChunkMap struct {
+	XMLName   xml.Name  `json:"-" xml:"chunks"`
+	Name      string    `json:"name" xml:"name,attr"`
+	Size      int64     `json:"size" xml:"size,attr"`
+	ModTime   time.Time `json:"mod_time" xml:"mod_time,attr"` // ModTime is the modification time of the file the map was computed from.
+	ChunkSize int64     `json:"chunk_size" xml:"chunk_size,attr"`
+	Chunks    []Chunk   `json:"chunks" xml:"chunk"`
+}
+
+// chunkMapPath returns the path of the cached chunk map of the file name stored in baseDir.
+func chunkMapPath(baseDir, name string) string {
+	return filepath.Join(baseDir, chunkMapsDir, name+".json")
+}
+
+// computeChunkMap reads the file f, of file info fi, to compute its chunk map.
+func computeChunkMap(f *os.File, fi fs.FileInfo, chunkSize int64) (ChunkMap, error) {
+	m := ChunkMap{Name: fi.Name(), Size: fi.Size(), ModTime: fi.ModTime().UTC(), ChunkSize: chunkSize, Chunks: []Chunk{}}
+	for offset := int64(0); offset < fi.Size(); offset += chunkSize {
+		h := sha256.New()
+		n, err := io.Copy(h, io.NewSectionReader(f, offset, chunkSize))
+		if err != nil {
+			return ChunkMap{}, err
+		}
+		m.Chunks = append(m.Chunks, Chunk{Offset: offset, Length: n, SHA256: hex.EncodeToString(h.Sum(nil))})
+	}
+	return m, nil
+}
+
+// cachedChunkMap returns the chunk map of the file name stored in baseDir cached for fi and chunkSize, if any.
+func cachedChunkMap(baseDir, name string, fi fs.FileInfo, chunkSize int64) (ChunkMap, bool) {
+	var m ChunkMap
+	b, err := os.ReadFile(chunkMapPath(baseDir, name))
+	if err != nil || json.Unmarshal(b, &m) != nil {
+		return ChunkMap{}, false
+	}
+	if m.Size != fi.Size() || !m.ModTime.Equal(fi.ModTime()) || m.ChunkSize != chunkSize {
+		return ChunkMap{}, false
+	}
+	return m, true
+}
+
+// cacheChunkMap caches m as the chunk map of the file name stored in baseDir, replacing any previous one.
+func cacheChunkMap(baseDir, name string, m ChunkMap) error {
+	path := chunkMapPath(baseDir, name)
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := createIn(filepath.Dir(path), func() error { return os.WriteFile(tmp, b, 0o644) }); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// clearWriteDeadline lifts the write deadline of the response w, so reading or hashing a whole file before
+// responding, which for a large one may take longer than -write-timeout, does not cut the response short.
+func clearWriteDeadline(w http.ResponseWriter) {
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
+
+// chunkMap handles GET /files/{name}/chunks, responding with the [ChunkMap] of a stored file as JSON, or XML
+// for clients preferring it. Chunks are chunk_size bytes, 8 MiB by default. Maps are computed on first request
+// and cached until the file changes, files archived to the cold tier being restored to the local disk first.
+// Names are also looked up in the normalization form file names are stored in, like downloads.
+// Requesting the map of a file is not a download of it.
+func chunkMap(logger *log.Logger, baseDir string, tier *ColdTier, form NormalizationForm) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !validFileName(name) {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+		name = storedName(baseDir, name, form)
+
+		chunkSize := int64(defaultChunkSize)
+		if v := r.URL.Query().Get("chunk_size"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < minChunkSize || n > maxChunkSize {
+				http.Error(w, "Invalid chunk size, expected a number of bytes between 65536 and 1073741824", http.StatusBadRequest)
+				return
+			}
+			chunkSize = n
+		}
+
+		if m, err := readMetadata(baseDir, name); err == nil && (m.expired(time.Now()) || m.burned()) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if _, err := tier.restore(r.Context(), name); err != nil {
+			logger.Printf("Error restoring file from cold tier: %v", err)
+			http.Error(w, "Could not open file", http.StatusInternalServerError)
+			return
+		}
+
+		f, err := os.Open(filepath.Join(baseDir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error opening file for chunk map: %v", err)
+			http.Error(w, "Could not open file", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			logger.Printf("Error reading file info: %v", err)
+			http.Error(w, "Could not open file", http.StatusInternalServerError)
+			return
+		}
+
+		m, ok := cachedChunkMap(baseDir, name, fi, chunkSize)
+		if !ok {
+			clearWriteDeadline(w)
+
+			start := time.Now()
+			if m, err = computeChunkMap(f, fi, chunkSize); err != nil {
+				logger.Printf("Error computing chunk map: %v", err)
+				http.Error(w, "Could not read file", http.StatusInternalServerError)
+				return
+			}
+			debugf(logger, "Chunk map of %s computed in %v: %d chunks of %d bytes", name, time.Since(start).Round(time.Millisecond), len(m.Chunks), chunkSize)
+
+			if err := cacheChunkMap(baseDir, name, m); err != nil {
+				logger.Printf("Error caching chunk map: %v", err)
+			}
+		}
+
+		w.Header().Set("Cache-Control", "no-cache")
+		writeNegotiated(w, r, m, m)
+	})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// version is the version of the binary, set at build time with -ldflags '-X main.version=...', see the Makefile.
+var version = "dev"
+
+// subcommand is a command of the binary, run with the arguments following its name and returning the exit code.
+type subcommand struct {
+	name    string
+	aliases []string
+	summary string
+	run     func(args []string) int
+}
+
+// subcommands are the commands of the binary, in the order they are listed by help. They are set by init, as
+// the usage of the server flags lists them.
+var subcommands []subcommand
+
+func init() {
+	subcommands = []subcommand{
+		{name: "serve", summary: "Run the upload server, the default command", run: serveMain},
+		{name: "check", summary: "Validate the server flags and environment without starting the server", run: checkMain},
+		{name: "put", summary: "Upload files to a running server", run: putMain},
+		{name: "list", summary: "List the files stored in an upload directory", run: listMain},
+		{name: "admin", summary: "Export or import the state of the upload directory of a stopped server", run: adminMain},
+		{name: "migrate", aliases: []string{"migrate-storage"}, summary: "Copy the state of an upload directory to another storage", run: migrateStorageMain},
+		{name: "replay", summary: "Replay recorded failed uploads against a server", run: replayMain},
+		{name: "bench", summary: "Load test a running server", run: benchMain},
+		{name: "version", summary: "Print the version of the binary", run: versionMain},
+	}
+}
+
+// lookupSubcommand returns the subcommand called name, or by an alias of name.
+func lookupSubcommand(name string) (subcommand, bool) {
+	i := slices.IndexFunc(subcommands, func(c subcommand) bool { return c.name == name || slices.Contains(c.aliases, name) })
+	if i < 0 {
+		return subcommand{}, false
+	}
+	return subcommands[i], true
+}
+
+// printSubcommands writes the list of the subcommands to w.
+func printSubcommands(w io.Writer) {
+	fmt.Fprintf(w, "Commands:\n")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, c := range subcommands {
+		fmt.Fprintf(tw, "  %s\t%s\n", c.name, c.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nRun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
+
+// checkMain implements the check subcommand, validating the server flags it is given, and the environment
+// variables setting them, like serve does on startup.
+func checkMain(args []string) int {
+	config, err := newConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+	if problems := config.validate(); len(problems) > 0 {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n  - %s\n", strings.Join(problems, "\n  - "))
+		return 1
+	}
+	fmt.Println("Configuration is valid")
+	return 0
+}
+
+// putMain implements the put subcommand, uploading files to a running server one at a time.
+func putMain(args []string) int {
+	fs := flag.NewFlagSet("put", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:3000", "Base URL of the server to upload to (default: 'http://localhost:3000').")
+	endpoint := fs.String("upload-endpoint", "/upload", "The upload endpoint of the server (default: '/upload').")
+	formField := fs.String("form-field", "upload", "The name of the form field files are sent in (default: 'upload').")
+	authToken := fs.String("auth-token", "", "Bearer token sent with uploads (default: none).")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s put [flags] file...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	base, err := url.Parse(*target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid target: %v\n", err)
+		return 2
+	}
+	uploadURL := base.ResolveReference(&url.URL{Path: *endpoint})
+
+	status := 0
+	for _, path := range fs.Args() {
+		fileURL, err := putFile(uploadURL, *formField, *authToken, path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			status = 1
+			continue
+		}
+		fmt.Printf("%s: %s\n", path, fileURL)
+	}
+	return status
+}
+
+// putFile uploads the file at path to uploadURL in the form field formField, streaming it with the content type
+// of its extension, and returns the URL the server stored it at.
+func putFile(uploadURL *url.URL, formField, authToken, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		contentType := mime.TypeByExtension(filepath.Ext(path))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{"name": formField, "filename": filepath.Base(path)}))
+		h.Set("Content-Type", contentType)
+		part, err := mw.CreatePart(h)
+		if err == nil {
+			_, err = io.Copy(part, f)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, uploadURL.String(), pr)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	if authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("upload: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return "", err
+	}
+	return location.String(), nil
+}
+
+// listMain implements the list subcommand, listing the files stored in an upload directory, including those
+// archived to the cold tier, without a running server.
+func listMain(args []string) int {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	dir := fs.String("dir", "/tmp", "The upload directory to list (default: '/tmp').")
+	asJSON := fs.Bool("json", false, "Print the metadata of every file as a line of JSON (default: false).")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s list [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	logger := log.New(os.Stderr, "", 0)
+	enc := json.NewEncoder(os.Stdout)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if !*asJSON {
+		fmt.Fprintf(tw, "NAME\tSIZE\tUPLOADED\tTYPE\n")
+	}
+
+	err := listFiles(logger, *dir, func(m Metadata) bool {
+		if *asJSON {
+			enc.Encode(m)
+		} else {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", m.Name, m.Size, m.UploadedAt.Format(time.RFC3339), m.ContentType)
+		}
+		return true
+	})
+	tw.Flush()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "list failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// versionMain implements the version subcommand.
+func versionMain(args []string) int {
+	revision := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" {
+				revision = s.Value
+			}
+		}
+	}
+	fmt.Printf("usrv %s (revision %s, %s %s/%s)\n", version, revision, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return 0
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// The fclonefileat system call, cloning a file on APFS, see clonefile(2), and the directory descriptor
+// resolving paths relative to the working directory.
+const (
+	sysFclonefileat = 517
+	atFDCWD         = -2
+)
+
+// cloneFile makes dst, a newly created empty file, a copy of src sharing its blocks until either is changed,
+// and returns the file to use in place of dst. As clones are made at a new path on macOS, dst is replaced by a
+// clone with its mode, and closed. It fails if the filesystem is not APFS or the files are on different ones,
+// leaving dst empty for the caller to copy src to instead.
+func cloneFile(dst, src *os.File) (*os.File, error) {
+	fi, err := dst.Stat()
+	if err != nil {
+		return dst, err
+	}
+
+	tmp := dst.Name() + ".clone"
+	p, err := syscall.BytePtrFromString(tmp)
+	if err != nil {
+		return dst, err
+	}
+	dirfd := atFDCWD
+	if _, _, errno := syscall.Syscall6(sysFclonefileat, src.Fd(), uintptr(dirfd), uintptr(unsafe.Pointer(p)), 0, 0, 0); errno != 0 {
+		return dst, &os.PathError{Op: "clone", Path: dst.Name(), Err: errno}
+	}
+
+	if err := os.Chmod(tmp, fi.Mode().Perm()); err != nil {
+		os.Remove(tmp)
+		return dst, err
+	}
+	if err := os.Rename(tmp, dst.Name()); err != nil {
+		os.Remove(tmp)
+		return dst, err
+	}
+	clone, err := os.OpenFile(dst.Name(), os.O_RDWR, 0)
+	if err != nil {
+		return dst, err
+	}
+	dst.Close()
+	return clone, nil
+}
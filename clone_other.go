@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile is not supported on this platform, files are copied instead.
+func cloneFile(dst, src *os.File) (*os.File, error) {
+	return dst, errors.ErrUnsupported
+}
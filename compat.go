@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Compat is a preset adapting the upload endpoint to a browser upload library. It implements [flag.Value].
+// It is one of "" (none), "uppy" or "dropzone".
+type Compat string
+
+const (
+	CompatNone     Compat = ""         // CompatNone keeps the built-in responses.
+	CompatUppy     Compat = "uppy"     // CompatUppy speaks to the XHR upload plugin of Uppy.
+	CompatDropzone Compat = "dropzone" // CompatDropzone speaks to Dropzone.
+)
+
+func (c *Compat) String() string {
+	return string(*c)
+}
+
+func (c *Compat) Set(v string) error {
+	switch mode := Compat(v); mode {
+	case CompatNone, CompatUppy, CompatDropzone:
+		*c = mode
+		return nil
+	default:
+		return fmt.Errorf("unknown preset %q, expected uppy or dropzone", v)
+	}
+}
+
+// formField returns the form field the library sends files in by default.
+func (c Compat) formField() string {
+	switch c {
+	case CompatUppy, CompatDropzone:
+		return "file"
+	default:
+		return ""
+	}
+}
+
+// compatFile is a stored file as reported to upload libraries, whose URL Uppy exposes as the file's uploadURL.
+type compatFile struct {
+	Metadata
+	URL string `json:"url"`
+}
+
+// compatSuccess is the response to stored uploads of the presets, describing the first file, and every file
+// of transactions.
+type compatSuccess struct {
+	compatFile
+	Files []compatFile `json:"files,omitempty"`
+}
+
+// write writes the response of c to the upload storing files, whose URLs are under the storage's URL, with status.
+// It reports false without writing anything if c is [CompatNone].
+func (c Compat) write(w http.ResponseWriter, storage *UploadStorage, files []Metadata, status int) bool {
+	if c == CompatNone || len(files) == 0 {
+		return false
+	}
+
+	var resp compatSuccess
+	for _, f := range files {
+		resp.Files = append(resp.Files, compatFile{Metadata: f, URL: storage.URL + url.PathEscape(f.Name)})
+	}
+	resp.compatFile = resp.Files[0]
+	if len(resp.Files) == 1 {
+		resp.Files = nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+	return true
+}
+
+// writeError writes the response of c to an upload failing with message and status: Dropzone displays the
+// "error" member of JSON responses, and Uppy the "message" member. It reports false without writing anything
+// if c is [CompatNone].
+func (c Compat) writeError(w http.ResponseWriter, message string, status int) bool {
+	var resp any
+	switch c {
+	case CompatUppy:
+		resp = map[string]string{"message": message}
+	case CompatDropzone:
+		resp = map[string]string{"error": message}
+	default:
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+	return true
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// reservedPaths are the paths of the built-in routes, which the upload endpoint may neither be nor lie under.
+var reservedPaths = []string{
+	"/healthz", "/readyz", "/livez", "/files", "/uploads", "/search", "/debug", "/statusz", "/minisign.pub", "/manifest", "/manifest.sig", "/admin", "/buckets", "/static", "/internal",
+}
+
+// validate checks c for invalid values and conflicting settings, returning every problem found,
+// each naming the flags involved and how to fix it.
+func (c Config) validate() []string {
+	problems := c.options.validate() // checks of single options, see newConfig
+	problemf := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for _, d := range []struct{ flag, dir string }{{"-dir", c.dir}, {"-backup-dir", c.backupDir}, {"-record-dir", c.recordDir}} {
+		if d.dir != "" && !filepath.IsAbs(d.dir) {
+			problemf("%s %q is relative, use an absolute path so it does not depend on the working directory", d.flag, d.dir)
+		}
+	}
+	if c.publicDir != "" {
+		if fi, err := os.Stat(c.publicDir); err != nil || !fi.IsDir() || !filepath.IsAbs(c.publicDir) {
+			problemf("-public-dir %q does not name an existing absolute directory", c.publicDir)
+		}
+	}
+	if dir, ok := c.rootMode.dir(); ok {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() || !filepath.IsAbs(dir) {
+			problemf("-root %q does not name an existing absolute directory", c.rootMode)
+		}
+	}
+	if fi, err := os.Stat(c.dir); err != nil {
+		problemf("-dir: %v, create it or point -dir to an existing directory", err)
+	} else if !fi.IsDir() {
+		problemf("-dir %q is not a directory", c.dir)
+	}
+
+	if c.listenNetwork != "tcp" && c.listenNetwork != "tcp4" && c.listenNetwork != "tcp6" {
+		problemf("-listen-network %q is not one of tcp, tcp4 or tcp6", c.listenNetwork)
+	}
+	if host, _, err := net.SplitHostPort(c.listenAddr); err != nil {
+		problemf("-listen-addr %q: %v, expected host:port or :port", c.listenAddr, err)
+	} else if err := checkListenHost(host, c.listenNetwork); err != nil {
+		problemf("-listen-addr %q: %v", c.listenAddr, err)
+	}
+	if c.opsAddr != "" {
+		if host, _, err := net.SplitHostPort(c.opsAddr); err != nil {
+			problemf("-ops-addr %q: %v, expected host:port or :port", c.opsAddr, err)
+		} else if c.opsAddr == c.listenAddr {
+			problemf("-ops-addr must differ from -listen-addr")
+		} else if err := checkListenHost(host, c.listenNetwork); err != nil {
+			problemf("-ops-addr %q: %v", c.opsAddr, err)
+		}
+	}
+
+	if c.formUploadField == "" {
+		problemf("-form-field is empty, name the form field files are sent in")
+	}
+
+	switch e := c.uploadEndpoint; {
+	case !strings.HasPrefix(e, "/") || path.Clean(e) != e || strings.ContainsAny(e, "{} \t"):
+		problemf("-upload-endpoint %q is not a clean absolute path, e.g. '/upload'", e)
+	case e == "/":
+		problemf("-upload-endpoint '/' would catch every request, use a path such as '/upload'")
+	default:
+		for _, p := range reservedPaths {
+			if e == p || strings.HasPrefix(e, p+"/") {
+				problemf("-upload-endpoint %q collides with the built-in %s route, use another path", e, p)
+			}
+		}
+	}
+
+	if c.batchWorkers < 1 {
+		problemf("-batch-workers %d is not a positive number of workers", c.batchWorkers)
+	}
+
+	if c.rateLimit > 0 && c.rateLimitWindow == 0 {
+		problemf("-rate-limit requires a positive -rate-limit-window")
+	}
+	if c.memoryBudget > 0 && c.memoryBudget < c.maxInMemorySize {
+		problemf("-memory-budget is below -max-size, so not even a single upload could hold a file in memory")
+	}
+	if c.quota > 0 && c.quotaWindow == 0 {
+		problemf("-quota requires a positive -quota-window")
+	}
+	if c.alertWebhook != "" && c.alertWindow == 0 {
+		problemf("-alert-webhook requires a positive -alert-window")
+	}
+	if c.signFiles && c.signingKey == "" {
+		problemf("-sign-files requires -signing-key")
+	}
+	if c.backupInterval > 0 && c.backupDir == "" {
+		problemf("-backup-interval requires -backup-dir")
+	}
+	if c.backupS3Bucket != "" && c.backupInterval == 0 {
+		problemf("-backup-s3-bucket is only synced to with a positive -backup-interval")
+	}
+	if c.scrubRepair && (c.backupInterval == 0 || c.backupS3Bucket == "") {
+		problemf("-scrub-repair requires backups synced to -backup-s3-bucket every -backup-interval")
+	}
+	if c.scrubRepair && c.scrubInterval == 0 {
+		problemf("-scrub-repair requires a positive -scrub-interval")
+	}
+	if c.tierColdAfter > 0 && c.tierS3Bucket == "" {
+		problemf("-tier-cold-after requires -tier-s3-bucket")
+	}
+	if c.tierPresignTTL > 0 && c.tierColdAfter == 0 {
+		problemf("-tier-presign-ttl requires -tier-cold-after")
+	}
+	if c.tierPresignTTL > 7*24*time.Hour {
+		problemf("-tier-presign-ttl %v exceeds the 7 days presigned URLs may be valid for", c.tierPresignTTL)
+	}
+	if u, err := url.Parse(c.opaURL); c.opaURL != "" && (err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "") {
+		problemf("-opa-url %q is not an http or https URL", c.opaURL)
+	}
+	if c.usageMetaKey != "" && c.adminToken == "" {
+		problemf("-usage-meta-key requires -admin-token, storage usage is reported by the admin API")
+	}
+	if _, err := parseOutboundProxy(c.outboundProxy); c.outboundProxy != "" && err != nil {
+		problemf("-outbound-proxy: %v, e.g. 'http://proxy.internal:3128'", err)
+	}
+	if _, err := outboundTLSConfig(c.outboundCAFile, c.outboundInsecureSkipVerify, c.outboundTLSMinVersion); err != nil {
+		problemf("-outbound-ca-file, -outbound-tls-min-version: %v", err)
+	}
+	if _, _, err := net.SplitHostPort(c.outboundDNS); c.outboundDNS != "" && err != nil {
+		problemf("-outbound-dns %q: %v, expected host:port, e.g. '10.0.0.2:53'", c.outboundDNS, err)
+	}
+	if _, err := parseOutboundHosts(c.outboundHosts); err != nil {
+		problemf("-outbound-hosts: %v, e.g. 'minio.internal=10.0.0.7'", err)
+	}
+	if c.sftpHost != "" {
+		if _, err := parseSFTPTarget(c.sftpHost, c.sftpKey, c.sftpKnownHosts); err != nil {
+			problemf("-sftp-host: %v, e.g. 'upload@sftp.example.com:22'", err)
+		}
+		if _, err := exec.LookPath("ssh"); err != nil {
+			problemf("-sftp-host requires the ssh command: %v", err)
+		}
+		for _, f := range []struct{ flag, path string }{{"-sftp-key", c.sftpKey}, {"-sftp-known-hosts", c.sftpKnownHosts}} {
+			if _, err := os.Stat(f.path); f.path != "" && err != nil {
+				problemf("%s: %v", f.flag, err)
+			}
+		}
+	}
+	if c.ioUring && !uringSupported {
+		problemf("-io-uring requires a Linux binary built with '-tags uring', e.g. 'make build TAGS=uring'")
+	}
+	if _, _, err := parseFetchAllowlists(c.ingestSchemes, c.ingestPorts); err != nil {
+		problemf("-ingest-schemes, -ingest-ports: %v", err)
+	}
+	if _, err := parseUploadMethods(c.uploadMethods); err != nil {
+		problemf("-upload-methods: %v, list POST, PUT or both", err)
+	}
+	for _, t := range newDistribution(c).Trackers {
+		if u, err := url.Parse(t); err != nil || u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp" || u.Host == "" {
+			problemf("-torrent-trackers: %q is not an http, https or udp announce URL", t)
+		}
+	}
+	if c.torrentTrackers != "" && c.distributionMinSize == 0 {
+		problemf("-torrent-trackers requires -distribution-min-size, torrents are disabled")
+	}
+	if _, err := parseCallbackAllowlist(c.callbackAllowlist); err != nil {
+		problemf("-callback-allowlist: %v, list URL prefixes such as 'https://hooks.example.com/uploads/'", err)
+	}
+	if _, err := parseTrustedProxies(c.trustedProxies); err != nil {
+		problemf("-trusted-proxies: %v, list addresses or ranges such as '10.0.0.0/8'", err)
+	}
+
+	return problems
+}
+
+// checkListenHost reports a listen address host that is an IP literal of the other family than network binds.
+func checkListenHost(host, network string) error {
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return nil
+	case network == "tcp4" && ip.To4() == nil:
+		return fmt.Errorf("IPv6 address cannot be listened on with -listen-network tcp4")
+	case network == "tcp6" && ip.To4() != nil:
+		return fmt.Errorf("IPv4 address cannot be listened on with -listen-network tcp6")
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateUploadEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		wantErr  bool
+	}{
+		{endpoint: "/upload", wantErr: false},
+		{endpoint: "/manifests", wantErr: false},
+		{endpoint: "/", wantErr: true},
+		{endpoint: "upload", wantErr: true},
+		{endpoint: "/upload/", wantErr: true},
+		{endpoint: "/files", wantErr: true},
+		{endpoint: "/files/new", wantErr: true},
+		{endpoint: "/manifest", wantErr: true},
+		{endpoint: "/manifest.sig", wantErr: true},
+		{endpoint: "/manifest/upload", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.endpoint, func(t *testing.T) {
+			config, err := newConfig([]string{"-dir", t.TempDir(), "-upload-endpoint", tt.endpoint})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var problems []string
+			for _, p := range config.validate() {
+				if strings.Contains(p, "-upload-endpoint") {
+					problems = append(problems, p)
+				}
+			}
+			if (len(problems) > 0) != tt.wantErr {
+				t.Errorf("validate() = %q, want a problem with -upload-endpoint %t", problems, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/xml"
+	"flag"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Sources of the values of configuration settings.
+const (
+	sourceFlag    = "flag"    // set on the command line
+	sourceDefault = "default" // the default of the flag
+	sourceDerived = "derived" // derived from other settings or the environment, e.g. container limits
+	sourceEnv     = "env"     // read from the environment
+)
+
+// secretFlags are the flags whose values are redacted from the reported configuration, by how they are redacted.
+var secretFlags = map[string]func(string) string{
+	"auth-token":     redact,
+	"hmac-secret":    redact,
+	"admin-token":    redact,
+	"alert-webhook":  redact,
+	"redis":          redactURL,
+	"mqtt-broker":    redactURL,
+	"opa-url":        redactURL,
+	"outbound-proxy": redactURL,
+}
+
+// configEnv are the environment variables the server reads, reported along with the flags, with how their
+// values are redacted, if they are.
+var configEnv = []struct {
+	name   string
+	redact func(string) string
+}{
+	{"GOMAXPROCS", nil}, {"GOMEMLIMIT", nil}, {"HTTP_PROXY", redactURL}, {"HTTPS_PROXY", redactURL}, {"NO_PROXY", nil},
+	{"AWS_ACCESS_KEY_ID", redact}, {"AWS_SECRET_ACCESS_KEY", redact},
+}
+
+// configSetting is the effective value of a configuration setting and where it came from.
+type configSetting struct {
+	Name    string `json:"name" xml:"name,attr"`
+	Value   string `json:"value" xml:"value"`
+	Default string `json:"default,omitempty" xml:"default,omitempty"`
+	Source  string `json:"source" xml:"source,attr"`
+}
+
+// configReport is the configuration the server runs with, as reported by the admin API.
+type configReport struct {
+	XMLName   xml.Name        `json:"-" xml:"config"`
+	Hostname  string          `json:"hostname" xml:"hostname"`
+	StartedAt time.Time       `json:"started_at" xml:"started_at"`
+	Settings  []configSetting `json:"settings" xml:"setting"`
+}
+
+// effectiveConfig returns the settings of all flags of config, by name, and the environment variables that are
+// set, with secrets redacted.
+func effectiveConfig(config Config) []configSetting {
+	options := config.options
+	set := make(map[string]bool)
+	options.fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	var settings []configSetting
+	options.fs.VisitAll(func(f *flag.Flag) {
+		s := configSetting{Name: f.Name, Value: f.Value.String(), Default: f.DefValue, Source: sourceDefault}
+		if options.setFromEnv(f.Name) {
+			s.Source = sourceEnv
+		} else if set[f.Name] {
+			s.Source = sourceFlag
+		} else if v, ok := options.derived[f.Name]; ok {
+			s.Value, s.Source = v, sourceDerived
+		}
+		if redactValue, ok := secretFlags[f.Name]; ok {
+			s.Value, s.Default = redactValue(s.Value), redactValue(s.Default)
+		}
+		settings = append(settings, s)
+	})
+
+	for _, env := range configEnv {
+		v, ok := os.LookupEnv(env.name)
+		if !ok {
+			continue
+		}
+		if env.redact != nil {
+			v = env.redact(v)
+		}
+		settings = append(settings, configSetting{Name: env.name, Value: v, Source: sourceEnv})
+	}
+	return settings
+}
+
+// configHandler handles GET /admin/config, responding with the effective configuration config of the server as
+// JSON, or XML for clients preferring it.
+func configHandler(config Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hostname, _ := os.Hostname()
+		report := configReport{Hostname: hostname, StartedAt: startedAt, Settings: effectiveConfig(config)}
+
+		w.Header().Set("Cache-Control", "no-store")
+		writeNegotiated(w, r, report, report)
+	})
+}
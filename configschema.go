@@ -0,0 +1,217 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// configEnvPrefix prefixes the names of the environment variables options may be set by, see [configOption].
+const configEnvPrefix = "USRV_"
+
+// configOption is an option of the server: a flag, the section of the help it is listed in, the environment
+// variable it may also be set by, named after the flag, e.g. USRV_MAX_SIZE for -max-size, and the checks of
+// its value that do not depend on other options.
+type configOption struct {
+	name    string
+	group   string
+	env     string
+	fromEnv bool                         // fromEnv is set if the option was set by its environment variable.
+	checks  []func(value float64) string // checks return why a value is invalid, or "" if it is not.
+}
+
+// nonNegative checks that the value of o, a number or duration, is not negative.
+func (o *configOption) nonNegative() *configOption {
+	o.checks = append(o.checks, func(v float64) string {
+		if v < 0 {
+			return "is negative"
+		}
+		return ""
+	})
+	return o
+}
+
+// within checks that the value of o, a number, is between lo and hi, kind naming what it is, e.g. "a fraction".
+func (o *configOption) within(lo, hi float64, kind string) *configOption {
+	o.checks = append(o.checks, func(v float64) string {
+		if v < lo || v > hi {
+			return fmt.Sprintf("is not %s between %g and %g", kind, lo, hi)
+		}
+		return ""
+	})
+	return o
+}
+
+// configSchema registers the options of the server as flags of a flag set, by section, and sets them from the
+// command line and the environment. Its methods registering flags are those of [flag.FlagSet] by the same name.
+type configSchema struct {
+	fs       *flag.FlagSet
+	group    string // group is the section options are registered in.
+	options  []*configOption
+	problems []string          // problems are the environment variables that failed to set their option.
+	derived  map[string]string // derived holds the values given to options that were not set, in place of their defaults, see [configSchema.derive].
+}
+
+// newConfigSchema returns a schema registering options as flags of fs, listing them by section in its usage.
+func newConfigSchema(fs *flag.FlagSet) *configSchema {
+	s := &configSchema{fs: fs, derived: make(map[string]string)}
+	fs.Usage = s.usage
+	return s
+}
+
+// section lists the options registered next under title in the help.
+func (s *configSchema) section(title string) {
+	s.group = title
+}
+
+// add adds the option of the flag name just registered.
+func (s *configSchema) add(name string) *configOption {
+	o := &configOption{name: name, group: s.group, env: configEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))}
+	s.options = append(s.options, o)
+	return o
+}
+
+func (s *configSchema) StringVar(p *string, name, value, usage string) *configOption {
+	s.fs.StringVar(p, name, value, usage)
+	return s.add(name)
+}
+
+func (s *configSchema) BoolVar(p *bool, name string, value bool, usage string) *configOption {
+	s.fs.BoolVar(p, name, value, usage)
+	return s.add(name)
+}
+
+func (s *configSchema) IntVar(p *int, name string, value int, usage string) *configOption {
+	s.fs.IntVar(p, name, value, usage)
+	return s.add(name)
+}
+
+func (s *configSchema) Int64Var(p *int64, name string, value int64, usage string) *configOption {
+	s.fs.Int64Var(p, name, value, usage)
+	return s.add(name)
+}
+
+func (s *configSchema) Float64Var(p *float64, name string, value float64, usage string) *configOption {
+	s.fs.Float64Var(p, name, value, usage)
+	return s.add(name)
+}
+
+func (s *configSchema) DurationVar(p *time.Duration, name string, value time.Duration, usage string) *configOption {
+	s.fs.DurationVar(p, name, value, usage)
+	return s.add(name)
+}
+
+func (s *configSchema) Var(value flag.Value, name, usage string) *configOption {
+	s.fs.Var(value, name, usage)
+	return s.add(name)
+}
+
+// parse sets the options from args, then the options not set by args from their environment variables.
+// It returns the error parsing args failed with, [flag.ErrHelp] if the help was asked for.
+func (s *configSchema) parse(args []string) error {
+	if err := s.fs.Parse(args); err != nil {
+		return err
+	}
+
+	set := make(map[string]bool)
+	s.fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, o := range s.options {
+		v, ok := os.LookupEnv(o.env)
+		if !ok || set[o.name] {
+			continue
+		}
+		if err := s.fs.Set(o.name, v); err != nil {
+			if redactValue, ok := secretFlags[o.name]; ok {
+				v = redactValue(v)
+			}
+			s.problems = append(s.problems, fmt.Sprintf("$%s: invalid value %q for -%s: %v", o.env, v, o.name, err))
+			continue
+		}
+		o.fromEnv = true
+	}
+	return nil
+}
+
+// isSet reports whether the option name was set, by its flag or its environment variable.
+func (s *configSchema) isSet(name string) bool {
+	set := false
+	s.fs.Visit(func(f *flag.Flag) { set = set || f.Name == name })
+	return set
+}
+
+// derive records the value v the option name, which was not set, was given in place of its default, in the
+// units of its flag, e.g. megabytes.
+func (s *configSchema) derive(name, v string) {
+	s.derived[name] = v
+}
+
+// setFromEnv reports whether the option name was set by its environment variable.
+func (s *configSchema) setFromEnv(name string) bool {
+	i := slices.IndexFunc(s.options, func(o *configOption) bool { return o.name == name })
+	return i >= 0 && s.options[i].fromEnv
+}
+
+// validate returns the problems of the values of the options failing their checks, naming the environment
+// variable they were set by, if any, and of the environment variables that could not be parsed.
+func (s *configSchema) validate() []string {
+	problems := slices.Clone(s.problems)
+	for _, o := range s.options {
+		f := s.fs.Lookup(o.name)
+		g, ok := f.Value.(flag.Getter)
+		if !ok || len(o.checks) == 0 {
+			continue
+		}
+
+		var v float64
+		switch n := g.Get().(type) {
+		case int:
+			v = float64(n)
+		case int64:
+			v = float64(n)
+		case float64:
+			v = n
+		case time.Duration:
+			v = float64(n)
+		default:
+			continue
+		}
+
+		for _, check := range o.checks {
+			problem := check(v)
+			if problem == "" {
+				continue
+			}
+			if o.fromEnv {
+				problem = fmt.Sprintf("(from $%s) %s", o.env, problem)
+			}
+			problems = append(problems, fmt.Sprintf("-%s %v %s", o.name, g.Get(), problem))
+		}
+	}
+	return problems
+}
+
+// usage writes the help of the options, by section, to the output of the flag set.
+func (s *configSchema) usage() {
+	out := s.fs.Output()
+	fmt.Fprintf(out, "Usage: %s [serve|check] [flags]\n\n", s.fs.Name())
+	printSubcommands(out)
+	fmt.Fprintf(out, "\nServer flags, which may also be set by the environment variable in brackets, the command line taking precedence.\n")
+
+	var group string
+	for _, o := range s.options {
+		if o.group != group {
+			group = o.group
+			fmt.Fprintf(out, "\n%s:\n", group)
+		}
+
+		name, usage := flag.UnquoteUsage(s.fs.Lookup(o.name))
+		line := "  -" + o.name
+		if name != "" {
+			line += " " + name
+		}
+		fmt.Fprintf(out, "%s\n    \t%s [$%s]\n", line, usage, o.env)
+	}
+}
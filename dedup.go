@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// uploadsCoalesced counts the uploads answered with the result of an identical upload, published through [expvar].
+var uploadsCoalesced = expvar.NewInt("uploads_coalesced")
+
+// dedupResult is the outcome of an upload shared with its duplicates.
+type dedupResult struct {
+	done     chan struct{} // done is closed once the upload is stored or failed.
+	stored   Metadata
+	err      error
+	finished time.Time
+}
+
+// Deduplicator coalesces identical uploads, having the same directory, file name, size and content,
+// arriving within a window, such as the retries of buggy clients submitting forms several times.
+// Duplicates of an upload in progress wait for it and share its result, and duplicates arriving
+// within the window after it was stored get its result without storing the file again. Failures
+// are only shared with the uploads waiting for them, so retries of failed uploads go through.
+// Uploads are only coalesced within a replica. A nil *Deduplicator coalesces nothing.
+type Deduplicator struct {
+	window time.Duration
+	logger *log.Logger
+
+	mu      sync.Mutex
+	uploads map[string]*dedupResult
+}
+
+// newDeduplicator creates the deduplicator configured by config, or nil if deduplication is disabled.
+func newDeduplicator(config Config, logger *log.Logger) *Deduplicator {
+	if config.dedupWindow <= 0 {
+		return nil
+	}
+	return &Deduplicator{window: config.dedupWindow, logger: logger, uploads: make(map[string]*dedupResult)}
+}
+
+// do stores the upload f to dir by calling store, unless an identical upload is in progress or was stored
+// within the window, in which case it returns that upload's result. coalesced reports the latter.
+func (d *Deduplicator) do(dir string, f *spooledFile, store func() (Metadata, error)) (stored Metadata, coalesced bool, err error) {
+	if d == nil {
+		stored, err = store()
+		return stored, false, err
+	}
+
+	key, err := dedupKey(dir, f)
+	if err != nil {
+		d.logger.Printf("Error hashing upload for deduplication: %v", err)
+		stored, err = store()
+		return stored, false, err
+	}
+
+	d.mu.Lock()
+	for k, u := range d.uploads {
+		if !u.finished.IsZero() && time.Since(u.finished) > d.window {
+			delete(d.uploads, k)
+		}
+	}
+	if u, ok := d.uploads[key]; ok {
+		d.mu.Unlock()
+		<-u.done
+		uploadsCoalesced.Add(1)
+		infof(d.logger, "Coalesced duplicate upload of %s", f.Filename)
+		return u.stored, true, u.err
+	}
+	u := &dedupResult{done: make(chan struct{})}
+	d.uploads[key] = u
+	d.mu.Unlock()
+
+	u.stored, u.err = store()
+
+	d.mu.Lock()
+	u.finished = time.Now()
+	if u.err != nil {
+		delete(d.uploads, key)
+	}
+	d.mu.Unlock()
+	close(u.done)
+
+	return u.stored, false, u.err
+}
+
+// dedupKey returns the key identical uploads of f to dir share.
+func dedupKey(dir string, f *spooledFile) (string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s\x00%s\x00%d\x00%s", dir, f.Filename, f.Size, hex.EncodeToString(h.Sum(nil))), nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Block sizes of file signatures, in bytes.
+const (
+	defaultDeltaBlockSize = 64 << 10
+	minDeltaBlockSize     = 1 << 10
+	maxDeltaBlockSize     = 16 << 20
+)
+
+// Delta headers and instructions.
+const (
+	deltaBlockSizeHeader = "X-Delta-Block-Size"  // deltaBlockSizeHeader is the block size of the signature a delta was computed against.
+	deltaBaseHeader      = "X-Delta-Base-SHA256" // deltaBaseHeader is the checksum of the content a delta was computed against.
+	deltaResultHeader    = "X-Delta-SHA256"      // deltaResultHeader is the checksum of the content a delta results in, optional.
+
+	deltaCopy    = 'C' // deltaCopy copies blocks of the base content: the uvarint index of the first one, then their uvarint count.
+	deltaLiteral = 'L' // deltaLiteral inserts new content: its uvarint length, then the bytes.
+)
+
+// SignatureBlock describes a block of a stored file by the checksums delta encoders look it up with.
+type SignatureBlock struct {
+	Weak   uint32 `json:"weak" xml:"weak,attr"`     // Weak is the rolling checksum of the block, see [weakChecksum].
+	Strong string `json:"strong" xml:"strong,attr"` // Strong is the hex encoded SHA-256 checksum of the block.
+}
+
+// FileSignature describes the content of a stored file block by block, for clients to compute the delta of a
+// new version of it against, sending only the blocks changed, see [applyDelta].
+type FileSignature struct {
+	XMLName   xml.Name         `json:"-" xml:"signature"`
+	Name      string           `json:"name" xml:"name,attr"`
+	Size      int64            `json:"size" xml:"size,attr"`
+	SHA256    string           `json:"sha256" xml:"sha256,attr"` // SHA256 is the checksum of the whole content, sent back with deltas as their base.
+	BlockSize int64            `json:"block_size" xml:"block_size,attr"`
+	Blocks    []SignatureBlock `json:"blocks" xml:"block"`
+}
+
+// weakChecksum returns the rsync rolling checksum of b, which an encoder can update in constant time as it slides
+// a window over the new content, looking for blocks of the base content.
+func weakChecksum(b []byte) uint32 {
+	var s1, s2 uint32
+	for i, c := range b {
+		s1 += uint32(c)
+		s2 += uint32(len(b)-i) * uint32(c)
+	}
+	return s1&0xffff | s2<<16
+}
+
+// computeSignature reads r to compute the signature of the file name.
+func computeSignature(r io.Reader, name string, blockSize int64) (FileSignature, error) {
+	sig := FileSignature{Name: name, BlockSize: blockSize, Blocks: []SignatureBlock{}}
+	whole := sha256.New()
+	block := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			strong := sha256.Sum256(block[:n])
+			sig.Blocks = append(sig.Blocks, SignatureBlock{Weak: weakChecksum(block[:n]), Strong: hex.EncodeToString(strong[:])})
+			whole.Write(block[:n])
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return FileSignature{}, err
+		}
+	}
+	sig.SHA256 = hex.EncodeToString(whole.Sum(nil))
+	return sig, nil
+}
+
+// parseBlockSize parses the signature block size v, the default one if empty.
+func parseBlockSize(v string) (int64, error) {
+	if v == "" {
+		return defaultDeltaBlockSize, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < minDeltaBlockSize || n > maxDeltaBlockSize {
+		return 0, fmt.Errorf("block size %q is not a number of bytes between %d and %d", v, minDeltaBlockSize, maxDeltaBlockSize)
+	}
+	return n, nil
+}
+
+// errInvalidDelta reports a delta that does not apply to its base.
+var errInvalidDelta = errors.New("invalid delta")
+
+// applyDelta writes to w the content the delta read from r results in, applied to the base content of size
+// bytes, in blocks of blockSize bytes, returning the number of bytes copied from base and sent as literals.
+// It fails with [errInvalidDelta] on malformed instructions, and once more than maxSize bytes, unless 0, are written.
+func applyDelta(w io.Writer, r *bufio.Reader, base io.ReaderAt, size, blockSize, maxSize int64) (copied, sent int64, err error) {
+	blocks := (size + blockSize - 1) / blockSize
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			return copied, sent, nil
+		}
+		if err != nil {
+			return copied, sent, err
+		}
+
+		var n int64
+		switch op {
+		case deltaCopy:
+			first, err1 := binary.ReadUvarint(r)
+			count, err2 := binary.ReadUvarint(r)
+			if err := errors.Join(err1, err2); err != nil {
+				return copied, sent, fmt.Errorf("%w: truncated copy instruction", errInvalidDelta)
+			}
+			if count == 0 || first >= uint64(blocks) || count > uint64(blocks)-first {
+				return copied, sent, fmt.Errorf("%w: copy of blocks %d+%d beyond the %d blocks of the base", errInvalidDelta, first, count, blocks)
+			}
+			offset := int64(first) * blockSize
+			n = min(int64(count)*blockSize, size-offset)
+			if maxSize > 0 && copied+sent+n > maxSize {
+				return copied, sent, fmt.Errorf("%w: result exceeds %d bytes", errInvalidDelta, maxSize)
+			}
+			if _, err := io.Copy(w, io.NewSectionReader(base, offset, n)); err != nil {
+				return copied, sent, err
+			}
+			copied += n
+
+		case deltaLiteral:
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return copied, sent, fmt.Errorf("%w: truncated literal instruction", errInvalidDelta)
+			}
+			n = int64(length)
+			if n < 0 || maxSize > 0 && copied+sent+n > maxSize {
+				return copied, sent, fmt.Errorf("%w: result exceeds %d bytes", errInvalidDelta, maxSize)
+			}
+			m, err := io.CopyN(w, r, n)
+			sent += m
+			if err == io.EOF {
+				return copied, sent, fmt.Errorf("%w: literal of %d bytes truncated at %d", errInvalidDelta, n, m)
+			}
+			if err != nil {
+				return copied, sent, err
+			}
+
+		default:
+			return copied, sent, fmt.Errorf("%w: unknown instruction %q", errInvalidDelta, op)
+		}
+	}
+}
+
+// fileSignature handles GET /files/{name}/signature, responding with the [FileSignature] of a stored file as JSON,
+// or XML for clients preferring it, in blocks of block_size bytes, 64 KiB by default. Files archived to the cold
+// tier are restored to the local disk first.
+func fileSignature(logger *log.Logger, baseDir string, tier *ColdTier) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !validFileName(name) {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+		blockSize, err := parseBlockSize(r.URL.Query().Get("block_size"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid block size: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if _, err := tier.restore(r.Context(), name); err != nil {
+			logger.Printf("Error restoring file from cold tier: %v", err)
+			http.Error(w, "Could not open file", http.StatusInternalServerError)
+			return
+		}
+
+		f, err := os.Open(filepath.Join(baseDir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error opening file for signature: %v", err)
+			http.Error(w, "Could not open file", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		clearWriteDeadline(w)
+		sig, err := computeSignature(bufio.NewReader(f), name, blockSize)
+		if err != nil {
+			logger.Printf("Error computing file signature: %v", err)
+			http.Error(w, "Could not read file", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-cache")
+		writeNegotiated(w, r, sig, sig)
+	})
+}
+
+// applyFileDelta handles POST /files/{name}/delta, replacing the content of a stored file with the result of the
+// delta sent as the request body, computed against its [FileSignature]. The request states the block size of the
+// signature and the checksum of the content it describes, and the delta is rejected with 412 Precondition Failed
+// if the file changed since. With the checksum of the result, the delta is rejected if it does not result in it.
+// The new content is built aside, up to maxSize bytes unless 0, and replaces the file once complete, flushed to
+// disk according to fsync. Its metadata is updated, and the new content signed with signer, like that of patched
+// files, see [patchFile].
+func applyFileDelta(logger *log.Logger, baseDir string, tier *ColdTier, maxSize int64, fsync FsyncPolicy, signer *Minisigner, indexes *FileIndexes) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !validFileName(name) {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+		blockSize, err := parseBlockSize(r.Header.Get(deltaBlockSizeHeader))
+		if err != nil || r.Header.Get(deltaBlockSizeHeader) == "" {
+			http.Error(w, "Invalid or missing "+deltaBlockSizeHeader, http.StatusBadRequest)
+			return
+		}
+		baseSum := r.Header.Get(deltaBaseHeader)
+		if baseSum == "" {
+			http.Error(w, "Missing "+deltaBaseHeader, http.StatusBadRequest)
+			return
+		}
+
+		if _, err := tier.restore(r.Context(), name); err != nil {
+			logger.Printf("Error restoring file from cold tier: %v", err)
+			http.Error(w, "Could not open file", http.StatusInternalServerError)
+			return
+		}
+
+		path := filepath.Join(baseDir, name)
+		base, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error opening file for delta: %v", err)
+			http.Error(w, "Could not open file", http.StatusInternalServerError)
+			return
+		}
+		defer base.Close()
+
+		fi, err := base.Stat()
+		if err != nil {
+			logger.Printf("Error reading file info: %v", err)
+			http.Error(w, "Could not open file", http.StatusInternalServerError)
+			return
+		}
+
+		current := ""
+		if m, err := readMetadata(baseDir, name); err == nil && m.Size == fi.Size() {
+			current = m.SHA256
+		}
+		if current == "" {
+			if current, err = sha256File(path); err != nil {
+				logger.Printf("Error computing file checksum: %v", err)
+				http.Error(w, "Could not read file", http.StatusInternalServerError)
+				return
+			}
+		}
+		if current != baseSum {
+			http.Error(w, "File changed since the delta was computed", http.StatusPreconditionFailed)
+			return
+		}
+
+		tmp, err := os.CreateTemp(baseDir, ".delta-*.tmp")
+		if err != nil {
+			logger.Printf("Error creating file on disk: %v", err)
+			http.Error(w, "Could not create file on disk", http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+
+		h := sha256.New()
+		copied, sent, err := applyDelta(io.MultiWriter(tmp, h), bufio.NewReader(r.Body), base, fi.Size(), blockSize, maxSize)
+		if errors.Is(err, errInvalidDelta) {
+			logger.Printf("Delta of %s rejected: %v", name, err)
+			http.Error(w, fmt.Sprintf("Delta rejected: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error applying delta: %v", err)
+			http.Error(w, "Could not apply delta", http.StatusInternalServerError)
+			return
+		}
+
+		sum := hex.EncodeToString(h.Sum(nil))
+		if want := r.Header.Get(deltaResultHeader); want != "" && want != sum {
+			logger.Printf("Delta of %s rejected: result checksum %s, expected %s", name, sum, want)
+			http.Error(w, "Delta rejected: result does not match "+deltaResultHeader, http.StatusUnprocessableEntity)
+			return
+		}
+
+		if err := fsync.sync(tmp, baseDir); err != nil {
+			logger.Printf("Error syncing file: %v", err)
+			http.Error(w, "Could not save file", http.StatusInternalServerError)
+			return
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			logger.Printf("Error replacing file: %v", err)
+			http.Error(w, "Could not save file", http.StatusInternalServerError)
+			return
+		}
+		os.Chmod(path, fi.Mode().Perm())
+		updateContentMetadata(logger, baseDir, name, copied+sent, sum, signer, indexes)
+
+		infof(logger, "File updated from delta: %s, %d bytes copied, %d bytes sent\n", name, copied, sent)
+		fmt.Fprintf(w, "File updated successfully: %s\n", name)
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// DirPruner removes the directories left empty below the upload directory by deletes, restores and purges, such as
+// the [trashDir] once emptied, or the [metadataDir] and [attachmentsDir] of the trash and of buckets. Directories
+// up to keepDepth levels below the upload directory are kept, e.g. 1 keeps the trash and metadata directories of
+// the upload directory itself, the upload directory is always kept. A nil *DirPruner keeps every directory.
+type DirPruner struct {
+	logger    *log.Logger
+	root      string
+	keepDepth int
+}
+
+// newDirPruner returns the pruner of the directories below root deeper than keepDepth, nil if keepDepth is negative.
+func newDirPruner(logger *log.Logger, root string, keepDepth int) *DirPruner {
+	if keepDepth < 0 {
+		return nil
+	}
+	return &DirPruner{logger: logger, root: filepath.Clean(root), keepDepth: keepDepth}
+}
+
+// prune removes each of dirs if it is empty, and then its parents as long as they are empty too, up to the depth kept.
+func (p *DirPruner) prune(dirs ...string) {
+	if p == nil {
+		return
+	}
+
+	for _, dir := range dirs {
+		for dir = filepath.Clean(dir); p.depth(dir) > p.keepDepth; dir = filepath.Dir(dir) {
+			// Removing a directory fails unless it is empty, which ends the walk up
+			err := os.Remove(dir)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				if !isDirNotEmpty(err) {
+					p.logger.Printf("Error removing empty directory: %v", err)
+				}
+				break
+			}
+			debugf(p.logger, "Removed empty directory: %s", dir)
+		}
+	}
+}
+
+// depth returns the number of levels dir is below the root of p, 0 for the root itself or a directory outside of it.
+func (p *DirPruner) depth(dir string) int {
+	rel, err := filepath.Rel(p.root, dir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// isDirNotEmpty reports whether err is the failure to remove a directory that is not empty.
+func isDirNotEmpty(err error) bool {
+	return errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST)
+}
+
+// storedFileDirs returns the directories of baseDir holding the metadata, attachments and caches of stored files,
+// which deleting the last of them leaves empty.
+func storedFileDirs(baseDir string) []string {
+	return []string{
+		filepath.Join(baseDir, metadataDir),
+		filepath.Join(baseDir, attachmentsDir),
+		filepath.Join(baseDir, chunkMapsDir),
+		filepath.Join(baseDir, torrentsDir),
+	}
+}
+
+// createIn creates dir, and runs create, which creates an entry in it, again after creating dir again if dir was
+// removed in the meantime by a [DirPruner].
+func createIn(dir string, create func() error) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	err := create()
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if _, statErr := os.Stat(dir); !errors.Is(statErr, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	return create()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDirPrunerPrune(t *testing.T) {
+	tests := []struct {
+		name      string
+		keepDepth int
+		want      []string // want are the directories left, relative to the root.
+	}{
+		{name: "keep all", keepDepth: -1, want: []string{".buckets", ".meta", ".trash", ".trash/.meta", ".trash/.torrents"}},
+		{name: "keep depth 2", keepDepth: 2, want: []string{".buckets", ".meta", ".trash", ".trash/.meta", ".trash/.torrents"}},
+		{name: "keep depth 1", keepDepth: 1, want: []string{".buckets", ".meta", ".trash"}},
+		{name: "keep depth 0", keepDepth: 0, want: []string{".meta"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			for _, dir := range []string{".buckets", ".meta", ".trash/.meta", ".trash/.torrents"} {
+				if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// A directory that is not empty is kept, along with its parents
+			if err := os.WriteFile(filepath.Join(root, ".meta", "a.json"), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			p := newDirPruner(log.New(io.Discard, "", 0), root, tt.keepDepth)
+			p.prune(filepath.Join(root, ".buckets"), filepath.Join(root, ".meta"), filepath.Join(root, ".missing"))
+			p.prune(storedFileDirs(filepath.Join(root, trashDir))...)
+
+			var got []string
+			err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+				if err != nil || !d.IsDir() || path == root {
+					return err
+				}
+				rel, _ := filepath.Rel(root, path)
+				got = append(got, filepath.ToSlash(rel))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("directories left = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateInPrunedDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), ".meta")
+	attempts := 0
+	err := createIn(dir, func() error {
+		attempts++
+		if attempts == 1 {
+			// The directory is pruned between its creation and the creation of the entry
+			if err := os.Remove(dir); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return os.WriteFile(filepath.Join(dir, "a.json"), nil, 0o644)
+	})
+	if err != nil || attempts != 2 {
+		t.Fatalf("createIn() = %v after %d attempts, want nil after 2", err, attempts)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.json")); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/Gabriel-Ladzaretti/go-multipart/internal/httpx"
+)
+
+// diskSpacePollInterval is the interval at which the free space of the upload directory is sampled.
+const diskSpacePollInterval = 2 * time.Second
+
+// DiskMonitor tracks the free space of the filesystem of a directory.
+// Space claimed by in-flight uploads is held back until they complete.
+type DiskMonitor struct {
+	dir      string
+	logger   *log.Logger
+	free     atomic.Int64 // free is the last sampled number of bytes available to unprivileged users.
+	reserved atomic.Int64 // reserved is the number of bytes claimed by in-flight uploads.
+}
+
+// newDiskMonitor returns a monitor of the filesystem of dir, having taken a first sample.
+func newDiskMonitor(dir string, logger *log.Logger) (*DiskMonitor, error) {
+	m := &DiskMonitor{dir: dir, logger: logger}
+	if err := m.sample(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// sample updates the free space of the monitored filesystem.
+func (m *DiskMonitor) sample() error {
+	free, err := freeSpace(m.dir)
+	if err != nil {
+		return err
+	}
+	m.free.Store(free)
+	return nil
+}
+
+// available returns the free space that is not claimed by in-flight uploads.
+func (m *DiskMonitor) available() int64 {
+	return m.free.Load() - m.reserved.Load()
+}
+
+// run samples the free space periodically until ctx is done.
+func (m *DiskMonitor) run(ctx context.Context) {
+	ticker := time.NewTicker(diskSpacePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := m.sample(); err != nil {
+			m.logger.Printf("Error sampling free disk space: %v", err)
+		}
+	}
+}
+
+// NewDiskSpaceMiddleware creates a middleware rejecting requests with 507 Insufficient Storage
+// while less than watermark bytes of the disk monitored by m are available, so uploads are refused
+// up front instead of failing mid-copy once the disk is full. The Content-Length of admitted
+// requests is claimed from the available space until they complete.
+func NewDiskSpaceMiddleware(m *DiskMonitor, watermark int64) httpx.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claim := max(r.ContentLength, 0)
+
+			if m.available()-claim < watermark {
+				m.logger.Printf("Rejecting request, %d bytes of free disk space left", m.available())
+				http.Error(w, "Insufficient storage", http.StatusInsufficientStorage)
+				return
+			}
+
+			m.reserved.Add(claim)
+			defer m.reserved.Add(-claim)
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// torrentsDir is the directory, relative to the upload directory, caching the piece hashes of the torrents of
+// stored files, one document per file named after it.
+const torrentsDir = ".torrents"
+
+// Piece lengths of torrents and metalinks, in bytes.
+const (
+	minPieceLength = 256 << 10
+	maxPieceLength = 16 << 20
+	maxPieces      = 2000 // maxPieces is the number of pieces files are split in at most, unless pieces would exceed maxPieceLength.
+)
+
+// Distribution describes how the stored files of at least MinSize bytes are offered for peer-to-peer distribution,
+// as torrents and metalinks with the server as web seed.
+type Distribution struct {
+	MinSize  int64    // MinSize is the size in bytes files must have to be distributed, 0 disables distribution.
+	Trackers []string // Trackers are the announce URLs of torrents, which have the web seed only if empty.
+}
+
+// newDistribution returns the distribution configured by config.
+func newDistribution(config Config) Distribution {
+	var trackers []string
+	for _, t := range strings.Split(config.torrentTrackers, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			trackers = append(trackers, t)
+		}
+	}
+	return Distribution{MinSize: config.distributionMinSize, Trackers: trackers}
+}
+
+// pieceLength returns the length of the pieces a file of size bytes is split in: a power of two between
+// minPieceLength and maxPieceLength, making up to maxPieces pieces if possible.
+func pieceLength(size int64) int64 {
+	n := int64(minPieceLength)
+	for n < maxPieceLength && size/n > maxPieces {
+		n *= 2
+	}
+	return n
+}
+
+// torrentPieces are the SHA-1 piece hashes of a torrent, cached for the version of the file they were computed from.
+type torrentPieces struct {
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mod_time"`
+	PieceLength int64     `json:"piece_length"`
+	Pieces      []byte    `json:"pieces"` // Pieces are the concatenated SHA-1 hashes of each piece.
+}
+
+// torrentPiecesPath returns the path of the cached torrent pieces of the file name stored in baseDir.
+func torrentPiecesPath(baseDir, name string) string {
+	return filepath.Join(baseDir, torrentsDir, name+".json")
+}
+
+// hashPieces returns the torrent pieces of the file f, of file info fi, from their cache if still valid, computing
+// and caching them otherwise.
+func hashPieces(logger *log.Logger, baseDir, name string, f *os.File, fi fs.FileInfo) (torrentPieces, error) {
+	path := torrentPiecesPath(baseDir, name)
+	length := pieceLength(fi.Size())
+
+	var p torrentPieces
+	if b, err := os.ReadFile(path); err == nil && json.Unmarshal(b, &p) == nil &&
+		p.Size == fi.Size() && p.ModTime.Equal(fi.ModTime()) && p.PieceLength == length {
+		return p, nil
+	}
+
+	p = torrentPieces{Size: fi.Size(), ModTime: fi.ModTime().UTC(), PieceLength: length}
+	for offset := int64(0); offset < fi.Size(); offset += length {
+		h := sha1.New()
+		if _, err := io.Copy(h, io.NewSectionReader(f, offset, length)); err != nil {
+			return torrentPieces{}, err
+		}
+		p.Pieces = h.Sum(p.Pieces)
+	}
+
+	b, err := json.Marshal(p)
+	if err == nil {
+		err = createIn(filepath.Dir(path), func() error { return os.WriteFile(path+".tmp", b, 0o644) })
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		logger.Printf("Error caching torrent pieces: %v", err)
+	}
+	return p, nil
+}
+
+// bencode writes v, a string, integer, list or dictionary, bencoded to b. Dictionary keys are sorted as
+// required, so equal torrents have equal info hashes.
+func bencode(b *bytes.Buffer, v any) {
+	switch v := v.(type) {
+	case string:
+		fmt.Fprintf(b, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(b, "%d:%s", len(v), v)
+	case int64:
+		fmt.Fprintf(b, "i%de", v)
+	case []any:
+		b.WriteByte('l')
+		for _, item := range v {
+			bencode(b, item)
+		}
+		b.WriteByte('e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		b.WriteByte('d')
+		for _, k := range keys {
+			bencode(b, k)
+			bencode(b, v[k])
+		}
+		b.WriteByte('e')
+	default:
+		panic(fmt.Sprintf("bencode: unsupported type %T", v))
+	}
+}
+
+// metalink is a Metalink document (RFC 5854) describing a single file.
+type metalink struct {
+	XMLName   xml.Name     `xml:"urn:ietf:params:xml:ns:metalink metalink"`
+	Generator string       `xml:"generator"`
+	Published string       `xml:"published"`
+	File      metalinkFile `xml:"file"`
+}
+
+type metalinkFile struct {
+	Name   string          `xml:"name,attr"`
+	Size   int64           `xml:"size"`
+	Hash   *metalinkHash   `xml:"hash,omitempty"`
+	Pieces *metalinkPieces `xml:"pieces,omitempty"`
+	URLs   []metalinkURL   `xml:"url"`
+}
+
+type metalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkPieces struct {
+	Length int64    `xml:"length,attr"`
+	Type   string   `xml:"type,attr"`
+	Hashes []string `xml:"hash"`
+}
+
+type metalinkURL struct {
+	Priority int    `xml:"priority,attr"`
+	URL      string `xml:",chardata"`
+}
+
+// distributedFile opens the file name stored in baseDir for distribution, restoring it from the cold tier
+// first. It writes an error response and returns nil if the file does not exist or is too small to be distributed.
+func (d Distribution) distributedFile(logger *log.Logger, w http.ResponseWriter, r *http.Request, baseDir string, tier *ColdTier) (*os.File, fs.FileInfo) {
+	name := r.PathValue("name")
+	if !validFileName(name) {
+		http.Error(w, "Invalid file name", http.StatusBadRequest)
+		return nil, nil
+	}
+	if m, err := readMetadata(baseDir, name); err == nil && (m.expired(time.Now()) || m.limited() || m.Encryption != nil) {
+		// Peers could not be kept to download limits, nor decrypt the content
+		http.NotFound(w, r)
+		return nil, nil
+	} else if err == nil && m.Size < d.MinSize {
+		// Small files need not be restored from the cold tier to be turned down
+		http.Error(w, fmt.Sprintf("Only files of at least %d bytes are distributed", d.MinSize), http.StatusNotFound)
+		return nil, nil
+	}
+
+	if _, err := tier.restore(r.Context(), name); err != nil {
+		logger.Printf("Error restoring file from cold tier: %v", err)
+		http.Error(w, "Could not open file", http.StatusInternalServerError)
+		return nil, nil
+	}
+
+	f, err := os.Open(filepath.Join(baseDir, name))
+	if errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return nil, nil
+	}
+	if err != nil {
+		logger.Printf("Error opening file for distribution: %v", err)
+		http.Error(w, "Could not open file", http.StatusInternalServerError)
+		return nil, nil
+	}
+
+	fi, err := f.Stat()
+	if err != nil || fi.Size() < d.MinSize {
+		f.Close()
+		if err != nil {
+			logger.Printf("Error reading file info: %v", err)
+			http.Error(w, "Could not open file", http.StatusInternalServerError)
+			return nil, nil
+		}
+		http.Error(w, fmt.Sprintf("Only files of at least %d bytes are distributed", d.MinSize), http.StatusNotFound)
+		return nil, nil
+	}
+	return f, fi
+}
+
+// torrentHandler handles GET /files/{name}/torrent, responding with a torrent of a stored file of at least
+// the minimum size of d, announced to its trackers and with the file, downloaded under urlPrefix, as web seed
+// (BEP 19). Piece hashes are computed on first request and cached until the file changes.
+// Files with a download limit and files encrypted by the client are not distributed.
+func (d Distribution) torrentHandler(logger *log.Logger, baseDir string, tier *ColdTier, urlPrefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, fi := d.distributedFile(logger, w, r, baseDir, tier)
+		if f == nil {
+			return
+		}
+		defer f.Close()
+
+		clearWriteDeadline(w)
+		p, err := hashPieces(logger, baseDir, fi.Name(), f, fi)
+		if err != nil {
+			logger.Printf("Error hashing torrent pieces: %v", err)
+			http.Error(w, "Could not read file", http.StatusInternalServerError)
+			return
+		}
+
+		torrent := map[string]any{
+			"created by":    "usrv",
+			"creation date": fi.ModTime().Unix(),
+			"url-list":      []any{requestOrigin(r) + urlPrefix + url.PathEscape(fi.Name())},
+			"info": map[string]any{
+				"name":         fi.Name(),
+				"length":       fi.Size(),
+				"piece length": p.PieceLength,
+				"pieces":       p.Pieces,
+			},
+		}
+		if len(d.Trackers) > 0 {
+			torrent["announce"] = d.Trackers[0]
+			tiers := make([]any, len(d.Trackers))
+			for i, t := range d.Trackers {
+				tiers[i] = []any{t}
+			}
+			torrent["announce-list"] = tiers
+		}
+
+		var b bytes.Buffer
+		bencode(&b, torrent)
+		w.Header().Set("Content-Type", "application/x-bittorrent")
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", fi.Name()+".torrent"))
+		w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+		b.WriteTo(w)
+	})
+}
+
+// metalinkHandler handles GET /files/{name}/metalink, responding with a Metalink document of a stored file of at
+// least the minimum size of d, listing the file, downloaded under urlPrefix, with its SHA-256 checksum and those
+// of its pieces, which are the chunks of its chunk map, see [ChunkMap].
+// Files with a download limit and files encrypted by the client are not distributed.
+func (d Distribution) metalinkHandler(logger *log.Logger, baseDir string, tier *ColdTier, urlPrefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, fi := d.distributedFile(logger, w, r, baseDir, tier)
+		if f == nil {
+			return
+		}
+		defer f.Close()
+		name := fi.Name()
+
+		length := pieceLength(fi.Size())
+		chunks, ok := cachedChunkMap(baseDir, name, fi, length)
+		if !ok {
+			clearWriteDeadline(w)
+			var err error
+			if chunks, err = computeChunkMap(f, fi, length); err != nil {
+				logger.Printf("Error computing chunk map: %v", err)
+				http.Error(w, "Could not read file", http.StatusInternalServerError)
+				return
+			}
+			if err := cacheChunkMap(baseDir, name, chunks); err != nil {
+				logger.Printf("Error caching chunk map: %v", err)
+			}
+		}
+
+		file := metalinkFile{
+			Name:   name,
+			Size:   fi.Size(),
+			Pieces: &metalinkPieces{Length: length, Type: "sha-256"},
+			URLs:   []metalinkURL{{Priority: 1, URL: requestOrigin(r) + urlPrefix + url.PathEscape(name)}},
+		}
+		for _, c := range chunks.Chunks {
+			file.Pieces.Hashes = append(file.Pieces.Hashes, c.SHA256)
+		}
+		if m, err := readMetadata(baseDir, name); err == nil && m.SHA256 != "" && m.Size == fi.Size() {
+			file.Hash = &metalinkHash{Type: "sha-256", Value: m.SHA256}
+		}
+
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", name+".meta4"))
+		w.Header().Set("Content-Type", "application/metalink4+xml")
+		w.Write([]byte(xml.Header))
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		if err := enc.Encode(metalink{Generator: "usrv", Published: fi.ModTime().UTC().Format(time.RFC3339), File: file}); err != nil {
+			logger.Printf("Error writing metalink: %v", err)
+		}
+	})
+}
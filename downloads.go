@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxDownloadsHeader is the request header setting how many times an uploaded file may be downloaded before it
+// is deleted, e.g. "1" for one-time handoffs. Multipart uploads may send it as the maxDownloadsField form field instead.
+const (
+	maxDownloadsHeader = "X-Max-Downloads"
+	maxDownloadsField  = "max_downloads"
+)
+
+// errNoDownloadsLeft reports a download of a file whose downloads are used up.
+var errNoDownloadsLeft = errors.New("no downloads left")
+
+// FileLocks holds the locks of the files served by a [Server], by path, serializing the counting of their
+// downloads and their patches, so concurrent downloads never exceed the limit of a file and concurrent patches
+// are not lost, while those of different files proceed in parallel. Locks are dropped once released by every
+// holder, so only the files in use have one.
+type FileLocks struct {
+	mu    sync.Mutex
+	locks map[string]*fileLock
+}
+
+// fileLock is the lock of a file, shared by those holding or waiting for it.
+type fileLock struct {
+	sync.Mutex
+	refs int // refs counts those holding or waiting for the lock.
+}
+
+// newFileLocks returns the locks of files, none held.
+func newFileLocks() *FileLocks {
+	return &FileLocks{locks: make(map[string]*fileLock)}
+}
+
+// lock locks the file at path, waiting for it to be unlocked first if locked, and returns the function unlocking it.
+func (l *FileLocks) lock(path string) (unlock func()) {
+	path = filepath.Clean(path)
+
+	l.mu.Lock()
+	fl := l.locks[path]
+	if fl == nil {
+		fl = &fileLock{}
+		l.locks[path] = fl
+	}
+	fl.refs++
+	l.mu.Unlock()
+
+	fl.Lock()
+	return func() {
+		fl.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if fl.refs--; fl.refs == 0 {
+			delete(l.locks, path)
+		}
+	}
+}
+
+// parseMaxDownloads parses the download limit of an upload, a positive number, 0 if v is empty.
+func parseMaxDownloads(v string) (int64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a positive number of downloads", v)
+	}
+	return n, nil
+}
+
+// limited reports whether the file described by m may only be downloaded a limited number of times.
+func (m Metadata) limited() bool {
+	return m.MaxDownloads > 0
+}
+
+// burned reports whether the file described by m has no downloads left.
+func (m Metadata) burned() bool {
+	return m.limited() && m.Downloads >= m.MaxDownloads
+}
+
+// countDownload counts a download of the file name of baseDir in its metadata, recording its access time,
+// and returns the updated metadata. It fails with [errNoDownloadsLeft] if the file has none left, and with
+// [fs.ErrNotExist] if the file has no metadata. Counting is serialized with the other downloads of the file by
+// locks, and with its tiering by tier.
+func countDownload(baseDir, name string, tier *ColdTier, indexes *FileIndexes, locks *FileLocks) (Metadata, error) {
+	if tier != nil {
+		tier.mu.Lock()
+		defer tier.mu.Unlock()
+	}
+	defer locks.lock(filepath.Join(baseDir, name))()
+
+	m, err := readMetadata(baseDir, name)
+	if err != nil {
+		return m, err
+	}
+	if m.burned() {
+		return m, errNoDownloadsLeft
+	}
+
+	now := time.Now().UTC()
+	m.Downloads++
+	m.AccessedAt = &now
+	return m, writeMetadata(baseDir, m, indexes)
+}
+
+// removeStoredFile permanently removes the file name from baseDir, along with its metadata, attachments and the checksums cached for it.
+func removeStoredFile(baseDir, name string, indexes *FileIndexes) error {
+	if err := os.Remove(filepath.Join(baseDir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := removeMetadata(baseDir, name, indexes); err != nil {
+		return err
+	}
+	for _, cache := range []string{chunkMapPath(baseDir, name), torrentPiecesPath(baseDir, name)} {
+		if err := os.Remove(cache); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.RemoveAll(attachmentsPath(baseDir, name))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDownloadLimitConcurrent(t *testing.T) {
+	const maxDownloads, clients = 3, 20
+	s, url := newTestServer(t)
+
+	body, contentType := multipartBody(t, "upload", "once.txt", "secret")
+	req, err := http.NewRequest(http.MethodPost, url+"/upload", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(maxDownloadsHeader, strconv.Itoa(maxDownloads))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload status = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+
+	var ok atomic.Int64
+	var wg sync.WaitGroup
+	for range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(url + "/files/once.txt")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				ok.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := ok.Load(); n != maxDownloads {
+		t.Errorf("%d downloads succeeded, want %d", n, maxDownloads)
+	}
+	if n := len(s.locks.locks); n != 0 {
+		t.Errorf("%d file locks left, want none", n)
+	}
+}
+
+func TestFileLocks(t *testing.T) {
+	locks := newFileLocks()
+
+	unlockA := locks.lock("/srv/a.txt")
+	// Other files are not held up by the lock of a
+	unlockB := locks.lock("/srv/b.txt")
+	unlockB()
+
+	locked := make(chan struct{})
+	go func() {
+		defer locks.lock("/srv/./a.txt")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("a.txt locked twice")
+	default:
+	}
+
+	unlockA()
+	<-locked
+}
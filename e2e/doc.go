@@ -0,0 +1,4 @@
+// Package e2e holds the end-to-end tests of the server, run against real backends started in containers with
+// testcontainers. They are built with the e2e tag, see e2e_test.go, and kept in a module of their own, so the
+// server keeps no dependencies.
+package e2e
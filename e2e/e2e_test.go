@@ -0,0 +1,288 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/network"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// Credentials of the MinIO server backing the cold tier.
+const (
+	minioUser     = "usrv-e2e"
+	minioPassword = "usrv-e2e-secret"
+	minioBucket   = "usrv"
+)
+
+// tierColdAfter is the idle time after which the server under test archives files to MinIO, which is also the
+// interval of the migration.
+const tierColdAfter = 5 * time.Second
+
+// eicar is the EICAR antivirus test file, detected as infected by ClamAV.
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+var (
+	server  testcontainers.Container // server is the container of the server under test.
+	baseURL string                   // baseURL is the URL of the server under test.
+)
+
+// TestMain starts the server under test, built from the Dockerfile, along with MinIO as its cold tier, ClamAV
+// scanning uploads through the scan step of its pipelines and Redis locking resumable upload sessions and electing
+// the leader, all on a network of their own, and stops them once the tests ran.
+func TestMain(m *testing.M) {
+	code, err := run(m)
+	if err != nil {
+		log.Print(err)
+		code = 1
+	}
+	os.Exit(code)
+}
+
+func run(m *testing.M) (int, error) {
+	ctx := context.Background()
+
+	net, err := network.New(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("creating network: %w", err)
+	}
+	defer net.Remove(ctx)
+
+	start := func(alias string, req testcontainers.ContainerRequest) (testcontainers.Container, error) {
+		req.Networks = []string{net.Name}
+		req.NetworkAliases = map[string][]string{net.Name: {alias}}
+		c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{ContainerRequest: req, Started: true})
+		if err != nil {
+			return c, fmt.Errorf("starting %s: %w", alias, err)
+		}
+		return c, nil
+	}
+
+	minio, err := start("minio", testcontainers.ContainerRequest{
+		Image:        "minio/minio:latest",
+		Cmd:          []string{"server", "/data"},
+		Env:          map[string]string{"MINIO_ROOT_USER": minioUser, "MINIO_ROOT_PASSWORD": minioPassword},
+		ExposedPorts: []string{"9000/tcp"},
+		WaitingFor:   wait.ForHTTP("/minio/health/ready").WithPort("9000/tcp"),
+	})
+	defer testcontainers.TerminateContainer(minio)
+	if err != nil {
+		return 0, err
+	}
+	mb := fmt.Sprintf("mc alias set e2e http://localhost:9000 %s %s && mc mb --ignore-existing e2e/%s", minioUser, minioPassword, minioBucket)
+	if code, out, err := minio.Exec(ctx, []string{"sh", "-c", mb}); err != nil || code != 0 {
+		b, _ := io.ReadAll(out)
+		return 0, fmt.Errorf("creating bucket: exit code %d, %v: %s", code, err, b)
+	}
+
+	redis, err := start("redis", testcontainers.ContainerRequest{
+		Image:      "redis:7-alpine",
+		WaitingFor: wait.ForLog("Ready to accept connections"),
+	})
+	defer testcontainers.TerminateContainer(redis)
+	if err != nil {
+		return 0, err
+	}
+
+	// ClamAV downloads its signatures on its first start, which takes minutes
+	clamav, err := start("clamav", testcontainers.ContainerRequest{
+		Image:        "clamav/clamav:stable",
+		ExposedPorts: []string{"3310/tcp"},
+		WaitingFor:   wait.ForListeningPort("3310/tcp").WithStartupTimeout(10 * time.Minute),
+	})
+	defer testcontainers.TerminateContainer(clamav)
+	if err != nil {
+		return 0, err
+	}
+
+	server, err = start("usrv", testcontainers.ContainerRequest{
+		FromDockerfile: testcontainers.FromDockerfile{Context: "..", Dockerfile: "e2e/Dockerfile"},
+		Cmd: []string{
+			"-dir=/data",
+			"-listen-addr=:3000",
+			"-pipelines=/etc/usrv/pipelines.json",
+			"-tier-cold-after=" + tierColdAfter.String(),
+			"-tier-s3-endpoint=http://minio:9000",
+			"-tier-s3-bucket=" + minioBucket,
+			"-redis=redis://redis:6379/0",
+			"-leader-election=redis",
+		},
+		Env:          map[string]string{"AWS_ACCESS_KEY_ID": minioUser, "AWS_SECRET_ACCESS_KEY": minioPassword},
+		ExposedPorts: []string{"3000/tcp"},
+		WaitingFor:   wait.ForHTTP("/readyz").WithPort("3000/tcp"),
+	})
+	defer testcontainers.TerminateContainer(server)
+	if err != nil {
+		return 0, err
+	}
+	if baseURL, err = server.PortEndpoint(ctx, "3000/tcp", "http"); err != nil {
+		return 0, fmt.Errorf("getting server address: %w", err)
+	}
+
+	return m.Run(), nil
+}
+
+// logOnFailure logs the last lines of the logs of the server at the end of t, if it failed.
+func logOnFailure(t *testing.T) {
+	t.Cleanup(func() {
+		if !t.Failed() {
+			return
+		}
+		logs, err := server.Logs(context.Background())
+		if err != nil {
+			t.Logf("reading server logs: %v", err)
+			return
+		}
+		defer logs.Close()
+		b, _ := io.ReadAll(logs)
+		t.Logf("server logs:\n%s", b[max(len(b)-8192, 0):])
+	})
+}
+
+// randomContent returns n random bytes.
+func randomContent(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// do sends a request with body to path, and returns the status and body of the response.
+func do(t *testing.T, method, path string, body io.Reader, header http.Header) (int, []byte, http.Header) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, baseURL+path, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading response: %v", method, path, err)
+	}
+	return resp.StatusCode, b, resp.Header
+}
+
+// expectStatus sends a request like [do] and fails t unless it is answered with want.
+func expectStatus(t *testing.T, want int, method, path string, body io.Reader, header http.Header) http.Header {
+	t.Helper()
+	status, b, h := do(t, method, path, body, header)
+	if status != want {
+		t.Fatalf("%s %s: status %d, want %d: %.200s", method, path, status, want, b)
+	}
+	return h
+}
+
+// upload uploads content as filename and fails t unless it is answered with want.
+func upload(t *testing.T, want int, filename string, content []byte) {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("upload", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	mw.Close()
+
+	expectStatus(t, want, http.MethodPost, "/upload", &body, http.Header{"Content-Type": {mw.FormDataContentType()}})
+}
+
+// expectContent fails t unless the file filename is served with content.
+func expectContent(t *testing.T, filename string, content []byte) {
+	t.Helper()
+	status, b, _ := do(t, http.MethodGet, "/files/"+filename, nil, nil)
+	if status != http.StatusOK || !bytes.Equal(b, content) {
+		t.Fatalf("GET /files/%s: status %d and %d bytes, want 200 and the %d bytes uploaded", filename, status, len(b), len(content))
+	}
+}
+
+func TestUploadDownloadDelete(t *testing.T) {
+	logOnFailure(t)
+	content := randomContent(t, 256<<10)
+
+	upload(t, http.StatusCreated, "plain.bin", content)
+	expectContent(t, "plain.bin", content)
+
+	expectStatus(t, http.StatusOK, http.MethodDelete, "/files/plain.bin", nil, nil)
+	expectStatus(t, http.StatusNotFound, http.MethodGet, "/files/plain.bin", nil, nil)
+
+	expectStatus(t, http.StatusOK, http.MethodPost, "/files/plain.bin/restore", nil, nil)
+	expectContent(t, "plain.bin", content)
+}
+
+func TestInfectedUploadRejected(t *testing.T) {
+	logOnFailure(t)
+
+	upload(t, http.StatusUnprocessableEntity, "eicar.txt", []byte(eicar))
+	expectStatus(t, http.StatusNotFound, http.MethodGet, "/files/eicar.txt", nil, nil)
+}
+
+func TestResumableUpload(t *testing.T) {
+	logOnFailure(t)
+	content := randomContent(t, 256<<10)
+	half := len(content) / 2
+
+	h := expectStatus(t, http.StatusCreated, http.MethodPost, "/uploads?name=resumed.bin", nil,
+		http.Header{"Upload-Length": {fmt.Sprint(len(content))}})
+	location := h.Get("Location")
+	if location == "" {
+		t.Fatal("upload session created without a Location")
+	}
+
+	// Chunks sent out of order are assembled in order
+	expectStatus(t, http.StatusNoContent, http.MethodPatch, location, bytes.NewReader(content[half:]),
+		http.Header{"Upload-Offset": {fmt.Sprint(half)}})
+	expectStatus(t, http.StatusCreated, http.MethodPatch, location, bytes.NewReader(content[:half]),
+		http.Header{"Upload-Offset": {"0"}})
+	expectContent(t, "resumed.bin", content)
+}
+
+func TestColdTier(t *testing.T) {
+	logOnFailure(t)
+	content := randomContent(t, 256<<10)
+	ctx := context.Background()
+
+	upload(t, http.StatusCreated, "tiered.bin", content)
+
+	// The file is archived by the first migration once it is idle
+	deadline := time.Now().Add(6 * tierColdAfter)
+	for {
+		code, _, err := server.Exec(ctx, []string{"test", "-e", "/data/tiered.bin"})
+		if err != nil {
+			t.Fatalf("checking the local copy: %v", err)
+		}
+		if code != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tiered.bin is still on the local disk after %v", 6*tierColdAfter)
+		}
+		time.Sleep(time.Second)
+	}
+
+	expectContent(t, "tiered.bin", content)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Headers marking an upload as encrypted by the client. They are stored verbatim and sent back on download,
+// the server never sees the key.
+const (
+	encryptionAlgorithmHeader = "X-Upload-Encryption-Algorithm"
+	encryptionKeyIDHeader     = "X-Upload-Encryption-Key-Id"
+	encryptionIVHeader        = "X-Upload-Encryption-Iv"
+)
+
+// maxEncryptionHeaderSize is the maximum size in bytes of each of the encryption headers.
+const maxEncryptionHeaderSize = 256
+
+// Encryption describes how the client encrypted an upload, so it can decrypt it once downloaded.
+// The content of client-encrypted uploads is opaque to the server: it is neither sniffed nor transformed.
+type Encryption struct {
+	Algorithm string `json:"algorithm" xml:"algorithm"`
+	KeyID     string `json:"key_id,omitempty" xml:"key_id,omitempty"`
+	IV        string `json:"iv,omitempty" xml:"iv,omitempty"`
+}
+
+// parseEncryptionHeaders returns the encryption the client declared in h, or nil if the upload is not
+// client-encrypted.
+func parseEncryptionHeaders(h http.Header) (*Encryption, error) {
+	e := &Encryption{
+		Algorithm: h.Get(encryptionAlgorithmHeader),
+		KeyID:     h.Get(encryptionKeyIDHeader),
+		IV:        h.Get(encryptionIVHeader),
+	}
+
+	if e.Algorithm == "" {
+		if e.KeyID != "" || e.IV != "" {
+			return nil, fmt.Errorf("%s is required along with %s and %s", encryptionAlgorithmHeader, encryptionKeyIDHeader, encryptionIVHeader)
+		}
+		return nil, nil
+	}
+
+	for _, v := range []string{e.Algorithm, e.KeyID, e.IV} {
+		if len(v) > maxEncryptionHeaderSize {
+			return nil, fmt.Errorf("X-Upload-Encryption-* headers are limited to %d bytes each", maxEncryptionHeaderSize)
+		}
+	}
+
+	return e, nil
+}
+
+// setHeaders sets the encryption headers of e on h, if e is not nil.
+func (e *Encryption) setHeaders(h http.Header) {
+	if e == nil {
+		return
+	}
+
+	h.Set(encryptionAlgorithmHeader, e.Algorithm)
+	if e.KeyID != "" {
+		h.Set(encryptionKeyIDHeader, e.KeyID)
+	}
+	if e.IV != "" {
+		h.Set(encryptionIVHeader, e.IV)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Upload lifecycle event types.
+const (
+	EventUploadStarted   = "upload.started"
+	EventUploadCompleted = "upload.completed"
+	EventUploadFailed    = "upload.failed"
+	EventUploadCoalesced = "upload.coalesced" // EventUploadCoalesced reports an upload answered with the result of an identical one, see [Deduplicator].
+)
+
+// Event describes an upload lifecycle event published to the configured broker.
+type Event struct {
+	Type      string    `json:"type"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Filename  string    `json:"filename,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// EventPublisher publishes upload lifecycle events to an external broker.
+type EventPublisher interface {
+	Publish(e Event) error
+	Close() error
+}
+
+// EventEncoder serializes an [Event] into a broker message payload.
+type EventEncoder func(e Event) ([]byte, error)
+
+// newEventEncoder returns the [EventEncoder] for the given encoding name.
+func newEventEncoder(encoding string) (EventEncoder, error) {
+	switch encoding {
+	case "json":
+		return encodeEventJSON, nil
+	case "text":
+		return encodeEventText, nil
+	default:
+		return nil, fmt.Errorf("unknown event encoding %q", encoding)
+	}
+}
+
+// encodeEventJSON encodes e as a JSON object.
+func encodeEventJSON(e Event) ([]byte, error) {
+	return json.Marshal(e)
+}
+
+// encodeEventText encodes e as a single line of space separated key=value pairs.
+func encodeEventText(e Event) ([]byte, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "type=%s time=%s request_id=%q", e.Type, e.Time.Format(time.RFC3339Nano), e.RequestID)
+	if e.Filename != "" {
+		fmt.Fprintf(&b, " filename=%q", e.Filename)
+	}
+	if e.Size != 0 {
+		fmt.Fprintf(&b, " size=%d", e.Size)
+	}
+	if e.Error != "" {
+		fmt.Fprintf(&b, " error=%q", e.Error)
+	}
+	return []byte(b.String()), nil
+}
+
+// nopPublisher is the [EventPublisher] used when event publishing is disabled.
+type nopPublisher struct{}
+
+func (nopPublisher) Publish(Event) error { return nil }
+func (nopPublisher) Close() error        { return nil }
+
+// newEventPublisher creates the [EventPublisher] described by config, connecting to the broker with outbound.
+// A no-op publisher is returned if no broker is configured.
+func newEventPublisher(config Config, outbound *Outbound, logger *log.Logger) (EventPublisher, error) {
+	if config.eventsNATSServers == "" {
+		return nopPublisher{}, nil
+	}
+
+	encode, err := newEventEncoder(config.eventsEncoding)
+	if err != nil {
+		return nil, err
+	}
+
+	servers := strings.Split(config.eventsNATSServers, ",")
+	return newNATSPublisher(servers, config.eventsSubject, encode, outbound, logger), nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// JPEG markers handled when stripping metadata.
+const (
+	jpegSOI  = 0xD8 // jpegSOI is the start of image marker.
+	jpegEOI  = 0xD9 // jpegEOI is the end of image marker.
+	jpegSOS  = 0xDA // jpegSOS is the start of scan marker, after which entropy coded data follows.
+	jpegAPP1 = 0xE1 // jpegAPP1 holds Exif (including GPS) and XMP metadata.
+	jpegAPPD = 0xED // jpegAPPD holds Photoshop IRB and IPTC metadata.
+	jpegCOM  = 0xFE // jpegCOM is a free text comment.
+)
+
+// pngSignature is the signature every PNG file starts with.
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks are the PNG chunk types removed when stripping metadata.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// stripImageMetadata is a [TransformerFunc] removing Exif, GPS and textual metadata
+// from JPEG and PNG images. Other content is passed through untouched.
+func stripImageMetadata(c *UploadCandidate, src io.Reader) (io.Reader, error) {
+	switch c.ContentType {
+	case "image/jpeg":
+		return streamTransform(stripJPEGMetadata, src), nil
+	case "image/png":
+		return streamTransform(stripPNGMetadata, src), nil
+	default:
+		return src, nil
+	}
+}
+
+// stripJPEGMetadata copies the JPEG image in src to w, leaving out its
+// APP1 (Exif/XMP), APP13 (IPTC) and comment segments.
+// Segments needed to render the image correctly, e.g. ICC profiles, are kept.
+func stripJPEGMetadata(w io.Writer, src io.Reader) error {
+	r := bufio.NewReader(src)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil {
+		return fmt.Errorf("reading jpeg header: %w", err)
+	}
+	if soi[0] != 0xFF || soi[1] != jpegSOI {
+		return errors.New("not a jpeg image")
+	}
+	if _, err := w.Write(soi[:]); err != nil {
+		return err
+	}
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("reading jpeg marker: %w", err)
+		}
+		if b != 0xFF {
+			return fmt.Errorf("invalid jpeg marker prefix 0x%02x", b)
+		}
+
+		// Markers may be preceded by any number of 0xFF fill bytes
+		marker := byte(0xFF)
+		for marker == 0xFF {
+			if marker, err = r.ReadByte(); err != nil {
+				return fmt.Errorf("reading jpeg marker: %w", err)
+			}
+		}
+
+		// Standalone markers carry no length
+		if marker == jpegEOI || (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 {
+			if _, err := w.Write([]byte{0xFF, marker}); err != nil {
+				return err
+			}
+			if marker == jpegEOI {
+				_, err := io.Copy(w, r)
+				return err
+			}
+			continue
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return fmt.Errorf("reading jpeg segment length: %w", err)
+		}
+
+		size := int64(binary.BigEndian.Uint16(length[:]))
+		if size < 2 {
+			return fmt.Errorf("invalid jpeg segment length %d", size)
+		}
+
+		if marker == jpegAPP1 || marker == jpegAPPD || marker == jpegCOM {
+			if _, err := r.Discard(int(size - 2)); err != nil {
+				return fmt.Errorf("skipping jpeg segment: %w", err)
+			}
+			continue
+		}
+
+		if _, err := w.Write([]byte{0xFF, marker, length[0], length[1]}); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, size-2); err != nil {
+			return fmt.Errorf("copying jpeg segment: %w", err)
+		}
+
+		// The entropy coded scan data, and everything after it, is copied as is
+		if marker == jpegSOS {
+			_, err := io.Copy(w, r)
+			return err
+		}
+	}
+}
+
+// stripPNGMetadata copies the PNG image in src to w, leaving out its
+// eXIf, textual (tEXt, zTXt, iTXt) and tIME chunks.
+func stripPNGMetadata(w io.Writer, src io.Reader) error {
+	r := bufio.NewReader(src)
+
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, sig); err != nil {
+		return fmt.Errorf("reading png signature: %w", err)
+	}
+	if !bytes.Equal(sig, pngSignature) {
+		return errors.New("not a png image")
+	}
+	if _, err := w.Write(sig); err != nil {
+		return err
+	}
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return fmt.Errorf("reading png chunk header: %w", err)
+		}
+
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		typ := string(header[4:])
+
+		// Chunk data is followed by a 4 byte CRC
+		if pngMetadataChunks[typ] {
+			if _, err := io.CopyN(io.Discard, r, length+4); err != nil {
+				return fmt.Errorf("skipping png chunk: %w", err)
+			}
+			continue
+		}
+
+		if _, err := w.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(w, r, length+4); err != nil {
+			return fmt.Errorf("copying png chunk: %w", err)
+		}
+
+		if typ == "IEND" {
+			return nil
+		}
+	}
+}
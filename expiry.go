@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"time"
+)
+
+// expiresAfterHeader is the request header setting how long an uploaded file is kept for, e.g. "72h".
+// Multipart uploads may send it as the expiresAfterField form field instead.
+const (
+	expiresAfterHeader = "X-Expires-After"
+	expiresAfterField  = "expires_after"
+)
+
+// expiryPurgeInterval is the interval between purges of expired files.
+const expiryPurgeInterval = time.Minute
+
+// parseExpiresAfter parses the expiry of an upload, a positive duration such as "72h", 0 if v is empty.
+func parseExpiresAfter(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%q is not a positive duration such as 72h", v)
+	}
+	return d, nil
+}
+
+// expired reports whether the file described by m expired at now.
+func (m Metadata) expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !now.Before(*m.ExpiresAt)
+}
+
+// purgeExpired permanently removes the files of baseDir whose expiry has passed, regardless of the trash
+// retention, along with their metadata and attachments. Archived files are removed from tier. The directories
+// the files leave empty are pruned by pruner, and the files removed from indexes.
+func purgeExpired(ctx context.Context, logger *log.Logger, baseDir string, tier *ColdTier, pruner *DirPruner, indexes *FileIndexes) error {
+	now := time.Now()
+	var expired []Metadata
+	err := listFiles(logger, baseDir, func(m Metadata) bool {
+		if m.expired(now) {
+			expired = append(expired, m)
+		}
+		return true
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, m := range expired {
+		if ctx.Err() != nil {
+			break
+		}
+
+		if m.Tier == tierCold {
+			if err := tier.remove(ctx, m.Name); err != nil {
+				errs = append(errs, fmt.Errorf("removing %s from cold tier: %w", m.Name, err))
+				continue
+			}
+		}
+
+		if err := removeStoredFile(baseDir, m.Name, indexes); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		infof(logger, "Purged expired file: %s", m.Name)
+	}
+	if len(expired) > 0 {
+		pruner.prune(storedFileDirs(baseDir)...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// runExpiryPurger purges the expired files of baseDir, with its cold tier tier, and of all buckets periodically,
+// in passes run by jobs, until ctx is done.
+func runExpiryPurger(ctx context.Context, logger *log.Logger, jobs *JobRunner, baseDir string, tier *ColdTier, buckets *Buckets, pruner *DirPruner, indexes *FileIndexes) {
+	ticker := time.NewTicker(expiryPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		jobs.Do(func() {
+			if err := purgeExpired(ctx, logger, baseDir, tier, pruner, indexes); err != nil {
+				logger.Printf("Error purging expired files: %v", err)
+			}
+
+			list, err := buckets.list()
+			if err != nil {
+				logger.Printf("Error listing buckets: %v", err)
+			}
+			for _, bucket := range list {
+				if err := purgeExpired(ctx, logger, buckets.path(bucket.Name), nil, pruner, indexes); err != nil {
+					logger.Printf("Error purging expired files of bucket %s: %v", bucket.Name, err)
+				}
+			}
+		})
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// charClasses maps the character classes file names may be restricted to, see [CharClasses], to their members.
+var charClasses = map[string]func(r rune) bool{
+	"alnum":  func(r rune) bool { return r <= unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) },
+	"letter": unicode.IsLetter,
+	"digit":  unicode.IsDigit,
+	"mark":   unicode.IsMark,
+	"space":  func(r rune) bool { return r == ' ' },
+	"punct":  unicode.IsPunct,
+	"symbol": unicode.IsSymbol,
+}
+
+// CharClasses is a comma separated list of the character classes file names may hold: alnum (ASCII letters and
+// digits), letter, digit, mark (combining marks), space, punct and symbol, all of Unicode unless noted.
+// It implements [flag.Value].
+type CharClasses string
+
+func (c *CharClasses) String() string {
+	return string(*c)
+}
+
+func (c *CharClasses) Set(v string) error {
+	if v != "" {
+		for _, class := range strings.Split(v, ",") {
+			if _, ok := charClasses[strings.TrimSpace(class)]; !ok {
+				return fmt.Errorf("unknown character class %q, expected alnum, letter, digit, mark, space, punct or symbol", class)
+			}
+		}
+	}
+	*c = CharClasses(v)
+	return nil
+}
+
+// allows reports whether r belongs to one of the classes of c.
+func (c CharClasses) allows(r rune) bool {
+	for _, class := range strings.Split(string(c), ",") {
+		if charClasses[strings.TrimSpace(class)](r) {
+			return true
+		}
+	}
+	return false
+}
+
+// filenameValidator normalizes the file names of uploads to form, renaming them, and rejects names longer than
+// maxLength bytes, once UTF-8 encoded, if it is positive, or holding characters outside of classes and extra, if set.
+func filenameValidator(maxLength int, classes CharClasses, extra string, form NormalizationForm) Validator {
+	return ValidatorFunc(func(c *UploadCandidate) error {
+		c.Filename = normalize(c.Filename, form)
+
+		if maxLength > 0 && len(c.Filename) > maxLength {
+			return &RejectionError{http.StatusBadRequest, fmt.Sprintf("file name exceeds %d bytes", maxLength)}
+		}
+		if classes == "" {
+			return nil
+		}
+		for _, r := range c.Filename {
+			if !classes.allows(r) && !strings.ContainsRune(extra, r) {
+				return &RejectionError{http.StatusBadRequest, fmt.Sprintf("file name character %q is not allowed", r)}
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// validFileName reports whether name can be used to address a stored file.
+// Names must not contain path separators and must not be hidden,
+// which keeps the server's own bookkeeping directories unreachable.
+func validFileName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, `/\`)
+}
+
+// parseContentRange parses a "bytes start-end/total" Content-Range request header,
+// where total may be "*", returning the inclusive byte range.
+func parseContentRange(s string) (start, end int64, err error) {
+	spec, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("unsupported range unit in %q", s)
+	}
+
+	rng, _, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("missing total length in %q", s)
+	}
+
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid range start in %q", s)
+	}
+
+	end, err = strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, fmt.Errorf("invalid range end in %q", s)
+	}
+
+	return start, end, nil
+}
+
+// patchFile handles PATCH /files/{name}, writing the request body into an existing file.
+//
+// With a "Content-Range: bytes start-end/*" header the body must be exactly the size of the range
+// and is written at start. With an "offset" query parameter the body is written at that offset.
+// Otherwise the body is appended. Writes may overwrite and extend the file, but not leave holes in it,
+// nor grow it beyond maxSize bytes unless maxSize is 0.
+// The patch is applied to a copy of the file, which only replaces it once the whole body is read without
+// error, so a truncated body leaves the file untouched. The copy is a full one unless the filesystem supports
+// reflinks, see [cloneFile]. Patches of a file are applied one at a time with locks, so none is lost.
+// Files archived to the cold tier are restored before being patched. Writes are flushed to disk according to fsync.
+// The new content is signed with signer unless it is nil, and its metadata updated in indexes.
+func patchFile(logger *log.Logger, baseDir string, tier *ColdTier, maxSize int64, fsync FsyncPolicy, signer *Minisigner, indexes *FileIndexes, locks *FileLocks) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !validFileName(name) {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := tier.restore(r.Context(), name); err != nil {
+			logger.Printf("Error restoring file from cold tier: %v", err)
+			http.Error(w, "Could not open file", http.StatusInternalServerError)
+			return
+		}
+
+		offset, length := int64(-1), int64(-1)
+
+		if cr := r.Header.Get("Content-Range"); cr != "" {
+			start, end, err := parseContentRange(cr)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid Content-Range: %v", err), http.StatusBadRequest)
+				return
+			}
+			offset, length = start, end-start+1
+		} else if o := r.URL.Query().Get("offset"); o != "" {
+			var err error
+			offset, err = strconv.ParseInt(o, 10, 64)
+			if err != nil || offset < 0 {
+				http.Error(w, "Invalid offset", http.StatusBadRequest)
+				return
+			}
+		}
+
+		path := filepath.Join(baseDir, name)
+		// The file must not change between its size being read and the patched copy replacing it
+		defer locks.lock(path)()
+		src, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error opening file for patching: %v", err)
+			http.Error(w, "Could not open file", http.StatusInternalServerError)
+			return
+		}
+		defer src.Close()
+
+		fi, err := src.Stat()
+		if err != nil {
+			logger.Printf("Error reading file info: %v", err)
+			http.Error(w, "Could not open file", http.StatusInternalServerError)
+			return
+		}
+
+		if offset < 0 {
+			offset = fi.Size()
+		}
+
+		if offset > fi.Size() {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fi.Size()))
+			http.Error(w, "Offset is beyond the end of the file", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+
+		// limit is the number of bytes read into the file, one more is read to detect a longer body
+		limit := int64(math.MaxInt64)
+		if maxSize > 0 {
+			limit = max(maxSize-offset, 0)
+		}
+		if length >= 0 {
+			if length > limit {
+				http.Error(w, fmt.Sprintf("File would exceed %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+				return
+			}
+			limit = length
+		}
+
+		tmp, err := os.CreateTemp(baseDir, ".patch-*.tmp")
+		if err != nil {
+			logger.Printf("Error creating file on disk: %v", err)
+			http.Error(w, "Could not create file on disk", http.StatusInternalServerError)
+			return
+		}
+		defer func() {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}()
+
+		// Within a filesystem supporting reflinks, the copy is a clone sharing the blocks of the file
+		if tmp, err = cloneFile(tmp, src); err != nil {
+			_, err = io.Copy(tmp, src)
+		}
+		if err == nil {
+			_, err = tmp.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			logger.Printf("Error copying file for patching: %v", err)
+			http.Error(w, "Could not write file", http.StatusInternalServerError)
+			return
+		}
+
+		// The body is read up to its end before the copy replaces the file
+		n, err := io.Copy(tmp, io.LimitReader(r.Body, limit))
+		var extra int64
+		if err == nil {
+			extra, err = io.Copy(io.Discard, io.LimitReader(r.Body, 1))
+		}
+		if err != nil {
+			logger.Printf("Error patching file: %v", err)
+			http.Error(w, "Could not write file", http.StatusInternalServerError)
+			return
+		}
+
+		if length >= 0 && (n != length || extra != 0) {
+			logger.Printf("Patch of %s does not match Content-Range, %d bytes received", name, n+extra)
+			http.Error(w, "Request body does not match Content-Range", http.StatusBadRequest)
+			return
+		}
+
+		size := max(fi.Size(), offset+n)
+		if extra != 0 || (maxSize > 0 && size > maxSize) {
+			logger.Printf("Patch of %s rejected: file would exceed %d bytes", name, maxSize)
+			http.Error(w, fmt.Sprintf("File would exceed %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if err := fsync.sync(tmp, baseDir); err != nil {
+			logger.Printf("Error syncing file: %v", err)
+			http.Error(w, "Could not write file", http.StatusInternalServerError)
+			return
+		}
+
+		sum, err := sha256File(tmp.Name())
+		if err != nil {
+			logger.Printf("Error computing file checksum: %v", err)
+		}
+
+		os.Chmod(tmp.Name(), fi.Mode().Perm())
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			logger.Printf("Error replacing file: %v", err)
+			http.Error(w, "Could not write file", http.StatusInternalServerError)
+			return
+		}
+		updateContentMetadata(logger, baseDir, name, size, sum, signer, indexes)
+
+		infof(logger, "File patched successfully: %s, %d bytes at offset %d\n", name, n, offset)
+		fmt.Fprintf(w, "File patched successfully: %s\n", name)
+	})
+}
+
+// downloadFile handles GET /files/{name}, serving the content of a stored file.
+// Files archived to the cold tier are restored to the local disk first, or redirected to with a presigned URL.
+// Names are also looked up in the normalization form file names are stored in.
+// The file is handed off to the reverse proxy if offload is not nil, see [DownloadOffload].
+// Downloads are counted in the file's metadata, recorded in indexes, one at a time per file with locks, and files
+// with a download limit are deleted after their last one.
+func downloadFile(logger *log.Logger, baseDir string, tier *ColdTier, form NormalizationForm, offload *DownloadOffload, indexes *FileIndexes, locks *FileLocks) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !validFileName(name) {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+		// Clients may send the name in another form than it was stored in, e.g. macOS decomposes it
+		name = storedName(baseDir, name, form)
+		// Expired and burned files are gone as far as clients are concerned, even before they are removed
+		m, err := readMetadata(baseDir, name)
+		if err == nil && (m.expired(time.Now()) || m.burned()) {
+			http.NotFound(w, r)
+			return
+		}
+		limited := err == nil && m.limited()
+
+		disposition := r.URL.Query().Get("disposition")
+		if disposition != "" && disposition != "inline" && disposition != "attachment" {
+			http.Error(w, "Invalid disposition, expected inline or attachment", http.StatusBadRequest)
+			return
+		}
+
+		params := url.Values{}
+		if disposition != "" {
+			params.Set("response-content-disposition", contentDisposition(disposition, name))
+		}
+		// Downloads of limited files must be counted, which redirected ones could not be
+		if u, ok := tier.presignedURL(name, params); ok && !limited {
+			tierRedirects.Add(1)
+			tier.touch(name)
+			http.Redirect(w, r, u, http.StatusTemporaryRedirect)
+			return
+		}
+
+		restored, err := tier.restore(r.Context(), name)
+		if err != nil {
+			logger.Printf("Error restoring file from cold tier: %v", err)
+			http.Error(w, "Could not open file", http.StatusInternalServerError)
+			return
+		}
+
+		f, err := os.Open(filepath.Join(baseDir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			// Signatures of stored files are kept in their metadata
+			if signed, ok := strings.CutSuffix(name, minisigSuffix); ok {
+				if m, err := readMetadata(baseDir, signed); err == nil && m.Minisig != "" {
+					w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+					fmt.Fprint(w, m.Minisig)
+					return
+				}
+			}
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error opening file for download: %v", err)
+			http.Error(w, "Could not open file", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			logger.Printf("Error reading file info: %v", err)
+			http.Error(w, "Could not open file", http.StatusInternalServerError)
+			return
+		}
+
+		counted := false
+		if r.Method != http.MethodHead {
+			m, err = countDownload(baseDir, name, tier, indexes, locks)
+			switch {
+			case err == nil:
+				counted = true
+			case errors.Is(err, errNoDownloadsLeft):
+				http.NotFound(w, r)
+				return
+			case !errors.Is(err, fs.ErrNotExist):
+				logger.Printf("Error counting download: %v", err)
+				if limited {
+					http.Error(w, "Could not open file", http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+
+		if tier != nil {
+			if restored {
+				tierColdHits.Add(1)
+			} else {
+				tierHotHits.Add(1)
+			}
+			if !counted {
+				tier.touch(name)
+			}
+		}
+
+		if m, err := readMetadata(baseDir, name); err == nil && m.Encryption != nil {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			m.Encryption.setHeaders(w.Header())
+		}
+
+		if disposition != "" {
+			w.Header().Set("Content-Disposition", contentDisposition(disposition, name))
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+		}
+		if disposition == "inline" {
+			// Uploaded content is untrusted, keep documents rendered in-browser from running scripts
+			w.Header().Set("Content-Security-Policy", "sandbox")
+		}
+
+		// The proxy reads offloaded files after the response, when burned ones must be gone already
+		if !limited && offload.serve(w, f.Name(), f) {
+			return
+		}
+		http.ServeContent(w, r, name, fi.ModTime(), f)
+
+		if counted && m.burned() {
+			if err := removeStoredFile(baseDir, name, indexes); err != nil {
+				logger.Printf("Error deleting file after its last download: %v", err)
+				return
+			}
+			infof(logger, "File deleted after its last download: %s\n", name)
+		}
+	})
+}
+
+// updateContentMetadata records the new size and checksum of the content of the file name stored in baseDir,
+// once changed in place, in its metadata, if it has any, and in indexes, signing the new content with signer
+// unless it is nil.
+func updateContentMetadata(logger *log.Logger, baseDir, name string, size int64, sum string, signer *Minisigner, indexes *FileIndexes) {
+	meta, err := readMetadata(baseDir, name)
+	if err != nil {
+		return
+	}
+
+	meta.Size, meta.SHA256 = size, sum
+	// A signature of the previous content would no longer verify
+	meta.Minisig = ""
+	if signer != nil {
+		if meta.Minisig, err = signer.signFile(filepath.Join(baseDir, name), name); err != nil {
+			logger.Printf("Error signing file: %v", err)
+		}
+	}
+	if err := writeMetadata(baseDir, meta, indexes); err != nil {
+		logger.Printf("Error updating file metadata: %v", err)
+	}
+}
+
+// storedName returns name, or its normalization to form if only that is stored in baseDir,
+// either on the local disk or archived to the cold tier.
+func storedName(baseDir, name string, form NormalizationForm) string {
+	normalized := normalize(name, form)
+	if normalized == name {
+		return name
+	}
+
+	stored := func(name string) bool {
+		if _, err := os.Lstat(filepath.Join(baseDir, name)); err == nil {
+			return true
+		}
+		_, err := os.Lstat(metadataPath(baseDir, name))
+		return err == nil
+	}
+	if !stored(name) && stored(normalized) {
+		return normalized
+	}
+	return name
+}
+
+// contentDisposition returns a Content-Disposition header value of the given type for the file name,
+// as described by RFC 6266: an ASCII filename parameter for older clients, followed by a UTF-8
+// encoded filename* parameter (RFC 8187) if name is not plain ASCII.
+func contentDisposition(disposition, name string) string {
+	var fallback, encoded strings.Builder
+	ascii := true
+	for _, r := range name {
+		switch {
+		case r == '"' || r == '\\':
+			fallback.WriteByte('\\')
+			fallback.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fallback.WriteByte('_')
+		case r > 0x7f:
+			fallback.WriteByte('_')
+			ascii = false
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+	if ascii {
+		return fmt.Sprintf(`%s; filename="%s"`, disposition, fallback.String())
+	}
+
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback.String(), encoded.String())
+}
+
+// isAttrChar reports whether b can appear unencoded in an RFC 8187 extended parameter value.
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPatchAppendConcurrent(t *testing.T) {
+	const clients = 20
+	s, url := newTestServer(t)
+
+	body, contentType := multipartBody(t, "upload", "app.log", "start\n")
+	resp, err := http.Post(url+"/upload", contentType, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload status = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+
+	// Bodies are held back until every patch had the time to read the size of the file, which they would all
+	// append at unless applied one at a time
+	sent := make(chan struct{})
+	time.AfterFunc(200*time.Millisecond, func() { close(sent) })
+
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pr, pw := io.Pipe()
+			go func() {
+				<-sent
+				fmt.Fprintf(pw, "line %02d\n", i)
+				pw.Close()
+			}()
+			req, err := http.NewRequest(http.MethodPatch, url+"/files/app.log", pr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("patch status = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+		}()
+	}
+	wg.Wait()
+
+	resp, err = http.Get(url + "/files/app.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := len("start\n") + clients*len("line 00\n"); len(content) != want {
+		t.Errorf("file has %d bytes, want %d", len(content), want)
+	}
+	for i := range clients {
+		if line := fmt.Sprintf("line %02d\n", i); !strings.Contains(string(content), line) {
+			t.Errorf("file lacks %q", line)
+		}
+	}
+	if n := len(s.locks.locks); n != 0 {
+		t.Errorf("%d file locks left, want none", n)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"time"
+)
+
+// filterRequest is the JSON document written to the standard input of an external filter.
+type filterRequest struct {
+	Filename    string            `json:"filename"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"content_type"`
+	Head        []byte            `json:"head"` // Head is encoded as base64.
+	Meta        map[string]string `json:"meta,omitempty"`
+}
+
+// filterResponse is the JSON document an external filter writes to its standard output.
+type filterResponse struct {
+	Action   string            `json:"action"`             // Action is one of "accept", "reject" or "transform".
+	Reason   string            `json:"reason,omitempty"`   // Reason explains a rejection to the client.
+	Status   int               `json:"status,omitempty"`   // Status is the HTTP status of a rejection, 400 if unset.
+	Filename string            `json:"filename,omitempty"` // Filename renames a transformed upload.
+	Meta     map[string]string `json:"meta,omitempty"`     // Meta replaces the user metadata of a transformed upload.
+}
+
+// execFilter is a [Validator] running an external filter command, timed apart from the other validators.
+type execFilter func(c *UploadCandidate) error
+
+func (f execFilter) Validate(c *UploadCandidate) error {
+	return f(c)
+}
+
+// execValidator returns a [Validator] running the external filter command name with args
+// for every upload. The filter receives a [filterRequest] on its standard input and must
+// answer with a [filterResponse] on its standard output within timeout.
+// Uploads are rejected if the filter fails.
+func execValidator(timeout time.Duration, name string, args ...string) Validator {
+	return execFilter(func(c *UploadCandidate) error {
+		in, err := json.Marshal(filterRequest{
+			Filename:    c.Filename,
+			Size:        c.Size,
+			ContentType: c.ContentType,
+			Head:        c.Head,
+			Meta:        c.Meta,
+		})
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Stdin = bytes.NewReader(in)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+
+		if err := cmd.Run(); err != nil {
+			c.Upload.Logger.Printf("Upload filter %s failed: %v: %s", name, err, bytes.TrimSpace(stderr.Bytes()))
+			return &RejectionError{http.StatusInternalServerError, "upload filter failed"}
+		}
+
+		var resp filterResponse
+		if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+			c.Upload.Logger.Printf("Upload filter %s returned an invalid response: %v", name, err)
+			return &RejectionError{http.StatusInternalServerError, "upload filter failed"}
+		}
+
+		switch resp.Action {
+		case "accept":
+			return nil
+		case "reject":
+			status := resp.Status
+			if status < 400 || status > 599 {
+				status = http.StatusBadRequest
+			}
+			reason := resp.Reason
+			if reason == "" {
+				reason = "rejected by upload filter"
+			}
+			return &RejectionError{status, reason}
+		case "transform":
+			if resp.Filename != "" {
+				c.Filename = resp.Filename
+			}
+			if resp.Meta != nil {
+				c.Meta = resp.Meta
+			}
+			return nil
+		default:
+			c.Upload.Logger.Printf("Upload filter %s returned unknown action %q", name, resp.Action)
+			return &RejectionError{http.StatusInternalServerError, "upload filter failed"}
+		}
+	})
+}
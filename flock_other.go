@@ -0,0 +1,13 @@
+//go:build !(linux || darwin)
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// tryFlock is not supported on this platform.
+func tryFlock(f *os.File) (bool, error) {
+	return false, errors.New("file locks are not supported on this platform")
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// flowFileField is the form field the chunks of Flow.js and Resumable.js uploads are sent in.
+const flowFileField = "file"
+
+// flowMaxParamSize bounds the size of the form fields sent along with chunks.
+const flowMaxParamSize = 4 << 10
+
+// flowChunk is a chunk of an upload sent with the protocol of Flow.js, or of Resumable.js, which differs only
+// by its parameters being prefixed "resumable" rather than "flow", e.g. flowChunkNumber or resumableChunkNumber.
+type flowChunk struct {
+	Number      int64  // Number is the 1-based index of the chunk.
+	Size        int64  // Size is the size of all chunks but the last, which may be larger.
+	CurrentSize int64  // CurrentSize is the size of this chunk.
+	TotalSize   int64  // TotalSize is the size of the file.
+	Identifier  string // Identifier identifies the file among the uploads of the client.
+	Filename    string
+}
+
+// parseFlowChunk returns the chunk described by the Flow.js or Resumable.js parameters in values.
+func parseFlowChunk(values url.Values) (flowChunk, error) {
+	prefix := "flow"
+	if !values.Has("flowChunkNumber") && values.Has("resumableChunkNumber") {
+		prefix = "resumable"
+	}
+
+	var c flowChunk
+	for _, p := range []struct {
+		name string
+		v    *int64
+	}{{"ChunkNumber", &c.Number}, {"ChunkSize", &c.Size}, {"CurrentChunkSize", &c.CurrentSize}, {"TotalSize", &c.TotalSize}} {
+		n, err := strconv.ParseInt(values.Get(prefix+p.name), 10, 64)
+		if err != nil || n < 0 {
+			return c, fmt.Errorf("invalid %s%s", prefix, p.name)
+		}
+		*p.v = n
+	}
+	c.Identifier = values.Get(prefix + "Identifier")
+	c.Filename = values.Get(prefix + "Filename")
+
+	switch {
+	case c.Number < 1:
+		return c, fmt.Errorf("invalid %sChunkNumber", prefix)
+	case c.Size < 1:
+		return c, fmt.Errorf("invalid %sChunkSize", prefix)
+	case c.Identifier == "":
+		return c, fmt.Errorf("missing %sIdentifier", prefix)
+	case c.offset()/c.Size != c.Number-1 || c.offset()+c.CurrentSize > c.TotalSize:
+		return c, fmt.Errorf("chunk %d of %d bytes exceeds the file of %d bytes", c.Number, c.CurrentSize, c.TotalSize)
+	}
+	return c, nil
+}
+
+// offset returns the offset of c in the file.
+func (c flowChunk) offset() int64 {
+	return (c.Number - 1) * c.Size
+}
+
+// sessionID returns the ID of the upload session c is a chunk of, which is derived from the file identifier, name
+// and size chosen by client, as identifiers such as Flow.js' default, "<size>-<name>", are not unique across clients.
+func (c flowChunk) sessionID(client string) string {
+	h := sha256.Sum256(fmt.Appendf(nil, "flow\x00%s\x00%s\x00%s\x00%d", client, c.Identifier, c.Filename, c.TotalSize))
+	return hex.EncodeToString(h[:16])
+}
+
+// flowTestChunk handles the test GET requests of Flow.js and Resumable.js, answering with 200 OK if the chunk
+// described by the query parameters was received already, and 204 No Content otherwise, so it is sent.
+// Requests must carry an [UploadContext], which identifies the client.
+func flowTestChunk(logger *log.Logger, sessions *uploadSessions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uc := uploadContextFrom(r.Context())
+		chunk, err := parseFlowChunk(r.URL.Query())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid chunk: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		_, ranges, err := sessions.load(chunk.sessionID(uc.Identity))
+		if errors.Is(err, fs.ErrNotExist) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error loading upload session: %v", err)
+			http.Error(w, "Could not load upload session", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		start, end := chunk.offset(), chunk.offset()+chunk.CurrentSize
+		for _, r := range ranges {
+			if r.Start <= start && end <= r.End {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// flowUploadChunk handles the chunks of Flow.js and Resumable.js uploads, sent as multipart forms, the chunk in
+// the "file" field after the protocol parameters, or as raw bodies with the parameters in the query string.
+// Chunks are written to an upload session, see [uploadSessions], started by the first chunk arriving, with the
+// X-Upload-Meta-* and X-Upload-Encryption-* headers it carries. The request completing the upload stores it like
+// a regular one, see [completeSession], within the [UploadContext] of the request. Uploads are bounded by its limits.
+func flowUploadChunk(logger *log.Logger, sessions *uploadSessions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uc := uploadContextFrom(r.Context())
+		fsync := uc.Storage.Fsync
+
+		values, body := r.URL.Query(), io.Reader(r.Body)
+		if mr, headers, err := newMultipartReader(r, uc.Limits.Multipart.MaxPartHeaderSize); err == nil {
+			body = nil
+			for parts := 0; body == nil; parts++ {
+				part, err := headers.nextPart(mr)
+				if err == nil && parts >= uc.Limits.Multipart.MaxParts {
+					err = fmt.Errorf("more than %d parts", uc.Limits.Multipart.MaxParts)
+				}
+				if err != nil {
+					logger.Printf("Error parsing chunk form: %v", err)
+					http.Error(w, "Could not get chunk from form", http.StatusBadRequest)
+					return
+				}
+
+				if part.FormName() == flowFileField {
+					body = part
+					continue
+				}
+
+				v, err := io.ReadAll(io.LimitReader(part, flowMaxParamSize))
+				if err == nil {
+					_, err = io.Copy(io.Discard, part)
+				}
+				if err != nil {
+					logger.Printf("Error parsing chunk form: %v", err)
+					http.Error(w, "Could not parse multipart form", http.StatusBadRequest)
+					return
+				}
+				values.Set(part.FormName(), string(v))
+			}
+		}
+
+		chunk, err := parseFlowChunk(values)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid chunk: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if !validFileName(chunk.Filename) {
+			uc.respondError(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+
+		if uc.Limits.MaxSize > 0 && chunk.TotalSize > uc.Limits.MaxSize {
+			uc.respondError(w, fmt.Sprintf("Upload rejected: file exceeds %d bytes", uc.Limits.MaxSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		id := chunk.sessionID(uc.Identity)
+		if _, err := os.Stat(sessions.path(id, ".part")); errors.Is(err, fs.ErrNotExist) {
+			meta, err := parseMetaHeaders(r.Header, uc.Limits.MaxMetaHeaders, uc.Limits.MaxMetaSize)
+			if err != nil {
+				logger.Printf("Error parsing upload metadata: %v", err)
+				uc.respondError(w, fmt.Sprintf("Invalid upload metadata: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			enc, err := parseEncryptionHeaders(r.Header)
+			if err != nil {
+				logger.Printf("Error parsing upload encryption: %v", err)
+				uc.respondError(w, fmt.Sprintf("Invalid upload encryption: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			expiry, err := parseExpiresAfter(r.Header.Get(expiresAfterHeader))
+			if err != nil {
+				logger.Printf("Error parsing upload expiry: %v", err)
+				uc.respondError(w, fmt.Sprintf("Invalid upload expiry: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			maxDownloads, err := parseMaxDownloads(r.Header.Get(maxDownloadsHeader))
+			if err != nil {
+				logger.Printf("Error parsing upload download limit: %v", err)
+				uc.respondError(w, fmt.Sprintf("Invalid upload download limit: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			// Chunks may arrive in parallel, the first one creates the session
+			err = sessions.create(uploadSession{
+				ID:           id,
+				Filename:     chunk.Filename,
+				Length:       chunk.TotalSize,
+				Meta:         meta,
+				Encryption:   enc,
+				Expiry:       duration(expiry),
+				MaxDownloads: maxDownloads,
+				CreatedAt:    time.Now().UTC(),
+			})
+			switch {
+			case err == nil:
+				uc.publish(Event{Type: EventUploadStarted, Filename: chunk.Filename})
+				infof(logger, "Upload session created: %s for %s, %d bytes\n", id, chunk.Filename, chunk.TotalSize)
+			case !errors.Is(err, fs.ErrExist):
+				logger.Printf("Error creating upload session: %v", err)
+				http.Error(w, "Could not create upload session", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		part, err := os.OpenFile(sessions.path(id, ".part"), os.O_RDWR, 0)
+		if errors.Is(err, fs.ErrNotExist) {
+			// The upload was completed or aborted meanwhile
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error opening upload session: %v", err)
+			http.Error(w, "Could not load upload session", http.StatusInternalServerError)
+			return
+		}
+		defer part.Close()
+
+		n, err := io.Copy(io.NewOffsetWriter(part, chunk.offset()), io.LimitReader(body, chunk.CurrentSize))
+		if err == nil && n < chunk.CurrentSize {
+			http.Error(w, "Chunk is shorter than its declared size", http.StatusBadRequest)
+			return
+		}
+		if err == nil {
+			err = fsync.sync(part, sessions.dir)
+		}
+		if err == nil && n > 0 {
+			err = sessions.record(id, byteRange{Start: chunk.offset(), End: chunk.offset() + n}, fsync)
+		}
+		if err != nil {
+			logger.Printf("Error writing upload session chunk: %v", err)
+			http.Error(w, "Could not write chunk", http.StatusInternalServerError)
+			return
+		}
+
+		if extra, _ := io.Copy(io.Discard, io.LimitReader(body, 1)); extra != 0 {
+			http.Error(w, "Chunk exceeds its declared size", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		// The session is only complete once the request creating it persisted it
+		sess, ranges, err := sessions.load(id)
+		if err == nil && contiguousOffset(ranges) == sess.Length && completeSession(logger, w, uc, sessions, sess, part) {
+			return
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Printf("Error loading upload session: %v", err)
+			http.Error(w, "Could not load upload session", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+}
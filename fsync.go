@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// FsyncPolicy controls how stored files are flushed to stable storage before success is reported.
+// It implements [flag.Value].
+type FsyncPolicy string
+
+const (
+	FsyncAlways  FsyncPolicy = "always"   // FsyncAlways syncs files and the directory entries of new files.
+	FsyncOnClose FsyncPolicy = "on-close" // FsyncOnClose syncs files once written, leaving directory entries to the OS.
+	FsyncNever   FsyncPolicy = "never"    // FsyncNever leaves flushing entirely to the OS.
+)
+
+func (p *FsyncPolicy) String() string {
+	return string(*p)
+}
+
+func (p *FsyncPolicy) Set(v string) error {
+	switch FsyncPolicy(v) {
+	case FsyncAlways, FsyncOnClose, FsyncNever:
+		*p = FsyncPolicy(v)
+		return nil
+	default:
+		return fmt.Errorf("unknown fsync policy %q, expected one of always, on-close or never", v)
+	}
+}
+
+// sync flushes the written file f according to p. With [FsyncAlways] the directory
+// dir holding f is synced as well, so the entry of a newly created file survives a crash.
+func (p FsyncPolicy) sync(f *os.File, dir string) error {
+	if p == FsyncNever {
+		return nil
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("syncing %s: %w", f.Name(), err)
+	}
+
+	if p != FsyncAlways {
+		return nil
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir flushes the entries of the directory dir to stable storage.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("syncing directory %s: %w", dir, err)
+	}
+
+	return nil
+}
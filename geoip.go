@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+// mmdbMetadataMarker precedes the metadata section at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// mmdbDataSectionSeparatorSize is the size of the zeroed separator between the search tree and data section.
+const mmdbDataSectionSeparatorSize = 16
+
+// mmdb is a minimal reader for the MaxMind DB file format, as used by
+// the GeoLite2/GeoIP2 databases. The whole database is held in memory.
+//
+// See https://maxmind.github.io/MaxMind-DB/ for the format specification.
+type mmdb struct {
+	buf        []byte // buf is the complete database file.
+	data       []byte // data is the data section of the database.
+	nodeCount  uint64 // nodeCount is the number of nodes in the search tree.
+	recordSize uint64 // recordSize is the size in bits of a single search tree record.
+	ipVersion  uint64 // ipVersion is the IP version of the search tree, either 4 or 6.
+	ipv4Start  uint64 // ipv4Start is the node IPv4 lookups start from in an IPv6 tree.
+}
+
+// openMMDB reads and validates the MaxMind DB file at path.
+func openMMDB(path string) (*mmdb, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: not a MaxMind DB file", path)
+	}
+
+	metaSection := buf[i+len(mmdbMetadataMarker):]
+	meta, _, err := mmdbDecode(metaSection, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%s: decoding metadata: %w", path, err)
+	}
+
+	m, ok := meta.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: invalid metadata", path)
+	}
+
+	db := &mmdb{buf: buf}
+	db.nodeCount, _ = m["node_count"].(uint64)
+	db.recordSize, _ = m["record_size"].(uint64)
+	db.ipVersion, _ = m["ip_version"].(uint64)
+
+	switch db.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, db.recordSize)
+	}
+
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+mmdbDataSectionSeparatorSize > uint64(i) {
+		return nil, fmt.Errorf("%s: search tree exceeds file size", path)
+	}
+	db.data = buf[treeSize+mmdbDataSectionSeparatorSize : i]
+
+	if db.ipVersion == 6 {
+		node := uint64(0)
+		for n := 0; n < 96 && node < db.nodeCount; n++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *mmdb) record(node uint64, bit uint) uint64 {
+	switch db.recordSize {
+	case 24:
+		b := db.buf[node*6+uint64(bit)*3:]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	case 28:
+		b := db.buf[node*7:]
+		if bit == 0 {
+			return uint64(b[3]&0xF0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0F)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+	default:
+		return uint64(binary.BigEndian.Uint32(db.buf[node*8+uint64(bit)*4:]))
+	}
+}
+
+// lookup returns the decoded record for ip, or nil if the database has no entry for it.
+func (db *mmdb) lookup(ip net.IP) (any, error) {
+	node := uint64(0)
+
+	addr := ip.To4()
+	if addr != nil && db.ipVersion == 6 {
+		node = db.ipv4Start
+	} else if addr == nil {
+		if db.ipVersion == 4 {
+			return nil, nil
+		}
+		addr = ip.To16()
+	}
+
+	for i := 0; i < len(addr)*8 && node < db.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-i%8)) & 1
+		node = db.record(node, bit)
+	}
+
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+
+	offset := node - db.nodeCount - mmdbDataSectionSeparatorSize
+	if offset >= uint64(len(db.data)) {
+		return nil, errors.New("invalid data section pointer")
+	}
+
+	v, _, err := mmdbDecode(db.data, offset)
+	return v, err
+}
+
+// mmdbDecode decodes the data field stored at offset in section, returning
+// the decoded value and the offset of the following field.
+func mmdbDecode(section []byte, offset uint64) (any, uint64, error) {
+	if offset >= uint64(len(section)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+
+	ctrl := section[offset]
+	offset++
+
+	typ := uint64(ctrl >> 5)
+
+	if typ == 1 { // pointer
+		ss := (ctrl >> 3) & 0x3
+		n := uint64(ss) + 1
+		if offset+n > uint64(len(section)) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+
+		p := uint64(ctrl & 0x7)
+		if ss == 3 {
+			p = 0
+		}
+		for _, b := range section[offset : offset+n] {
+			p = p<<8 | uint64(b)
+		}
+
+		switch ss {
+		case 1:
+			p += 2048
+		case 2:
+			p += 526336
+		}
+
+		v, _, err := mmdbDecode(section, p)
+		return v, offset + n, err
+	}
+
+	if typ == 0 { // extended
+		if offset >= uint64(len(section)) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+		typ = 7 + uint64(section[offset])
+		offset++
+	}
+
+	size := uint64(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > uint64(len(section)) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+
+		var v uint64
+		for _, b := range section[offset : offset+n] {
+			v = v<<8 | uint64(b)
+		}
+		offset += n
+
+		switch size {
+		case 29:
+			size = 29 + v
+		case 30:
+			size = 285 + v
+		default:
+			size = 65821 + v
+		}
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]any, size)
+		for i := uint64(0); i < size; i++ {
+			k, next, err := mmdbDecode(section, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+
+			v, next, err := mmdbDecode(section, next)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]any, 0, size)
+		for i := uint64(0); i < size; i++ {
+			v, next, err := mmdbDecode(section, offset)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case 14: // boolean
+		return size != 0, offset, nil
+	case 12, 13: // data cache container, end marker
+		return nil, offset, nil
+	}
+
+	if offset+size > uint64(len(section)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+	b := section[offset : offset+size]
+	offset += size
+
+	switch typ {
+	case 2: // utf8 string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4, 10: // bytes, uint128
+		return b, offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("invalid float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 5, 6, 8, 9: // uint16, uint32, int32, uint64
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		if typ == 8 {
+			return int64(int32(v)), offset, nil
+		}
+		return v, offset, nil
+	default:
+		return nil, 0, fmt.Errorf("unknown data type %d", typ)
+	}
+}
+
+// GeoIP enriches client addresses with their country and autonomous system,
+// looked up in MaxMind GeoLite2/GeoIP2 databases.
+type GeoIP struct {
+	country *mmdb // country is a Country or City database, may be nil.
+	asn     *mmdb // asn is an ASN database, may be nil.
+}
+
+// newGeoIP opens the given country and ASN databases, either of which may be empty.
+// A nil *GeoIP is returned if neither database is configured.
+func newGeoIP(countryDB, asnDB string) (*GeoIP, error) {
+	if countryDB == "" && asnDB == "" {
+		return nil, nil
+	}
+
+	g := &GeoIP{}
+
+	var err error
+	if countryDB != "" {
+		if g.country, err = openMMDB(countryDB); err != nil {
+			return nil, err
+		}
+	}
+
+	if asnDB != "" {
+		if g.asn, err = openMMDB(asnDB); err != nil {
+			return nil, err
+		}
+	}
+
+	return g, nil
+}
+
+// Lookup returns the log annotation for remoteAddr, given in "host:port" or "host" form,
+// e.g. `country=US asn=15169 org="GOOGLE"`. Unknown values are logged as "-".
+func (g *GeoIP) Lookup(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	country, asn, org := "-", "-", "-"
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Sprintf("country=%s asn=%s org=%s", country, asn, org)
+	}
+
+	if g.country != nil {
+		if rec, err := g.country.lookup(ip); err == nil {
+			if v, ok := mmdbPath(rec, "country", "iso_code").(string); ok {
+				country = v
+			}
+		}
+	}
+
+	if g.asn != nil {
+		if rec, err := g.asn.lookup(ip); err == nil {
+			if v, ok := mmdbPath(rec, "autonomous_system_number").(uint64); ok {
+				asn = fmt.Sprint(v)
+			}
+			if v, ok := mmdbPath(rec, "autonomous_system_organization").(string); ok {
+				org = fmt.Sprintf("%q", v)
+			}
+		}
+	}
+
+	return fmt.Sprintf("country=%s asn=%s org=%s", country, asn, org)
+}
+
+// mmdbPath walks nested maps of a decoded record along keys.
+func mmdbPath(v any, keys ...string) any {
+	for _, k := range keys {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HMAC request signing headers and authorization scheme.
+//
+// A signed request carries:
+//
+//	X-Usrv-Date: <unix timestamp in seconds>
+//	X-Usrv-Content-Sha256: <hex SHA-256 of the request body>
+//	Authorization: USRV-HMAC-SHA256 <hex HMAC-SHA256 of the string to sign>
+//
+// where the string to sign is the timestamp, method, escaped path, canonical query and body hash joined by
+// newlines, see [hmacCanonicalQuery]. Each signature is accepted once, replays of a signed request are rejected.
+const (
+	hmacDateHeader          = "X-Usrv-Date"
+	hmacContentSHA256Header = "X-Usrv-Content-Sha256"
+	hmacScheme              = "USRV-HMAC-SHA256 "
+)
+
+// hmacReplayPrefix prefixes the keys counting the uses of signatures in the [CounterStore] of replays.
+const hmacReplayPrefix = "usrv:hmac:"
+
+// hmacStringToSign returns the string signed by clients for a request.
+func hmacStringToSign(timestamp, method, path, query, bodyHash string) string {
+	return strings.Join([]string{timestamp, method, path, query, bodyHash}, "\n")
+}
+
+// hmacCanonicalQuery returns the canonical form of query signed by clients: its parameters sorted by name then
+// value, with names and values escaped as in forms, joined by "&". It is empty for requests without a query.
+func hmacCanonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, url.QueryEscape(name)+"="+url.QueryEscape(value))
+		}
+	}
+	slices.Sort(params)
+	return strings.Join(params, "&")
+}
+
+// hmacSign returns the hex encoded signature of stringToSign using secret.
+func hmacSign(secret, stringToSign string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hmacAuthenticator returns an [Authenticator] accepting requests signed with secret
+// whose timestamp is within maxSkew of the server time.
+//
+// The signature covers the declared body hash, and the body is verified before the request is accepted: it is
+// spooled like uploaded files, in memory up to maxMemory bytes reserved from budget and in a temporary file beyond,
+// and requests whose body does not match the signed hash, or is larger than maxBody bytes unless 0, are rejected.
+// Handlers thus never see unverified content, whether or not they read the body to its end. Requests whose body
+// cannot reserve memory from budget fail with [errMemoryBudgetExhausted] instead, to be retried.
+// The uses of signatures are counted in replays for as long as their timestamp is accepted, once their body is
+// verified, and a signature already used is rejected, so a captured request cannot be replayed. Requests are
+// also rejected if replays fails, e.g. when Redis is unreachable.
+func hmacAuthenticator(secret string, maxSkew time.Duration, replays CounterStore, budget *MemoryBudget, maxMemory, maxBody int64) Authenticator {
+	return func(r *http.Request) (*http.Request, error) {
+		signature, ok := strings.CutPrefix(r.Header.Get("Authorization"), hmacScheme)
+		if !ok {
+			return r, errUnauthenticated
+		}
+
+		timestamp := r.Header.Get(hmacDateHeader)
+		sec, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return r, errUnauthenticated
+		}
+
+		skew := time.Since(time.Unix(sec, 0))
+		if skew > maxSkew || skew < -maxSkew {
+			return r, errUnauthenticated
+		}
+
+		bodyHash := strings.ToLower(r.Header.Get(hmacContentSHA256Header))
+		want, err := hex.DecodeString(bodyHash)
+		if err != nil || len(want) != sha256.Size {
+			return r, errUnauthenticated
+		}
+
+		query, err := url.ParseQuery(r.URL.RawQuery)
+		if err != nil {
+			return r, errUnauthenticated
+		}
+
+		expected := hmacSign(secret, hmacStringToSign(timestamp, r.Method, r.URL.EscapedPath(), hmacCanonicalQuery(query), bodyHash))
+		if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(expected)) {
+			return r, errUnauthenticated
+		}
+
+		reserve := maxMemory + 1
+		if r.ContentLength >= 0 {
+			reserve = min(reserve, r.ContentLength)
+		}
+		h := sha256.New()
+		f, err := spoolReserved(r.Context(), budget, io.TeeReader(r.Body, h), &spooledFile{}, maxMemory, maxBody, reserve)
+		if errors.Is(err, errMemoryBudgetExhausted) {
+			return r, err
+		}
+		if err != nil {
+			return r, errUnauthenticated
+		}
+		body, err := f.Open()
+		if err != nil || !hmac.Equal(h.Sum(nil), want) {
+			f.Remove()
+			return r, errUnauthenticated
+		}
+
+		// The signature is only used once the request is verified, so a request failing before is not burned.
+		// A timestamp is accepted from maxSkew before to maxSkew after it.
+		if uses, _, err := replays.Add(hmacReplayPrefix+expected, 1, 2*maxSkew); err != nil || uses > 1 {
+			f.Remove()
+			return r, errUnauthenticated
+		}
+
+		r = r.Clone(r.Context())
+		r.Body = &spooledBody{Reader: body, file: f}
+		r.ContentLength = f.Size
+
+		return r, nil
+	}
+}
+
+// spooledBody is a request body verified by [hmacAuthenticator], read from the file it was spooled to.
+// Closing it releases the file.
+type spooledBody struct {
+	io.Reader
+	file *spooledFile
+}
+
+func (b *spooledBody) Close() error {
+	return b.file.Remove()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signRequest signs req with secret as a request whose body is signedBody, which may differ from the body it sends.
+func signRequest(req *http.Request, secret string, signedBody []byte) {
+	sum := sha256.Sum256(signedBody)
+	hash, timestamp := hex.EncodeToString(sum[:]), strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(hmacDateHeader, timestamp)
+	req.Header.Set(hmacContentSHA256Header, hash)
+	query := hmacCanonicalQuery(req.URL.Query())
+	req.Header.Set("Authorization", hmacScheme+hmacSign(secret, hmacStringToSign(timestamp, req.Method, req.URL.EscapedPath(), query, hash)))
+}
+
+// multipartBody returns a multipart form holding content as the file name in field, and its content type.
+func multipartBody(t *testing.T, field, name, content string) (string, string) {
+	t.Helper()
+
+	var body strings.Builder
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile(field, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(content))
+	mw.Close()
+	return body.String(), mw.FormDataContentType()
+}
+
+func TestHMACRejectsTamperedBodies(t *testing.T) {
+	const secret = "secret"
+	s, url := newTestServer(t, "-hmac-secret", secret, "-max-size", "0")
+	if err := os.WriteFile(s.config.dir+"/existing.txt", []byte("original"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	form, formType := multipartBody(t, "upload", "a.txt", "signed")
+	batch, batchType := multipartBody(t, "files", "a.txt", "signed")
+	flowForm := func() (string, string) {
+		var body strings.Builder
+		mw := multipart.NewWriter(&body)
+		for name, value := range map[string]string{"flowChunkNumber": "1", "flowTotalChunks": "1", "flowChunkSize": "6",
+			"flowTotalSize": "6", "flowIdentifier": "a", "flowFilename": "a.txt", "flowRelativePath": "a.txt"} {
+			mw.WriteField(name, value)
+		}
+		fw, _ := mw.CreateFormFile("file", "a.txt")
+		fw.Write([]byte("signed"))
+		mw.Close()
+		return body.String(), mw.FormDataContentType()
+	}
+	flow, flowType := flowForm()
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		body        string
+		contentType string
+	}{
+		{name: "upload", method: http.MethodPost, path: "/upload", body: form, contentType: formType},
+		{name: "json", method: http.MethodPost, path: "/upload/json", body: `{"filename": "a.txt", "content_b64": "c2lnbmVk"}`, contentType: "application/json"},
+		{name: "flow", method: http.MethodPost, path: "/upload/flow", body: flow, contentType: flowType},
+		{name: "batch", method: http.MethodPost, path: "/upload/batch", body: batch, contentType: batchType},
+		{name: "tus", method: http.MethodPatch, path: "/uploads/a", body: "signed", contentType: "application/offset+octet-stream"},
+		{name: "patch", method: http.MethodPatch, path: "/files/existing.txt?offset=0", body: "signed", contentType: "application/octet-stream"},
+		{name: "delta", method: http.MethodPost, path: "/files/existing.txt/delta", body: "signed", contentType: "application/octet-stream"},
+		{name: "attachment", method: http.MethodPut, path: "/files/existing.txt/attachments/notes", body: "signed", contentType: "text/plain"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The tampered body flips the case of the signed content, keeping its size and structure
+			tampered := strings.NewReplacer("signed", "SIGNED", "c2lnbmVk", "U0lHTkVE").Replace(tt.body)
+			req, err := http.NewRequest(tt.method, url+tt.path, strings.NewReader(tampered))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tt.contentType)
+			signRequest(req, secret, []byte(tt.body))
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+			}
+
+			entries, err := os.ReadDir(s.config.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range entries {
+				if e.Name() == "a.txt" {
+					t.Errorf("tampered upload was stored")
+				}
+			}
+			if got, err := os.ReadFile(s.config.dir + "/existing.txt"); err != nil || !bytes.Equal(got, []byte("original")) {
+				t.Errorf("existing.txt = %q, %v, want %q", got, err, "original")
+			}
+		})
+	}
+}
+
+func TestHMACAcceptsSignedBodies(t *testing.T) {
+	const secret = "secret"
+	for _, maxSize := range []string{"0", "10"} {
+		t.Run("max-size="+maxSize, func(t *testing.T) {
+			s, url := newTestServer(t, "-hmac-secret", secret, "-max-size", maxSize)
+
+			body, contentType := multipartBody(t, "upload", "a.txt", "signed")
+			req, err := http.NewRequest(http.MethodPost, url+"/upload", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", contentType)
+			signRequest(req, secret, []byte(body))
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusCreated {
+				t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusCreated)
+			}
+			if got, err := os.ReadFile(s.config.dir + "/a.txt"); err != nil || string(got) != "signed" {
+				t.Errorf("stored content = %q, %v, want %q", got, err, "signed")
+			}
+		})
+	}
+}
+
+func TestHMACRejectsBodiesOverLimit(t *testing.T) {
+	const secret = "secret"
+	_, url := newTestServer(t, "-hmac-secret", secret, "-hmac-max-body", "1")
+
+	body := bytes.Repeat([]byte("a"), 1<<20+1)
+	req, err := http.NewRequest(http.MethodPatch, url+"/uploads/a", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signRequest(req, secret, body)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestHMACBusyKeepsSignature(t *testing.T) {
+	const secret = "secret"
+	s, url := newTestServer(t, "-hmac-secret", secret, "-max-size", "1", "-memory-budget", "1", "-memory-budget-wait", "10ms")
+
+	body, contentType := multipartBody(t, "upload", "a.txt", "signed")
+	signed, err := http.NewRequest(http.MethodPost, url+"/upload", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed.Header.Set("Content-Type", contentType)
+	signRequest(signed, secret, []byte(body))
+	// send sends the signed request, the same each time
+	send := func() *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, url+"/upload", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = signed.Header.Clone()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// The body cannot be spooled while the budget is used up, which the client is told to retry
+	n, err := s.memoryBudget.reserve(context.Background(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := send()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("status = %d, Retry-After %q, want %d with Retry-After", resp.StatusCode, resp.Header.Get("Retry-After"), http.StatusServiceUnavailable)
+	}
+	s.memoryBudget.release(n)
+
+	// The signature was not used up by the request that failed
+	if retry := send(); retry.StatusCode != http.StatusCreated {
+		t.Errorf("retry status = %d, want %d", retry.StatusCode, http.StatusCreated)
+	}
+	if again := send(); again.StatusCode != http.StatusUnauthorized {
+		t.Errorf("replay status = %d, want %d", again.StatusCode, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// sqsWaitTime is how long a receive call waits for messages, long polling keeps idle queues cheap.
+const sqsWaitTime = 20 * time.Second
+
+// sqsClient is a minimal client of an SQS queue, speaking the query API signed with AWS Signature Version 4.
+type sqsClient struct {
+	queueURL  *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// sqsMessage is a message received from an SQS queue.
+type sqsMessage struct {
+	MessageID     string `xml:"MessageId"`
+	ReceiptHandle string `xml:"ReceiptHandle"`
+	Body          string `xml:"Body"`
+}
+
+// newSQSClient creates a client of the queue at queueURL, e.g. "https://sqs.eu-west-1.amazonaws.com/123456789012/uploads".
+// Credentials are taken from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables. Requests are
+// made with outbound.
+func newSQSClient(queueURL, region string, outbound *Outbound) (*sqsClient, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing sqs queue url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid sqs queue url %q", queueURL)
+	}
+
+	c := &sqsClient{
+		queueURL:  u,
+		region:    region,
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		// Long polling requests outlast the wait time
+		client: outbound.client(sqsWaitTime + 10*time.Second),
+	}
+
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, errors.New("sqs credentials missing, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+
+	return c, nil
+}
+
+// receive long polls the queue for up to 10 messages.
+func (c *sqsClient) receive(ctx context.Context) ([]sqsMessage, error) {
+	var result struct {
+		Messages []sqsMessage `xml:"ReceiveMessageResult>Message"`
+	}
+	err := c.call(ctx, url.Values{
+		"Action":              {"ReceiveMessage"},
+		"MaxNumberOfMessages": {"10"},
+		"WaitTimeSeconds":     {fmt.Sprint(int(sqsWaitTime / time.Second))},
+	}, &result)
+	return result.Messages, err
+}
+
+// delete removes the message identified by receiptHandle from the queue, acknowledging it.
+func (c *sqsClient) delete(ctx context.Context, receiptHandle string) error {
+	return c.call(ctx, url.Values{
+		"Action":        {"DeleteMessage"},
+		"ReceiptHandle": {receiptHandle},
+	}, nil)
+}
+
+// call sends the query API request described by params, decoding the XML response into result unless it is nil.
+func (c *sqsClient) call(ctx context.Context, params url.Values, result any) error {
+	params.Set("Version", "2012-11-05")
+	body := s3EncodeQuery(params)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.queueURL.String(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	hash := sha256.Sum256([]byte(body))
+	signV4(req, "sqs", c.region, c.accessKey, c.secretKey, hex.EncodeToString(hash[:]), time.Now().UTC())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("sqs %s: %s: %s", params.Get("Action"), resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	if result == nil {
+		return nil
+	}
+	return xml.NewDecoder(resp.Body).Decode(result)
+}
+
+// fetchRequest is the body of a message asking for a file to be fetched. Messages may also hold the bare URL.
+type fetchRequest struct {
+	URL      string `json:"url"`
+	Filename string `json:"filename,omitempty"` // Filename is the name the file is stored under, the last element of the URL path by default.
+}
+
+// parseFetchRequest parses the body of a fetch message.
+func parseFetchRequest(body string) (fetchRequest, error) {
+	var req fetchRequest
+
+	body = strings.TrimSpace(body)
+	if strings.HasPrefix(body, "{") {
+		if err := json.Unmarshal([]byte(body), &req); err != nil {
+			return req, err
+		}
+	} else {
+		req.URL = body
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return req, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return req, fmt.Errorf("unsupported url %q", req.URL)
+	}
+
+	if req.Filename == "" {
+		req.Filename = path.Base(u.Path)
+	}
+	if !validFileName(req.Filename) {
+		return req, fmt.Errorf("invalid file name %q", req.Filename)
+	}
+
+	return req, nil
+}
+
+// URLIngester consumes messages holding the URLs of files from an SQS queue, fetches the files and stores
+// them like uploads. Messages are only deleted from the queue once their file is stored, failed ones are
+// redelivered after the queue's visibility timeout, or moved to its dead-letter queue.
+type URLIngester struct {
+	queue   *sqsClient
+	guard   *FetchGuard
+	fetch   *http.Client
+	maxSize int64 // maxSize is the maximum size in bytes of a fetched file, 0 means unlimited.
+
+	storage *UploadStorage
+	events  EventPublisher
+	logger  *log.Logger
+}
+
+// newURLIngester creates the URL ingester configured by config, storing files in storage and publishing their events
+// to events, or nil if URL ingestion is disabled.
+func newURLIngester(config Config, storage *UploadStorage, events EventPublisher, logger *log.Logger) (*URLIngester, error) {
+	if config.ingestSQSQueueURL == "" {
+		return nil, nil
+	}
+
+	queue, err := newSQSClient(config.ingestSQSQueueURL, config.ingestSQSRegion, storage.Outbound)
+	if err != nil {
+		return nil, err
+	}
+
+	guard, err := newFetchGuard(config, storage.Outbound)
+	if err != nil {
+		return nil, err
+	}
+
+	return &URLIngester{
+		queue:   queue,
+		guard:   guard,
+		fetch:   guard.client(config.ingestFetchTimeout),
+		maxSize: config.maxFileSize,
+		storage: storage,
+		events:  events,
+		logger:  logger,
+	}, nil
+}
+
+// run consumes the queue until ctx is done.
+func (i *URLIngester) run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		messages, err := i.queue.receive(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			i.logger.Printf("Error receiving from sqs, retrying in %v: %v", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, time.Minute)
+			continue
+		}
+		backoff = time.Second
+
+		for _, msg := range messages {
+			if err := i.ingest(ctx, msg.Body); err != nil {
+				i.logger.Printf("Error ingesting sqs message %s: %v", msg.MessageID, err)
+				continue
+			}
+			if err := i.queue.delete(ctx, msg.ReceiptHandle); err != nil {
+				i.logger.Printf("Error deleting sqs message %s: %v", msg.MessageID, err)
+			}
+		}
+	}
+}
+
+// ingest fetches and stores the file requested by the message body.
+func (i *URLIngester) ingest(ctx context.Context, body string) error {
+	req, err := parseFetchRequest(body)
+	if err != nil {
+		return fmt.Errorf("invalid fetch request: %w", err)
+	}
+
+	uc := &UploadContext{
+		RequestID: fmt.Sprintf("%d", time.Now().UnixNano()),
+		Identity:  req.URL,
+		Limits:    UploadLimits{MaxSize: i.maxSize},
+		Meta:      map[string]string{"source-url": req.URL},
+		Storage:   i.storage,
+		Events:    i.events,
+		Logger:    i.logger,
+		Stages:    newUploadStages(i.logger),
+	}
+	stages, publish := uc.Stages, uc.publish
+
+	publish(Event{Type: EventUploadStarted})
+
+	f, err := i.download(ctx, req)
+	if err != nil {
+		publish(Event{Type: EventUploadFailed, Filename: req.Filename, Error: err.Error()})
+		return err
+	}
+	defer f.Remove()
+	stages.mark(stageParse)
+
+	stored, err := storeUpload(uc, f)
+	if err != nil {
+		publish(Event{Type: EventUploadFailed, Filename: req.Filename, Error: err.Error()})
+		return err
+	}
+
+	stages.record(stored.Name)
+	infof(i.logger, "File uploaded successfully: %s\n", stored.Name)
+	publish(Event{Type: EventUploadCompleted, Filename: stored.Name, Size: stored.Size})
+	return nil
+}
+
+// download fetches the file requested by req into a temporary file, within the limits of the fetch guard.
+func (i *URLIngester) download(ctx context.Context, req fetchRequest) (*spooledFile, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, req.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := i.guard.check(httpReq); err != nil {
+		return nil, err
+	}
+
+	resp, err := i.fetch.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", req.URL, resp.Status)
+	}
+
+	tmp, err := os.CreateTemp("", "usrv-fetch-*")
+	if err != nil {
+		return nil, err
+	}
+	f := &spooledFile{Filename: req.Filename, Header: map[string][]string{"Content-Type": {resp.Header.Get("Content-Type")}}, tmp: tmp}
+
+	r := io.Reader(resp.Body)
+	if i.maxSize > 0 {
+		r = io.LimitReader(r, i.maxSize+1)
+	}
+	f.Size, err = io.Copy(tmp, r)
+	if err == nil && i.maxSize > 0 && f.Size > i.maxSize {
+		err = fmt.Errorf("fetching %s: file exceeds %d bytes", req.URL, i.maxSize)
+	}
+	if err != nil {
+		f.Remove()
+		return nil, err
+	}
+
+	return f, nil
+}
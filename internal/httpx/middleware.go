@@ -0,0 +1,142 @@
+// Package httpx provides the HTTP middleware and server lifecycle
+// helpers shared by the server binaries.
+package httpx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// key defines a type for context keys used in the package.
+type key int
+
+const (
+	requestIDKey key = 0 // requestIDKey is used to store the request ID in the context.
+)
+
+// Middleware is a function that wraps [http.Handler]s
+// proving functionality before or/and after execution
+// of the h handler.
+type Middleware func(h http.Handler) http.Handler
+
+// StatusRecorder is an [http.ResponseWriter] recording the response status code.
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int // Status is the response status code, 200 unless set otherwise.
+}
+
+// NewStatusRecorder wraps w in a [StatusRecorder].
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (s *StatusRecorder) WriteHeader(status int) {
+	s.Status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// ReadFrom copies src to the underlying [http.ResponseWriter], through its own ReadFrom if it has one,
+// so responses served from files, e.g. by [http.ServeContent], keep using sendfile(2).
+func (s *StatusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	return io.Copy(s.ResponseWriter, src)
+}
+
+// Unwrap returns the underlying [http.ResponseWriter], for use by [http.ResponseController].
+func (s *StatusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// LogAnnotator returns additional information about a request to append to its access log line.
+type LogAnnotator func(r *http.Request) string
+
+// NewLoggingMiddleware creates a middleware that logs HTTP requests.
+// If annotate is not nil, its result is appended to every log line.
+func NewLoggingMiddleware(logger *log.Logger, annotate LogAnnotator) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func(start time.Time) {
+				elapsed := time.Since(start)
+				requestID := RequestIDFromContext(r.Context())
+				if annotate != nil {
+					logger.Println(requestID, r.Method, r.URL.Path, elapsed, r.RemoteAddr, r.UserAgent(), annotate(r))
+					return
+				}
+				logger.Println(requestID, r.Method, r.URL.Path, elapsed, r.RemoteAddr, r.UserAgent())
+			}(time.Now())
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequestIDFunc is a function type for generating unique request IDs,
+// used in the tracing middleware [NewTracingMiddleware].
+type RequestIDFunc func() string
+
+// defaultRequestIDFunc generates a unique request ID based on the current time.
+// It is the default [RequestIDFunc] used if none is provided for the tracing middleware.
+func defaultRequestIDFunc() string {
+	return fmt.Sprintf("%d", time.Now().UnixNano())
+}
+
+// RequestIDFromContext returns the request ID stored in ctx by the
+// tracing middleware [NewTracingMiddleware], or "unknown" if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, ok := ctx.Value(requestIDKey).(string)
+	if !ok {
+		return "unknown"
+	}
+	return requestID
+}
+
+// NewTracingMiddleware creates a middleware that sets and
+// propagates a request ID through the request context and response header.
+func NewTracingMiddleware(requestIDFunc RequestIDFunc) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := r.Header.Get("X-Request-Id")
+
+			if len(requestID) == 0 {
+				if requestIDFunc != nil {
+					requestID = requestIDFunc()
+				} else {
+					requestID = defaultRequestIDFunc()
+				}
+			}
+
+			ctx := context.WithValue(r.Context(), requestIDKey, requestID)
+			w.Header().Set("X-Request-Id", requestID)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// NewRecoveryMiddleware creates a middleware that recovers from panics of the wrapped handler, logging them along
+// with the request ID and the stack, and answers 500 Internal Server Error, which clients only see if the response
+// was not started yet. Panics with [http.ErrAbortHandler] are left to abort the response, as they are meant to.
+func NewRecoveryMiddleware(logger *log.Logger) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				logger.Printf("Panic serving %s %s %s: %v\n%s", RequestIDFromContext(r.Context()), r.Method, r.URL.Path, err, debug.Stack())
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
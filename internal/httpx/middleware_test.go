@@ -0,0 +1,237 @@
+package httpx
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readerFromWriter is an [http.ResponseWriter] with a ReadFrom, like those of [http.Server], which use sendfile(2)
+// in it, recording the calls to it.
+type readerFromWriter struct {
+	*httptest.ResponseRecorder
+	readFrom int // readFrom counts the calls to ReadFrom.
+}
+
+func (w *readerFromWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.readFrom++
+	return io.Copy(w.ResponseRecorder, src)
+}
+
+func TestStatusRecorderReadFrom(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int // status is written before the copy, if not 0.
+		want   int
+	}{
+		{name: "implicit status", want: http.StatusOK},
+		{name: "explicit status", status: http.StatusPartialContent, want: http.StatusPartialContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &readerFromWriter{ResponseRecorder: httptest.NewRecorder()}
+			rec := NewStatusRecorder(w)
+			if tt.status != 0 {
+				rec.WriteHeader(tt.status)
+			}
+
+			// Like files, the source is no io.WriterTo, which io.Copy would prefer to ReadFrom
+			n, err := io.Copy(rec, io.LimitReader(strings.NewReader("content"), 7))
+			if err != nil || n != 7 {
+				t.Fatalf("io.Copy() = %d, %v, want 7, nil", n, err)
+			}
+			if w.readFrom != 1 {
+				t.Errorf("ReadFrom of the underlying writer called %d times, want 1", w.readFrom)
+			}
+			if got := w.Body.String(); got != "content" {
+				t.Errorf("body = %q, want %q", got, "content")
+			}
+			if rec.Status != tt.want || w.Code != tt.want {
+				t.Errorf("status = %d, written %d, want %d", rec.Status, w.Code, tt.want)
+			}
+			if rec.Unwrap() != w {
+				t.Error("Unwrap() does not return the underlying writer")
+			}
+		})
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		annotate LogAnnotator
+		want     string
+	}{
+		{
+			name: "plain",
+			want: "req-1 POST /upload",
+		},
+		{
+			name:     "annotated",
+			annotate: func(r *http.Request) string { return "country=NL" },
+			want:     "req-1 POST /upload",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := log.New(&buf, "", 0)
+
+			served := false
+			h := NewTracingMiddleware(func() string { return "req-1" })(
+				NewLoggingMiddleware(logger, tt.annotate)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					served = true
+				})))
+
+			r := httptest.NewRequest(http.MethodPost, "/upload", nil)
+			r.Header.Set("User-Agent", "test-agent")
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if !served {
+				t.Fatal("wrapped handler was not called")
+			}
+			line := strings.TrimSpace(buf.String())
+			if strings.Count(line, "\n") != 0 {
+				t.Fatalf("logged %q, want a single line", line)
+			}
+			if !strings.HasPrefix(line, tt.want) {
+				t.Errorf("logged %q, want prefix %q", line, tt.want)
+			}
+			if !strings.Contains(line, "test-agent") {
+				t.Errorf("logged %q, want the user agent", line)
+			}
+			if hasAnnotation := strings.HasSuffix(line, " country=NL"); hasAnnotation != (tt.annotate != nil) {
+				t.Errorf("logged %q, annotated: %t, want %t", line, hasAnnotation, tt.annotate != nil)
+			}
+		})
+	}
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		header        string
+		requestIDFunc RequestIDFunc
+		want          string // want is the expected request ID, any if empty.
+	}{
+		{
+			name:          "generated",
+			requestIDFunc: func() string { return "generated-id" },
+			want:          "generated-id",
+		},
+		{
+			name:          "propagated",
+			header:        "client-id",
+			requestIDFunc: func() string { return "generated-id" },
+			want:          "client-id",
+		},
+		{
+			name: "default",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			h := NewTracingMiddleware(tt.requestIDFunc)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = RequestIDFromContext(r.Context())
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Request-Id", tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if seen == "" || seen == "unknown" {
+				t.Fatalf("request ID in context = %q, want one set", seen)
+			}
+			if tt.want != "" && seen != tt.want {
+				t.Errorf("request ID in context = %q, want %q", seen, tt.want)
+			}
+			if got := w.Header().Get("X-Request-Id"); got != seen {
+				t.Errorf("X-Request-Id = %q, want %q", got, seen)
+			}
+		})
+	}
+}
+
+func TestRequestIDFromContextUnknown(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if got := RequestIDFromContext(r.Context()); got != "unknown" {
+		t.Errorf("RequestIDFromContext() = %q, want %q", got, "unknown")
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		handler    http.HandlerFunc
+		wantStatus int
+		wantLog    string // wantLog is expected in the log, nothing is if empty.
+		wantPanic  any    // wantPanic is the panic expected to be left to the server, if any.
+	}{
+		{
+			name:       "no panic",
+			handler:    func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusCreated) },
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "panic",
+			handler:    func(w http.ResponseWriter, r *http.Request) { panic("boom") },
+			wantStatus: http.StatusInternalServerError,
+			wantLog:    "Panic serving req-1 GET /files/a: boom",
+		},
+		{
+			name:       "panic with error",
+			handler:    func(w http.ResponseWriter, r *http.Request) { panic(http.ErrBodyNotAllowed) },
+			wantStatus: http.StatusInternalServerError,
+			wantLog:    "Panic serving req-1 GET /files/a: " + http.ErrBodyNotAllowed.Error(),
+		},
+		{
+			name:      "abort",
+			handler:   func(w http.ResponseWriter, r *http.Request) { panic(http.ErrAbortHandler) },
+			wantPanic: http.ErrAbortHandler,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			h := NewTracingMiddleware(func() string { return "req-1" })(NewRecoveryMiddleware(log.New(&buf, "", 0))(tt.handler))
+
+			w := httptest.NewRecorder()
+			panicked := func() (p any) {
+				defer func() { p = recover() }()
+				h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/files/a", nil))
+				return nil
+			}()
+
+			if panicked != tt.wantPanic {
+				t.Fatalf("panic = %v, want %v", panicked, tt.wantPanic)
+			}
+			if tt.wantPanic != nil {
+				return
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantLog == "" && buf.Len() != 0 {
+				t.Errorf("logged %q, want nothing", buf.String())
+			}
+			if tt.wantLog != "" && !strings.Contains(buf.String(), tt.wantLog) {
+				t.Errorf("logged %q, want %q", buf.String(), tt.wantLog)
+			}
+			if tt.wantLog != "" && !strings.Contains(buf.String(), "goroutine") {
+				t.Errorf("logged %q, want the stack", buf.String())
+			}
+		})
+	}
+}
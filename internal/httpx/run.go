@@ -0,0 +1,113 @@
+package httpx
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Options tune the listener and the shutdown of a server started by [Run].
+type Options struct {
+	// Network is the network listened on: "tcp4", "tcp6", or "tcp", the default, for either.
+	Network string
+	// ShutdownTimeout is the time in-flight requests are given to complete.
+	ShutdownTimeout time.Duration
+	// DrainDelay is waited for once shutdown begins, before the server stops accepting requests,
+	// so load balancers notice it is going away and stop routing requests to it.
+	DrainDelay time.Duration
+	// OnShutdown, if set, is called as soon as shutdown begins, e.g. to start failing readiness checks.
+	OnShutdown func()
+}
+
+// Run starts the HTTP server on opts.Network and handles graceful shutdown on SIGINT or SIGTERM.
+// In-flight requests are given opts.ShutdownTimeout to complete once a signal is received,
+// a second signal exits the process immediately with a non-zero code.
+// It returns the signal that stopped the server, or the error that did.
+func Run(ctx context.Context, logger *log.Logger, httpServer *http.Server, opts Options) (os.Signal, error) {
+	network := opts.Network
+	if network == "" {
+		network = "tcp"
+	}
+	ln, err := net.Listen(network, httpServer.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening: %w", err)
+	}
+
+	listenErr := make(chan error, 1)
+	go func() {
+		logger.Printf("listening on %s\n", DescribeListener(network, ln.Addr()))
+		if err := httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
+			listenErr <- err
+		}
+	}()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	var sig os.Signal
+	select {
+	case sig = <-signals:
+		logger.Printf("Received %v, shutting down gracefully, press Ctrl+C again to force", sig)
+	case err := <-listenErr:
+		return nil, fmt.Errorf("error listening and serving: %w", err)
+	case <-ctx.Done():
+		logger.Println("Shutting down gracefully")
+	}
+
+	// signals is never closed, so the wait for a second one ends when Run returns instead
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-signals:
+			fmt.Fprintln(os.Stderr, "forced shutdown")
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+
+	if opts.OnShutdown != nil {
+		opts.OnShutdown()
+	}
+
+	if opts.DrainDelay > 0 {
+		logger.Printf("Draining for %v before shutting down", opts.DrainDelay)
+		time.Sleep(opts.DrainDelay)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		return sig, fmt.Errorf("error shutting down http server: %w", err)
+	}
+
+	logger.Println("Server shut down successfully")
+	return sig, nil
+}
+
+// DescribeListener describes the address addr bound on network, along with the IP versions it accepts
+// connections over, e.g. "[::]:3000 (IPv4 and IPv6)" for ":3000" bound on "tcp" by a dual-stack host.
+func DescribeListener(network string, addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.String()
+	}
+
+	switch {
+	case tcp.IP.To4() != nil:
+		return tcp.String() + " (IPv4 only)"
+	case tcp.IP.IsUnspecified() && network == "tcp":
+		// The wildcard address of tcp listeners accepts IPv4 connections as IPv4-mapped IPv6 addresses
+		return tcp.String() + " (IPv4 and IPv6)"
+	default:
+		return tcp.String() + " (IPv6 only)"
+	}
+}
@@ -0,0 +1,239 @@
+package httpx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a [bytes.Buffer] safe for concurrent use, for loggers written by servers under test.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// runResult is the outcome of [Run].
+type runResult struct {
+	sig os.Signal
+	err error
+}
+
+// startRun starts [Run] serving handler on a free port of the loopback interface until ctx is done, and returns the
+// address it listens on, once it accepts connections, and the channel receiving its result.
+func startRun(t *testing.T, ctx context.Context, handler http.Handler, opts Options) (string, <-chan runResult) {
+	t.Helper()
+
+	logs := &syncBuffer{}
+	srv := &http.Server{Addr: "127.0.0.1:0", Handler: handler}
+	done := make(chan runResult, 1)
+	go func() {
+		sig, err := Run(ctx, log.New(logs, "", 0), srv, opts)
+		done <- runResult{sig, err}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, addr, ok := strings.Cut(logs.String(), "listening on "); ok {
+			addr, _, _ = strings.Cut(addr, " ")
+			if conn, err := net.Dial("tcp", addr); err == nil {
+				conn.Close()
+				return addr, done
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server did not start listening, logs: %q", logs.String())
+	return "", nil
+}
+
+func TestRunShutsDownOnSignal(t *testing.T) {
+	tests := []struct {
+		name string
+		sig  syscall.Signal
+	}{
+		{"SIGTERM", syscall.SIGTERM},
+		{"SIGINT", syscall.SIGINT},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started, release := make(chan struct{}), make(chan struct{})
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				<-release
+				io.WriteString(w, "done")
+			})
+
+			shutdown := make(chan struct{})
+			addr, done := startRun(t, context.Background(), handler, Options{
+				ShutdownTimeout: 5 * time.Second,
+				OnShutdown:      func() { close(shutdown) },
+			})
+
+			// An in-flight request is given the time to complete
+			type response struct {
+				body string
+				err  error
+			}
+			responses := make(chan response, 1)
+			go func() {
+				resp, err := http.Get("http://" + addr)
+				if err != nil {
+					responses <- response{err: err}
+					return
+				}
+				defer resp.Body.Close()
+				b, err := io.ReadAll(resp.Body)
+				responses <- response{string(b), err}
+			}()
+			<-started
+
+			if err := syscall.Kill(os.Getpid(), tt.sig); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-shutdown:
+			case <-time.After(5 * time.Second):
+				t.Fatal("shutdown did not begin on signal")
+			}
+			close(release)
+
+			if resp := <-responses; resp.err != nil || resp.body != "done" {
+				t.Errorf("in-flight request = %q, %v, want it completed", resp.body, resp.err)
+			}
+			result := <-done
+			if result.err != nil || result.sig != tt.sig {
+				t.Errorf("Run() = %v, %v, want %v, nil", result.sig, result.err, tt.sig)
+			}
+			if _, err := net.Dial("tcp", addr); err == nil {
+				t.Error("server still accepts connections after Run returned")
+			}
+		})
+	}
+}
+
+func TestRunShutsDownOnContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	_, done := startRun(t, ctx, http.NotFoundHandler(), Options{ShutdownTimeout: time.Second})
+	cancel()
+
+	select {
+	case result := <-done:
+		if result.err != nil || result.sig != nil {
+			t.Errorf("Run() = %v, %v, want nil, nil", result.sig, result.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return once the context was done")
+	}
+}
+
+func TestRunLeavesNoGoroutines(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	_, done := startRun(t, ctx, http.NotFoundHandler(), Options{ShutdownTimeout: time.Second})
+	cancel()
+	<-done
+
+	// Goroutines started by Run may take a moment to be scheduled once it returns
+	var stacks []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		stacks = make([]byte, 1<<20)
+		stacks = stacks[:runtime.Stack(stacks, true)]
+		if !bytes.Contains(stacks, []byte("httpx.Run.func")) {
+			return
+		}
+	}
+	t.Errorf("goroutines of Run left once it returned:\n%s", stacks)
+}
+
+func TestRunListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	srv := &http.Server{Addr: ln.Addr().String()}
+	if _, err := Run(context.Background(), log.New(io.Discard, "", 0), srv, Options{}); err == nil {
+		t.Error("Run() on a taken address succeeded, want an error")
+	}
+}
+
+// forcedExitEnv runs [TestRunForcedExit] as the server of the parent test, see [TestRunForcedExit].
+const forcedExitEnv = "HTTPX_TEST_FORCED_EXIT"
+
+// TestRunForcedExit checks that a second signal exits the process while it is shutting down gracefully. As the
+// process exits, the test runs itself in a child process serving until shutdown, which a drain delay prolongs.
+func TestRunForcedExit(t *testing.T) {
+	if os.Getenv(forcedExitEnv) != "" {
+		srv := &http.Server{Addr: "127.0.0.1:0", Handler: http.NotFoundHandler()}
+		Run(context.Background(), log.New(os.Stderr, "", 0), srv, Options{DrainDelay: time.Minute})
+		os.Exit(0)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRunForcedExit$")
+	cmd.Env = append(os.Environ(), forcedExitEnv+"=1")
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	lines := bufio.NewScanner(stderr)
+	var logs []string
+	waitFor := func(prefix string) {
+		t.Helper()
+		for lines.Scan() {
+			logs = append(logs, lines.Text())
+			if strings.HasPrefix(lines.Text(), prefix) {
+				return
+			}
+		}
+		t.Fatalf("child did not log %q, logs: %q", prefix, logs)
+	}
+
+	waitFor("listening on ")
+	// The signal handler is installed once the server is started, which is shortly after it listens
+	time.Sleep(100 * time.Millisecond)
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("Draining for ")
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("forced shutdown")
+
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Errorf("child exited with %v, want exit status 1", err)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// jsonUploadRequest is the body of a JSON upload.
+type jsonUploadRequest struct {
+	Filename   string `json:"filename"`
+	ContentB64 string `json:"content_b64"` // ContentB64 is the standard base64 encoded file content.
+}
+
+// jsonUploadOverhead bounds the bytes of a JSON upload body besides the encoded content.
+const jsonUploadOverhead = 4 << 10
+
+// uploadJSON handles JSON uploads of base64 encoded files, up to the maximum size of the [UploadContext]
+// of requests, for clients unable to send multipart bodies. Uploads are stored like multipart ones, see [storeUpload].
+func uploadJSON() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uc := uploadContextFrom(r.Context())
+		logger, stages, publish := uc.Logger, uc.Stages, uc.publish
+		maxSize := uc.Limits.MaxSize
+
+		publish(Event{Type: EventUploadStarted})
+
+		fail := func(filename string, err error) {
+			publish(Event{Type: EventUploadFailed, Filename: filename, Error: err.Error()})
+		}
+
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			uc.respondError(w, "Content type must be application/json", http.StatusUnsupportedMediaType)
+			fail("", errors.New("unsupported content type"))
+			return
+		}
+
+		meta, err := parseMetaHeaders(r.Header, uc.Limits.MaxMetaHeaders, uc.Limits.MaxMetaSize)
+		if err != nil {
+			logger.Printf("Error parsing upload metadata: %v", err)
+			uc.respondError(w, fmt.Sprintf("Invalid upload metadata: %v", err), http.StatusBadRequest)
+			fail("", err)
+			return
+		}
+
+		enc, err := parseEncryptionHeaders(r.Header)
+		if err != nil {
+			logger.Printf("Error parsing upload encryption: %v", err)
+			uc.respondError(w, fmt.Sprintf("Invalid upload encryption: %v", err), http.StatusBadRequest)
+			fail("", err)
+			return
+		}
+		uc.Meta, uc.Encryption = meta, enc
+
+		uc.Expiry, err = parseExpiresAfter(r.Header.Get(expiresAfterHeader))
+		if err != nil {
+			logger.Printf("Error parsing upload expiry: %v", err)
+			uc.respondError(w, fmt.Sprintf("Invalid upload expiry: %v", err), http.StatusBadRequest)
+			fail("", err)
+			return
+		}
+
+		uc.MaxDownloads, err = parseMaxDownloads(r.Header.Get(maxDownloadsHeader))
+		if err != nil {
+			logger.Printf("Error parsing upload download limit: %v", err)
+			uc.respondError(w, fmt.Sprintf("Invalid upload download limit: %v", err), http.StatusBadRequest)
+			fail("", err)
+			return
+		}
+
+		var req jsonUploadRequest
+		body := http.MaxBytesReader(w, r.Body, int64(base64.StdEncoding.EncodedLen(int(maxSize)))+jsonUploadOverhead)
+		dec := json.NewDecoder(body)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&req)
+		if err == nil {
+			// The body holds nothing but the document
+			var rest []byte
+			rest, err = io.ReadAll(io.MultiReader(dec.Buffered(), body))
+			if err == nil && len(bytes.TrimSpace(rest)) > 0 {
+				err = errors.New("data after the JSON document")
+			}
+		}
+		if err != nil {
+			logger.Printf("Error decoding JSON upload: %v", err)
+			var maxBytesErr *http.MaxBytesError
+			switch {
+			case errors.As(err, &maxBytesErr):
+				uc.respondError(w, fmt.Sprintf("File exceeds %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+			default:
+				uc.respondError(w, "Could not decode JSON body", http.StatusBadRequest)
+			}
+			fail("", err)
+			return
+		}
+
+		if !validFileName(req.Filename) {
+			uc.respondError(w, "Invalid file name", http.StatusBadRequest)
+			fail(req.Filename, errors.New("invalid file name"))
+			return
+		}
+
+		content, err := base64.StdEncoding.DecodeString(req.ContentB64)
+		if err != nil {
+			logger.Printf("Error decoding JSON upload content: %v", err)
+			uc.respondError(w, "Could not decode content_b64", http.StatusBadRequest)
+			fail(req.Filename, err)
+			return
+		}
+		if int64(len(content)) > maxSize {
+			uc.respondError(w, fmt.Sprintf("File exceeds %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+			fail(req.Filename, errors.New("file too large"))
+			return
+		}
+
+		f := &spooledFile{Filename: req.Filename, Size: int64(len(content)), mem: content}
+		stages.mark(stageParse)
+		stored, err := storeUpload(uc, f)
+		if err != nil {
+			se := err.(*storeError)
+			uc.respondError(w, se.Message, se.Status)
+			fail(se.Filename, err)
+			return
+		}
+
+		stages.record(stored.Name)
+		infof(logger, "File uploaded successfully: %s\n", stored.Name)
+		uc.respond(w, stored)
+		uc.notifyCallback(stored)
+		publish(Event{Type: EventUploadCompleted, Filename: stored.Name, Size: stored.Size})
+	})
+}
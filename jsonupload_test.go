@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUploadJSONVerifiesSignedBody(t *testing.T) {
+	const secret = "secret"
+	s, url := newTestServer(t, "-hmac-secret", secret)
+
+	signed := `{"filename": "a.txt", "content_b64": "c2lnbmVk"}`
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "signed body", body: signed, want: http.StatusCreated},
+		{name: "tampered body", body: `{"filename": "a.txt", "content_b64": "dGFtcGVy"}`, want: http.StatusUnauthorized},
+		{name: "trailing data", body: signed + `{}`, want: http.StatusUnauthorized},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Each signature is accepted once, the signed query makes them differ
+			req, err := http.NewRequest(http.MethodPost, url+"/upload/json?n="+strconv.Itoa(i), strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			signRequest(req, secret, []byte(signed))
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+
+			got, err := os.ReadFile(filepath.Join(s.config.dir, "a.txt"))
+			if err != nil || string(got) != "signed" {
+				t.Errorf("stored content = %q, %v, want %q", got, err, "signed")
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// leaderLockName is the name of the lock held by the leading replica.
+const leaderLockName = "leader"
+
+// leaderRetryInterval is the interval at which followers try to become leader.
+const leaderRetryInterval = 15 * time.Second
+
+// newLeaderLocker returns the [Locker] electing the replica running background jobs, as selected by
+// the election method: "file" for a lock file in the upload directory, "redis" for a lock in Redis, or
+// "none", returning nil, for running the jobs on every replica.
+func newLeaderLocker(config Config, cluster *redisClient, logger *log.Logger) (Locker, error) {
+	switch config.leaderElection {
+	case "none":
+		return nil, nil
+	case "file":
+		return &fileLocker{dir: config.dir}, nil
+	case "redis":
+		if cluster == nil {
+			return nil, fmt.Errorf("redis leader election requires a redis server")
+		}
+		return &redisLocker{client: cluster, logger: logger}, nil
+	default:
+		return nil, fmt.Errorf("unknown leader election method %q", config.leaderElection)
+	}
+}
+
+// runAsLeader runs job whenever this replica is elected leader through locker, until ctx is done.
+// The context passed to job is canceled once leadership is lost.
+func runAsLeader(ctx context.Context, logger *log.Logger, locker Locker, job func(ctx context.Context)) {
+	ticker := time.NewTicker(leaderRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		lock, ok, err := locker.TryLock(leaderLockName)
+		if err != nil {
+			logger.Printf("Error running leader election: %v", err)
+		}
+
+		if ok {
+			logger.Println("Elected leader, running background jobs")
+
+			leaderCtx, cancel := context.WithCancel(ctx)
+			go func() {
+				select {
+				case <-lock.Lost():
+					cancel()
+				case <-leaderCtx.Done():
+				}
+			}()
+
+			job(leaderCtx)
+			cancel()
+			lock.Unlock()
+
+			if ctx.Err() == nil {
+				logger.Println("Lost leadership, background jobs stopped")
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisLockTTL is the expiry of locks held in Redis. Held locks are refreshed well before they expire,
+// so the TTL only bounds how long a lock outlives a crashed replica.
+const redisLockTTL = 30 * time.Second
+
+// redisLockPrefix is the prefix of the Redis keys of locks.
+const redisLockPrefix = "usrv:lock:"
+
+// Lua scripts releasing and refreshing a lock only if it is still held by the caller's token.
+const (
+	redisUnlockScript  = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`
+	redisRefreshScript = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`
+)
+
+// Lock is a claim on a name obtained from a [Locker].
+type Lock interface {
+	// Unlock releases the claim.
+	Unlock()
+	// Lost returns a channel that is closed if the claim is lost before being released,
+	// e.g. because it could not be refreshed before it expired.
+	Lost() <-chan struct{}
+}
+
+// Locker provides named, non-blocking mutual exclusion, e.g. between the writers of an upload session.
+type Locker interface {
+	// TryLock claims name, reporting false if it is claimed already.
+	TryLock(name string) (lock Lock, ok bool, err error)
+}
+
+// unlockFunc is a [Lock] that cannot be lost, released by calling it.
+type unlockFunc func()
+
+func (f unlockFunc) Unlock() {
+	f()
+}
+
+func (f unlockFunc) Lost() <-chan struct{} {
+	return nil
+}
+
+// localLocker is a [Locker] within a single process.
+type localLocker struct {
+	mu   sync.Mutex
+	held map[string]bool
+}
+
+func newLocalLocker() *localLocker {
+	return &localLocker{held: make(map[string]bool)}
+}
+
+func (l *localLocker) TryLock(name string) (Lock, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.held[name] {
+		return nil, false, nil
+	}
+	l.held[name] = true
+
+	return unlockFunc(func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.held, name)
+	}), true, nil
+}
+
+// redisLocker is a [Locker] shared by all server replicas using the same Redis server.
+// Locks are refreshed while held and expire if their holder goes away.
+type redisLocker struct {
+	client *redisClient
+	logger *log.Logger
+}
+
+// redisLock is a [Lock] held in Redis.
+type redisLock struct {
+	client *redisClient
+	logger *log.Logger
+	key    string
+	token  string
+
+	done chan struct{} // done is closed on unlock.
+	lost chan struct{} // lost is closed once the lock is lost.
+}
+
+func (l *redisLocker) TryLock(name string) (Lock, bool, error) {
+	key := redisLockPrefix + name
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, false, err
+	}
+	token := hex.EncodeToString(b)
+
+	reply, err := l.client.Do("SET", key, token, "NX", "PX", strconv.FormatInt(redisLockTTL.Milliseconds(), 10))
+	if err != nil {
+		return nil, false, fmt.Errorf("acquiring lock %s: %w", name, err)
+	}
+	if reply == nil {
+		return nil, false, nil
+	}
+
+	lock := &redisLock{
+		client: l.client,
+		logger: l.logger,
+		key:    key,
+		token:  token,
+		done:   make(chan struct{}),
+		lost:   make(chan struct{}),
+	}
+	go lock.refresh()
+
+	return lock, true, nil
+}
+
+// refresh extends the expiry of the lock until it is unlocked. The lock is
+// considered lost once it is held by someone else, or could not be refreshed before it expired.
+func (l *redisLock) refresh() {
+	ticker := time.NewTicker(redisLockTTL / 3)
+	defer ticker.Stop()
+
+	ttl := strconv.FormatInt(redisLockTTL.Milliseconds(), 10)
+	refreshed := time.Now()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.done:
+			return
+		}
+
+		reply, err := l.client.Do("EVAL", redisRefreshScript, "1", l.key, l.token, ttl)
+		switch {
+		case err != nil:
+			l.logger.Printf("Error refreshing lock %s: %v", l.key, err)
+			if time.Since(refreshed) < redisLockTTL {
+				continue
+			}
+		case reply != int64(0):
+			refreshed = time.Now()
+			continue
+		}
+
+		l.logger.Printf("Lost lock %s", l.key)
+		close(l.lost)
+		return
+	}
+}
+
+func (l *redisLock) Unlock() {
+	close(l.done)
+	if _, err := l.client.Do("EVAL", redisUnlockScript, "1", l.key, l.token); err != nil {
+		l.logger.Printf("Error releasing lock %s: %v", l.key, err)
+	}
+}
+
+func (l *redisLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// fileLocker is a [Locker] backed by advisory file locks in a directory, shared by all processes
+// using the same directory, including replicas on other hosts if the filesystem supports locking across them.
+// Locks are released by the operating system when their holder exits.
+type fileLocker struct {
+	dir string
+}
+
+func (l *fileLocker) TryLock(name string) (Lock, bool, error) {
+	f, err := os.OpenFile(filepath.Join(l.dir, "."+name+".lock"), os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ok, err := tryFlock(f)
+	if err != nil || !ok {
+		f.Close()
+		return nil, false, err
+	}
+
+	return unlockFunc(func() { f.Close() }), true, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel is the verbosity of the logs, changeable at runtime. It implements [flag.Value].
+type LogLevel string
+
+const (
+	LogDebug LogLevel = "debug" // LogDebug adds troubleshooting details, such as the parts of multipart requests.
+	LogInfo  LogLevel = "info"  // LogInfo logs requests and successful operations.
+	LogWarn  LogLevel = "warn"  // LogWarn only logs errors, warnings and state changes of the server.
+)
+
+func (l *LogLevel) String() string {
+	return string(*l)
+}
+
+func (l *LogLevel) Set(v string) error {
+	switch LogLevel(v) {
+	case LogDebug, LogInfo, LogWarn:
+		*l = LogLevel(v)
+		return nil
+	default:
+		return fmt.Errorf("unknown log level %q, expected one of debug, info or warn", v)
+	}
+}
+
+// rank orders log levels by decreasing verbosity.
+func (l LogLevel) rank() int {
+	switch l {
+	case LogDebug:
+		return 0
+	case LogWarn:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// levelWriter is the output of the logger of a server, holding the log level in effect, so that everything
+// logging through the logger follows the level of its server.
+type levelWriter struct {
+	io.Writer
+	level atomic.Value // level holds the LogLevel in effect, changed at runtime through the admin API and SIGUSR2.
+}
+
+// withLogLevel returns a logger writing to the output of logger, with its prefix and flags, at the level l.
+func withLogLevel(logger *log.Logger, l LogLevel) *log.Logger {
+	w := &levelWriter{Writer: logger.Writer()}
+	w.level.Store(l)
+	return log.New(w, logger.Prefix(), logger.Flags())
+}
+
+// currentLogLevel returns the log level in effect for logger, [LogInfo] unless set otherwise.
+func currentLogLevel(logger *log.Logger) LogLevel {
+	if w, ok := logger.Writer().(*levelWriter); ok {
+		return w.level.Load().(LogLevel)
+	}
+	return LogInfo
+}
+
+// setLogLevel changes the log level in effect for logger, which must have been created by [withLogLevel].
+func setLogLevel(logger *log.Logger, l LogLevel) {
+	if w, ok := logger.Writer().(*levelWriter); ok {
+		w.level.Store(l)
+	}
+	logger.Printf("Log level set to %s", l)
+}
+
+// logEnabled reports whether messages of level l are logged by logger.
+func logEnabled(logger *log.Logger, l LogLevel) bool {
+	return currentLogLevel(logger).rank() <= l.rank()
+}
+
+// debugf logs a message at the debug level.
+func debugf(logger *log.Logger, format string, v ...any) {
+	if logEnabled(logger, LogDebug) {
+		logger.Printf("DEBUG: "+format, v...)
+	}
+}
+
+// infof logs a message at the info level.
+func infof(logger *log.Logger, format string, v ...any) {
+	if logEnabled(logger, LogInfo) {
+		logger.Printf(format, v...)
+	}
+}
+
+// withAccessLog returns an HTTP handler serving requests with logged, the handler logging
+// requests, when logger logs at the info level and more verbose ones, and with h otherwise.
+func withAccessLog(logger *log.Logger, logged, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if logEnabled(logger, LogInfo) {
+			logged.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// logLevelHandler handles GET and PUT /admin/loglevel, reporting the log level in effect,
+// or setting it to the level in the request body.
+func logLevelHandler(logger *log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			b, err := io.ReadAll(io.LimitReader(r.Body, 64))
+			if err != nil {
+				http.Error(w, "Could not read request body", http.StatusBadRequest)
+				return
+			}
+
+			var l LogLevel
+			if err := l.Set(strings.TrimSpace(string(b))); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid log level: %v", err), http.StatusBadRequest)
+				return
+			}
+			setLogLevel(logger, l)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "%s\n", currentLogLevel(logger))
+	})
+}
+
+// watchLogLevelToggle toggles the log level between debug and configured on every SIGUSR2, until ctx is done.
+// If configured is debug itself, the toggle switches to info.
+func watchLogLevelToggle(ctx context.Context, logger *log.Logger, configured LogLevel) {
+	if configured == LogDebug {
+		configured = LogInfo
+	}
+
+	c := make(chan os.Signal, 1)
+	if !notifyLogLevelToggle(c) {
+		return
+	}
+
+	for {
+		select {
+		case <-c:
+			if currentLogLevel(logger) == LogDebug {
+				setLogLevel(logger, configured)
+			} else {
+				setLogLevel(logger, LogDebug)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
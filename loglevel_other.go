@@ -0,0 +1,10 @@
+//go:build !(linux || darwin)
+
+package main
+
+import "os"
+
+// notifyLogLevelToggle is not supported on this platform, which has no SIGUSR2.
+func notifyLogLevelToggle(c chan<- os.Signal) bool {
+	return false
+}
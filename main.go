@@ -2,132 +2,1162 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"os/signal"
+	"path"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/Gabriel-Ladzaretti/go-multipart/internal/httpx"
 )
 
-// key defines a type for context keys used in the application.
-type key int
+// Server is an upload server: its configuration and the services it enables, set up by [newServer]. Servers
+// only share what is process-wide by nature, the runtime limits, the custom MIME types and the [expvar] metrics,
+// so a process, such as a test binary, may run several of them.
+type Server struct {
+	config  Config
+	logger  *log.Logger     // logger logs at the level of the server, see [withLogLevel].
+	healthy atomic.Bool     // healthy is reported by the health checks, set once serving and cleared on shutdown.
+	metrics *requestMetrics // metrics count the requests served.
 
-const (
-	requestIDKey key = 0 // requestIDKey is used to store the request ID in the context.
-)
+	publisher    EventPublisher     // publisher publishes upload lifecycle events.
+	geo          *GeoIP             // geo enriches access logs with client geolocation, nil if disabled.
+	coldTier     *ColdTier          // coldTier archives idle files to cold storage, nil if disabled.
+	sftpRelay    *SFTPRelay         // sftpRelay copies stored files to a remote SFTP host, nil if disabled.
+	disk         *DiskMonitor       // disk tracks the free space of the upload directory, nil if disabled.
+	cluster      *redisClient       // cluster coordinates server replicas through Redis, nil if disabled.
+	leaderLocker Locker             // leaderLocker elects the replica running background jobs, nil if every replica runs them.
+	backup       *Backup            // backup periodically backs up the upload directory, nil if disabled.
+	mqttIngester *MQTTIngester      // mqttIngester stores messages received from an MQTT broker, nil if disabled.
+	urlIngester  *URLIngester       // urlIngester fetches the files whose URLs are received from a queue, nil if disabled.
+	signingKey   ed25519.PrivateKey // signingKey signs the manifests served, nil if signing is disabled.
+	keyring      *Keyring           // keyring verifies the detached signatures of uploads, nil if verification is disabled.
+	fileSigner   *Minisigner        // fileSigner signs stored files, nil if signing is disabled.
+	maintenance  *JobRunner         // maintenance runs the passes of background maintenance jobs at a lowered priority.
+	dedup        *Deduplicator      // dedup coalesces identical uploads arriving within a window, nil if disabled.
+	memoryBudget *MemoryBudget      // memoryBudget bounds the memory of all uploads buffering files, nil if unbounded.
+	usage        *UsageIndex        // usage reports the storage used per bucket and tenant through the admin API, nil if it is disabled.
+	scrubber     *Scrubber          // scrubber verifies stored files against their checksums, nil if disabled.
+	alerter      *Alerter           // alerter notifies a webhook of high error rates and disk usage, nil if disabled.
+	shutdown     ShutdownHooks      // shutdown runs the cleanup of subsystems once the HTTP server shut down.
+	replays      CounterStore       // replays counts the uses of HMAC signatures to reject replays, nil if signing is disabled.
+	pruner       *DirPruner         // pruner removes the directories emptied by deletes and purges, nil if they are kept.
+	indexes      *FileIndexes       // indexes hold the in-memory indexes of the metadata of the stored files.
+	locks        *FileLocks         // locks serialize the downloads and patches of each stored file.
+	outbound     *Outbound          // outbound holds the settings of the outbound connections of the server.
+}
 
-var (
-	config  Config      // config holds the configuration settings for the application.
-	logger  *log.Logger // logger is the default logger used.
-	healthy int32       // healthy indicates the health status of the application.
-)
+// newServer performs the necessary checks of config and sets up the server it configures, with the services it
+// enables, logging to the output of logger at the configured level. It fails with a [startupError] if any of
+// them fails.
+func newServer(logger *log.Logger, config Config) (*Server, error) {
+	logger = withLogLevel(logger, config.logLevel)
+	applyResourceLimits(logger, &config, detectResourceLimits())
+
+	if problems := config.validate(); len(problems) > 0 {
+		return nil, &startupError{Stage: "config", Message: "Invalid configuration", Problems: problems}
+	}
+	outbound, err := newOutbound(config)
+	if err != nil {
+		return nil, &startupError{Stage: "outbound", Message: "Error configuring outbound connections", Err: err}
+	}
+	if config.outboundInsecureSkipVerify {
+		logger.Printf("Warning: certificates of outbound TLS connections are not verified, -outbound-insecure-skip-verify is for labs only")
+	}
+	if config.ioUring {
+		if err := probeUring(config.dir); err != nil {
+			logger.Printf("Warning: io_uring writes unavailable, using the standard write path: %v", err)
+			config.ioUring = false
+		}
+	}
+
+	if config.mimeTypes != "" {
+		if err := loadMIMETypes(config.mimeTypes); err != nil {
+			return nil, &startupError{Stage: "mime-types", Message: "Error loading MIME types", Err: err}
+		}
+	}
+
+	// Transactions interrupted by a crash leave their staged files behind
+	dirs := []string{config.dir}
+	buckets := newBuckets(config.dir, logger)
+	list, _ := buckets.list()
+	for _, b := range list {
+		dirs = append(dirs, buckets.path(b.Name))
+	}
+	for _, dir := range dirs {
+		if err := removeStaleTransactions(dir); err != nil {
+			logger.Printf("Error removing stale transactions: %v", err)
+		}
+	}
+
+	s := &Server{config: config, logger: logger, metrics: &requestMetrics{start: time.Now()}, outbound: outbound}
+	s.pruner = newDirPruner(logger, config.dir, config.emptyDirKeepDepth)
+	s.indexes = newFileIndexes()
+	s.locks = newFileLocks()
+
+	s.publisher, err = newEventPublisher(config, outbound, logger)
+	if err != nil {
+		return nil, &startupError{Stage: "events", Message: "Error configuring event publishing", Err: err}
+	}
+	s.shutdown.register("event publisher", func(context.Context) error { return s.publisher.Close() })
 
-// mustInitialize sets up the configuration and performs necessary checks.
-// Logs any errors and exits if encountered.
-func mustInitialize() {
-	logger = log.New(os.Stdout, "http: ", log.LstdFlags)
+	s.geo, err = newGeoIP(config.geoIPCountryDB, config.geoIPASNDB)
+	if err != nil {
+		return nil, &startupError{Stage: "geoip", Message: "Error loading GeoIP databases", Err: err}
+	}
 
-	config = newConfig()
+	s.coldTier, err = newColdTier(config, outbound, s.indexes, logger)
+	if err != nil {
+		return nil, &startupError{Stage: "tiering", Message: "Error configuring storage tiering", Err: err}
+	}
 
-	fi, err := os.Stat(config.dir)
+	s.backup, err = newBackup(config, outbound, logger)
 	if err != nil {
-		logger.Fatalf("Error checking configured directory: %v", err)
+		return nil, &startupError{Stage: "backup", Message: "Error configuring backups", Err: err}
 	}
 
-	if !fi.IsDir() {
-		logger.Fatalf("Configured path is not a directory: %s", config.dir)
+	s.sftpRelay, err = newSFTPRelay(config, outbound, logger)
+	if err != nil {
+		return nil, &startupError{Stage: "sftp-relay", Message: "Error configuring the SFTP relay", Err: err}
+	}
+
+	if config.signingKey != "" {
+		s.signingKey, err = loadSigningKey(config.signingKey)
+		if err != nil {
+			return nil, &startupError{Stage: "signing-key", Message: "Error loading signing key", Err: err}
+		}
+	}
+
+	if config.signFiles {
+		if s.signingKey == nil {
+			return nil, &startupError{Stage: "signing-key", Message: "Signing files requires a signing key", Err: errors.New("no signing key")}
+		}
+		s.fileSigner = newMinisigner(s.signingKey)
+	}
+
+	if config.gpgKeyring != "" {
+		s.keyring, err = loadKeyring(config.gpgKeyring)
+		if err != nil {
+			return nil, &startupError{Stage: "gpg-keyring", Message: "Error loading GPG keyring", Err: err}
+		}
+	}
+
+	s.dedup = newDeduplicator(config, logger)
+	s.memoryBudget = newMemoryBudget(config)
+
+	// Ingested files are stored like uploads, so the services of uploads are set up first
+	s.mqttIngester, err = newMQTTIngester(config, s.uploadStorage(config.dir), s.publisher, logger)
+	if err != nil {
+		return nil, &startupError{Stage: "mqtt", Message: "Error configuring MQTT ingestion", Err: err}
 	}
+
+	s.urlIngester, err = newURLIngester(config, s.uploadStorage(config.dir), s.publisher, logger)
+	if err != nil {
+		return nil, &startupError{Stage: "ingest", Message: "Error configuring URL ingestion", Err: err}
+	}
+
+	if config.redisAddr != "" {
+		s.cluster, err = newRedisClient(config.redisAddr, s.outbound)
+		if err != nil {
+			return nil, &startupError{Stage: "redis", Message: "Error configuring redis", Err: err}
+		}
+		s.shutdown.register("redis", func(context.Context) error { return s.cluster.Close() })
+	}
+
+	if config.hmacSecret != "" {
+		s.replays = s.counterStore()
+	}
+
+	s.leaderLocker, err = newLeaderLocker(config, s.cluster, logger)
+	if err != nil {
+		return nil, &startupError{Stage: "leader-election", Message: "Error configuring leader election", Err: err}
+	}
+
+	if config.minFreeSpace > 0 {
+		s.disk, err = newDiskMonitor(config.dir, logger)
+		if err != nil {
+			return nil, &startupError{Stage: "disk", Message: "Error checking free disk space", Err: err}
+		}
+	}
+
+	s.maintenance = newJobRunner(config, logger)
+	if config.adminToken != "" {
+		s.usage = newUsageIndex(logger, config)
+	}
+
+	s.alerter, err = newAlerter(config, outbound, logger)
+	if err != nil {
+		return nil, &startupError{Stage: "alerting", Message: "Error configuring alerting", Err: err}
+	}
+
+	s.scrubber, err = newScrubber(config, s.backup, s.alerter, s.indexes, logger)
+	if err != nil {
+		return nil, &startupError{Stage: "scrub", Message: "Error configuring scrubbing", Err: err}
+	}
+
+	return s, nil
 }
 
+// main runs the subcommand named by the first argument, see [subcommands], or serve if it is a flag.
 func main() {
-	mustInitialize()
+	args := os.Args[1:]
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		os.Exit(serveMain(args))
+	}
+	if args[0] == "help" {
+		fmt.Printf("Usage: %s <command> [flags]\n\n", os.Args[0])
+		printSubcommands(os.Stdout)
+		os.Exit(0)
+	}
+
+	cmd, ok := lookupSubcommand(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		printSubcommands(os.Stderr)
+		os.Exit(2)
+	}
+	os.Exit(cmd.run(args[1:]))
+}
+
+// serveMain implements the serve subcommand, running the server until it is signaled to shut down.
+func serveMain(args []string) int {
+	config, err := newConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		return 2 // reported along with the usage by the flag set
+	}
+
+	s, err := newServer(log.New(os.Stdout, "http: ", log.LstdFlags), config)
+	if err != nil {
+		reportStartupFailure(log.New(os.Stdout, "http: ", log.LstdFlags), config.terminationLog, err)
+		return 1
+	}
+	logger, config := s.logger, s.config
 
 	logger.Printf("Initialization completed successfully; Server config: %s", config)
 
-	srv := newServer(logger, config, nil)
+	if config.chaos {
+		logger.Println("WARNING: chaos mode is enabled, requests will be delayed, failed and dropped at random")
+	}
 
 	httpServer := &http.Server{
 		Addr:         config.listenAddr,
-		Handler:      srv,
+		Handler:      s.handler(nil),
 		ErrorLog:     logger,
 		ReadTimeout:  config.readTimeout,
 		WriteTimeout: config.writeTimeout,
 		IdleTimeout:  config.idleTimeout,
 	}
 
-	ctx := context.Background()
-	run(ctx, logger, httpServer)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.start(ctx)
+
+	var opsDone <-chan struct{}
+	if config.opsAddr != "" {
+		var err error
+		if opsDone, err = serveOps(ctx, logger, config.listenNetwork, config.opsAddr, s.opsHandler()); err != nil {
+			reportStartupFailure(logger, config.terminationLog, &startupError{Stage: "ops-listener", Message: "Error listening on ops address", Err: err})
+			return 1
+		}
+		s.shutdown.register("ops server", func(ctx context.Context) error { return waitDone(ctx, opsDone) })
+	}
+
+	s.healthy.Store(true)
+	logEvent(logger, newStartupEvent(config, s.coldTier))
+
+	sig, err := httpx.Run(ctx, logger, httpServer, httpx.Options{
+		Network:         config.listenNetwork,
+		ShutdownTimeout: config.shutdownTimeout,
+		DrainDelay:      config.drainDelay,
+		OnShutdown:      func() { s.healthy.Store(false) },
+	})
+	if err != nil {
+		logger.Printf("Error running server: %v", err)
+	}
+
+	// Subsystems stop once ctx is done, the hooks wait for them and release what they hold
+	cancel()
+	cleanupErr := s.shutdown.run(logger, config.shutdownTimeout)
+
+	reason := fmt.Sprintf("Shut down on %v", sig)
+	if err != nil {
+		reason = err.Error()
+	}
+	if cleanupErr != nil {
+		reason += fmt.Sprintf(", cleanup failed: %v", cleanupErr)
+	}
+	writeTerminationLog(logger, config.terminationLog, reason)
+
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// start starts the background jobs and monitors of s, which run until ctx is done. Stopping them is waited
+// for by the shutdown hooks of s.
+func (s *Server) start(ctx context.Context) {
+	logger, config := s.logger, s.config
+
+	// Stopping the background jobs releases leadership for another replica to take over
+	jobsDone := make(chan struct{})
+	go func() {
+		defer close(jobsDone)
+		if s.leaderLocker != nil {
+			runAsLeader(ctx, logger, s.leaderLocker, s.runJobs)
+		} else {
+			s.runJobs(ctx)
+		}
+	}()
+	s.shutdown.register("background jobs", func(ctx context.Context) error { return waitDone(ctx, jobsDone) })
+
+	if s.disk != nil {
+		go s.disk.run(ctx)
+	}
+
+	if s.alerter != nil {
+		go s.alerter.run(ctx)
+	}
+
+	go watchLogLevelToggle(ctx, logger, config.logLevel)
+
+	// Replicas compete for queued messages, so every one of them consumes the queue
+	if s.urlIngester != nil {
+		go s.urlIngester.run(ctx)
+	}
+}
+
+// writeTerminationLog writes the reason the server terminated to path, which is only done if path exists,
+// e.g. as the termination message file of a Kubernetes container.
+func writeTerminationLog(logger *log.Logger, path, reason string) {
+	if path == "" {
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		logger.Printf("Error opening termination log: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, reason); err != nil {
+		logger.Printf("Error writing termination log: %v", err)
+	}
+}
+
+// runJobs runs the background jobs maintaining the upload directory of s until ctx is done.
+func (s *Server) runJobs(ctx context.Context) {
+	logger, config, jobs := s.logger, s.config, s.maintenance
+	var wg sync.WaitGroup
+
+	if config.trashRetention > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runTrashPurger(ctx, logger, jobs, config.dir, config.trashRetention, s.pruner)
+		}()
+	}
+
+	if s.coldTier != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.coldTier.run(ctx, jobs)
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		newBuckets(config.dir, logger).runTrashPurger(ctx, jobs, s.pruner)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		runExpiryPurger(ctx, logger, jobs, config.dir, s.coldTier, newBuckets(config.dir, logger), s.pruner, s.indexes)
+	}()
+
+	if s.backup != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.backup.run(ctx, jobs)
+		}()
+	}
+
+	if s.sftpRelay != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.sftpRelay.run(ctx)
+		}()
+	}
+
+	if s.usage != nil && config.usageInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.usage.run(ctx, jobs, config.usageInterval)
+		}()
+	}
+
+	if s.scrubber != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.scrubber.run(ctx, jobs)
+		}()
+	}
+
+	// Ingesting on the leader only keeps replicas from storing every message once each
+	if s.mqttIngester != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.mqttIngester.run(ctx)
+		}()
+	}
+
+	wg.Wait()
 }
 
 // Config holds the configuration settings for the application.
 type Config struct {
-	dir             string        // dir is the directory where files are saved.
-	listenAddr      string        // listenAddr on which the server listens.
-	formUploadField string        // formUploadField is the name of the form field used for file uploads.
-	uploadEndpoint  string        // uploadEndpoint is the path the to file upload endpoint.
-	maxInMemorySize int64         // maxInMemorySize bytes of the file parts are stored in memory, with the remainder stored on disk in temporary files.
-	readTimeout     time.Duration // readTimeout is the timeout value for reading the request
-	writeTimeout    time.Duration // writeTimeout is the timeout value for writing the response
-	idleTimeout     time.Duration // idleTimeout is the timeout for keeping idle connections
+	dir              string        // dir is the directory where files are saved.
+	listenAddr       string        // listenAddr on which the server listens.
+	listenNetwork    string        // listenNetwork is the network listenAddr and opsAddr are bound on: tcp, tcp4 or tcp6.
+	formUploadField  string        // formUploadField is the name of the form field used for file uploads.
+	uploadEndpoint   string        // uploadEndpoint is the path the to file upload endpoint.
+	maxInMemorySize  int64         // maxInMemorySize bytes of the file parts are stored in memory, with the remainder stored on disk in temporary files.
+	memoryBudget     int64         // memoryBudget is the number of bytes all uploads together may hold in memory, unbounded if 0.
+	memoryBudgetWait time.Duration // memoryBudgetWait is how long uploads queue for memory before they are rejected.
+	readTimeout      time.Duration // readTimeout is the timeout value for reading the request
+	writeTimeout     time.Duration // writeTimeout is the timeout value for writing the response
+	idleTimeout      time.Duration // idleTimeout is the timeout for keeping idle connections
+	shutdownTimeout  time.Duration // shutdownTimeout is the time in-flight requests are given to complete on shutdown
+	drainDelay       time.Duration // drainDelay is the time readiness checks fail for before shutdown begins
+	terminationLog   string        // terminationLog is the file the reason for terminating is written to, if it exists
+
+	eventsNATSServers string // eventsNATSServers is a comma separated list of NATS servers upload events are published to.
+	eventsSubject     string // eventsSubject is the NATS subject upload events are published on.
+	eventsEncoding    string // eventsEncoding is the encoding of published events, either "json" or "text".
+
+	geoIPCountryDB string // geoIPCountryDB is the path to a MaxMind Country or City database.
+	geoIPASNDB     string // geoIPASNDB is the path to a MaxMind ASN database.
+
+	authToken   string        // authToken is the bearer token required for uploads, authentication is disabled if empty.
+	tarpit      bool          // tarpit enables faking successful uploads for unauthorized upload attempts.
+	tarpitDelay time.Duration // tarpitDelay is how long unauthorized upload attempts are stalled for in tarpit mode.
+	hmacSecret  string        // hmacSecret is the shared secret HMAC signed requests are verified with, signing is disabled if empty.
+	hmacMaxSkew time.Duration // hmacMaxSkew is the maximum allowed difference between a signed request's timestamp and the server time.
+	hmacMaxBody int64         // hmacMaxBody is the maximum size in bytes of a signed request body, unlimited if 0.
+
+	maxMetaHeaders int // maxMetaHeaders is the maximum number of X-Upload-Meta-* headers accepted per upload.
+	maxMetaSize    int // maxMetaSize is the maximum combined size in bytes of the X-Upload-Meta-* headers of an upload.
+
+	chaos               bool          // chaos enables fault injection for testing clients.
+	chaosMaxLatency     time.Duration // chaosMaxLatency is the maximum latency injected per request in chaos mode.
+	chaosErrorRate      float64       // chaosErrorRate is the probability of a request failing with a 5xx error in chaos mode.
+	chaosDisconnectRate float64       // chaosDisconnectRate is the probability of a request's connection being dropped in chaos mode.
+
+	recordDir     string // recordDir is the directory raw requests of failed uploads are recorded to, recording is disabled if empty.
+	recordMaxBody int64  // recordMaxBody is the maximum number of body bytes recorded per failed upload.
+
+	multipartLimits MultipartLimits // multipartLimits bounds the structure of accepted multipart payloads.
+
+	trashRetention    time.Duration // trashRetention is how long deleted files are kept for restoring, 0 deletes files immediately.
+	emptyDirKeepDepth int           // emptyDirKeepDepth is the depth below dir down to which emptied directories are kept, all are if negative.
+
+	maxFileSize       int64  // maxFileSize is the maximum size in bytes of an uploaded file, 0 means unlimited.
+	maxJSONUploadSize int64  // maxJSONUploadSize is the maximum size in bytes of a file uploaded as JSON.
+	allowedExtensions string // allowedExtensions is a comma separated list of accepted file extensions, all are accepted if empty.
+	allowedTypes      string // allowedTypes is a comma separated list of accepted sniffed content type patterns, all are accepted if empty.
+	mimeTypes         string // mimeTypes is the path to a mime.types file of custom extension to content type mappings.
+
+	typeMismatch MismatchPolicy // typeMismatch is what happens to uploads whose declared content type does not match their content.
+
+	batchWorkers  int // batchWorkers is the number of files of a batch upload stored at once.
+	batchMaxFiles int // batchMaxFiles is the maximum number of files of a batch upload, 0 means unlimited.
+
+	distributionMinSize int64  // distributionMinSize is the size in bytes stored files must have to be offered as torrents and metalinks, 0 disables them.
+	torrentTrackers     string // torrentTrackers is a comma separated list of the announce URLs of torrents.
+
+	maxFilenameLength     int               // maxFilenameLength is the maximum length of file names in bytes, 0 means unlimited.
+	filenameChars         CharClasses       // filenameChars restricts file names to character classes, any character is accepted if empty.
+	filenameExtraChars    string            // filenameExtraChars holds the characters accepted in file names besides filenameChars.
+	filenameNormalization NormalizationForm // filenameNormalization is the Unicode normalization form file names are stored in.
+
+	filterCmds    stringList    // filterCmds are the commands of the external upload filters, run in order.
+	filterTimeout time.Duration // filterTimeout is the time an external upload filter is given to decide.
+
+	stripEXIF bool // stripEXIF enables removing Exif, GPS and textual metadata from uploaded JPEG and PNG images.
+
+	sanitizeCmd        string        // sanitizeCmd is the command documents are sanitized with, sanitization is disabled if empty.
+	sanitizeExtensions string        // sanitizeExtensions is a comma separated list of the extensions of documents to sanitize.
+	sanitizeTimeout    time.Duration // sanitizeTimeout is the time the sanitizer command is given per document.
+
+	tierColdAfter  time.Duration // tierColdAfter is how long a file must be idle for before it is archived to the cold tier, 0 disables tiering.
+	tierS3Endpoint string        // tierS3Endpoint is the URL of the S3 compatible service of the cold tier.
+	tierS3Region   string        // tierS3Region is the region requests to the cold tier are signed for.
+	tierS3Bucket   string        // tierS3Bucket is the bucket files are archived to.
+	tierS3Prefix   string        // tierS3Prefix is prepended to the object keys of archived files.
+	tierPresignTTL time.Duration // tierPresignTTL is how long the presigned URLs downloads of archived files are redirected to are valid, 0 disables redirects.
+
+	minFreeSpace int64 // minFreeSpace is the free disk space in bytes below which uploads are rejected, 0 disables the check.
+
+	fsync       FsyncPolicy // fsync controls whether stored files are flushed to disk before success is reported.
+	ioUring     bool        // ioUring writes large files with io_uring, experimental, see uring_linux.go.
+	hashOffload bool        // hashOffload hashes stored files in a goroutine of their own, overlapping hashing with writing them to disk.
+
+	redisAddr string // redisAddr is the Redis server coordinating server replicas sharing the upload directory, disabled if empty.
+
+	rateLimit       int64         // rateLimit is the number of requests a client may make per rateLimitWindow, 0 means unlimited.
+	rateLimitWindow time.Duration // rateLimitWindow is the window requests are counted in for rate limiting.
+	quota           int64         // quota is the number of bytes a client may upload per quotaWindow, 0 means unlimited.
+	quotaWindow     time.Duration // quotaWindow is the window uploaded bytes are counted in for quotas.
+
+	leaderElection string // leaderElection is how the replica running background jobs is elected, one of "none", "file" or "redis".
+
+	backupInterval time.Duration // backupInterval is the time between backups, 0 disables backups.
+	backupDir      string        // backupDir is the directory metadata snapshots are written to.
+	backupKeep     int           // backupKeep is the number of snapshots kept.
+	backupS3Bucket string        // backupS3Bucket is the bucket the upload directory is synced to, syncing is disabled if empty.
+	backupS3Prefix string        // backupS3Prefix is prepended to the object keys of backed up files.
+
+	sftpHost       string // sftpHost is the "[user@]host[:port]" of the SFTP host stored files are relayed to, relaying is disabled if empty.
+	sftpKey        string // sftpKey is the private key file authenticating with the SFTP host, the default identities of ssh if empty.
+	sftpDir        string // sftpDir is the remote directory files are relayed to.
+	sftpKnownHosts string // sftpKnownHosts is the file of the trusted SFTP host keys, the known hosts of ssh if empty.
+
+	adminToken    string        // adminToken is the bearer token required by the admin API, which is disabled if empty.
+	usageInterval time.Duration // usageInterval is the time between refreshes of the storage usage reported by the admin API, 0 refreshes it on demand only.
+	usageMetaKey  string        // usageMetaKey is the user metadata key storage usage is grouped by, e.g. "tenant", in addition to buckets.
+
+	logLevel LogLevel // logLevel is the initial log level.
+
+	alertWebhook   string        // alertWebhook is the URL alerts are posted to, e.g. a Slack incoming webhook, alerting is disabled if empty.
+	alertWindow    time.Duration // alertWindow is the interval over which error rates are computed and thresholds checked.
+	alertErrorRate float64       // alertErrorRate is the fraction of server errors in a window alerted on, 0 disables it.
+	alertDiskUsage float64       // alertDiskUsage is the disk usage percentage of the upload directory alerted on, 0 disables it.
+
+	backgroundNice        int        // backgroundNice is the nice level of background jobs, 0 leaves it unchanged.
+	backgroundIOPriority  IOPriority // backgroundIOPriority is the I/O priority of background jobs.
+	backgroundConcurrency int        // backgroundConcurrency is the number of background job passes run at once, 0 means unlimited.
+
+	rootMode     RootMode      // rootMode configures what the root path and paths without a route serve.
+	publicDir    string        // publicDir is the directory of the static content served under /static/, disabled if empty.
+	publicMaxAge time.Duration // publicMaxAge is how long clients may cache static content.
+
+	successTemplate ResponseTemplate // successTemplate renders the responses to stored uploads, the built-in response is sent if unset.
+	failureTemplate ResponseTemplate // failureTemplate renders the responses to failed uploads, the built-in response is sent if unset.
+	compat          Compat           // compat adapts the upload endpoint to a browser upload library, see [Compat].
+
+	downloadOffload OffloadMode // downloadOffload configures handing downloads off to the reverse proxy, see [DownloadOffload].
+
+	pipelines Pipelines // pipelines are the post-processing steps run on stored files, by name.
+
+	outboundProxy     string // outboundProxy is the URL of the proxy outbound HTTP requests go through, HTTPS_PROXY and HTTP_PROXY if empty.
+	uploadMethods     string // uploadMethods is a comma separated list of the HTTP methods multipart uploads are accepted with, POST and PUT.
+	callbackAllowlist string // callbackAllowlist is a comma separated list of the URL prefixes uploads may ask to be called back at, callbacks are disabled if empty.
+	trustedProxies    string // trustedProxies is a comma separated list of the addresses and CIDR ranges of the reverse proxies whose forwarding headers are honored.
+
+	outboundCAFile             string // outboundCAFile is a PEM file of the CA certificates outbound TLS connections trust besides the system ones.
+	outboundInsecureSkipVerify bool   // outboundInsecureSkipVerify disables verifying the certificates of outbound TLS connections.
+	outboundTLSMinVersion      string // outboundTLSMinVersion is the minimum TLS version of outbound connections.
+	outboundDNS                string // outboundDNS is the host:port of the DNS server outbound connections resolve hosts with, the system one if empty.
+	outboundHosts              string // outboundHosts is a comma separated list of host=address overrides of outbound connections.
+
+	policy     Policy        // policy authorizes uploads by name, size, type, identity and metadata, see [Policy].
+	opaURL     string        // opaURL is the OPA data API document deciding whether to allow uploads, disabled if empty.
+	opaTimeout time.Duration // opaTimeout is the time OPA is given to decide.
+
+	opsAddr string // opsAddr is the address of the private listener of the health checks, metrics, pprof and admin API, served with the data plane if empty.
+
+	dedupWindow time.Duration // dedupWindow is the time identical uploads are coalesced within, 0 disables deduplication.
+
+	scrubInterval time.Duration // scrubInterval is the time between scrubs of the stored files, 0 disables scrubbing.
+	scrubRate     int64         // scrubRate is the maximum rate in bytes per second files are read at when scrubbing, 0 means unlimited.
+	scrubRepair   bool          // scrubRepair enables repairing corrupted files from the backup replica.
+
+	mqttBroker   string // mqttBroker is the MQTT broker messages are ingested from, as "mqtt://[user:pass@]host:port", disabled if empty.
+	mqttTopics   string // mqttTopics is a comma separated list of the topic filters subscribed to.
+	mqttClientID string // mqttClientID identifies the persistent session with the MQTT broker.
+
+	ingestSQSQueueURL  string        // ingestSQSQueueURL is the SQS queue the URLs of files to fetch are received from, disabled if empty.
+	ingestSQSRegion    string        // ingestSQSRegion is the AWS region of the SQS queue.
+	ingestFetchTimeout time.Duration // ingestFetchTimeout bounds fetching a single file.
+	ingestSchemes      string        // ingestSchemes is a comma separated list of the schemes of the URLs files may be fetched from.
+	ingestPorts        string        // ingestPorts is a comma separated list of the ports of the URLs files may be fetched from, any if empty.
+	ingestAllowPrivate bool          // ingestAllowPrivate allows fetching files from private, loopback and link-local addresses.
+	ingestMaxRedirects int           // ingestMaxRedirects is the number of redirects followed when fetching a file.
+
+	signingKey string // signingKey is the path to the Ed25519 private key manifests are signed with, signing is disabled if empty.
+	signFiles  bool   // signFiles enables signing stored files with signingKey.
+	gpgKeyring string // gpgKeyring is the path to the OpenPGP public keys detached signatures of uploads are verified against.
+
+	corsOrigins string // corsOrigins is a comma separated list of the origins browsers may upload from cross-origin, "*" allows any, disabled if empty.
+
+	options *configSchema // options is the schema the configuration was parsed with, telling where settings came from.
+}
+
+// stringList is a [flag.Value] collecting the values of a repeated flag.
+type stringList []string
+
+func (s *stringList) String() string {
+	return fmt.Sprint([]string(*s))
+}
+
+func (s *stringList) Set(v string) error {
+	if strings.TrimSpace(v) == "" {
+		return fmt.Errorf("empty value")
+	}
+	*s = append(*s, v)
+	return nil
 }
 
 func (c Config) String() string {
 	return fmt.Sprintf(
-		"Config{dir: %s, listenAddr: %s, formUploadField: %s, uploadEndpoint: %s, maxInMemorySize: %dB, readTimeout: %v, writeTimeout: %v, idleTimeout: %v}",
-		c.dir, c.listenAddr, c.formUploadField, c.uploadEndpoint, c.maxInMemorySize, c.readTimeout, c.writeTimeout, c.idleTimeout,
+		"Config{dir: %s, listenAddr: %s, formUploadField: %s, uploadEndpoint: %s, maxInMemorySize: %dB, readTimeout: %v, writeTimeout: %v, idleTimeout: %v, shutdownTimeout: %v, drainDelay: %v, terminationLog: %s, eventsNATSServers: %s, eventsSubject: %s, eventsEncoding: %s, geoIPCountryDB: %s, geoIPASNDB: %s, authToken: %s, tarpit: %t, tarpitDelay: %v, hmacSecret: %s, hmacMaxSkew: %v, hmacMaxBody: %dB, maxMetaHeaders: %d, maxMetaSize: %dB, chaos: %t, chaosMaxLatency: %v, chaosErrorRate: %g, chaosDisconnectRate: %g, recordDir: %s, recordMaxBody: %dB, multipartLimits: %+v, trashRetention: %v, emptyDirKeepDepth: %d, maxFileSize: %dB, maxJSONUploadSize: %dB, allowedExtensions: %s, allowedTypes: %s, mimeTypes: %s, filterCmds: %q, filterTimeout: %v, stripEXIF: %t, sanitizeCmd: %s, sanitizeExtensions: %s, sanitizeTimeout: %v, tierColdAfter: %v, tierS3Endpoint: %s, tierS3Region: %s, tierS3Bucket: %s, tierS3Prefix: %s, minFreeSpace: %dB, fsync: %s, redisAddr: %s, rateLimit: %d, rateLimitWindow: %v, quota: %dB, quotaWindow: %v, leaderElection: %s, mqttBroker: %s, mqttTopics: %s, mqttClientID: %s, ingestSQSQueueURL: %s, ingestSQSRegion: %s, ingestFetchTimeout: %v, signingKey: %s, signFiles: %t, gpgKeyring: %s, corsOrigins: %s, trustedProxies: %s, adminToken: %s, backupInterval: %v, backupDir: %s, backupKeep: %d, backupS3Bucket: %s, backupS3Prefix: %s, logLevel: %s, alertWebhook: %s, alertWindow: %v, alertErrorRate: %g, alertDiskUsage: %g, backgroundNice: %d, backgroundIOPriority: %s, backgroundConcurrency: %d, scrubInterval: %v, scrubRate: %dB/s, scrubRepair: %t, dedupWindow: %v, maxFilenameLength: %d, filenameChars: %s, filenameExtraChars: %q, filenameNormalization: %s, rootMode: %s, publicDir: %s, publicMaxAge: %v, successTemplate: %s, failureTemplate: %s, compat: %s, downloadOffload: %s, tierPresignTTL: %v, pipelines: %s, opsAddr: %s, policy: %s, opaURL: %s, opaTimeout: %v, callbackAllowlist: %s, memoryBudget: %dB, memoryBudgetWait: %v, uploadMethods: %s, usageInterval: %v, usageMetaKey: %s, outboundProxy: %s, ingestSchemes: %s, ingestPorts: %s, ingestAllowPrivate: %t, ingestMaxRedirects: %d, typeMismatch: %s, batchWorkers: %d, batchMaxFiles: %d, distributionMinSize: %dB, torrentTrackers: %s, listenNetwork: %s, outboundCAFile: %s, outboundInsecureSkipVerify: %t, outboundTLSMinVersion: %s, outboundDNS: %s, outboundHosts: %s, hashOffload: %t, ioUring: %t, sftpHost: %s, sftpKey: %s, sftpDir: %s, sftpKnownHosts: %s}",
+		c.dir, c.listenAddr, c.formUploadField, c.uploadEndpoint, c.maxInMemorySize, c.readTimeout, c.writeTimeout, c.idleTimeout, c.shutdownTimeout, c.drainDelay, c.terminationLog, c.eventsNATSServers, c.eventsSubject, c.eventsEncoding, c.geoIPCountryDB, c.geoIPASNDB, redact(c.authToken), c.tarpit, c.tarpitDelay, redact(c.hmacSecret), c.hmacMaxSkew, c.hmacMaxBody, c.maxMetaHeaders, c.maxMetaSize, c.chaos, c.chaosMaxLatency, c.chaosErrorRate, c.chaosDisconnectRate, c.recordDir, c.recordMaxBody, c.multipartLimits, c.trashRetention, c.emptyDirKeepDepth, c.maxFileSize, c.maxJSONUploadSize, c.allowedExtensions, c.allowedTypes, c.mimeTypes, []string(c.filterCmds), c.filterTimeout, c.stripEXIF, c.sanitizeCmd, c.sanitizeExtensions, c.sanitizeTimeout, c.tierColdAfter, c.tierS3Endpoint, c.tierS3Region, c.tierS3Bucket, c.tierS3Prefix, c.minFreeSpace, c.fsync, redactURL(c.redisAddr), c.rateLimit, c.rateLimitWindow, c.quota, c.quotaWindow, c.leaderElection, redactURL(c.mqttBroker), c.mqttTopics, c.mqttClientID, c.ingestSQSQueueURL, c.ingestSQSRegion, c.ingestFetchTimeout, c.signingKey, c.signFiles, c.gpgKeyring, c.corsOrigins, c.trustedProxies, redact(c.adminToken), c.backupInterval, c.backupDir, c.backupKeep, c.backupS3Bucket, c.backupS3Prefix, c.logLevel, redact(c.alertWebhook), c.alertWindow, c.alertErrorRate, c.alertDiskUsage, c.backgroundNice, c.backgroundIOPriority, c.backgroundConcurrency, c.scrubInterval, c.scrubRate, c.scrubRepair, c.dedupWindow, c.maxFilenameLength, c.filenameChars, c.filenameExtraChars, c.filenameNormalization, c.rootMode, c.publicDir, c.publicMaxAge, c.successTemplate, c.failureTemplate, c.compat, c.downloadOffload, c.tierPresignTTL, c.pipelines, c.opsAddr, c.policy, redactURL(c.opaURL), c.opaTimeout, c.callbackAllowlist, c.memoryBudget, c.memoryBudgetWait, c.uploadMethods, c.usageInterval, c.usageMetaKey, redactURL(c.outboundProxy), c.ingestSchemes, c.ingestPorts, c.ingestAllowPrivate, c.ingestMaxRedirects, c.typeMismatch, c.batchWorkers, c.batchMaxFiles, c.distributionMinSize, c.torrentTrackers, c.listenNetwork, c.outboundCAFile, c.outboundInsecureSkipVerify, c.outboundTLSMinVersion, c.outboundDNS, c.outboundHosts, c.hashOffload, c.ioUring, c.sftpHost, c.sftpKey, c.sftpDir, c.sftpKnownHosts,
 	)
 }
 
-// newConfig parses command-line flags and returns a Config instance.
-func newConfig() Config {
+// redact hides a secret configuration value, reporting only whether it is set.
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "<redacted>"
+}
+
+// redactURL hides the password of a URL configuration value, if any.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	return u.Redacted()
+}
+
+// newConfig parses the server flags in args, and the environment variables setting them, with a flag set of its
+// own, and returns a Config instance. It returns the error parsing args failed with, which the flag set reported
+// along with the usage, [flag.ErrHelp] if the help was asked for.
+func newConfig(args []string) (Config, error) {
 	c := Config{}
 
-	flag.StringVar(&c.dir, "dir", "/tmp", "A path to the directory where files are saved to (default: '/tmp').")
-	flag.StringVar(&c.listenAddr, "listen-addr", ":3000", "Address for the server to listen on, in the form 'host:port'. (default: ':3000').")
-	flag.StringVar(&c.formUploadField, "form-field", "upload", "The name of the form field used for file uploads (default: 'upload').")
-	flag.StringVar(&c.uploadEndpoint, "upload-endpoint", "/upload", "The path to the upload API endpoint (default: '/upload').")
-	flag.Int64Var(&c.maxInMemorySize, "max-size", 10, "The maximum memory size (in megabytes) for storing part files in memory (default: 10).")
-	flag.DurationVar(&c.readTimeout, "read-timeout", 15*time.Second, "Timeout for reading the request (default: '15s').")
-	flag.DurationVar(&c.writeTimeout, "write-timeout", 15*time.Second, "Timeout for writing the response (default: '15s').")
-	flag.DurationVar(&c.idleTimeout, "idle-timeout", 60*time.Second, "Timeout for keeping idle connections (default: '60s').")
+	c.filenameNormalization = NormalizationNFC
+	c.typeMismatch = MismatchWarn
+	c.fsync = FsyncNever
+	c.logLevel = LogInfo
+	c.backgroundIOPriority = IOPriorityLow
+	c.rootMode = RootNotFound
+
+	s := newConfigSchema(flag.NewFlagSet(os.Args[0], flag.ContinueOnError))
+	c.options = s
+
+	s.section("Server")
+	s.StringVar(&c.dir, "dir", "/tmp", "A path to the directory where files are saved to (default: '/tmp').")
+	s.StringVar(&c.listenAddr, "listen-addr", ":3000", "Address for the server to listen on, in the form 'host:port'. (default: ':3000').")
+	s.StringVar(&c.listenNetwork, "listen-network", "tcp", "The network -listen-addr and -ops-addr are bound on, one of 'tcp' (IPv4 and IPv6, dual-stack for an address without host), 'tcp4' (IPv4 only) or 'tcp6' (IPv6 only) (default: 'tcp').")
+	s.StringVar(&c.opsAddr, "ops-addr", "", "Private address serving the health checks, metrics, status, pprof profiles and admin API, which are then no longer served on -listen-addr, e.g. '127.0.0.1:9090' (default: disabled).")
+	s.DurationVar(&c.readTimeout, "read-timeout", 15*time.Second, "Timeout for reading the request (default: '15s').").nonNegative()
+	s.DurationVar(&c.writeTimeout, "write-timeout", 15*time.Second, "Timeout for writing the response (default: '15s').").nonNegative()
+	s.DurationVar(&c.idleTimeout, "idle-timeout", 60*time.Second, "Timeout for keeping idle connections (default: '60s').").nonNegative()
+	s.DurationVar(&c.shutdownTimeout, "shutdown-timeout", 10*time.Second, "Time in-flight requests are given to complete on shutdown (default: '10s').").nonNegative()
+	s.DurationVar(&c.drainDelay, "drain-delay", 0, "Time /readyz fails for after a shutdown signal before the server stops accepting requests, for load balancers to catch up (default: 0).").nonNegative()
+	s.StringVar(&c.terminationLog, "termination-log", "/dev/termination-log", "File the reason for terminating is written to, if it exists (default: '/dev/termination-log').")
+	s.Var(&c.logLevel, "log-level", "Log verbosity, one of 'debug' (adds multipart part details), 'info' (requests and successful operations) or 'warn' (errors only), changeable at runtime through the admin API and SIGUSR2 (default: 'info').")
+	s.StringVar(&c.corsOrigins, "cors-origins", "", "Comma separated list of the origins browsers may upload and poll upload progress from cross-origin, '*' allows any (default: disabled).")
+	s.StringVar(&c.trustedProxies, "trusted-proxies", "", "Comma separated list of the addresses and CIDR ranges of the reverse proxies whose Forwarded or X-Forwarded-Proto and X-Forwarded-Host headers set the scheme and host of the URLs of stored files, e.g. '10.0.0.0/8' (default: none).")
+	s.Var(&c.rootMode, "root", "What the root path serves, one of 'not-found', 'ui' (a built-in upload page), 'dir:<path>' (a static landing page, with its 404.html for missing pages) or 'redirect:<url>' (default: 'not-found').")
+	s.StringVar(&c.publicDir, "public-dir", "", "A directory of static content, such as UI assets and client binaries, served read-only under /static/ (default: disabled).")
+	s.DurationVar(&c.publicMaxAge, "public-max-age", time.Hour, "How long clients may cache static content before revalidating it (default: '1h').").nonNegative()
+	s.StringVar(&c.adminToken, "admin-token", "", "Bearer token required by the admin API, e.g. for managing buckets (default: disabled).")
+
+	s.section("Uploads")
+	s.StringVar(&c.formUploadField, "form-field", "upload", "The name of the form field used for file uploads (default: 'upload').")
+	s.StringVar(&c.uploadEndpoint, "upload-endpoint", "/upload", "The path to the upload API endpoint (default: '/upload').")
+	s.StringVar(&c.uploadMethods, "upload-methods", "POST", "Comma separated list of the HTTP methods multipart uploads are accepted with, POST and PUT, for clients only sending PUT (default: 'POST').")
+	s.Var(&c.compat, "compat", "Adapt the upload endpoint to a browser upload library, one of 'uppy' or 'dropzone', defaulting -form-field to 'file' and answering with the JSON they expect (default: none).")
+	s.Int64Var(&c.maxInMemorySize, "max-size", 10, "The maximum memory size (in megabytes) for storing part files in memory (default: 10).").nonNegative()
+	s.Int64Var(&c.memoryBudget, "memory-budget", 0, "The memory (in megabytes) all concurrent uploads together may hold files in, uploads beyond it queue for -memory-budget-wait, 0 means unbounded (default: a quarter of the container memory limit, if any, otherwise 0).").nonNegative()
+	s.DurationVar(&c.memoryBudgetWait, "memory-budget-wait", 5*time.Second, "How long uploads queue for memory under -memory-budget before they are rejected with 503 Service Unavailable (default: '5s').").nonNegative()
+	s.Int64Var(&c.maxFileSize, "max-file-size", 0, "The maximum size (in megabytes) of an uploaded file, 0 means unlimited (default: 0). Patching a file copies it whole unless the filesystem supports reflinks.").nonNegative()
+	s.Int64Var(&c.maxJSONUploadSize, "max-json-upload-size", 1, "The maximum size (in megabytes) of a file uploaded as base64 encoded JSON (default: 1).").nonNegative()
+	s.IntVar(&c.maxMetaHeaders, "max-meta-headers", 16, "The maximum number of X-Upload-Meta-* headers accepted per upload (default: 16).").nonNegative()
+	s.IntVar(&c.maxMetaSize, "max-meta-size", 4096, "The maximum combined size in bytes of the X-Upload-Meta-* headers of an upload (default: 4096).").nonNegative()
+	s.IntVar(&c.multipartLimits.MaxParts, "multipart-max-parts", 100, "The maximum number of parts of a multipart upload, including nested ones (default: 100).")
+	s.IntVar(&c.multipartLimits.MaxPartHeaderSize, "multipart-max-part-header-size", 8192, "The maximum size in bytes of the headers of a single multipart part (default: 8192).")
+	s.IntVar(&c.multipartLimits.MaxDepth, "multipart-max-depth", 2, "The maximum nesting depth of multipart bodies, 1 allows no nesting (default: 2).")
+	s.IntVar(&c.batchWorkers, "batch-workers", 8, "The number of files of a batch upload stored at once (default: 8).")
+	s.IntVar(&c.batchMaxFiles, "batch-max-files", 100000, "The maximum number of files of a batch upload, 0 means unlimited (default: 100000).").nonNegative()
+	s.StringVar(&c.callbackAllowlist, "callback-allowlist", "", "Comma separated list of the URL prefixes uploads may ask to be notified at once stored, with the callback query parameter, e.g. 'https://hooks.example.com/uploads/' (default: disabled).")
+	s.Var(&c.successTemplate, "success-template", "A text/template file rendering the response bodies of stored uploads, given the request ID, status, stored files and metadata, sent with the content type of its extension (default: built-in).")
+	s.Var(&c.failureTemplate, "failure-template", "A text/template file rendering the response bodies of failed uploads, given the request ID, status, error and metadata, sent with the content type of its extension (default: built-in).")
+	s.DurationVar(&c.dedupWindow, "dedup-window", 0, "The time identical uploads, with the same name, size and content, are coalesced within, answering all with the result of the first, 0 disables deduplication (default: 0).").nonNegative()
+
+	s.section("File names")
+	s.IntVar(&c.maxFilenameLength, "max-filename-length", 0, "The maximum length (in bytes, UTF-8 encoded) of uploaded file names, 0 means unlimited (default: 0).").nonNegative()
+	s.Var(&c.filenameChars, "filename-chars", "Comma separated list of the character classes uploaded file names may hold: alnum (ASCII letters and digits), letter, digit, mark, space, punct and symbol (default: all characters).")
+	s.StringVar(&c.filenameExtraChars, "filename-extra-chars", "", "Characters uploaded file names may hold besides -filename-chars, e.g. '._-' (default: none).")
+	s.Var(&c.filenameNormalization, "filename-normalization", "The Unicode normalization form uploaded file names are stored in, one of none, nfc or nfd (default: nfc).")
+
+	s.section("Validation and processing")
+	s.StringVar(&c.allowedExtensions, "allowed-extensions", "", "Comma separated list of accepted file extensions, e.g. '.png,.jpg' (default: all).")
+	s.StringVar(&c.allowedTypes, "allowed-types", "", "Comma separated list of accepted content types, sniffed from the file content, e.g. 'image/*,application/pdf' (default: all).")
+	s.StringVar(&c.mimeTypes, "mime-types", "", "Path to a mime.types file mapping file extensions to content types, for downloads and for -allowed-types when content sniffing is inconclusive (default: none).")
+	s.Var(&c.typeMismatch, "type-mismatch", "What happens to uploads whose declared content type does not match the type sniffed from their content, one of 'ignore', 'warn' (logged and recorded in the metadata) or 'reject' (default: 'warn').")
+	s.Var(&c.policy, "policy", "A file of rules allowing or denying uploads by name, extension, type, size, client identity and metadata, e.g. 'deny if size > 1GB and ext == .iso unless identity in group ci' (default: none).")
+	s.StringVar(&c.opaURL, "opa-url", "", "URL of the OPA data API document deciding whether to allow uploads, e.g. 'http://localhost:8181/v1/data/usrv/upload' (default: disabled).")
+	s.DurationVar(&c.opaTimeout, "opa-timeout", 2*time.Second, "The time OPA is given to decide on an upload, uploads are rejected once it elapses (default: '2s').").nonNegative()
+	s.Var(&c.filterCmds, "filter-cmd", "Command of an external upload filter speaking the JSON filter protocol, may be repeated (default: none).")
+	s.DurationVar(&c.filterTimeout, "filter-timeout", 10*time.Second, "The time an external upload filter is given to decide (default: '10s').").nonNegative()
+	s.BoolVar(&c.stripEXIF, "strip-exif", false, "Remove Exif, GPS and textual metadata from uploaded JPEG and PNG images (default: false).")
+	s.StringVar(&c.sanitizeCmd, "sanitize-cmd", "", "Command documents are sanitized with, '{in}' and '{out}' are replaced with the original and sanitized document paths (default: disabled).")
+	s.StringVar(&c.sanitizeExtensions, "sanitize-extensions", ".pdf,.doc,.docx,.xls,.xlsx,.ppt,.pptx,.odt,.ods,.odp,.rtf", "Comma separated list of the extensions of documents to sanitize (default: '.pdf,.doc,.docx,.xls,.xlsx,.ppt,.pptx,.odt,.ods,.odp,.rtf').")
+	s.DurationVar(&c.sanitizeTimeout, "sanitize-timeout", 5*time.Minute, "The time the sanitizer command is given per document (default: '5m').").nonNegative()
+	s.Var(&c.pipelines, "pipelines", "A JSON file of the post-processing pipelines of stored files, mapping file name patterns to ordered checksum, scan, thumbnail, extract and webhook steps (default: none).")
+
+	s.section("Authentication and limits")
+	s.StringVar(&c.authToken, "auth-token", "", "Bearer token required for uploads (default: disabled).")
+	s.BoolVar(&c.tarpit, "tarpit", false, "Stall and fake success for unauthorized upload attempts instead of responding with 401 (default: false).")
+	s.DurationVar(&c.tarpitDelay, "tarpit-delay", 10*time.Second, "How long unauthorized upload attempts are stalled for in tarpit mode (default: '10s').").nonNegative()
+	s.StringVar(&c.hmacSecret, "hmac-secret", "", "Shared secret used to verify HMAC signed upload requests (default: disabled).")
+	s.DurationVar(&c.hmacMaxSkew, "hmac-max-skew", 5*time.Minute, "Maximum allowed clock skew of HMAC signed requests (default: '5m').").nonNegative()
+	s.Int64Var(&c.hmacMaxBody, "hmac-max-body", 1024, "The maximum body size (in megabytes) of HMAC signed requests, which are spooled and verified before being handled, 0 for no limit (default: 1024).").nonNegative()
+	s.StringVar(&c.redisAddr, "redis", "", "Redis server coordinating replicas sharing the upload directory, as 'redis://[:password@]host:port[/db]' (default: disabled).")
+	s.Int64Var(&c.rateLimit, "rate-limit", 0, "The number of requests a client may make per rate limit window, 0 means unlimited (default: 0).").nonNegative()
+	s.DurationVar(&c.rateLimitWindow, "rate-limit-window", time.Minute, "The window requests are counted in for rate limiting (default: '1m').").nonNegative()
+	s.Int64Var(&c.quota, "quota", 0, "The amount (in megabytes) a client may upload per quota window, 0 means unlimited (default: 0).").nonNegative()
+	s.DurationVar(&c.quotaWindow, "quota-window", 24*time.Hour, "The window uploaded bytes are counted in for quotas (default: '24h').").nonNegative()
+
+	s.section("Storage")
+	s.Int64Var(&c.minFreeSpace, "min-free-space", 0, "The free disk space (in megabytes) of the upload directory below which uploads are rejected with 507 (default: disabled).").nonNegative()
+	s.Var(&c.fsync, "fsync", "Whether stored files are flushed to disk before success is reported, one of 'always' (files and directory entries), 'on-close' (files only) or 'never' (default: 'never').")
+	s.BoolVar(&c.hashOffload, "hash-offload", true, "Hash stored files in a goroutine of their own, overlapping hashing with writing them to disk (default: true).")
+	s.BoolVar(&c.ioUring, "io-uring", false, "Experimental: write files of 4 MB and more with io_uring on Linux, in binaries built with '-tags uring' (default: false).")
+	s.DurationVar(&c.trashRetention, "trash-retention", 7*24*time.Hour, "How long deleted files are kept for restoring, 0 deletes files immediately (default: '168h').").nonNegative()
+	s.IntVar(&c.emptyDirKeepDepth, "empty-dir-keep-depth", -1, "The depth below -dir down to which directories left empty by deletes and purges, such as the trash, metadata directories and buckets directory, are kept, deeper ones being removed, e.g. 0 removes all, -1 keeps all (default: -1).")
+	s.DurationVar(&c.tierColdAfter, "tier-cold-after", 0, "How long a file must be idle for before it is archived to the cold tier, 0 disables tiering (default: 0).").nonNegative()
+	s.StringVar(&c.tierS3Endpoint, "tier-s3-endpoint", "https://s3.amazonaws.com", "URL of the S3 compatible service of the cold tier (default: 'https://s3.amazonaws.com').")
+	s.StringVar(&c.tierS3Region, "tier-s3-region", "us-east-1", "The region requests to the cold tier are signed for (default: 'us-east-1').")
+	s.StringVar(&c.tierS3Bucket, "tier-s3-bucket", "", "The bucket idle files are archived to (default: none).")
+	s.StringVar(&c.tierS3Prefix, "tier-s3-prefix", "", "Prefix of the object keys of archived files (default: none).")
+	s.DurationVar(&c.tierPresignTTL, "tier-presign-ttl", 0, "Redirect downloads of archived files to presigned URLs of the cold tier valid for this long, rather than restoring them to the local disk, 0 disables redirects (default: 0).").nonNegative()
+	s.Var(&c.downloadOffload, "download-offload", "Hand downloads off to the reverse proxy, which serves the files from disk, one of 'x-sendfile' (Apache, lighttpd) or 'x-accel-redirect:<location>' (nginx, with an internal location aliasing -dir) (default: disabled).")
+	s.Int64Var(&c.distributionMinSize, "distribution-min-size", 0, "The size (in megabytes) stored files must have to be offered as torrents and metalinks, with the server as web seed (default: disabled).").nonNegative()
+	s.StringVar(&c.torrentTrackers, "torrent-trackers", "", "Comma separated list of the tracker announce URLs of torrents, e.g. 'udp://tracker.example.com:6969/announce' (default: none, web seed only).")
+	s.StringVar(&c.signingKey, "signing-key", "", "Path to a PEM encoded Ed25519 private key manifests are signed with (default: disabled).")
+	s.BoolVar(&c.signFiles, "sign-files", false, "Sign stored files with the signing key, serving their minisign signatures as <name>.minisig (default: false).")
+	s.StringVar(&c.gpgKeyring, "gpg-keyring", "", "Path to the OpenPGP public keys, as exported by 'gpg --export', detached .asc signatures of uploads are verified against (default: disabled).")
+	s.DurationVar(&c.scrubInterval, "scrub-interval", 0, "The time between scrubs verifying stored files against their checksums, 0 disables scrubbing (default: 0).").nonNegative()
+	s.Int64Var(&c.scrubRate, "scrub-rate", 10, "The maximum rate (in megabytes per second) files are read at when scrubbing, 0 means unlimited (default: 10).").nonNegative()
+	s.BoolVar(&c.scrubRepair, "scrub-repair", false, "Repair corrupted files from their copy synced to -backup-s3-bucket (default: false).")
+	s.DurationVar(&c.usageInterval, "usage-interval", 5*time.Minute, "Time between refreshes of the storage usage reported by GET /admin/usage, 0 refreshes it on demand only (default: 5m).").nonNegative()
+	s.StringVar(&c.usageMetaKey, "usage-meta-key", "", "User metadata key, sent as an X-Upload-Meta-* header, storage usage is grouped by in addition to buckets, e.g. 'tenant' (default: none).")
+
+	s.section("Backups")
+	s.DurationVar(&c.backupInterval, "backup-interval", 0, "The time between backups of the upload directory, 0 disables backups (default: 0).").nonNegative()
+	s.StringVar(&c.backupDir, "backup-dir", "", "The directory metadata snapshots are written to, required by backups (default: none).")
+	s.IntVar(&c.backupKeep, "backup-keep", 7, "The number of metadata snapshots kept in the backup directory (default: 7).")
+	s.StringVar(&c.backupS3Bucket, "backup-s3-bucket", "", "The bucket backups sync the upload directory to, at the service of -tier-s3-endpoint (default: disabled).")
+	s.StringVar(&c.backupS3Prefix, "backup-s3-prefix", "", "Prefix of the object keys of backed up files (default: none).")
+	s.StringVar(&c.sftpHost, "sftp-host", "", "Remote host stored files are relayed to over SFTP as they are uploaded, as '[user@]host[:port]', using the ssh command (default: disabled).")
+	s.StringVar(&c.sftpKey, "sftp-key", "", "Private key file authenticating with the SFTP host (default: the default identities of ssh).")
+	s.StringVar(&c.sftpDir, "sftp-dir", ".", "Directory of the SFTP host files are relayed to, relative to the home directory unless absolute (default: '.').")
+	s.StringVar(&c.sftpKnownHosts, "sftp-known-hosts", "", "File of the trusted host keys of the SFTP host, whose key must be listed (default: the known hosts of ssh).")
+
+	s.section("Events and ingestion")
+	s.StringVar(&c.eventsNATSServers, "events-nats", "", "Comma separated list of NATS servers to publish upload events to, e.g. 'nats://localhost:4222' (default: disabled).")
+	s.StringVar(&c.eventsSubject, "events-subject", "uploads", "The NATS subject upload events are published on (default: 'uploads').")
+	s.StringVar(&c.eventsEncoding, "events-encoding", "json", "Encoding of published upload events, either 'json' or 'text' (default: 'json').")
+	s.StringVar(&c.leaderElection, "leader-election", "none", "How the replica running background jobs such as trash purging is elected, one of 'none' (every replica runs them), 'file' or 'redis' (default: 'none').")
+	s.StringVar(&c.mqttBroker, "mqtt-broker", "", "MQTT broker the payloads of received messages are stored from, as 'mqtt://[user:pass@]host:port' (default: disabled).")
+	s.StringVar(&c.mqttTopics, "mqtt-topics", "", "Comma separated list of the MQTT topic filters subscribed to, e.g. 'devices/+/telemetry' (default: none).")
+	s.StringVar(&c.mqttClientID, "mqtt-client-id", "usrv", "Client ID of the persistent MQTT session, messages are queued by the broker while it is disconnected (default: 'usrv').")
+	s.StringVar(&c.ingestSQSQueueURL, "ingest-sqs-queue-url", "", "URL of an SQS queue of messages holding the URLs of files to fetch and store, credentials are taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY (default: disabled).")
+	s.StringVar(&c.ingestSQSRegion, "ingest-sqs-region", "us-east-1", "The AWS region of the SQS queue (default: 'us-east-1').")
+	s.DurationVar(&c.ingestFetchTimeout, "ingest-fetch-timeout", 5*time.Minute, "The time fetching a single file from its URL is given (default: '5m').").nonNegative()
+	s.StringVar(&c.ingestSchemes, "ingest-schemes", "https,http", "Comma separated list of the schemes of the URLs files may be fetched from (default: 'https,http').")
+	s.StringVar(&c.ingestPorts, "ingest-ports", "80,443", "Comma separated list of the ports of the URLs files may be fetched from, empty allows any (default: '80,443').")
+	s.BoolVar(&c.ingestAllowPrivate, "ingest-allow-private", false, "Allow fetching files from private, loopback, link-local and other internal addresses (default: false).")
+	s.IntVar(&c.ingestMaxRedirects, "ingest-max-redirects", 3, "The number of redirects followed when fetching a file, each checked like the URL itself, 0 follows none (default: 3).").nonNegative()
+
+	s.section("Outbound connections")
+	s.StringVar(&c.outboundProxy, "outbound-proxy", "", "URL of the http, https or socks5 proxy outbound HTTP requests, e.g. webhooks, fetches and S3, go through, hosts listed in NO_PROXY excepted (default: HTTPS_PROXY and HTTP_PROXY).")
+	s.StringVar(&c.outboundCAFile, "outbound-ca-file", "", "PEM file of the CA certificates outbound TLS connections, e.g. to S3 and webhooks, trust besides the system ones, for endpoints behind a private CA (default: '').")
+	s.BoolVar(&c.outboundInsecureSkipVerify, "outbound-insecure-skip-verify", false, "Skip verifying the certificates of outbound TLS connections, for labs only (default: false).")
+	s.StringVar(&c.outboundTLSMinVersion, "outbound-tls-min-version", "1.2", "Minimum TLS version of outbound connections, one of '1.0', '1.1', '1.2' or '1.3' (default: '1.2').")
+	s.StringVar(&c.outboundDNS, "outbound-dns", "", "Address of the DNS server outbound connections resolve hosts with, in the form \"host:port\", e.g. '10.0.0.2:53' (default: the system resolver).")
+	s.StringVar(&c.outboundHosts, "outbound-hosts", "", "Comma separated list of host=address overrides of outbound connections, e.g. 'minio.internal=10.0.0.7', like /etc/hosts entries (default: '').")
+
+	s.section("Monitoring")
+	s.StringVar(&c.geoIPCountryDB, "geoip-country-db", "", "Path to a MaxMind Country or City database used to add the client country to access logs (default: disabled).")
+	s.StringVar(&c.geoIPASNDB, "geoip-asn-db", "", "Path to a MaxMind ASN database used to add the client ASN to access logs (default: disabled).")
+	s.StringVar(&c.alertWebhook, "alert-webhook", "", "URL alerts are posted to as JSON, e.g. a Slack incoming webhook (default: disabled).")
+	s.DurationVar(&c.alertWindow, "alert-window", 5*time.Minute, "The interval over which the error rate is computed and alert thresholds are checked (default: '5m').").nonNegative()
+	s.Float64Var(&c.alertErrorRate, "alert-error-rate", 0.05, "The fraction of requests failing with a server error in a window that fires an alert, 0 disables it (default: 0.05).").within(0, 1, "a fraction")
+	s.Float64Var(&c.alertDiskUsage, "alert-disk-usage", 90, "The disk usage percentage of the upload directory that fires an alert, 0 disables it (default: 90).").within(0, 100, "a percentage")
 
-	flag.Parse()
+	s.section("Background jobs")
+	s.IntVar(&c.backgroundNice, "background-nice", 10, "The nice level background jobs such as trash purges, cold tier migrations and backups run at, 0 leaves it unchanged (default: 10).").within(-20, 19, "a nice level")
+	s.Var(&c.backgroundIOPriority, "background-io-priority", "The I/O priority of background jobs on Linux, one of 'idle' (only when the disk is otherwise idle), 'low' (lowest best-effort) or 'normal' (default: 'low').")
+	s.IntVar(&c.backgroundConcurrency, "background-concurrency", 0, "The number of background job passes run at once, 0 means unlimited (default: GOMAXPROCS under a container CPU limit, otherwise 0).").nonNegative()
 
-	c.maxInMemorySize <<= 20 // convert to MB
+	s.section("Development")
+	s.BoolVar(&c.chaos, "chaos", false, "Developer mode injecting latency, 5xx errors and dropped connections, for testing clients (default: false).")
+	s.DurationVar(&c.chaosMaxLatency, "chaos-latency", 2*time.Second, "The maximum latency injected per request in chaos mode (default: '2s').").nonNegative()
+	s.Float64Var(&c.chaosErrorRate, "chaos-error-rate", 0.1, "The probability of a request failing with a 5xx error in chaos mode (default: 0.1).").within(0, 1, "a fraction")
+	s.Float64Var(&c.chaosDisconnectRate, "chaos-disconnect-rate", 0.05, "The probability of a request's connection being dropped mid-stream in chaos mode (default: 0.05).").within(0, 1, "a fraction")
+	s.StringVar(&c.recordDir, "record-dir", "", "Debug option recording the raw requests of failed uploads to this directory, see the replay subcommand (default: disabled).")
+	s.Int64Var(&c.recordMaxBody, "record-max-body", 10, "The maximum body size (in megabytes) recorded per failed upload (default: 10).").nonNegative()
 
-	return c
+	if err := s.parse(args); err != nil {
+		return c, err
+	}
+
+	// Presets only change the default form field, an explicit -form-field wins
+	if c.compat != CompatNone && !s.isSet("form-field") {
+		c.formUploadField = c.compat.formField()
+		s.derive("form-field", c.formUploadField)
+	}
+
+	c.maxInMemorySize <<= 20     // convert to MB
+	c.memoryBudget <<= 20        // convert to MB
+	c.recordMaxBody <<= 20       // convert to MB
+	c.hmacMaxBody <<= 20         // convert to MB
+	c.maxFileSize <<= 20         // convert to MB
+	c.maxJSONUploadSize <<= 20   // convert to MB
+	c.minFreeSpace <<= 20        // convert to MB
+	c.quota <<= 20               // convert to MB
+	c.scrubRate <<= 20           // convert to MB
+	c.distributionMinSize <<= 20 // convert to MB
+
+	return c, nil
 }
 
-// newServer creates a new HTTP server with middleware.
-func newServer(logger *log.Logger, config Config, nextRequestID RequestIDFunc) http.Handler {
+// handler returns the HTTP handler of s, its routes wrapped with middleware, identifying requests with
+// nextRequestID, or the default request IDs if nil.
+func (s *Server) handler(nextRequestID httpx.RequestIDFunc) http.Handler {
+	logger, config := s.logger, s.config
 	mux := http.NewServeMux()
-	addRoutes(mux, config)
+	s.addRoutes(mux)
 
 	var handler http.Handler = mux
-	handler = NewLoggingMiddleware(logger)(handler)
-	handler = NewTracingMiddleware(nextRequestID)(handler)
+	if config.trustedProxies != "" {
+		handler = NewForwardedMiddleware(config.trustedProxies)(handler)
+	}
+	if config.chaos {
+		handler = NewChaosMiddleware(logger, config.chaosMaxLatency, config.chaosErrorRate, config.chaosDisconnectRate, probePaths...)(handler)
+	}
+	if config.rateLimit > 0 {
+		handler = NewRateLimitMiddleware(logger, s.counterStore(), config.rateLimit, config.rateLimitWindow, probePaths...)(handler)
+	}
+	handler = httpx.NewRecoveryMiddleware(logger)(handler)
+	var annotate httpx.LogAnnotator
+	if s.geo != nil {
+		annotate = func(r *http.Request) string { return s.geo.Lookup(r.RemoteAddr) }
+	}
+
+	if s.alerter != nil {
+		handler = s.alerter.middleware(handler)
+	}
+	handler = s.metrics.middleware(handler)
+	handler = withAccessLog(logger, httpx.NewLoggingMiddleware(logger, annotate)(handler), handler)
+	handler = httpx.NewTracingMiddleware(nextRequestID)(handler)
 
 	return handler
 }
 
-// addRoutes configures the routes for the HTTP server.
-func addRoutes(mux *http.ServeMux, config Config) {
-	mux.Handle("/", http.NotFoundHandler())
-	mux.Handle("/healthz", healthz())
-	mux.Handle(config.uploadEndpoint, upload(config.dir, config.formUploadField, config.maxInMemorySize))
+// addRoutes configures the routes of s on mux.
+func (s *Server) addRoutes(mux *http.ServeMux) {
+	logger, config, tier := s.logger, s.config, s.coldTier
+	mux.Handle("/", rootHandler(logger, config.rootMode, config.uploadEndpoint, config.formUploadField))
+	mux.Handle("/healthz", healthz(&s.healthy))
+	mux.Handle("/readyz", healthz(&s.healthy))
+	mux.Handle("/livez", livez())
+	storage := s.uploadStorage(config.dir)
+	responses := newUploadResponses(config)
+	withUploadContext := NewUploadContextMiddleware(storage, s.uploadLimits(config.maxFileSize), responses, s.publisher, logger)
+	callbacks := NewCallbackMiddleware(config.callbackAllowlist)
+	uploadMethods, _ := parseUploadMethods(config.uploadMethods) // validated with the config
+	streaming := NewProgressStreamMiddleware()
+	var uploadHandler http.Handler = withUploadContext(callbacks(streaming(upload(config.formUploadField, uploadMethods, s.keyring, false))))
+	if config.recordDir != "" {
+		uploadHandler = NewRecordingMiddleware(logger, config.recordDir, config.recordMaxBody)(uploadHandler)
+	}
+
+	var jsonUploadHandler http.Handler = NewUploadContextMiddleware(storage, s.uploadLimits(config.maxJSONUploadSize), responses, s.publisher, logger)(callbacks(uploadJSON()))
+	var patchHandler http.Handler = patchFile(logger, config.dir, tier, config.maxFileSize, config.fsync, s.fileSigner, s.indexes, s.locks)
+	sessions := newUploadSessions(config.dir, s.locker())
+	var appendHandler http.Handler = withUploadContext(callbacks(appendSession(logger, sessions)))
+	var flowHandler http.Handler = withUploadContext(callbacks(flowUploadChunk(logger, sessions)))
+	quotas := s.counterStore()
+	admit := s.admissionMiddleware(quotas)
+	uploadHandler = admit(uploadHandler)
+	jsonUploadHandler = admit(jsonUploadHandler)
+	patchHandler = admit(patchHandler)
+	appendHandler = admit(appendHandler)
+	flowHandler = admit(flowHandler)
+
+	progress := NewProgressTracker()
+	uploadHandler = s.protectUpload(NewProgressMiddleware(progress)(uploadHandler))
+	progressHandler := s.protect(uploadProgressHandler(progress))
+	progressPath := path.Join(config.uploadEndpoint, "progress/{id}")
+	flowHandler = s.protectUpload(flowHandler)
+	flowTestHandler := s.protect(withUploadContext(flowTestChunk(logger, sessions)))
+	flowPath := path.Join(config.uploadEndpoint, "flow")
+	if config.corsOrigins != "" {
+		// CORS is handled ahead of authentication, as browsers send preflight requests without credentials
+		corsMethods := []string{http.MethodGet, http.MethodPost}
+		if slices.Contains(uploadMethods, http.MethodPut) {
+			corsMethods = append(corsMethods, http.MethodPut)
+		}
+		cors := NewCORSMiddleware(strings.Split(config.corsOrigins, ","), corsMethods)
+		uploadHandler = cors(uploadHandler)
+		progressHandler = cors(progressHandler)
+		flowHandler = cors(flowHandler)
+		flowTestHandler = cors(flowTestHandler)
+		mux.Handle("OPTIONS "+progressPath, progressHandler)
+		mux.Handle("OPTIONS "+flowPath, flowHandler)
+	}
+
+	mux.Handle(config.uploadEndpoint, uploadHandler)
+	mux.Handle("POST "+path.Join(config.uploadEndpoint, "json"), s.protectUpload(jsonUploadHandler))
+	mux.Handle("POST "+path.Join(config.uploadEndpoint, "batch"), s.protectUpload(admit(withUploadContext(callbacks(streaming(uploadBatch(config.batchWorkers, config.batchMaxFiles)))))))
+	mux.Handle("POST "+path.Join(config.uploadEndpoint, "validate"), s.protect(withUploadContext(preflightUpload(config, quotas, s.disk))))
+	mux.Handle("GET "+progressPath, progressHandler)
+	mux.Handle("GET "+flowPath, flowTestHandler)
+	mux.Handle("POST "+flowPath, flowHandler)
+	mux.Handle("GET /files/{name}", s.protect(downloadFile(logger, config.dir, tier, config.filenameNormalization, newDownloadOffload(config), s.indexes, s.locks)))
+	mux.Handle("PATCH /files/{name}", s.protect(patchHandler))
+	mux.Handle("DELETE /files/{name}", s.protect(deleteFile(logger, config.dir, config.trashRetention, tier, s.pruner, s.indexes)))
+	mux.Handle("POST /files/{name}/restore", s.protect(restoreFile(logger, config.dir, s.pruner, s.indexes)))
+	mux.Handle("GET /files/{name}/signature", s.protect(fileSignature(logger, config.dir, tier)))
+	mux.Handle("POST /files/{name}/delta", s.protect(admit(applyFileDelta(logger, config.dir, tier, config.maxFileSize, config.fsync, s.fileSigner, s.indexes))))
+	if distribution := newDistribution(config); distribution.MinSize > 0 {
+		mux.Handle("GET /files/{name}/torrent", s.protect(distribution.torrentHandler(logger, config.dir, tier, "/files/")))
+		mux.Handle("GET /files/{name}/metalink", s.protect(distribution.metalinkHandler(logger, config.dir, tier, "/files/")))
+	}
+	mux.Handle("GET /files/{name}/chunks", s.protect(chunkMap(logger, config.dir, tier, config.filenameNormalization)))
+	mux.Handle("GET /files/{name}/attachments", s.protect(listAttachments(logger, config.dir)))
+	mux.Handle("PUT /files/{name}/attachments/{kind}", s.protect(admit(putAttachment(logger, config.dir, config.maxFileSize, config.fsync, s.indexes))))
+	mux.Handle("GET /files/{name}/attachments/{kind}", s.protect(getAttachment(logger, config.dir)))
+	mux.Handle("DELETE /files/{name}/attachments/{kind}", s.protect(deleteAttachment(logger, config.dir, s.indexes)))
+	mux.Handle("POST /uploads", s.protectUpload(withUploadContext(createSession(logger, sessions))))
+	mux.Handle("HEAD /uploads/{id}", s.protect(sessionStatus(logger, sessions)))
+	mux.Handle("PATCH /uploads/{id}", s.protectUpload(appendHandler))
+	mux.Handle("DELETE /uploads/{id}", s.protect(abortSession(logger, sessions)))
+	mux.Handle("GET /search", s.protect(search(logger, config.dir, s.indexes)))
+	mux.Handle("GET /manifest", s.protect(manifest(logger, config.dir, s.signingKey, false, s.indexes)))
+	mux.Handle("GET /manifest.sig", s.protect(manifest(logger, config.dir, s.signingKey, true, s.indexes)))
+	if config.opsAddr == "" {
+		mux.Handle("GET /debug/vars", s.protect(vars()))
+		mux.Handle("GET /statusz", s.protect(statusz(s.backup)))
+		mux.Handle("GET /internal/metrics", s.protect(internalMetrics(s.metrics)))
+	}
+	if config.publicDir != "" {
+		mux.Handle("GET "+staticPrefix+"{path...}", staticFiles(logger, config.publicDir, config.publicMaxAge))
+	}
+	mux.Handle("GET /minisign.pub", s.protect(minisignPublicKey(s.fileSigner)))
+
+	s.addBucketRoutes(mux, admit)
+}
+
+// addAdminRoutes registers the endpoints of the admin API of s on mux, managing the log level and buckets,
+// if enabled.
+func (s *Server) addAdminRoutes(mux *http.ServeMux, buckets *Buckets) {
+	logger, config := s.logger, s.config
+	if config.adminToken == "" {
+		return
+	}
+
+	admin := NewAuthMiddleware(unauthorized(), bearerTokenAuthenticator(config.adminToken))
+	mux.Handle("GET /admin/loglevel", admin(logLevelHandler(logger)))
+	mux.Handle("PUT /admin/loglevel", admin(logLevelHandler(logger)))
+	mux.Handle("GET /admin/usage", admin(usageHandler(s.usage)))
+	mux.Handle("GET /admin/config", admin(configHandler(config)))
+	mux.Handle("GET /buckets", admin(listBuckets(logger, buckets)))
+	mux.Handle("PUT /buckets/{bucket}", admin(putBucket(logger, buckets, config.trashRetention)))
+	mux.Handle("GET /buckets/{bucket}", admin(getBucket(logger, buckets)))
+	mux.Handle("DELETE /buckets/{bucket}", admin(deleteBucket(logger, buckets, s.pruner, s.indexes)))
+}
+
+// admissionMiddleware creates the middleware admitting requests storing data, subject to the
+// free disk space and upload quotas enabled for s, the latter counted in quotas.
+func (s *Server) admissionMiddleware(quotas CounterStore) httpx.Middleware {
+	logger, config := s.logger, s.config
+	var quota httpx.Middleware
+	if config.quota > 0 {
+		quota = NewQuotaMiddleware(logger, quotas, config.quota, config.quotaWindow)
+	}
+
+	return func(h http.Handler) http.Handler {
+		if s.disk != nil {
+			h = NewDiskSpaceMiddleware(s.disk, config.minFreeSpace)(h)
+		}
+		if quota != nil {
+			h = quota(h)
+		}
+		return h
+	}
+}
+
+// addBucketRoutes registers the file endpoints of s scoped to buckets on mux, admitting requests storing data
+// through admit, and the admin API, unless it is served by the ops listener.
+func (s *Server) addBucketRoutes(mux *http.ServeMux, admit httpx.Middleware) {
+	logger, config := s.logger, s.config
+	buckets := newBuckets(config.dir, logger)
+	responses := newUploadResponses(config)
+	offload := newDownloadOffload(config)
+
+	if config.opsAddr == "" {
+		s.addAdminRoutes(mux, buckets)
+	}
+
+	uploadMethods, _ := parseUploadMethods(config.uploadMethods) // validated with the config
+	bucketUpload := inBucket(logger, buckets, s.protectUpload, func(b Bucket, dir string) http.Handler {
+		storage := s.uploadStorage(dir)
+		storage.URL = "/buckets/" + b.Name + "/files/"
+		withContext := NewUploadContextMiddleware(storage, s.uploadLimits(config.maxFileSize), responses, s.publisher, logger)
+		return admit(withContext(NewCallbackMiddleware(config.callbackAllowlist)(NewProgressStreamMiddleware()(upload(config.formUploadField, uploadMethods, s.keyring, b.RequireSignature)))))
+	})
+	for _, method := range uploadMethods {
+		mux.Handle(method+" /buckets/{bucket}/files", bucketUpload)
+	}
+	mux.Handle("GET /buckets/{bucket}/files/{name}", inBucket(logger, buckets, s.protect, func(b Bucket, dir string) http.Handler {
+		return downloadFile(logger, dir, nil, config.filenameNormalization, offload, s.indexes, s.locks)
+	}))
+	mux.Handle("PATCH /buckets/{bucket}/files/{name}", inBucket(logger, buckets, s.protect, func(b Bucket, dir string) http.Handler {
+		return admit(patchFile(logger, dir, nil, config.maxFileSize, config.fsync, s.fileSigner, s.indexes, s.locks))
+	}))
+	mux.Handle("DELETE /buckets/{bucket}/files/{name}", inBucket(logger, buckets, s.protect, func(b Bucket, dir string) http.Handler {
+		return deleteFile(logger, dir, time.Duration(b.Retention), nil, s.pruner, s.indexes)
+	}))
+	mux.Handle("POST /buckets/{bucket}/files/{name}/restore", inBucket(logger, buckets, s.protect, func(b Bucket, dir string) http.Handler {
+		return restoreFile(logger, dir, s.pruner, s.indexes)
+	}))
+	mux.Handle("GET /buckets/{bucket}/files/{name}/signature", inBucket(logger, buckets, s.protect, func(b Bucket, dir string) http.Handler {
+		return fileSignature(logger, dir, nil)
+	}))
+	mux.Handle("POST /buckets/{bucket}/files/{name}/delta", inBucket(logger, buckets, s.protect, func(b Bucket, dir string) http.Handler {
+		return admit(applyFileDelta(logger, dir, nil, config.maxFileSize, config.fsync, s.fileSigner, s.indexes))
+	}))
+	if distribution := newDistribution(config); distribution.MinSize > 0 {
+		mux.Handle("GET /buckets/{bucket}/files/{name}/torrent", inBucket(logger, buckets, s.protect, func(b Bucket, dir string) http.Handler {
+			return distribution.torrentHandler(logger, dir, nil, "/buckets/"+b.Name+"/files/")
+		}))
+		mux.Handle("GET /buckets/{bucket}/files/{name}/metalink", inBucket(logger, buckets, s.protect, func(b Bucket, dir string) http.Handler {
+			return distribution.metalinkHandler(logger, dir, nil, "/buckets/"+b.Name+"/files/")
+		}))
+	}
+	mux.Handle("GET /buckets/{bucket}/files/{name}/chunks", inBucket(logger, buckets, s.protect, func(b Bucket, dir string) http.Handler {
+		return chunkMap(logger, dir, nil, config.filenameNormalization)
+	}))
+	mux.Handle("GET /buckets/{bucket}/files/{name}/attachments", inBucket(logger, buckets, s.protect, func(b Bucket, dir string) http.Handler {
+		return listAttachments(logger, dir)
+	}))
+	mux.Handle("PUT /buckets/{bucket}/files/{name}/attachments/{kind}", inBucket(logger, buckets, s.protect, func(b Bucket, dir string) http.Handler {
+		return admit(putAttachment(logger, dir, config.maxFileSize, config.fsync, s.indexes))
+	}))
+	mux.Handle("GET /buckets/{bucket}/files/{name}/attachments/{kind}", inBucket(logger, buckets, s.protect, func(b Bucket, dir string) http.Handler {
+		return getAttachment(logger, dir)
+	}))
+	mux.Handle("DELETE /buckets/{bucket}/files/{name}/attachments/{kind}", inBucket(logger, buckets, s.protect, func(b Bucket, dir string) http.Handler {
+		return deleteAttachment(logger, dir, s.indexes)
+	}))
+	mux.Handle("GET /buckets/{bucket}/search", inBucket(logger, buckets, s.protect, func(b Bucket, dir string) http.Handler {
+		return search(logger, dir, s.indexes)
+	}))
+	mux.Handle("GET /files/{bucket}/manifest", inBucket(logger, buckets, s.protect, func(b Bucket, dir string) http.Handler {
+		return manifest(logger, dir, s.signingKey, false, s.indexes)
+	}))
+	mux.Handle("GET /files/{bucket}/manifest.sig", inBucket(logger, buckets, s.protect, func(b Bucket, dir string) http.Handler {
+		return manifest(logger, dir, s.signingKey, true, s.indexes)
+	}))
+}
+
+// locker returns the [Locker] coordinating the replicas of s, which is local to s unless Redis is configured.
+func (s *Server) locker() Locker {
+	if s.cluster != nil {
+		return &redisLocker{client: s.cluster}
+	}
+	return newLocalLocker()
+}
+
+// counterStore returns the [CounterStore] of the rate limits and quotas of s, which is local to s
+// unless Redis is configured.
+func (s *Server) counterStore() CounterStore {
+	if s.cluster != nil {
+		return &redisCounterStore{client: s.cluster}
+	}
+	return newMemoryCounterStore()
+}
 
+// protect wraps h with the authentication configured for the server, if any.
+// Unauthorized requests are rejected with 401 Unauthorized.
+func (s *Server) protect(h http.Handler) http.Handler {
+	return s.authenticate(h, unauthorized())
 }
 
+// protectUpload wraps the upload handler h like [Server.protect],
+// except that unauthorized requests are tarpitted if tarpit mode is enabled.
+func (s *Server) protectUpload(h http.Handler) http.Handler {
+	if !s.config.tarpit {
+		return s.protect(h)
+	}
+	return s.authenticate(h, tarpit(s.logger, s.config.tarpitDelay, s.config.successTemplate))
+}
+
+// authenticate wraps h with the authentication configured for the server, if any,
+// serving unauthorized requests with denied.
+func (s *Server) authenticate(h, denied http.Handler) http.Handler {
+	config := s.config
+	var authenticators []Authenticator
+	if config.authToken != "" {
+		authenticators = append(authenticators, bearerTokenAuthenticator(config.authToken))
+	}
+	if config.hmacSecret != "" {
+		authenticators = append(authenticators, hmacAuthenticator(config.hmacSecret, config.hmacMaxSkew, s.replays, s.memoryBudget, config.maxInMemorySize, config.hmacMaxBody))
+	}
+
+	if len(authenticators) == 0 {
+		return h
+	}
+
+	return NewAuthMiddleware(denied, authenticators...)(h)
+}
+
+// probePaths are the paths of the health check endpoints, which are exempt from fault injection and rate limiting.
+var probePaths = []string{"/healthz", "/readyz", "/livez"}
+
 // healthz returns an HTTP handler that checks the health status of the application.
-// It responds with 200 OK if the application is healthy, and 503 Service Unavailable otherwise.
-func healthz() http.Handler {
+// It responds with 200 OK if the application is healthy, and 503 Service Unavailable otherwise,
+// including while it is shutting down. It serves both /healthz and the /readyz readiness check.
+func healthz(healthy *atomic.Bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if atomic.LoadInt32(&healthy) == 1 {
+		if healthy.Load() {
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -135,130 +1165,231 @@ func healthz() http.Handler {
 	})
 }
 
-// upload handles file uploads from multipart forms.
-func upload(baseDir, formFileFieldName string, maxFileSize int64) http.Handler {
+// livez returns an HTTP handler for the liveness check, which responds with 200 OK for as long
+// as the server is serving requests, including while it drains on shutdown.
+func livez() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// vars returns an HTTP handler serving the [expvar] metrics as JSON.
+// Unlike [expvar.Handler], it leaves out the command line, which may carry secrets.
+func vars() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		sep := "{\n"
+		expvar.Do(func(kv expvar.KeyValue) {
+			if kv.Key == "cmdline" {
+				return
+			}
+			fmt.Fprintf(w, "%s%q: %s", sep, kv.Key, kv.Value)
+			sep = ",\n"
+		})
+		fmt.Fprintf(w, "\n}\n")
+	})
+}
+
+// parseUploadMethods parses the comma separated list of the methods multipart uploads are accepted with,
+// a subset of POST and PUT.
+func parseUploadMethods(list string) ([]string, error) {
+	var methods []string
+	for _, m := range strings.Split(list, ",") {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if m != http.MethodPost && m != http.MethodPut {
+			return nil, fmt.Errorf("%q is neither POST nor PUT", m)
+		}
+		if !slices.Contains(methods, m) {
+			methods = append(methods, m)
+		}
+	}
+	return methods, nil
+}
+
+// upload handles file uploads from multipart forms, sent in formFileFieldName, of requests carrying
+// an [UploadContext], see [NewUploadContextMiddleware].
+// X-Upload-Meta-* headers are stored as the upload's [Metadata], within the limits of the upload.
+// Lifecycle events of every upload are published to the events of the upload.
+// Multipart payloads violating limits are rejected.
+// Uploads are stored only once accepted by all validators of the upload's storage, under the file name
+// they settle on, with their content rewritten by its transformers, and flushed to disk according to its fsync policy.
+// With the transaction=true query parameter, every file sent is stored atomically, see [storeTransaction].
+// Stored files expire after the duration of the X-Expires-After header, or expires_after form field, if either is sent,
+// and are deleted after the number of downloads of the X-Max-Downloads header, or max_downloads form field.
+// Stored files are reported to the callback of the upload, if it has one, see [NewCallbackMiddleware].
+// Requests with other methods than methods are rejected with 405 Method Not Allowed, listing methods in the Allow header.
+func upload(formFileFieldName string, methods []string, keyring *Keyring, requireSignature bool) http.Handler {
+	allow := strings.Join(methods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(methods, r.Method) {
+			w.Header().Set("Allow", allow)
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		err := r.ParseMultipartForm(maxFileSize)
+		uc := uploadContextFrom(r.Context())
+		logger, stages, publish := uc.Logger, uc.Stages, uc.publish
+		baseDir := uc.Storage.Dir
+
+		publish(Event{Type: EventUploadStarted})
+
+		fail := func(filename string, err error) {
+			publish(Event{Type: EventUploadFailed, Filename: filename, Error: err.Error()})
+		}
+
+		meta, err := parseMetaHeaders(r.Header, uc.Limits.MaxMetaHeaders, uc.Limits.MaxMetaSize)
 		if err != nil {
-			logger.Printf("Error parsing multipart form: %v", err)
-			http.Error(w, "Could not parse multipart form", http.StatusBadRequest)
+			logger.Printf("Error parsing upload metadata: %v", err)
+			uc.respondError(w, fmt.Sprintf("Invalid upload metadata: %v", err), http.StatusBadRequest)
+			fail("", err)
 			return
 		}
 
-		file, handler, err := r.FormFile(formFileFieldName)
+		enc, err := parseEncryptionHeaders(r.Header)
 		if err != nil {
-			logger.Printf("Error retrieving file from form: %v", err)
-			http.Error(w, "Could not get file from form", http.StatusBadRequest)
+			logger.Printf("Error parsing upload encryption: %v", err)
+			uc.respondError(w, fmt.Sprintf("Invalid upload encryption: %v", err), http.StatusBadRequest)
+			fail("", err)
 			return
 		}
-		defer file.Close()
+		uc.Meta, uc.Encryption = meta, enc
 
-		// Create a new file in the uploads directory
-		path := filepath.Join(baseDir, handler.Filename)
-		dst, err := os.Create(path)
+		transaction := r.URL.Query().Get("transaction") == "true"
+		form, err := readUploadForm(logger, r, formFileFieldName, uc.Limits, transaction)
 		if err != nil {
-			logger.Printf("Error creating file on disk: %v", err)
-			http.Error(w, "Could not create file on disk", http.StatusInternalServerError)
+			logger.Printf("Error parsing multipart form: %v", err)
+			switch {
+			case isMultipartLimitError(err):
+				uc.respondError(w, fmt.Sprintf("Multipart form rejected: %v", err), http.StatusBadRequest)
+			case errors.Is(err, errMemoryBudgetExhausted):
+				retryAfter(w, max(uc.Limits.Memory.wait, time.Second))
+				uc.respondError(w, "Server is busy, retry later", http.StatusServiceUnavailable)
+			case errors.Is(err, errFileTooLarge):
+				uc.respondError(w, fmt.Sprintf("Upload rejected: file exceeds %d bytes", uc.Limits.MaxSize), http.StatusRequestEntityTooLarge)
+			default:
+				uc.respondError(w, "Could not parse multipart form", http.StatusBadRequest)
+			}
+			fail("", err)
 			return
 		}
-		defer dst.Close()
+		defer form.RemoveAll()
 
-		// Copy the uploaded file to the new file
-		_, err = io.Copy(dst, file)
+		// Consume what is left of the body, so it is fully verified before anything is stored
+		_, err = io.Copy(io.Discard, r.Body)
 		if err != nil {
-			log.Printf("Error saving file: %v", err)
-			http.Error(w, "Could not save file", http.StatusInternalServerError)
+			logger.Printf("Error reading request body: %v", err)
+			uc.respondError(w, "Could not read request body", http.StatusBadRequest)
+			fail("", err)
 			return
 		}
 
-		logger.Printf("File uploaded successfully: %s\n", handler.Filename)
-		fmt.Fprintf(w, "File uploaded successfully: %s\n", handler.Filename)
-	})
-}
-
-// Middleware is a function that wraps [http.Handler]s
-// proving functionality before or/and after execution
-// of the h handler.
-type Middleware func(h http.Handler) http.Handler
-
-// NewLoggingMiddleware creates a middleware that logs HTTP requests.
-func NewLoggingMiddleware(logger *log.Logger) Middleware {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			defer func(start time.Time) {
-				elapsed := time.Since(start)
-				requestID, ok := r.Context().Value(requestIDKey).(string)
-				if !ok {
-					requestID = "unknown"
-				}
-				logger.Println(requestID, r.Method, r.URL.Path, elapsed, r.RemoteAddr, r.UserAgent())
-			}(time.Now())
-
-			next.ServeHTTP(w, r)
-		})
-	}
-}
+		expiry := r.Header.Get(expiresAfterHeader)
+		if form.Values.Has(expiresAfterField) {
+			expiry = form.Values.Get(expiresAfterField)
+		}
+		uc.Expiry, err = parseExpiresAfter(expiry)
+		if err != nil {
+			logger.Printf("Error parsing upload expiry: %v", err)
+			uc.respondError(w, fmt.Sprintf("Invalid upload expiry: %v", err), http.StatusBadRequest)
+			fail("", err)
+			return
+		}
 
-// RequestIDFunc is a function type for generating unique request IDs,
-// used in the tracing middleware [NewTracingMiddleware].
-type RequestIDFunc func() string
+		maxDownloads := r.Header.Get(maxDownloadsHeader)
+		if form.Values.Has(maxDownloadsField) {
+			maxDownloads = form.Values.Get(maxDownloadsField)
+		}
+		uc.MaxDownloads, err = parseMaxDownloads(maxDownloads)
+		if err != nil {
+			logger.Printf("Error parsing upload download limit: %v", err)
+			uc.respondError(w, fmt.Sprintf("Invalid upload download limit: %v", err), http.StatusBadRequest)
+			fail("", err)
+			return
+		}
 
-// defaultRequestIDFunc generates a unique request ID based on the current time.
-// It is the default [RequestIDFunc] used if none is provided for the tracing middleware.
-func defaultRequestIDFunc() string {
-	return fmt.Sprintf("%d", time.Now().UnixNano())
-}
+		handler := form.File
+		if handler == nil {
+			logger.Printf("Error retrieving file from form: %v", http.ErrMissingFile)
+			uc.respondError(w, "Could not get file from form", http.StatusBadRequest)
+			fail("", http.ErrMissingFile)
+			return
+		}
 
-// NewTracingMiddleware creates a middleware that sets and
-// propagates a request ID through the request context and response header.
-func NewTracingMiddleware(requestIDFunc RequestIDFunc) Middleware {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			requestID := r.Header.Get("X-Request-Id")
-
-			if len(requestID) == 0 {
-				if requestIDFunc != nil {
-					requestID = requestIDFunc()
-				} else {
-					requestID = defaultRequestIDFunc()
-				}
+		sig, signer, err := verifyUploadSignature(keyring, form, requireSignature)
+		if err != nil {
+			logger.Printf("Upload of %s rejected: %v", handler.Filename, err)
+			if rejection, ok := err.(*RejectionError); ok {
+				uc.respondError(w, fmt.Sprintf("Upload rejected: %v", err), rejection.Status)
+			} else {
+				uc.respondError(w, "Could not verify signature", http.StatusInternalServerError)
 			}
+			fail(handler.Filename, err)
+			return
+		}
 
-			ctx := context.WithValue(r.Context(), requestIDKey, requestID)
-			w.Header().Set("X-Request-Id", requestID)
-
-			next.ServeHTTP(w, r.WithContext(ctx))
-		})
-	}
-}
+		if transaction {
+			stages.mark(stageParse)
+			files := append([]*spooledFile{handler}, form.Others...)
+			stored, err := storeTransaction(uc, files)
+			if err != nil {
+				se := err.(*storeError)
+				uc.respondError(w, se.Message, se.Status)
+				fail(se.Filename, err)
+				return
+			}
 
-// run starts the HTTP server and handles graceful shutdown.
-func run(ctx context.Context, logger *log.Logger, httpServer *http.Server) {
-	go func() {
-		logger.Printf("listening on %s\n", httpServer.Addr)
-		if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			fmt.Fprintf(os.Stderr, "error listening and serving: %s\n", err)
+			stages.record(fmt.Sprintf("%d files in a transaction", len(stored)))
+			for _, m := range stored {
+				infof(logger, "File uploaded successfully: %s\n", m.Name)
+				publish(Event{Type: EventUploadCompleted, Filename: m.Name, Size: m.Size})
+			}
+			uc.respond(w, stored...)
+			uc.notifyCallback(stored...)
+			return
 		}
-	}()
-
-	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt)
-	defer cancel()
 
-	<-ctx.Done()
+		// Signed content is stored as is, or it would no longer match its signature
+		fileUpload := uc
+		if sig != nil {
+			fileUpload = uc.in(baseDir)
+			fileUpload.Storage.Transformers = nil
+		}
 
-	logger.Println("Shutting down gracefully, press Ctrl+C again to force")
+		stages.mark(stageParse)
+		stored, coalesced, err := uc.Storage.Dedup.do(baseDir, handler, func() (Metadata, error) {
+			stored, err := storeUpload(fileUpload, handler)
+			if err != nil || sig == nil {
+				return stored, err
+			}
 
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+			if err := storeSignature(baseDir, stored, sig, signer, uc.Storage.Fsync, uc.Storage.Indexes); err != nil {
+				logger.Printf("Error saving signature: %v", err)
+				os.Remove(filepath.Join(baseDir, stored.Name))
+				removeMetadata(baseDir, stored.Name, uc.Storage.Indexes)
+				return Metadata{}, &storeError{Status: http.StatusInternalServerError, Message: "Could not save signature", Filename: stored.Name, Err: err}
+			}
+			stages.mark(stagePostProcess)
+			return stored, nil
+		})
+		if err != nil {
+			se := err.(*storeError)
+			uc.respondError(w, se.Message, se.Status)
+			fail(se.Filename, err)
+			return
+		}
 
-	if err := httpServer.Shutdown(shutdownCtx); err != nil {
-		fmt.Fprintf(os.Stderr, "error shutting down http server: %s\n", err)
-	}
+		if coalesced {
+			uc.respond(w, stored)
+			uc.notifyCallback(stored)
+			publish(Event{Type: EventUploadCoalesced, Filename: stored.Name, Size: stored.Size})
+			return
+		}
 
-	logger.Println("Server shut down successfully")
+		stages.record(stored.Name)
+		infof(logger, "File uploaded successfully: %s\n", stored.Name)
+		uc.respond(w, stored)
+		uc.notifyCallback(stored)
+		publish(Event{Type: EventUploadCompleted, Filename: stored.Name, Size: stored.Size})
+	})
 }
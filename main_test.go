@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestServer starts the server configured by args, storing files in a temporary directory, and returns it
+// along with the URL it is served at. Both are shut down at the end of tb.
+func newTestServer(tb testing.TB, args ...string) (*Server, string) {
+	tb.Helper()
+
+	config, err := newConfig(append([]string{"-dir", tb.TempDir()}, args...))
+	if err != nil {
+		tb.Fatalf("parsing flags: %v", err)
+	}
+	logger := log.New(io.Discard, "", 0)
+	s, err := newServer(logger, config)
+	if err != nil {
+		tb.Fatalf("starting server: %v", err)
+	}
+
+	ts := httptest.NewServer(s.handler(nil))
+	tb.Cleanup(func() {
+		ts.Close()
+		s.shutdown.run(logger, config.shutdownTimeout)
+	})
+	return s, ts.URL
+}
+
+// benchmarkUploads uploads files of size bytes to the server configured by args from concurrency clients at
+// once, b.N in total, each client overwriting a file of its own.
+func benchmarkUploads(b *testing.B, size int64, concurrency int, args ...string) {
+	_, url := newTestServer(b, args...)
+	url += "/upload"
+
+	payload := bytes.Repeat([]byte("0123456789abcdef"), int(size/16)+1)[:size]
+	const boundary = "usrv-benchmark"
+	tail := "\r\n--" + boundary + "--\r\n"
+	contentType := "multipart/form-data; boundary=" + boundary
+
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: concurrency}}
+	defer client.CloseIdleConnections()
+
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	errs := make(chan error, concurrency)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for worker := range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			head := fmt.Sprintf("--%s\r\nContent-Disposition: form-data; name=\"upload\"; filename=\"bench-%d.bin\"\r\n"+
+				"Content-Type: application/octet-stream\r\n\r\n", boundary, worker)
+			for next.Add(1) <= int64(b.N) {
+				body := io.MultiReader(strings.NewReader(head), bytes.NewReader(payload), strings.NewReader(tail))
+				req, err := http.NewRequest(http.MethodPost, url, body)
+				if err != nil {
+					errs <- err
+					return
+				}
+				req.ContentLength = int64(len(head)+len(tail)) + size
+				req.Header.Set("Content-Type", contentType)
+
+				resp, err := client.Do(req)
+				if err != nil {
+					errs <- err
+					return
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusCreated {
+					errs <- fmt.Errorf("upload answered %s", resp.Status)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	close(errs)
+	for err := range errs {
+		b.Fatal(err)
+	}
+}
+
+// benchmarkSizes are the sizes of the files uploaded by the benchmarks, by name.
+var benchmarkSizes = []struct {
+	name string
+	size int64
+}{
+	{"1KiB", 1 << 10},
+	{"64KiB", 64 << 10},
+	{"1MiB", 1 << 20},
+	{"16MiB", 16 << 20},
+}
+
+// BenchmarkUpload measures single uploads by file size and by the memory threshold above which files are spooled
+// to disk, -max-size, in megabytes: 0 spools every file, 10, the default, holds all but the largest in memory.
+func BenchmarkUpload(b *testing.B) {
+	for _, threshold := range []int{0, 1, 10} {
+		for _, s := range benchmarkSizes {
+			b.Run(fmt.Sprintf("max-size=%dMiB/size=%s", threshold, s.name), func(b *testing.B) {
+				benchmarkUploads(b, s.size, 1, "-max-size", strconv.Itoa(threshold))
+			})
+		}
+	}
+}
+
+// BenchmarkUploadConcurrent measures uploads by file size and by the number of clients uploading at once.
+func BenchmarkUploadConcurrent(b *testing.B) {
+	for _, concurrency := range []int{1, 4, 16, 64} {
+		for _, s := range benchmarkSizes[1:3] {
+			b.Run(fmt.Sprintf("clients=%d/size=%s", concurrency, s.name), func(b *testing.B) {
+				benchmarkUploads(b, s.size, concurrency)
+			})
+		}
+	}
+}
+
+// BenchmarkUploadMemoryBudget measures concurrent uploads held in memory, up to 2 megabytes each, within a memory
+// budget either smaller than their total size, so some of them wait for memory to be released, or larger.
+func BenchmarkUploadMemoryBudget(b *testing.B) {
+	for _, budget := range []int{8, 64} {
+		b.Run(fmt.Sprintf("memory-budget=%dMiB/clients=16/size=1MiB", budget), func(b *testing.B) {
+			benchmarkUploads(b, 1<<20, 16, "-max-size", "2", "-memory-budget", strconv.Itoa(budget), "-memory-budget-wait", "1m")
+		})
+	}
+}
+
+// BenchmarkUploadHashOffload compares hashing stored files inline with hashing them in a goroutine of their own.
+func BenchmarkUploadHashOffload(b *testing.B) {
+	for _, offload := range []bool{false, true} {
+		b.Run(fmt.Sprintf("hash-offload=%t/size=16MiB", offload), func(b *testing.B) {
+			benchmarkUploads(b, 16<<20, 1, "-hash-offload="+strconv.FormatBool(offload))
+		})
+	}
+}
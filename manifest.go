@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadSigningKey reads the Ed25519 private key at path, PEM encoded in PKCS #8 form as written by
+// "openssl genpkey -algorithm ed25519".
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return priv, nil
+}
+
+// manifestMaxAge is how long a cached manifest is served for before it is built again, picking up the files
+// changed outside of the server, e.g. by other replicas sharing the upload directory.
+const manifestMaxAge = 5 * time.Minute
+
+// manifestCache caches the manifest of a directory, built by the first request for it and discarded as the
+// metadata of its files changes, see [FileIndexes.indexFile] and [FileIndexes.unindexFile], so that the
+// manifest and its signature are served from the same content.
+type manifestCache struct {
+	build sync.Mutex // build is held while the manifest is built, so that it is built once at a time.
+
+	mu      sync.Mutex // mu guards the fields below.
+	data    []byte     // data is the manifest, nil until built.
+	builtAt time.Time
+	changes int // changes counts the invalidations of the manifest, discarding the builds they interrupt.
+}
+
+// invalidate discards the cached manifest, built again by the next request.
+func (c *manifestCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data = nil
+	c.changes++
+}
+
+// get returns the manifest of the files stored in dir, see [writeManifest], building it unless cached and no older
+// than [manifestMaxAge].
+func (c *manifestCache) get(logger *log.Logger, dir string) ([]byte, error) {
+	c.build.Lock()
+	defer c.build.Unlock()
+
+	c.mu.Lock()
+	if c.data != nil && time.Since(c.builtAt) <= manifestMaxAge {
+		defer c.mu.Unlock()
+		return c.data, nil
+	}
+	changes := c.changes
+	c.mu.Unlock()
+
+	var buf bytes.Buffer
+	builtAt := time.Now()
+	if err := writeManifest(&buf, logger, dir); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.changes == changes {
+		c.data, c.builtAt = buf.Bytes(), builtAt
+	}
+	return buf.Bytes(), nil
+}
+
+// writeManifest writes the SHA256SUMS manifest of the files stored in dir to w, one
+// "<hex sha256>  <name>" line per file sorted by name, as read by "sha256sum -c". Files are listed with the
+// checksum recorded in their metadata, including those archived to the cold tier, and only files stored without
+// one are hashed.
+func writeManifest(w io.Writer, logger *log.Logger, dir string) error {
+	sums := make(map[string]string)
+	var hashErr error
+	err := listFiles(logger, dir, func(m Metadata) bool {
+		if m.SHA256 != "" {
+			sums[m.Name] = m.SHA256
+			return true
+		}
+		if m.Tier == tierCold {
+			return true
+		}
+
+		sum, err := sha256File(filepath.Join(dir, m.Name))
+		if errors.Is(err, os.ErrNotExist) {
+			// Deleted since listed
+			return true
+		}
+		if err != nil {
+			hashErr = err
+			return false
+		}
+		sums[m.Name] = sum
+		return true
+	})
+	if err == nil {
+		err = hashErr
+	}
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(sums))
+	for name := range sums {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		sum := sums[name]
+		// Like sha256sum, lines of names with backslashes or newlines are marked and the names escaped
+		prefix := ""
+		if strings.ContainsAny(name, "\\\n") {
+			prefix = "\\"
+			name = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+		}
+		if _, err := fmt.Fprintf(w, "%s%s  %s\n", prefix, sum, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sha256File returns the hex encoded SHA-256 of the content of the file at path.
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// manifest returns an HTTP handler serving the SHA256SUMS manifest of the files stored in dir, cached in indexes.
+// If signed is set, it serves the detached Ed25519 signature of the cached manifest by key instead,
+// or 404 Not Found if no key is configured.
+func manifest(logger *log.Logger, dir string, key ed25519.PrivateKey, signed bool, indexes *FileIndexes) http.Handler {
+	cache := indexes.manifest(dir)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if signed && key == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		data, err := cache.get(logger, dir)
+		if err != nil {
+			logger.Printf("Error computing manifest: %v", err)
+			http.Error(w, "Could not compute manifest", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		if signed {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(ed25519.Sign(key, data))
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(data)
+	})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManifest(t *testing.T) {
+	s, url := newTestServer(t)
+	dir := s.config.dir
+
+	sum := func(content string) string {
+		h := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(h[:])
+	}
+	for name, content := range map[string]string{"b.txt": "second", "a.txt": "first"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Files archived to the cold tier are only known by their metadata
+	cold := Metadata{Name: "c.txt", SHA256: sum("third"), UploadedAt: time.Now().UTC(), Tier: tierCold}
+	if err := writeMetadata(dir, cold, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get(url + "/manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := sum("first") + "  a.txt\n" + sum("second") + "  b.txt\n" + sum("third") + "  c.txt\n"
+	if resp.StatusCode != http.StatusOK || string(body) != want {
+		t.Errorf("GET /manifest = %d %q, want %d %q", resp.StatusCode, body, http.StatusOK, want)
+	}
+
+	// Without a signing key, there is no signature
+	resp, err = http.Get(url + "/manifest.sig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /manifest.sig = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestManifestCached(t *testing.T) {
+	s, url := newTestServer(t)
+	dir := s.config.dir
+
+	get := func() string {
+		t.Helper()
+		resp, err := http.Get(url + "/manifest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	// Files are listed with the checksum of their metadata, rather than hashed again
+	recorded := strings.Repeat("0", 64)
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("first"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMetadata(dir, Metadata{Name: "a.txt", SHA256: recorded, UploadedAt: time.Now().UTC()}, s.indexes); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := get(), recorded+"  a.txt\n"; got != want {
+		t.Errorf("GET /manifest = %q, want %q", got, want)
+	}
+
+	// Files written behind the server's back are only picked up once the cache expires
+	if err := os.WriteFile(filepath.Join(dir, "b.txt"), []byte("second"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := get(), recorded+"  a.txt\n"; got != want {
+		t.Errorf("cached GET /manifest = %q, want %q", got, want)
+	}
+
+	// Writing metadata invalidates the cache
+	updated := strings.Repeat("1", 64)
+	if err := writeMetadata(dir, Metadata{Name: "a.txt", SHA256: updated, UploadedAt: time.Now().UTC()}, s.indexes); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("second"))
+	if got, want := get(), updated+"  a.txt\n"+hex.EncodeToString(sum[:])+"  b.txt\n"; got != want {
+		t.Errorf("GET /manifest after update = %q, want %q", got, want)
+	}
+}
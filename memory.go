@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Memory budget metrics, published through [expvar].
+var (
+	memoryBudgetInUse    = expvar.NewInt("memory_budget_in_use")   // memoryBudgetInUse is the number of bytes reserved for buffering uploads.
+	memoryBudgetWaits    = expvar.NewInt("memory_budget_waits")    // memoryBudgetWaits counts the uploads that queued for memory.
+	memoryBudgetRejected = expvar.NewInt("memory_budget_rejected") // memoryBudgetRejected counts the uploads rejected for lack of memory.
+)
+
+// errMemoryBudgetExhausted reports an upload that could not reserve memory to buffer its files within the wait.
+var errMemoryBudgetExhausted = errors.New("memory budget exhausted")
+
+// MemoryBudget bounds the memory all concurrent uploads may buffer their files in. Uploads reserve the memory
+// they may use before buffering and queue while the budget is exhausted, up to a wait after which they fail.
+// A nil *MemoryBudget is valid and grants every reservation.
+type MemoryBudget struct {
+	limit int64
+	wait  time.Duration
+
+	mu       sync.Mutex
+	used     int64
+	released chan struct{} // released is closed and replaced whenever memory is released, waking queued uploads.
+}
+
+// newMemoryBudget returns the memory budget configured by config, or nil if memory is unbounded.
+func newMemoryBudget(config Config) *MemoryBudget {
+	if config.memoryBudget <= 0 {
+		return nil
+	}
+	return &MemoryBudget{limit: config.memoryBudget, wait: config.memoryBudgetWait, released: make(chan struct{})}
+}
+
+// reserve reserves n bytes, capped to the whole budget, waiting for them to be released by other uploads
+// until ctx is done or the wait elapses, when it fails with [errMemoryBudgetExhausted]. It returns the number
+// of bytes reserved, to be given back to release.
+func (b *MemoryBudget) reserve(ctx context.Context, n int64) (int64, error) {
+	if b == nil {
+		return n, nil
+	}
+	n = min(n, b.limit)
+
+	var timeout <-chan time.Time
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			memoryBudgetInUse.Add(n)
+			return n, nil
+		}
+		released := b.released
+		b.mu.Unlock()
+
+		if timeout == nil {
+			memoryBudgetWaits.Add(1)
+			timer := time.NewTimer(b.wait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-released:
+		case <-timeout:
+			memoryBudgetRejected.Add(1)
+			return 0, errMemoryBudgetExhausted
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// release gives back n reserved bytes.
+func (b *MemoryBudget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+	memoryBudgetInUse.Add(-n)
+	close(b.released)
+	b.released = make(chan struct{})
+}
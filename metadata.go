@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// metadataDir is the directory, relative to the upload directory, where upload metadata is stored.
+const metadataDir = ".meta"
+
+// metaHeaderPrefix is the prefix of request headers carrying user metadata.
+const metaHeaderPrefix = "X-Upload-Meta-"
+
+// Metadata describes a stored upload. It is persisted as a JSON document
+// in the [metadataDir] of the upload directory, see [metadataPath].
+type Metadata struct {
+	Name         string                `json:"name"`
+	Size         int64                 `json:"size"`
+	ContentType  string                `json:"content_type,omitempty"`
+	SHA256       string                `json:"sha256,omitempty"`    // SHA256 is the checksum of the stored content, verified by the [Scrubber].
+	Checksums    map[string]string     `json:"checksums,omitempty"` // Checksums are the additional checksums recorded by [Pipelines], keyed by algorithm.
+	UploadedAt   time.Time             `json:"uploaded_at"`
+	RequestID    string                `json:"request_id,omitempty"`
+	Meta         map[string]string     `json:"meta,omitempty"`
+	ExpiresAt    *time.Time            `json:"expires_at,omitempty"`    // ExpiresAt is when the file is purged, regardless of the trash retention.
+	Downloads    int64                 `json:"downloads,omitempty"`     // Downloads counts the downloads of the file.
+	MaxDownloads int64                 `json:"max_downloads,omitempty"` // MaxDownloads is the number of downloads the file is deleted after, unlimited if 0.
+	DeletedAt    *time.Time            `json:"deleted_at,omitempty"`
+	AccessedAt   *time.Time            `json:"accessed_at,omitempty"`
+	Tier         string                `json:"tier,omitempty"`
+	Encryption   *Encryption           `json:"encryption,omitempty"`
+	Minisig      string                `json:"minisig,omitempty"`     // Minisig is the minisign signature of the file by the server, see [Minisigner].
+	SignedBy     string                `json:"signed_by,omitempty"`   // SignedBy is the fingerprint of the key the detached signature of the file was verified with.
+	Attachments  map[string]Attachment `json:"attachments,omitempty"` // Attachments are the auxiliary documents attached to the file, keyed by kind.
+	Warnings     []string              `json:"warnings,omitempty"`    // Warnings describe the anomalies noticed in the upload of the file, e.g. a content type mismatch.
+}
+
+// metadataPath returns the path of the metadata document of the upload name stored in baseDir.
+func metadataPath(baseDir, name string) string {
+	return filepath.Join(baseDir, metadataDir, name+".json")
+}
+
+// writeMetadata persists m, replacing any existing metadata of the same upload, and records it in indexes.
+func writeMetadata(baseDir string, m Metadata, indexes *FileIndexes) error {
+	path := metadataPath(baseDir, m.Name)
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := createIn(filepath.Dir(path), func() error { return os.WriteFile(tmp, b, 0o644) }); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	indexes.indexFile(baseDir, m)
+	return nil
+}
+
+// removeMetadata removes the metadata of the upload name stored in baseDir, along with the upload from indexes.
+// Uploads stored without metadata are removed from indexes alone.
+func removeMetadata(baseDir, name string, indexes *FileIndexes) error {
+	err := os.Remove(metadataPath(baseDir, name))
+	indexes.unindexFile(baseDir, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// readMetadata loads the metadata of the upload name stored in baseDir.
+func readMetadata(baseDir, name string) (Metadata, error) {
+	var m Metadata
+
+	b, err := os.ReadFile(metadataPath(baseDir, name))
+	if err != nil {
+		return m, err
+	}
+
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
+
+// parseMetaHeaders collects the X-Upload-Meta-* headers of h, keyed by the
+// lower-cased header name suffix. At most maxCount headers with a combined
+// key and value size of maxSize bytes are accepted.
+func parseMetaHeaders(h http.Header, maxCount, maxSize int) (map[string]string, error) {
+	var meta map[string]string
+	size := 0
+
+	for name, values := range h {
+		key, ok := strings.CutPrefix(name, metaHeaderPrefix)
+		if !ok || key == "" {
+			continue
+		}
+
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+
+		key = strings.ToLower(key)
+		value := strings.Join(values, ", ")
+		meta[key] = value
+
+		if len(meta) > maxCount {
+			return nil, fmt.Errorf("too many %s* headers, at most %d are allowed", metaHeaderPrefix, maxCount)
+		}
+
+		size += len(key) + len(value)
+		if size > maxSize {
+			return nil, fmt.Errorf("%s* headers exceed %d bytes", metaHeaderPrefix, maxSize)
+		}
+	}
+
+	return meta, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/Gabriel-Ladzaretti/go-multipart/internal/httpx"
+)
+
+// requestMetrics counts the requests served by the server with atomic counters, so reading them never
+// blocks requests. They are served as JSON by [internalMetrics].
+type requestMetrics struct {
+	start        time.Time
+	requests     atomic.Int64 // requests counts the requests served, including those in flight.
+	inflight     atomic.Int64 // inflight counts the requests being served.
+	clientErrors atomic.Int64 // clientErrors counts the responses with a 4xx status.
+	serverErrors atomic.Int64 // serverErrors counts the responses with a 5xx status.
+	bytesIn      atomic.Int64 // bytesIn counts the bytes of request bodies read.
+	bytesOut     atomic.Int64 // bytesOut counts the bytes of response bodies written.
+}
+
+// meteredBody is a request body counting the bytes read from it into n.
+type meteredBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (r *meteredBody) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// meteredWriter is an [httpx.StatusRecorder] counting the bytes written through it into n.
+type meteredWriter struct {
+	*httpx.StatusRecorder
+	n *atomic.Int64
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	n, err := w.StatusRecorder.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
+
+func (w *meteredWriter) ReadFrom(src io.Reader) (int64, error) {
+	n, err := w.StatusRecorder.ReadFrom(src)
+	w.n.Add(n)
+	return n, err
+}
+
+// middleware counts the requests passed to next in m.
+func (m *requestMetrics) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.requests.Add(1)
+		m.inflight.Add(1)
+		defer m.inflight.Add(-1)
+
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &meteredBody{ReadCloser: r.Body, n: &m.bytesIn}
+		}
+		rec := &meteredWriter{StatusRecorder: httpx.NewStatusRecorder(w), n: &m.bytesOut}
+		next.ServeHTTP(rec, r)
+
+		switch {
+		case rec.Status >= 500:
+			m.serverErrors.Add(1)
+		case rec.Status >= 400:
+			m.clientErrors.Add(1)
+		}
+	})
+}
+
+// internalMetrics returns an HTTP handler serving m as a flat JSON object, whose members never change,
+// for monitoring without a metrics library.
+func internalMetrics(m *requestMetrics) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(struct {
+			UptimeSeconds    int64 `json:"uptime_seconds"`
+			Requests         int64 `json:"requests"`
+			RequestsInflight int64 `json:"requests_inflight"`
+			ClientErrors     int64 `json:"client_errors"`
+			ServerErrors     int64 `json:"server_errors"`
+			BytesIn          int64 `json:"bytes_in"`
+			BytesOut         int64 `json:"bytes_out"`
+		}{
+			UptimeSeconds:    int64(time.Since(m.start).Seconds()),
+			Requests:         m.requests.Load(),
+			RequestsInflight: m.inflight.Load(),
+			ClientErrors:     m.clientErrors.Load(),
+			ServerErrors:     m.serverErrors.Load(),
+			BytesIn:          m.bytesIn.Load(),
+			BytesOut:         m.bytesOut.Load(),
+		})
+	})
+}
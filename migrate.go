@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+)
+
+// storageBackend is a storage the state of an upload directory can be migrated from and to.
+// Files are addressed by their slash separated path relative to the upload directory.
+type storageBackend interface {
+	// walk calls fn with the path and size of every file of the upload directory, until fn returns an error.
+	walk(ctx context.Context, fn func(rel string, size int64) error) error
+	// open returns the content of the file rel. The caller must close it.
+	open(ctx context.Context, rel string) (io.ReadCloser, error)
+	// store stores the local file at path as the file rel.
+	store(ctx context.Context, rel, path string) error
+	// checksum returns the hex encoded MD5 of the content of the file rel.
+	checksum(ctx context.Context, rel string) (string, error)
+}
+
+// localBackend is a [storageBackend] on the local disk.
+type localBackend struct {
+	dir string
+}
+
+func (b *localBackend) walk(ctx context.Context, fn func(rel string, size int64) error) error {
+	return filepath.WalkDir(b.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(b.dir, path)
+		if err != nil || !exportable(rel, true) {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		return fn(filepath.ToSlash(rel), fi.Size())
+	})
+}
+
+func (b *localBackend) open(ctx context.Context, rel string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(b.dir, filepath.FromSlash(rel)))
+}
+
+func (b *localBackend) store(ctx context.Context, rel, path string) error {
+	dst := filepath.Join(b.dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// Within a filesystem supporting reflinks, the copy is a clone sharing the blocks of the file
+	if tmp, err = cloneFile(tmp, src); err != nil {
+		_, err = io.Copy(tmp, src)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (b *localBackend) checksum(ctx context.Context, rel string) (string, error) {
+	f, err := b.open(ctx, rel)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// s3Backend is a [storageBackend] in an S3 compatible bucket, with files stored under prefix.
+type s3Backend struct {
+	client *s3Client
+	prefix string
+}
+
+func (b *s3Backend) walk(ctx context.Context, fn func(rel string, size int64) error) error {
+	return b.client.list(ctx, b.prefix, func(obj s3Object) error {
+		rel := strings.TrimPrefix(obj.Key, b.prefix)
+		if !exportable(rel, true) {
+			return nil
+		}
+		return fn(rel, obj.Size)
+	})
+}
+
+func (b *s3Backend) open(ctx context.Context, rel string) (io.ReadCloser, error) {
+	return b.client.get(ctx, b.prefix+rel)
+}
+
+func (b *s3Backend) store(ctx context.Context, rel, path string) error {
+	return b.client.put(ctx, b.prefix+rel, path)
+}
+
+func (b *s3Backend) checksum(ctx context.Context, rel string) (string, error) {
+	obj, err := b.client.head(ctx, b.prefix+rel)
+	if err != nil {
+		return "", err
+	}
+
+	// The ETag of objects uploaded in one piece is the MD5 of their content, others need to be read
+	if len(obj.ETag) == 32 {
+		if _, err := hex.DecodeString(obj.ETag); err == nil {
+			return strings.ToLower(obj.ETag), nil
+		}
+	}
+
+	body, err := b.open(ctx, rel)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// parseStorageBackend returns the backend described by s, either the path of a local upload directory,
+// optionally as a file:// URL, or an "s3://bucket/prefix" URL. S3 URLs take the endpoint and region
+// query parameters, and the access_key_env and secret_key_env parameters naming the environment variables
+// holding the credentials, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY by default. "sftp://[user@]host[:port]/dir"
+// URLs name a directory of an SFTP host, relative to the home directory if it starts with "/~/", and take the key
+// and known_hosts parameters of -sftp-key and -sftp-known-hosts.
+func parseStorageBackend(s string) (storageBackend, error) {
+	if !strings.Contains(s, "://") {
+		return &localBackend{dir: s}, nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		return &localBackend{dir: u.Path}, nil
+	case "s3":
+		q := u.Query()
+		get := func(key, fallback string) string {
+			if v := q.Get(key); v != "" {
+				return v
+			}
+			return fallback
+		}
+
+		client, err := newS3ClientFromEnv(
+			get("endpoint", "https://s3.amazonaws.com"),
+			get("region", "us-east-1"),
+			u.Host,
+			get("access_key_env", "AWS_ACCESS_KEY_ID"),
+			get("secret_key_env", "AWS_SECRET_ACCESS_KEY"),
+			nil,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		prefix := strings.TrimPrefix(u.Path, "/")
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return &s3Backend{client: client, prefix: prefix}, nil
+	case "sftp":
+		host := u.Host
+		if u.User != nil {
+			host = u.User.Username() + "@" + host
+		}
+		target, err := parseSFTPTarget(host, u.Query().Get("key"), u.Query().Get("known_hosts"))
+		if err != nil {
+			return nil, err
+		}
+
+		dir := u.Path
+		if dir == "/~" || strings.HasPrefix(dir, "/~/") {
+			dir = "." + strings.TrimPrefix(dir, "/~")
+		}
+		if dir == "" {
+			dir = "."
+		}
+
+		client, err := dialSFTP(context.Background(), target)
+		if err != nil {
+			return nil, err
+		}
+		return &sftpBackend{client: client, dir: dir}, nil
+	default:
+		return nil, fmt.Errorf("unsupported storage %q", u.Scheme)
+	}
+}
+
+// migrateStorageMain implements the migrate subcommand, copying the state of an upload directory,
+// i.e. its files, their metadata and the bucket configurations, from one storage to another.
+func migrateStorageMain(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := fs.String("from", "", "The storage to copy from, a directory, an 's3://bucket/prefix?endpoint=...&region=...' or an 'sftp://user@host/dir?key=...' URL (default: required).")
+	to := fs.String("to", "", "The storage to copy to, in the same form as -from (default: required).")
+	dryRun := fs.Bool("dry-run", false, "List the files that would be copied without copying them (default: false).")
+	statePath := fs.String("state", "migrate-storage.state", "The file recording the files copied so far, to resume an interrupted migration from (default: 'migrate-storage.state').")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s migrate -from storage -to storage [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *from == "" || *to == "" {
+		fs.Usage()
+		return 2
+	}
+
+	src, err := parseStorageBackend(*from)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -from: %v\n", err)
+		return 2
+	}
+	dst, err := parseStorageBackend(*to)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -to: %v\n", err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var state *migrationState
+	if !*dryRun {
+		state, err = openMigrationState(*statePath, *from+" -> "+*to)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		defer state.Close()
+	}
+
+	var copied, skipped, failed int
+	var bytes int64
+	err = src.walk(ctx, func(rel string, size int64) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if *dryRun {
+			fmt.Printf("would copy %s (%d bytes)\n", rel, size)
+			copied++
+			bytes += size
+			return nil
+		}
+
+		if state.done[rel] {
+			skipped++
+			return nil
+		}
+
+		if err := migrateFile(ctx, src, dst, rel); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", rel, err)
+			failed++
+			return nil
+		}
+
+		if err := state.record(rel); err != nil {
+			return err
+		}
+
+		fmt.Printf("copied %s (%d bytes)\n", rel, size)
+		copied++
+		bytes += size
+		return nil
+	})
+
+	fmt.Fprintf(os.Stderr, "%d files copied (%d bytes), %d already copied, %d failed\n", copied, bytes, skipped, failed)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migration stopped: %v\n", err)
+		return 1
+	}
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// migrateFile copies the file rel from src to dst, verifying the copy by checksum.
+func migrateFile(ctx context.Context, src, dst storageBackend, rel string) error {
+	r, err := src.open(ctx, rel)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp, err := os.CreateTemp("", "usrv-migrate-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("reading: %w", err)
+	}
+
+	if err := dst.store(ctx, rel, tmp.Name()); err != nil {
+		return fmt.Errorf("writing: %w", err)
+	}
+
+	want := hex.EncodeToString(h.Sum(nil))
+	got, err := dst.checksum(ctx, rel)
+	if err != nil {
+		return fmt.Errorf("verifying: %w", err)
+	}
+	if got != want {
+		return fmt.Errorf("checksum mismatch after copying: expected %s, got %s", want, got)
+	}
+
+	return nil
+}
+
+// migrationState records the files copied by a migration, one path per line following a header line
+// identifying the migration, so an interrupted migration resumes where it left off.
+type migrationState struct {
+	f    *os.File
+	done map[string]bool
+}
+
+// openMigrationState opens the state at path of the migration identified by id, creating it if needed.
+// It fails if path records another migration.
+func openMigrationState(path, id string) (*migrationState, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &migrationState{f: f, done: make(map[string]bool)}
+
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		if err := sc.Err(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if _, err := fmt.Fprintln(f, id); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return s, nil
+	}
+
+	if sc.Text() != id {
+		f.Close()
+		return nil, fmt.Errorf("%s records another migration: %s", path, sc.Text())
+	}
+	for sc.Scan() {
+		s.done[sc.Text()] = true
+	}
+	if err := sc.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if len(s.done) > 0 {
+		fmt.Fprintf(os.Stderr, "resuming migration, %d files already copied\n", len(s.done))
+	}
+	return s, nil
+}
+
+// record marks the file rel as copied.
+func (s *migrationState) record(rel string) error {
+	if _, err := fmt.Fprintln(s.f, rel); err != nil {
+		return err
+	}
+	s.done[rel] = true
+	return nil
+}
+
+func (s *migrationState) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"os"
+	"strings"
+)
+
+// customMIMETypes maps lower case file name extensions, e.g. ".dwg", to the content types configured
+// with [loadMIMETypes].
+var customMIMETypes = map[string]string{}
+
+// loadMIMETypes reads the extension to content type map at path, in the mime.types format of one
+// content type per line followed by its extensions, e.g. "application/x-acme-model  acm acmz".
+// The types are registered with [mime.AddExtensionType], so they take precedence over the
+// system defaults when serving downloads, and are used to type uploads whose content sniffs as generic.
+func loadMIMETypes(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return fmt.Errorf("%s:%d: no extensions for %s", path, line, fields[0])
+		}
+
+		for _, ext := range fields[1:] {
+			ext = "." + strings.ToLower(strings.TrimPrefix(ext, "."))
+			if err := mime.AddExtensionType(ext, fields[0]); err != nil {
+				return fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			customMIMETypes[ext] = fields[0]
+		}
+	}
+	return sc.Err()
+}
+
+// genericContentType reports whether the sniffed content type is too generic to identify a format,
+// in which case a configured type for the file name extension is preferred.
+func genericContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	return mediaType == "application/octet-stream" || mediaType == "text/plain"
+}
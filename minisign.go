@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// minisigSuffix is the extension under which the minisign signatures of stored files are served.
+const minisigSuffix = ".minisig"
+
+// Minisigner signs stored files in the minisign format, so consumers can verify their provenance with
+// "minisign -V". Files are prehashed with BLAKE2b-512, as minisign does by default.
+type Minisigner struct {
+	key   ed25519.PrivateKey
+	keyID [8]byte // keyID identifies the key in signatures, derived from the public key.
+}
+
+// newMinisigner returns a signer using key.
+func newMinisigner(key ed25519.PrivateKey) *Minisigner {
+	sum := sha256.Sum256(key.Public().(ed25519.PublicKey))
+	s := &Minisigner{key: key}
+	copy(s.keyID[:], sum[:])
+	return s
+}
+
+// PublicKey returns the public key of s in the minisign format, as read by "minisign -p".
+func (s *Minisigner) PublicKey() string {
+	b := append([]byte("Ed"), s.keyID[:]...)
+	b = append(b, s.key.Public().(ed25519.PublicKey)...)
+	return fmt.Sprintf("untrusted comment: minisign public key %016X\n%s\n",
+		binary.LittleEndian.Uint64(s.keyID[:]), base64.StdEncoding.EncodeToString(b))
+}
+
+// Sign returns the minisign signature of the content read from r, the file name signed at now.
+// The file name and time are part of the signature's trusted comment.
+func (s *Minisigner) Sign(r io.Reader, name string, now time.Time) (string, error) {
+	h := newBLAKE2b512()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	sig := append([]byte("ED"), s.keyID[:]...)
+	sig = append(sig, ed25519.Sign(s.key, h.Sum(nil))...)
+
+	// Comments are single lines
+	name = strings.NewReplacer("\r", "", "\n", "").Replace(name)
+	trusted := fmt.Sprintf("timestamp:%d\tfile:%s\tprehashed", now.Unix(), name)
+	global := ed25519.Sign(s.key, append(append([]byte{}, sig[10:]...), trusted...))
+
+	return fmt.Sprintf("untrusted comment: signature from usrv\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(sig), trusted, base64.StdEncoding.EncodeToString(global)), nil
+}
+
+// signFile returns the minisign signature of the file at path, stored under name.
+func (s *Minisigner) signFile(path, name string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return s.Sign(f, name, time.Now())
+}
+
+// minisignPublicKey returns an HTTP handler serving the public key of s, or 404 Not Found if s is nil.
+func minisignPublicKey(s *Minisigner) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, s.PublicKey())
+	})
+}
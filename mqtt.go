@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mqttDialTimeout bounds connecting to the MQTT broker and completing the handshake.
+const mqttDialTimeout = 5 * time.Second
+
+// mqttKeepAlive is the keep alive interval announced to the broker, pings are sent at half of it.
+const mqttKeepAlive = 60 * time.Second
+
+// mqttMaxBackoff bounds the delay between reconnection attempts.
+const mqttMaxBackoff = time.Minute
+
+// MQTT 3.1.1 control packet types, the high nibble of the first byte of a packet.
+const (
+	mqttConnect   = 1
+	mqttConnack   = 2
+	mqttPublish   = 3
+	mqttPuback    = 4
+	mqttSubscribe = 8
+	mqttSuback    = 9
+	mqttPingreq   = 12
+	mqttPingresp  = 13
+)
+
+// MQTTIngester subscribes to topics of an MQTT broker and stores the payloads of the messages it receives
+// as files, named after their topic. Only the subset of MQTT 3.1.1 needed for subscribing is implemented.
+// Messages are received with QoS 1 on a persistent session, and only acknowledged once stored, so the broker
+// redelivers the messages missed while the ingester is down or failing to store them.
+type MQTTIngester struct {
+	broker   *url.URL
+	clientID string
+	topics   []string
+	maxSize  int64 // maxSize is the maximum payload size in bytes, larger messages are dropped.
+
+	storage *UploadStorage
+	events  EventPublisher
+	logger  *log.Logger
+}
+
+// newMQTTIngester creates the MQTT ingester configured by config, storing files in storage and publishing their events
+// to events, or nil if MQTT ingestion is disabled.
+func newMQTTIngester(config Config, storage *UploadStorage, events EventPublisher, logger *log.Logger) (*MQTTIngester, error) {
+	if config.mqttBroker == "" {
+		return nil, nil
+	}
+
+	broker := config.mqttBroker
+	if !strings.Contains(broker, "://") {
+		broker = "mqtt://" + broker
+	}
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, fmt.Errorf("parsing mqtt broker: %w", err)
+	}
+	if u.Scheme != "mqtt" && u.Scheme != "tcp" {
+		return nil, fmt.Errorf("unsupported mqtt broker scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "1883")
+	}
+
+	var topics []string
+	for _, topic := range strings.Split(config.mqttTopics, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+	if len(topics) == 0 {
+		return nil, errors.New("mqtt ingestion requires at least one topic")
+	}
+
+	return &MQTTIngester{
+		broker:   u,
+		clientID: config.mqttClientID,
+		topics:   topics,
+		maxSize:  config.maxInMemorySize,
+		storage:  storage,
+		events:   events,
+		logger:   logger,
+	}, nil
+}
+
+// run receives and stores messages until ctx is done, reconnecting to the broker with backoff.
+func (m *MQTTIngester) run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := m.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > mqttMaxBackoff {
+			backoff = time.Second
+		}
+
+		m.logger.Printf("Error receiving from mqtt broker %s, reconnecting in %v: %v", m.broker.Host, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, mqttMaxBackoff)
+	}
+}
+
+// session connects to the broker, subscribes to the topics and stores the messages received until
+// the connection fails or ctx is done.
+func (m *MQTTIngester) session(ctx context.Context) error {
+	conn, err := m.storage.Outbound.dial("tcp", m.broker.Host, mqttDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	conn.SetDeadline(time.Now().Add(mqttDialTimeout))
+	r := bufio.NewReader(conn)
+
+	if err := m.handshake(conn, r); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	// Writes come from the pinger and from acknowledgements
+	var mu sync.Mutex
+	write := func(packet []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(mqttDialTimeout))
+		_, err := conn.Write(packet)
+		return err
+	}
+
+	pingCtx, cancelPing := context.WithCancel(ctx)
+	defer cancelPing()
+	go func() {
+		ticker := time.NewTicker(mqttKeepAlive / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := write([]byte{mqttPingreq << 4, 0}); err != nil {
+					conn.Close()
+					return
+				}
+			case <-pingCtx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+		header, body, err := mqttReadPacket(r, m.maxSize)
+		var tooLarge *mqttPacketTooLargeError
+		if errors.As(err, &tooLarge) {
+			// The payload was skipped, acknowledge the message so it is not redelivered forever
+			m.logger.Printf("Dropping mqtt message of %d bytes, exceeding %d bytes", tooLarge.size, m.maxSize)
+			if tooLarge.packetID != 0 {
+				if err := write(mqttPubackPacket(tooLarge.packetID)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		switch header >> 4 {
+		case mqttPublish:
+			msg, err := parseMQTTPublish(header, body)
+			if err != nil {
+				return err
+			}
+			if err := m.store(msg); err != nil {
+				return err
+			}
+			if msg.packetID != 0 {
+				if err := write(mqttPubackPacket(msg.packetID)); err != nil {
+					return err
+				}
+			}
+		case mqttSuback:
+			// Messages of the persistent session may be redelivered ahead of SUBACK
+			if len(body) != 2+len(m.topics) {
+				return errors.New("malformed mqtt SUBACK packet")
+			}
+			for i, code := range body[2:] {
+				if code == 0x80 {
+					return fmt.Errorf("mqtt broker refused subscription to %s", m.topics[i])
+				}
+			}
+			infof(m.logger, "Subscribed to mqtt topics %s on %s", strings.Join(m.topics, ","), m.broker.Host)
+		case mqttPingresp:
+		default:
+			return fmt.Errorf("unexpected mqtt packet type %d", header>>4)
+		}
+	}
+}
+
+// handshake connects to the broker and subscribes to the topics, the SUBACK reply is handled by [MQTTIngester.session].
+func (m *MQTTIngester) handshake(conn net.Conn, r *bufio.Reader) error {
+	var connect []byte
+	connect = mqttAppendString(connect, "MQTT")
+	connect = append(connect, 4) // protocol level 3.1.1
+
+	// Keep the session across connections, so messages are queued while disconnected
+	var flags byte
+	var user, pass string
+	var hasPass bool
+	if m.broker.User != nil {
+		user = m.broker.User.Username()
+		pass, hasPass = m.broker.User.Password()
+		flags |= 0x80
+		if hasPass {
+			flags |= 0x40
+		}
+	}
+	connect = append(connect, flags)
+	connect = binary.BigEndian.AppendUint16(connect, uint16(mqttKeepAlive/time.Second))
+	connect = mqttAppendString(connect, m.clientID)
+	if m.broker.User != nil {
+		connect = mqttAppendString(connect, user)
+		if hasPass {
+			connect = mqttAppendString(connect, pass)
+		}
+	}
+
+	if _, err := conn.Write(mqttPacket(mqttConnect<<4, connect)); err != nil {
+		return err
+	}
+
+	header, body, err := mqttReadPacket(r, 0)
+	if err != nil {
+		return fmt.Errorf("reading mqtt CONNACK: %w", err)
+	}
+	if header>>4 != mqttConnack || len(body) != 2 {
+		return fmt.Errorf("unexpected mqtt packet type %d instead of CONNACK", header>>4)
+	}
+	if body[1] != 0 {
+		return fmt.Errorf("mqtt broker refused connection: return code %d", body[1])
+	}
+
+	const subscribeID = 1
+	subscribe := binary.BigEndian.AppendUint16(nil, subscribeID)
+	for _, topic := range m.topics {
+		subscribe = mqttAppendString(subscribe, topic)
+		subscribe = append(subscribe, 1) // QoS 1
+	}
+	if _, err := conn.Write(mqttPacket(mqttSubscribe<<4|0x02, subscribe)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// store stores the payload of msg as a file named after its topic and the time of reception. Messages
+// rejected by the validators are logged and dropped, other failures are returned for the message to be redelivered.
+func (m *MQTTIngester) store(msg mqttMessage) error {
+	now := time.Now()
+	name := mqttFileName(msg.topic, now)
+
+	uc := &UploadContext{
+		RequestID: fmt.Sprintf("%d", now.UnixNano()),
+		Identity:  "mqtt:" + msg.topic,
+		Limits:    UploadLimits{MaxSize: m.maxSize},
+		Meta:      map[string]string{"mqtt-topic": msg.topic},
+		Storage:   m.storage,
+		Events:    m.events,
+		Logger:    m.logger,
+		Stages:    newUploadStages(m.logger),
+	}
+	stages, publish := uc.Stages, uc.publish
+
+	publish(Event{Type: EventUploadStarted})
+
+	f := &spooledFile{Filename: name, Size: int64(len(msg.payload)), mem: msg.payload}
+	stages.mark(stageParse)
+	stored, err := storeUpload(uc, f)
+	if err != nil {
+		publish(Event{Type: EventUploadFailed, Filename: name, Error: err.Error()})
+		if se := err.(*storeError); se.Status < 500 {
+			return nil
+		}
+		return err
+	}
+
+	stages.record(stored.Name)
+	infof(m.logger, "File uploaded successfully: %s\n", stored.Name)
+	publish(Event{Type: EventUploadCompleted, Filename: stored.Name, Size: stored.Size})
+	return nil
+}
+
+// mqttFileName returns the name of the file storing a message received on topic at t, e.g.
+// "devices_42_telemetry-20261016T003947.123456789Z" for topic "devices/42/telemetry".
+func mqttFileName(topic string, t time.Time) string {
+	name := strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\':
+			return '_'
+		}
+		return r
+	}, strings.Trim(topic, "/"))
+	name = strings.TrimLeft(name, ".")
+	if name == "" {
+		name = "mqtt"
+	}
+	return name + "-" + t.UTC().Format("20060102T150405.000000000Z")
+}
+
+// mqttMessage is a received PUBLISH packet.
+type mqttMessage struct {
+	topic    string
+	packetID uint16 // packetID identifies the message for acknowledging it, 0 for QoS 0 messages.
+	payload  []byte
+}
+
+// parseMQTTPublish parses the PUBLISH packet with the given fixed header byte and body.
+func parseMQTTPublish(header byte, body []byte) (mqttMessage, error) {
+	var msg mqttMessage
+
+	topic, rest, err := mqttReadString(body)
+	if err != nil {
+		return msg, err
+	}
+	msg.topic = topic
+
+	if qos := header >> 1 & 0x03; qos > 0 {
+		if len(rest) < 2 {
+			return msg, errors.New("truncated mqtt PUBLISH packet")
+		}
+		msg.packetID = binary.BigEndian.Uint16(rest)
+		rest = rest[2:]
+	}
+
+	msg.payload = rest
+	return msg, nil
+}
+
+// mqttPacketTooLargeError is returned by [mqttReadPacket] for skipped PUBLISH packets exceeding the size limit.
+type mqttPacketTooLargeError struct {
+	size     int
+	packetID uint16 // packetID identifies the skipped message, 0 for QoS 0 messages.
+}
+
+func (e *mqttPacketTooLargeError) Error() string {
+	return fmt.Sprintf("mqtt packet of %d bytes is too large", e.size)
+}
+
+// mqttReadPacket reads a control packet, returning its fixed header byte and its body. PUBLISH packets with
+// a body larger than maxSize plus room for the topic are skipped, unless maxSize is 0.
+func mqttReadPacket(r *bufio.Reader, maxSize int64) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	size, mult := 0, 1
+	for i := 0; ; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if i == 3 && b&0x80 != 0 {
+			return 0, nil, errors.New("malformed mqtt remaining length")
+		}
+		size += int(b&0x7f) * mult
+		mult *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	// Topics are at most 64KiB long
+	if maxSize > 0 && header>>4 == mqttPublish && int64(size) > maxSize+2+65535+2 {
+		// Read the topic and packet ID ahead of the payload, to acknowledge the message
+		head, err := r.Peek(2)
+		if err != nil {
+			return 0, nil, err
+		}
+		n := 2 + int(binary.BigEndian.Uint16(head))
+		if header>>1&0x03 > 0 {
+			n += 2
+		}
+		prefix := make([]byte, n)
+		if _, err := io.ReadFull(r, prefix); err != nil {
+			return 0, nil, err
+		}
+		if _, err := r.Discard(size - n); err != nil {
+			return 0, nil, err
+		}
+
+		msg, err := parseMQTTPublish(header, prefix)
+		if err != nil {
+			return 0, nil, err
+		}
+		return 0, nil, &mqttPacketTooLargeError{size: size, packetID: msg.packetID}
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// mqttPacket returns the control packet with the given fixed header byte and body.
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	size := len(body)
+	for {
+		b := byte(size % 128)
+		size /= 128
+		if size > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if size == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// mqttPubackPacket returns the PUBACK packet acknowledging the message identified by packetID.
+func mqttPubackPacket(packetID uint16) []byte {
+	return mqttPacket(mqttPuback<<4, binary.BigEndian.AppendUint16(nil, packetID))
+}
+
+// mqttAppendString appends s to b as a length prefixed MQTT string.
+func mqttAppendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttReadString reads a length prefixed MQTT string from b, returning the rest of b.
+func mqttReadString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("truncated mqtt string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("truncated mqtt string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
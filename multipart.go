@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Gabriel-Ladzaretti/go-multipart/internal/httpx"
+)
+
+// maxFormValuesSize is the maximum combined size of the non-file values of a multipart form,
+// matching the allowance of [http.Request.ParseMultipartForm].
+const maxFormValuesSize = 10 << 20
+
+// partReadahead is the number of bytes a [multipart.Reader] may read ahead of the part headers it parses.
+const partReadahead = 4096
+
+// errFileTooLarge is returned when spooling a file larger than the maximum size of uploads.
+var errFileTooLarge = errors.New("file too large")
+
+// MultipartLimits bounds the structure of accepted multipart payloads.
+type MultipartLimits struct {
+	MaxParts          int // MaxParts is the maximum number of parts, including nested ones.
+	MaxPartHeaderSize int // MaxPartHeaderSize is the maximum size in bytes of the headers of a single part.
+	MaxDepth          int // MaxDepth is the maximum nesting depth of multipart bodies, 1 allows no nesting.
+}
+
+// multipartLimitError reports a multipart payload exceeding its [MultipartLimits].
+type multipartLimitError struct {
+	msg string
+}
+
+func (e *multipartLimitError) Error() string {
+	return e.msg
+}
+
+// partHeaderLimiter is the body of a [multipart.Reader] bounding what the reader reads while reading the headers
+// of a part, in [partHeaderLimiter.nextPart], so oversized headers are rejected with a [*multipartLimitError]
+// before they are buffered. The allowance covers the headers, their delimiter and the read-ahead of the reader,
+// and the content left unread from the previous part, which should be fully read first, as should the preamble.
+type partHeaderLimiter struct {
+	r             io.Reader
+	maxHeaderSize int   // maxHeaderSize is the maximum size of the headers of a part in bytes.
+	allowance     int64 // allowance is the number of bytes read from r for the headers of a part.
+	left          int64 // left is the number of bytes left of the allowance, -1 while reading content.
+}
+
+// newPartHeaderLimiter returns the limiter of the part headers of the multipart body r delimited by boundary
+// to maxHeaderSize bytes.
+func newPartHeaderLimiter(r io.Reader, boundary string, maxHeaderSize int) *partHeaderLimiter {
+	// Headers follow a "\r\n--boundary\r\n" delimiter and end with an empty line
+	allowance := int64(maxHeaderSize + len(boundary) + len("\r\n--\r\n\r\n") + partReadahead)
+	return &partHeaderLimiter{r: r, maxHeaderSize: maxHeaderSize, allowance: allowance, left: -1}
+}
+
+func (l *partHeaderLimiter) Read(p []byte) (int, error) {
+	if l.left < 0 {
+		return l.r.Read(p)
+	}
+	if l.left == 0 {
+		return 0, &multipartLimitError{fmt.Sprintf("part headers exceed %d bytes", l.maxHeaderSize)}
+	}
+
+	n, err := l.r.Read(p[:min(int64(len(p)), l.left)])
+	l.left -= int64(n)
+	return n, err
+}
+
+// nextPart returns the next part of mr, a reader of l, within the allowance of its headers.
+func (l *partHeaderLimiter) nextPart(mr *multipart.Reader) (*multipart.Part, error) {
+	l.left = l.allowance
+	defer func() { l.left = -1 }()
+	return mr.NextPart()
+}
+
+// newMultipartReader returns the reader of the multipart body of r, like [http.Request.MultipartReader], along
+// with the limiter of its part headers to maxHeaderSize bytes, through which its parts must be read.
+func newMultipartReader(r *http.Request, maxHeaderSize int) (*multipart.Reader, *partHeaderLimiter, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "multipart/form-data" && mediaType != "multipart/mixed") {
+		return nil, nil, http.ErrNotMultipart
+	}
+	boundary := params["boundary"]
+	if boundary == "" {
+		return nil, nil, http.ErrMissingBoundary
+	}
+
+	headers := newPartHeaderLimiter(r.Body, boundary, maxHeaderSize)
+	return multipart.NewReader(headers, boundary), headers, nil
+}
+
+// spooledFile is an uploaded file buffered in memory, or in a temporary file if it is too large.
+type spooledFile struct {
+	Filename string               // Filename is the file name sent by the client.
+	Header   textproto.MIMEHeader // Header is the MIME header of the file's part.
+	Size     int64                // Size is the size of the file in bytes.
+
+	mem      []byte
+	tmp      *os.File
+	budget   *MemoryBudget // budget is the [MemoryBudget] memory is reserved from.
+	reserved int64         // reserved is the memory reserved for mem from budget.
+}
+
+// Open returns a reader of the file content, starting from its beginning.
+func (f *spooledFile) Open() (io.Reader, error) {
+	if f.tmp == nil {
+		return bytes.NewReader(f.mem), nil
+	}
+
+	if _, err := f.tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return f.tmp, nil
+}
+
+// Remove releases the temporary file backing f, if any, or the memory reserved for it.
+func (f *spooledFile) Remove() error {
+	if f.tmp == nil {
+		f.budget.release(f.reserved)
+		f.reserved = 0
+		return nil
+	}
+
+	f.tmp.Close()
+	return os.Remove(f.tmp.Name())
+}
+
+// uploadForm is a parsed multipart upload form.
+type uploadForm struct {
+	File      *spooledFile   // File is the uploaded file, nil if the form has none.
+	Signature *spooledFile   // Signature is the detached signature of File, nil if the form has none.
+	Others    []*spooledFile // Others holds the files sent in the field after File, kept for transactions only.
+	Values    url.Values     // Values holds the non-file form values.
+}
+
+// RemoveAll releases the temporary files of the form.
+func (f *uploadForm) RemoveAll() error {
+	if f.Signature != nil {
+		f.Signature.Remove()
+	}
+	for _, other := range f.Others {
+		other.Remove()
+	}
+	if f.File == nil {
+		return nil
+	}
+	return f.File.Remove()
+}
+
+// formReader reads an [uploadForm] while enforcing [MultipartLimits].
+type formReader struct {
+	ctx           context.Context
+	field         string
+	maxMemory     int64
+	maxSize       int64 // maxSize is the maximum size of a kept file in bytes, 0 for no limit.
+	budget        *MemoryBudget
+	contentLength int64 // contentLength is the length of the request body, -1 if unknown.
+	limits        MultipartLimits
+	logger        *log.Logger
+	requestID     string // requestID identifies the request in debug logs.
+	keepAll       bool   // keepAll keeps every file sent in field, for transactions, rather than the first and its signature.
+
+	parts      int
+	valuesSize int64
+	form       *uploadForm
+	summary    []partSummary // summary describes the parts read so far, for debug dumps.
+}
+
+// partSummary describes a part of a multipart request, without its content.
+type partSummary struct {
+	Depth       int    `json:"depth"`
+	Name        string `json:"name"`
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int64  `json:"size"` // Size is the number of content bytes read, 0 for nested multipart parts.
+}
+
+// formDump is the structured description of a multipart request that failed to parse, logged in debug mode.
+type formDump struct {
+	RequestID     string        `json:"request_id"`
+	Method        string        `json:"method"`
+	Path          string        `json:"path"`
+	ContentLength int64         `json:"content_length"`
+	Header        http.Header   `json:"header"`
+	Parts         []partSummary `json:"parts"`
+	Error         string        `json:"error"`
+}
+
+// dumpFailure logs the structured description of r, which failed to parse with err, at the debug level.
+// Credentials and cookies are left out of the dumped headers.
+func (fr *formReader) dumpFailure(r *http.Request, err error) {
+	if !logEnabled(fr.logger, LogDebug) {
+		return
+	}
+
+	h := r.Header.Clone()
+	for _, name := range []string{"Authorization", "Proxy-Authorization", "Cookie"} {
+		h.Del(name)
+	}
+
+	b, _ := json.Marshal(formDump{
+		RequestID:     fr.requestID,
+		Method:        r.Method,
+		Path:          r.URL.Path,
+		ContentLength: r.ContentLength,
+		Header:        h,
+		Parts:         fr.summary,
+		Error:         err.Error(),
+	})
+	debugf(fr.logger, "Multipart form %s failed to parse: %s", fr.requestID, b)
+}
+
+// readUploadForm parses the multipart body of r, keeping the first file sent in field,
+// along with its detached signature, the first other file of field whose name ends with ".asc",
+// or every file sent in field if keepAll is set.
+// Up to the MaxMemory bytes of limits of the file are held in memory, within the [MemoryBudget] of all uploads,
+// the rest is stored on disk in a temporary file. Other files are discarded. Payloads violating the multipart
+// limits are rejected with a [*multipartLimitError] as soon as the violation is read, and files larger than the
+// MaxSize of limits with [errFileTooLarge] once it is exceeded.
+//
+// Files of nested multipart/mixed parts are attributed to the form field of the enclosing part.
+//
+// In debug mode, requests failing to parse are dumped to the logs, see [formReader.dumpFailure].
+func readUploadForm(logger *log.Logger, r *http.Request, field string, limits UploadLimits, keepAll bool) (*uploadForm, error) {
+	fr := &formReader{
+		ctx:           r.Context(),
+		field:         field,
+		maxMemory:     limits.MaxMemory,
+		maxSize:       limits.MaxSize,
+		budget:        limits.Memory,
+		contentLength: r.ContentLength,
+		limits:        limits.Multipart,
+		requestID:     httpx.RequestIDFromContext(r.Context()),
+		logger:        logger,
+		keepAll:       keepAll,
+		form:          &uploadForm{Values: make(url.Values)},
+	}
+
+	mr, headers, err := newMultipartReader(r, fr.limits.MaxPartHeaderSize)
+	if err != nil {
+		fr.dumpFailure(r, err)
+		return nil, err
+	}
+
+	if logEnabled(logger, LogDebug) {
+		_, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		debugf(logger, "Multipart form %s: boundary %q, content length %d", fr.requestID, params["boundary"], r.ContentLength)
+	}
+
+	if err := fr.walk(mr, headers, 1, ""); err != nil {
+		fr.form.RemoveAll()
+		fr.dumpFailure(r, err)
+		return nil, err
+	}
+
+	// A lone signature file is a regular upload
+	if fr.form.File == nil {
+		fr.form.File, fr.form.Signature = fr.form.Signature, nil
+	}
+
+	return fr.form, nil
+}
+
+// walk reads all parts of mr, whose part headers are bounded by headers, found at the given nesting depth
+// within the form field name.
+func (fr *formReader) walk(mr *multipart.Reader, headers *partHeaderLimiter, depth int, name string) error {
+	for {
+		part, err := headers.nextPart(mr)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		fr.parts++
+		if fr.parts > fr.limits.MaxParts {
+			return &multipartLimitError{fmt.Sprintf("more than %d parts", fr.limits.MaxParts)}
+		}
+
+		size := headerSize(part.Header)
+		if size > fr.limits.MaxPartHeaderSize {
+			return &multipartLimitError{fmt.Sprintf("part headers of %d bytes exceed %d bytes", size, fr.limits.MaxPartHeaderSize)}
+		}
+
+		partName := name
+		if depth == 1 {
+			partName = part.FormName()
+		}
+		debugf(fr.logger, "Multipart form %s: part %d at depth %d, name %q, filename %q, content type %q, %d header bytes",
+			fr.requestID, fr.parts, depth, partName, part.FileName(), part.Header.Get("Content-Type"), size)
+		fr.summary = append(fr.summary, partSummary{Depth: depth, Name: partName, Filename: part.FileName(), ContentType: part.Header.Get("Content-Type")})
+		summary := &fr.summary[len(fr.summary)-1]
+
+		mediaType, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if strings.HasPrefix(mediaType, "multipart/") {
+			if depth+1 > fr.limits.MaxDepth {
+				return &multipartLimitError{fmt.Sprintf("multipart nesting deeper than %d levels", fr.limits.MaxDepth)}
+			}
+
+			nested := newPartHeaderLimiter(part, params["boundary"], fr.limits.MaxPartHeaderSize)
+			if err := fr.walk(multipart.NewReader(nested, params["boundary"]), nested, depth+1, partName); err != nil {
+				return err
+			}
+			// The epilogue of the nested body is not part of the headers of the next part
+			if _, err := io.Copy(io.Discard, part); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if part.FileName() != "" {
+			if partName == fr.field && fr.keepAll {
+				f, err := fr.spool(part)
+				if err != nil {
+					return err
+				}
+				if fr.form.File == nil {
+					fr.form.File = f
+				} else {
+					fr.form.Others = append(fr.form.Others, f)
+				}
+				summary.Size = f.Size
+				debugf(fr.logger, "Multipart form %s: part %d kept as file %d, %d bytes", fr.requestID, fr.parts, len(fr.form.Others)+1, f.Size)
+				continue
+			}
+			if partName == fr.field && fr.form.Signature == nil && strings.HasSuffix(partFileName(part), signatureSuffix) {
+				if fr.form.Signature, err = fr.spool(part); err != nil {
+					return err
+				}
+				summary.Size = fr.form.Signature.Size
+				debugf(fr.logger, "Multipart form %s: part %d kept as signature, %d bytes", fr.requestID, fr.parts, fr.form.Signature.Size)
+				continue
+			}
+			if partName == fr.field && fr.form.File == nil {
+				if fr.form.File, err = fr.spool(part); err != nil {
+					return err
+				}
+				summary.Size = fr.form.File.Size
+				debugf(fr.logger, "Multipart form %s: part %d kept as file, %d bytes", fr.requestID, fr.parts, fr.form.File.Size)
+				continue
+			}
+
+			n, err := io.Copy(io.Discard, part)
+			summary.Size = n
+			if err != nil {
+				return err
+			}
+			debugf(fr.logger, "Multipart form %s: part %d discarded, %d bytes", fr.requestID, fr.parts, n)
+			continue
+		}
+
+		var b strings.Builder
+		n, err := io.CopyN(&b, part, maxFormValuesSize-fr.valuesSize+1)
+		summary.Size = n
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		fr.valuesSize += n
+		if fr.valuesSize > maxFormValuesSize {
+			return multipart.ErrMessageTooLarge
+		}
+
+		fr.form.Values.Add(partName, b.String())
+	}
+}
+
+// partFileName returns the file name of part, decoded from the forms clients send it in: UTF-8, as browsers do,
+// the filename* parameter of RFC 7578 and RFC 2231, RFC 2047 encoded-words or, failing these, ISO-8859-1.
+// Names are decoded before being reduced to their base name, so that the slashes of encoded-words neither cut
+// them short nor survive decoding. Full Windows paths, as sent by Internet Explorer, are reduced to the file
+// name as well.
+func partFileName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	name := params["filename"]
+	if err != nil || name == "" {
+		return ""
+	}
+
+	if strings.HasPrefix(name, "=?") {
+		if decoded, err := new(mime.WordDecoder).DecodeHeader(name); err == nil {
+			name = decoded
+		}
+	}
+
+	if !utf8.ValidString(name) {
+		runes := make([]rune, len(name))
+		for i := 0; i < len(name); i++ {
+			runes[i] = rune(name[i])
+		}
+		name = string(runes)
+	}
+
+	// Browsers escape quotes as described by the HTML standard, newlines are left escaped
+	name = strings.ReplaceAll(name, "%22", `"`)
+
+	name = filepath.Base(name)
+	return name[strings.LastIndexByte(name, '\\')+1:]
+}
+
+// spool buffers the content of part like [spoolReserved].
+func (fr *formReader) spool(part *multipart.Part) (*spooledFile, error) {
+	want := fr.maxMemory + 1
+	if fr.contentLength >= 0 {
+		want = min(want, fr.contentLength)
+	}
+	return spoolReserved(fr.ctx, fr.budget, part, &spooledFile{Filename: partFileName(part), Header: part.Header}, fr.maxMemory, fr.maxSize, want)
+}
+
+// spoolReserved buffers the content of r into f like [spool], reserving want bytes of the memory it may hold
+// from budget first. It fails with [errMemoryBudgetExhausted] if the budget cannot spare it in time.
+func spoolReserved(ctx context.Context, budget *MemoryBudget, r io.Reader, f *spooledFile, maxMemory, maxSize, want int64) (*spooledFile, error) {
+	reserved, err := budget.reserve(ctx, want)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err = spool(r, f, maxMemory, maxSize)
+	if err != nil || f.tmp != nil {
+		budget.release(reserved)
+		return f, err
+	}
+
+	// Only what is held needs to stay reserved
+	f.budget, f.reserved = budget, min(reserved, f.Size)
+	budget.release(reserved - f.reserved)
+	return f, nil
+}
+
+// spool buffers the content of r into f, in memory up to maxMemory bytes, in a temporary file otherwise.
+// Content larger than maxSize bytes, unless 0, fails with [errFileTooLarge] as soon as the limit is exceeded,
+// reading at most one byte past it.
+func spool(r io.Reader, f *spooledFile, maxMemory, maxSize int64) (*spooledFile, error) {
+	if maxSize > 0 {
+		r = io.LimitReader(r, maxSize+1)
+	}
+
+	var b bytes.Buffer
+	n, err := io.CopyN(&b, r, maxMemory+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if maxSize > 0 && n > maxSize {
+		return nil, errFileTooLarge
+	}
+
+	if n <= maxMemory {
+		f.mem = b.Bytes()
+		f.Size = n
+		return f, nil
+	}
+
+	f.tmp, err = os.CreateTemp("", "usrv-upload-*")
+	if err != nil {
+		return nil, err
+	}
+
+	n, err = io.Copy(f.tmp, io.MultiReader(&b, r))
+	if err == nil && maxSize > 0 && n > maxSize {
+		err = errFileTooLarge
+	}
+	if err != nil {
+		f.Remove()
+		return nil, err
+	}
+
+	f.Size = n
+	return f, nil
+}
+
+// headerSize returns the size of h in wire format.
+func headerSize(h textproto.MIMEHeader) int {
+	size := 0
+	for k, vs := range h {
+		for _, v := range vs {
+			size += len(k) + len(v) + len(": \r\n")
+		}
+	}
+	return size
+}
+
+// isMultipartLimitError reports whether err is a [*multipartLimitError].
+func isMultipartLimitError(err error) bool {
+	var limitErr *multipartLimitError
+	return errors.As(err, &limitErr)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/textproto"
+	"testing"
+)
+
+func TestPartFileName(t *testing.T) {
+	tests := []struct {
+		name        string
+		disposition string
+		want        string
+	}{
+		{name: "plain", disposition: `form-data; name="upload"; filename="report.pdf"`, want: "report.pdf"},
+		{name: "utf-8", disposition: "form-data; name=\"upload\"; filename=\"r\u00E9sum\u00E9.pdf\"", want: "r\u00E9sum\u00E9.pdf"},
+		{name: "rfc 2231", disposition: `form-data; name="upload"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`, want: "r\u00E9sum\u00E9.pdf"},
+		{name: "iso-8859-1", disposition: "form-data; name=\"upload\"; filename=\"r\xE9sum\xE9.pdf\"", want: "r\u00E9sum\u00E9.pdf"},
+		{name: "escaped quote", disposition: `form-data; name="upload"; filename="a%22b.txt"`, want: `a"b.txt`},
+		{name: "unix path", disposition: `form-data; name="upload"; filename="dir/report.pdf"`, want: "report.pdf"},
+		{name: "windows path", disposition: `form-data; name="upload"; filename="C:\\Users\\me\\report.pdf"`, want: "report.pdf"},
+		{name: "no file name", disposition: `form-data; name="upload"`, want: ""},
+
+		// Encoded-words are decoded before being reduced to their base name
+		{name: "rfc 2047 q", disposition: `form-data; name="upload"; filename="=?UTF-8?Q?r=C3=A9sum=C3=A9.pdf?="`, want: "r\u00E9sum\u00E9.pdf"},
+		{name: "rfc 2047 b with slash", disposition: `form-data; name="upload"; filename="=?UTF-8?B?w7/Dvy50eHQ=?="`, want: "\u00FF\u00FF.txt"},
+		{name: "rfc 2047 encoded path", disposition: `form-data; name="upload"; filename="=?UTF-8?Q?dir=2Fevil.txt?="`, want: "evil.txt"},
+		{name: "rfc 2047 encoded parent", disposition: `form-data; name="upload"; filename="=?UTF-8?Q?=2E=2E=2F=2E=2E=2Fetc=2Fpasswd?="`, want: "passwd"},
+		{name: "rfc 2047 encoded windows path", disposition: `form-data; name="upload"; filename="=?UTF-8?Q?C:=5Cevil.txt?="`, want: "evil.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			if _, err := mw.CreatePart(textproto.MIMEHeader{"Content-Disposition": {tt.disposition}}); err != nil {
+				t.Fatal(err)
+			}
+			mw.Close()
+
+			part, err := multipart.NewReader(&body, mw.Boundary()).NextPart()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := partFileName(part); got != tt.want {
+				t.Errorf("partFileName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsDialTimeout bounds connecting to a NATS server and completing the handshake.
+const natsDialTimeout = 5 * time.Second
+
+// natsWriteTimeout bounds writing a single published message.
+const natsWriteTimeout = 2 * time.Second
+
+// natsQueueSize is the number of events queued for publishing, events published once it is full are dropped.
+const natsQueueSize = 1024
+
+// natsDrainTimeout bounds publishing the events still queued when the publisher is closed.
+const natsDrainTimeout = 5 * time.Second
+
+var (
+	eventsPublished = expvar.NewInt("events_published") // eventsPublished counts the events published.
+	eventsFailed    = expvar.NewInt("events_failed")    // eventsFailed counts the events that failed to be published.
+	eventsDropped   = expvar.NewInt("events_dropped")   // eventsDropped counts the events dropped as the queue was full.
+)
+
+// errEventQueueFull is returned by [natsPublisher.Publish] for the events dropped as the queue is full.
+var errEventQueueFull = errors.New("event queue full")
+
+// natsPublisher is an [EventPublisher] speaking the NATS client protocol.
+// Only the subset needed for fire-and-forget publishing is implemented.
+// Events are queued and published by a goroutine of its own, so that
+// uploads never wait for the broker, even while it is being redialed.
+type natsPublisher struct {
+	servers  []string
+	subject  string
+	encode   EventEncoder
+	outbound *Outbound // outbound connects to the servers.
+	logger   *log.Logger
+
+	queue     chan []byte   // queue holds the messages to publish.
+	stop      chan struct{} // stop is closed by Close.
+	done      chan struct{} // done is closed once the messages queued before Close are published.
+	closeOnce sync.Once
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// newNATSPublisher creates a publisher that connects lazily, with outbound, to the first
+// reachable server of servers and publishes events to subject.
+func newNATSPublisher(servers []string, subject string, encode EventEncoder, outbound *Outbound, logger *log.Logger) *natsPublisher {
+	p := &natsPublisher{
+		servers:  servers,
+		subject:  subject,
+		encode:   encode,
+		outbound: outbound,
+		logger:   logger,
+		queue:    make(chan []byte, natsQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Publish encodes e and queues it for publishing, failing with [errEventQueueFull] if the queue is full.
+func (p *natsPublisher) Publish(e Event) error {
+	payload, err := p.encode(e)
+	if err != nil {
+		return fmt.Errorf("encoding event: %w", err)
+	}
+
+	msg := fmt.Appendf(nil, "PUB %s %d\r\n", p.subject, len(payload))
+	msg = append(msg, payload...)
+	msg = append(msg, "\r\n"...)
+
+	select {
+	case <-p.stop:
+		return errors.New("event publisher closed")
+	default:
+	}
+	select {
+	case p.queue <- msg:
+		return nil
+	default:
+		eventsDropped.Add(1)
+		return errEventQueueFull
+	}
+}
+
+// run publishes the queued messages until p is closed, and then those still queued, for up to natsDrainTimeout.
+func (p *natsPublisher) run() {
+	defer close(p.done)
+
+	for {
+		select {
+		case msg := <-p.queue:
+			p.publish(msg)
+		case <-p.stop:
+			deadline := time.Now().Add(natsDrainTimeout)
+			for len(p.queue) > 0 && time.Now().Before(deadline) {
+				p.publish(<-p.queue)
+			}
+			if n := len(p.queue); n > 0 {
+				eventsDropped.Add(int64(n))
+				p.logger.Printf("Event publisher closed with %d events left to publish", n)
+			}
+			return
+		}
+	}
+}
+
+// publish writes msg to the connection, reconnecting once if the connection was lost, and logs failures.
+func (p *natsPublisher) publish(msg []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if p.conn == nil {
+			if err := p.connect(); err != nil {
+				eventsFailed.Add(1)
+				p.logger.Printf("Error publishing event: %v", err)
+				return
+			}
+		}
+
+		p.conn.SetWriteDeadline(time.Now().Add(natsWriteTimeout))
+		_, err := p.conn.Write(msg)
+		if err == nil {
+			eventsPublished.Add(1)
+			return
+		}
+
+		p.conn.Close()
+		p.conn = nil
+
+		if attempt > 0 {
+			eventsFailed.Add(1)
+			p.logger.Printf("Error publishing event: publishing to nats: %v", err)
+			return
+		}
+	}
+}
+
+// Close publishes the events still queued, for up to natsDrainTimeout, and closes the underlying connection, if any.
+func (p *natsPublisher) Close() error {
+	p.closeOnce.Do(func() { close(p.stop) })
+
+	// A publish blocked dialing unreachable servers may outlast the drain
+	select {
+	case <-p.done:
+	case <-time.After(natsDrainTimeout + natsDialTimeout):
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		return nil
+	}
+
+	err := p.conn.Close()
+	p.conn = nil
+	return err
+}
+
+// connect dials the configured servers in order and performs the protocol handshake.
+// Must be called with p.mu held.
+func (p *natsPublisher) connect() error {
+	var errs []error
+	for _, server := range p.servers {
+		conn, err := natsDial(p.logger, p.outbound, strings.TrimSpace(server))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		p.conn = conn
+		return nil
+	}
+
+	return fmt.Errorf("connecting to nats: %w", errors.Join(errs...))
+}
+
+// natsDial connects to server, given as "nats://[user:pass@]host:port" or "host:port", with outbound,
+// and completes the INFO/CONNECT handshake. A reader goroutine keeps the
+// connection alive by answering server PINGs until the connection is closed.
+func natsDial(logger *log.Logger, outbound *Outbound, server string) (net.Conn, error) {
+	if !strings.Contains(server, "://") {
+		server = "nats://" + server
+	}
+
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, fmt.Errorf("parsing nats server %q: %w", server, err)
+	}
+
+	conn, err := outbound.dial("tcp", u.Host, natsDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(natsDialTimeout))
+	r := bufio.NewReader(conn)
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading nats INFO from %s: %w", u.Host, err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected nats greeting from %s: %q", u.Host, strings.TrimSpace(line))
+	}
+
+	opts := map[string]any{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "usrv",
+		"lang":     "go",
+	}
+	if u.User != nil {
+		opts["user"] = u.User.Username()
+		if pass, ok := u.User.Password(); ok {
+			opts["pass"] = pass
+		}
+	}
+
+	connectOpts, err := json.Marshal(opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connectOpts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	line, err = r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading nats handshake reply from %s: %w", u.Host, err)
+	}
+	if !strings.HasPrefix(line, "PONG") {
+		conn.Close()
+		return nil, fmt.Errorf("nats handshake with %s failed: %s", u.Host, strings.TrimSpace(line))
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	go natsReadLoop(logger, conn, r)
+
+	return conn, nil
+}
+
+// natsReadLoop answers server PINGs and logs protocol errors until conn is closed.
+func natsReadLoop(logger *log.Logger, conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return
+		}
+
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			conn.Write([]byte("PONG\r\n"))
+		case strings.HasPrefix(line, "-ERR"):
+			logger.Printf("nats: %s", strings.TrimSpace(line))
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNATSServer accepts a single NATS client, completing its handshake unless stall is set, and sends the payloads
+// of the messages it publishes to the returned channel, until the returned function stops it, or t ends.
+func fakeNATSServer(t *testing.T, stall bool) (string, <-chan string, func()) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(stopped)
+			ln.Close()
+		})
+	}
+	t.Cleanup(stop)
+
+	published := make(chan string, natsQueueSize)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			<-stopped
+			conn.Close()
+		}()
+		if stall {
+			// Never greeting the client leaves it waiting for the dial timeout
+			io.Copy(io.Discard, conn)
+			return
+		}
+
+		io.WriteString(conn, "INFO {}\r\n")
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "PING"):
+				io.WriteString(conn, "PONG\r\n")
+			case strings.HasPrefix(line, "PUB "):
+				payload, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				published <- strings.TrimSuffix(payload, "\r\n")
+			}
+		}
+	}()
+	return ln.Addr().String(), published, stop
+}
+
+func TestNATSPublisherPublishes(t *testing.T) {
+	addr, published, _ := fakeNATSServer(t, false)
+	p := newNATSPublisher([]string{addr}, "uploads", encodeEventJSON, nil, log.New(io.Discard, "", 0))
+
+	before := eventsPublished.Value()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if err := p.Publish(Event{Type: EventUploadCompleted, Filename: name}); err != nil {
+			t.Fatalf("Publish() = %v", err)
+		}
+	}
+
+	for _, want := range []string{"a.txt", "b.txt", "c.txt"} {
+		select {
+		case payload := <-published:
+			var e Event
+			if err := json.Unmarshal([]byte(payload), &e); err != nil || e.Filename != want {
+				t.Fatalf("published %q, %v, want the event of %s", payload, err, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event of %s not published", want)
+		}
+	}
+
+	if err := p.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	if got := eventsPublished.Value() - before; got != 3 {
+		t.Errorf("events_published increased by %d, want 3", got)
+	}
+}
+
+func TestNATSPublisherDoesNotBlock(t *testing.T) {
+	addr, _, stop := fakeNATSServer(t, true)
+	p := newNATSPublisher([]string{addr}, "uploads", encodeEventJSON, nil, log.New(io.Discard, "", 0))
+	defer p.Close()
+	defer stop()
+
+	// The first event is taken by the writer, stuck dialing, the next fill the queue and the last are dropped
+	const dropped = 10
+	before := eventsDropped.Value()
+	start := time.Now()
+	var full int
+	for range natsQueueSize + 1 + dropped {
+		if err := p.Publish(Event{Type: EventUploadCompleted, Filename: "a.txt"}); errors.Is(err, errEventQueueFull) {
+			full++
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("publishing took %v while the server stalled, want no wait", elapsed)
+	}
+	if full < dropped {
+		t.Errorf("%d events rejected as the queue was full, want at least %d", full, dropped)
+	}
+	if got := eventsDropped.Value() - before; got != int64(full) {
+		t.Errorf("events_dropped increased by %d, want %d", got, full)
+	}
+}
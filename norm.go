@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"unicode/utf8"
+)
+
+//go:generate sh -c "go run normtables_gen.go -ucd $UCD > normtables.go"
+
+// NormalizationForm is a Unicode normalization form. It implements [flag.Value].
+type NormalizationForm string
+
+const (
+	NormalizationNone NormalizationForm = "none" // NormalizationNone leaves text as is.
+	NormalizationNFC  NormalizationForm = "nfc"  // NormalizationNFC composes characters, as macOS and Windows clients mostly send them.
+	NormalizationNFD  NormalizationForm = "nfd"  // NormalizationNFD decomposes characters, as HFS+ stores names.
+)
+
+func (f *NormalizationForm) String() string {
+	return string(*f)
+}
+
+func (f *NormalizationForm) Set(v string) error {
+	switch NormalizationForm(v) {
+	case NormalizationNone, NormalizationNFC, NormalizationNFD:
+		*f = NormalizationForm(v)
+		return nil
+	default:
+		return fmt.Errorf("unknown normalization form %q, expected one of none, nfc or nfd", v)
+	}
+}
+
+// Hangul syllables are composed algorithmically, see the Unicode standard, section 3.12.
+const (
+	hangulSBase  = 0xAC00
+	hangulLBase  = 0x1100
+	hangulVBase  = 0x1161
+	hangulTBase  = 0x11A7
+	hangulLCount = 19
+	hangulVCount = 21
+	hangulTCount = 28
+	hangulNCount = hangulVCount * hangulTCount
+	hangulSCount = hangulLCount * hangulNCount
+)
+
+// normalize returns s in the normalization form f.
+func normalize(s string, f NormalizationForm) string {
+	if f == NormalizationNone || isASCII(s) {
+		return s
+	}
+
+	runes := decompose(s)
+	if f == NormalizationNFC {
+		runes = compose(runes)
+	}
+	return string(runes)
+}
+
+// decompose returns the canonical decomposition of s, its combining marks in canonical order.
+func decompose(s string) []rune {
+	runes := make([]rune, 0, utf8.RuneCountInString(s))
+	var appendDecomposed func(r rune)
+	appendDecomposed = func(r rune) {
+		if r >= hangulSBase && r < hangulSBase+hangulSCount {
+			i := r - hangulSBase
+			runes = append(runes, hangulLBase+i/hangulNCount, hangulVBase+i%hangulNCount/hangulTCount)
+			if t := i % hangulTCount; t != 0 {
+				runes = append(runes, hangulTBase+t)
+			}
+			return
+		}
+		d, ok := normDecomp[r]
+		if !ok {
+			runes = append(runes, r)
+			return
+		}
+		appendDecomposed(d[0])
+		if d[1] != 0 {
+			appendDecomposed(d[1])
+		}
+	}
+	for _, r := range s {
+		appendDecomposed(r)
+	}
+
+	// Sort every run of combining marks by combining class, keeping the order of equal classes
+	for start := 0; start < len(runes); {
+		if normCombiningClass[runes[start]] == 0 {
+			start++
+			continue
+		}
+		end := start + 1
+		for end < len(runes) && normCombiningClass[runes[end]] != 0 {
+			end++
+		}
+		slices.SortStableFunc(runes[start:end], func(a, b rune) int {
+			return int(normCombiningClass[a]) - int(normCombiningClass[b])
+		})
+		start = end
+	}
+	return runes
+}
+
+// compose canonically composes the decomposed runes in place, returning them.
+func compose(runes []rune) []rune {
+	if len(runes) == 0 {
+		return runes
+	}
+
+	starter := 0
+	lastClass := normCombiningClass[runes[0]]
+	if lastClass != 0 {
+		// Nothing composes with a leading combining mark
+		lastClass = 255
+	}
+	out := 1
+	for _, r := range runes[1:] {
+		class := normCombiningClass[r]
+		// A mark composes with the starter unless a mark of the same or higher class is in between
+		if lastClass < class || lastClass == 0 {
+			if c, ok := composePair(runes[starter], r); ok {
+				runes[starter] = c
+				continue
+			}
+		}
+		if class == 0 {
+			starter = out
+		}
+		lastClass = class
+		runes[out] = r
+		out++
+	}
+	return runes[:out]
+}
+
+// composePair returns the primary composite of a and b, if any.
+func composePair(a, b rune) (rune, bool) {
+	if a >= hangulLBase && a < hangulLBase+hangulLCount && b >= hangulVBase && b < hangulVBase+hangulVCount {
+		return hangulSBase + ((a-hangulLBase)*hangulVCount+b-hangulVBase)*hangulTCount, true
+	}
+	if i := a - hangulSBase; i >= 0 && i < hangulSCount && i%hangulTCount == 0 && b > hangulTBase && b < hangulTBase+hangulTCount {
+		return a + b - hangulTBase, true
+	}
+	c, ok := normCompose[[2]rune{a, b}]
+	return c, ok
+}
+
+// isASCII reports whether s only holds ASCII characters, which normalization leaves as is.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+func TestNormalize(t *testing.T) {
+	// Cases in the columns of NormalizationTest.txt: the source, its NFC and its NFD
+	tests := []struct {
+		name     string
+		source   string
+		nfc, nfd string
+	}{
+		{name: "ascii", source: "report.pdf", nfc: "report.pdf", nfd: "report.pdf"},
+		{name: "precomposed", source: "caf\u00E9", nfc: "caf\u00E9", nfd: "cafe\u0301"},
+		{name: "decomposed", source: "cafe\u0301", nfc: "caf\u00E9", nfd: "cafe\u0301"},
+		{name: "canonical order", source: "a\u0302\u0323", nfc: "\u1EAD", nfd: "a\u0323\u0302"},
+		{name: "reordered composition", source: "\u1E0A\u0323", nfc: "\u1E0C\u0307", nfd: "D\u0323\u0307"},
+		{name: "blocked mark", source: "a\u0301\u0301", nfc: "\u00E1\u0301", nfd: "a\u0301\u0301"},
+		{name: "leading mark", source: "\u0301a", nfc: "\u0301a", nfd: "\u0301a"},
+
+		// Hangul syllables are decomposed and composed algorithmically
+		{name: "hangul lv", source: "\uAC00", nfc: "\uAC00", nfd: "\u1100\u1161"},
+		{name: "hangul lvt", source: "\uAC01", nfc: "\uAC01", nfd: "\u1100\u1161\u11A8"},
+		{name: "hangul last", source: "\uD7A3", nfc: "\uD7A3", nfd: "\u1112\u1175\u11C2"},
+		{name: "hangul jamo", source: "\u1100\u1161\u11A8", nfc: "\uAC01", nfd: "\u1100\u1161\u11A8"},
+		{name: "hangul lv and t", source: "\uAC00\u11A8", nfc: "\uAC01", nfd: "\u1100\u1161\u11A8"},
+		{name: "hangul lvt and t", source: "\uAC01\u11A8", nfc: "\uAC01\u11A8", nfd: "\u1100\u1161\u11A8\u11A8"},
+
+		// Singletons decompose to a single character and never recompose
+		{name: "angstrom sign", source: "\u212B", nfc: "\u00C5", nfd: "A\u030A"},
+		{name: "ohm sign", source: "\u2126", nfc: "\u03A9", nfd: "\u03A9"},
+		{name: "kelvin sign", source: "\u212A", nfc: "K", nfd: "K"},
+
+		// Composition exclusions decompose and are not recomposed
+		{name: "devanagari qa", source: "\u0958", nfc: "\u0915\u093C", nfd: "\u0915\u093C"},
+		{name: "hebrew shin with shin dot", source: "\uFB2A", nfc: "\u05E9\u05C1", nfd: "\u05E9\u05C1"},
+		{name: "forking", source: "\u2ADC", nfc: "\u2ADD\u0338", nfd: "\u2ADD\u0338"},
+
+		// Non-starter decompositions are excluded as well
+		{name: "greek dialytika tonos", source: "\u0344", nfc: "\u0308\u0301", nfd: "\u0308\u0301"},
+		{name: "tibetan vowel sign ii", source: "\u0F73", nfc: "\u0F71\u0F72", nfd: "\u0F71\u0F72"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalize(tt.source, NormalizationNFC); got != tt.nfc {
+				t.Errorf("NFC(%+q) = %+q, want %+q", tt.source, got, tt.nfc)
+			}
+			if got := normalize(tt.source, NormalizationNFD); got != tt.nfd {
+				t.Errorf("NFD(%+q) = %+q, want %+q", tt.source, got, tt.nfd)
+			}
+			if got := normalize(tt.source, NormalizationNone); got != tt.source {
+				t.Errorf("normalize(%+q, none) = %+q, want it as is", tt.source, got)
+			}
+		})
+	}
+}
+
+func TestNormalizeTables(t *testing.T) {
+	// The invariants NormalizationTest.txt checks, over every character with a decomposition
+	for r := range normDecomp {
+		s := string(r)
+		nfc, nfd := normalize(s, NormalizationNFC), normalize(s, NormalizationNFD)
+		for _, check := range []struct {
+			name      string
+			got, want string
+		}{
+			{name: "NFC(NFD(c)) == NFC(c)", got: normalize(nfd, NormalizationNFC), want: nfc},
+			{name: "NFC(NFC(c)) == NFC(c)", got: normalize(nfc, NormalizationNFC), want: nfc},
+			{name: "NFD(NFC(c)) == NFD(c)", got: normalize(nfc, NormalizationNFD), want: nfd},
+			{name: "NFD(NFD(c)) == NFD(c)", got: normalize(nfd, NormalizationNFD), want: nfd},
+		} {
+			if check.got != check.want {
+				t.Errorf("%s for %U: got %+q, want %+q", check.name, r, check.got, check.want)
+			}
+		}
+	}
+
+	for _, r := range []rune{hangulSBase, hangulSBase + 1, hangulSBase + hangulSCount/2, hangulSBase + hangulSCount - 1} {
+		s := string(r)
+		if got := normalize(normalize(s, NormalizationNFD), NormalizationNFC); got != s {
+			t.Errorf("NFC(NFD(%U)) = %+q, want it recomposed", r, got)
+		}
+	}
+}
+
+func TestNormalizationFormSet(t *testing.T) {
+	for _, v := range []string{"none", "nfc", "nfd"} {
+		var f NormalizationForm
+		if err := f.Set(v); err != nil || f.String() != v {
+			t.Errorf("Set(%q) = %v, form %q", v, err, f.String())
+		}
+	}
+	var f NormalizationForm
+	if err := f.Set("nfkc"); err == nil {
+		t.Errorf("Set(%q) succeeded, want an error", "nfkc")
+	}
+}
@@ -0,0 +1,156 @@
+//go:build ignore
+
+// normtables_gen generates normtables.go, the tables of the Unicode normalization in norm.go,
+// from the UnicodeData.txt and CompositionExclusions.txt files of the Unicode Character Database:
+//
+//	go run normtables_gen.go -ucd /path/to/ucd > normtables.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	ucd := flag.String("ucd", ".", "The directory holding UnicodeData.txt and CompositionExclusions.txt.")
+	flag.Parse()
+
+	decomp := make(map[rune][]rune)
+	ccc := make(map[rune]uint8)
+	version := ""
+
+	readLines(filepath.Join(*ucd, "UnicodeData.txt"), func(fields []string) {
+		r := parseRune(fields[0])
+		if c, _ := strconv.Atoi(fields[3]); c != 0 {
+			ccc[r] = uint8(c)
+		}
+		// Compatibility decompositions are tagged, e.g. "<compat> 0020"
+		if fields[5] != "" && !strings.HasPrefix(fields[5], "<") {
+			for _, f := range strings.Fields(fields[5]) {
+				decomp[r] = append(decomp[r], parseRune(f))
+			}
+		}
+	})
+
+	excluded := make(map[rune]bool)
+	readLines(filepath.Join(*ucd, "CompositionExclusions.txt"), func(fields []string) {
+		excluded[parseRune(fields[0])] = true
+	})
+	if data, err := os.ReadFile(filepath.Join(*ucd, "CompositionExclusions.txt")); err == nil {
+		first, _, _ := strings.Cut(string(data), "\n")
+		version = strings.TrimSpace(strings.TrimPrefix(first, "#"))
+	}
+
+	// Singletons and decompositions starting with a non-starter never compose either
+	compose := make(map[[2]rune]rune)
+	for r, d := range decomp {
+		if len(d) == 2 && !excluded[r] && ccc[r] == 0 && ccc[d[0]] == 0 {
+			compose[[2]rune{d[0], d[1]}] = r
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "// Code generated by normtables_gen.go; DO NOT EDIT.")
+	fmt.Fprintln(&b)
+	fmt.Fprintf(&b, "// Generated from %s.\n", version)
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "package main")
+	fmt.Fprintln(&b)
+
+	fmt.Fprintln(&b, "// normDecomp maps runes to their canonical decomposition, a single rune if the second is 0.")
+	fmt.Fprintln(&b, "var normDecomp = map[rune][2]rune{")
+	for _, r := range sortedKeys(decomp) {
+		d := decomp[r]
+		second := rune(0)
+		if len(d) > 1 {
+			second = d[1]
+		}
+		fmt.Fprintf(&b, "\t0x%04X: {0x%04X, 0x%04X},\n", r, d[0], second)
+	}
+	fmt.Fprintln(&b, "}")
+	fmt.Fprintln(&b)
+
+	fmt.Fprintln(&b, "// normCombiningClass maps runes to their canonical combining class, 0 if missing.")
+	fmt.Fprintln(&b, "var normCombiningClass = map[rune]uint8{")
+	for _, r := range sortedKeys(ccc) {
+		fmt.Fprintf(&b, "\t0x%04X: %d,\n", r, ccc[r])
+	}
+	fmt.Fprintln(&b, "}")
+	fmt.Fprintln(&b)
+
+	pairs := make([][2]rune, 0, len(compose))
+	for p := range compose {
+		pairs = append(pairs, p)
+	}
+	slices.SortFunc(pairs, func(x, y [2]rune) int {
+		if x[0] != y[0] {
+			return int(x[0] - y[0])
+		}
+		return int(x[1] - y[1])
+	})
+
+	fmt.Fprintln(&b, "// normCompose maps pairs of runes to their primary composite.")
+	fmt.Fprintln(&b, "var normCompose = map[[2]rune]rune{")
+	for _, p := range pairs {
+		fmt.Fprintf(&b, "\t{0x%04X, 0x%04X}: 0x%04X,\n", p[0], p[1], compose[p])
+	}
+	fmt.Fprintln(&b, "}")
+
+	src, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(src)
+}
+
+// readLines calls fn with the semicolon separated fields of the data lines of the file at path,
+// skipping comments.
+func readLines(path string, fn func(fields []string)) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line, _, _ := strings.Cut(s.Text(), "#")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, ";")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		fn(fields)
+	}
+	if err := s.Err(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func parseRune(s string) rune {
+	r, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return rune(r)
+}
+
+func sortedKeys[V any](m map[rune]V) []rune {
+	keys := make([]rune, 0, len(m))
+	for r := range m {
+		keys = append(keys, r)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// OffloadMode configures handing downloads off to the reverse proxy in front of the server. It implements [flag.Value].
+// It is one of "" (disabled), "x-sendfile" or "x-accel-redirect:<prefix>".
+type OffloadMode string
+
+const (
+	OffloadNone      OffloadMode = ""           // OffloadNone serves downloads from the server.
+	OffloadXSendfile OffloadMode = "x-sendfile" // OffloadXSendfile answers with the path of files in X-Sendfile, for Apache and lighttpd.
+
+	offloadXAccelPrefix = "x-accel-redirect:" // offloadXAccelPrefix precedes the nginx internal location the upload directory is served under.
+)
+
+func (m *OffloadMode) String() string {
+	return string(*m)
+}
+
+func (m *OffloadMode) Set(v string) error {
+	switch mode := OffloadMode(v); {
+	case mode == OffloadNone, mode == OffloadXSendfile:
+	case strings.HasPrefix(v, offloadXAccelPrefix) && strings.HasPrefix(strings.TrimPrefix(v, offloadXAccelPrefix), "/"):
+	default:
+		return fmt.Errorf("unknown offload mode %q, expected x-sendfile or x-accel-redirect:<location>", v)
+	}
+	*m = OffloadMode(v)
+	return nil
+}
+
+// DownloadOffload hands downloads off to the reverse proxy in front of the server, which serves the files from
+// disk itself, including ranges and conditional requests. A nil *DownloadOffload serves downloads from the server.
+type DownloadOffload struct {
+	header   string // header is the response header naming the file for the proxy.
+	location string // location is the nginx internal location the upload directory is served under, if any.
+	root     string // root is the upload directory.
+}
+
+// newDownloadOffload returns the download offload configured by config, or nil if it is disabled.
+func newDownloadOffload(config Config) *DownloadOffload {
+	switch location, ok := strings.CutPrefix(string(config.downloadOffload), offloadXAccelPrefix); {
+	case ok:
+		return &DownloadOffload{header: "X-Accel-Redirect", location: location, root: config.dir}
+	case config.downloadOffload == OffloadXSendfile:
+		return &DownloadOffload{header: "X-Sendfile", root: config.dir}
+	default:
+		return nil
+	}
+}
+
+// serve answers with the header handing the file f at p off to the proxy, and the content type the proxy would
+// not know, as [http.ServeContent] sets it. It reports false without answering if o is nil or p lies outside the
+// upload directory.
+func (o *DownloadOffload) serve(w http.ResponseWriter, p string, f *os.File) bool {
+	if o == nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(o.root, p)
+	if err != nil || !filepath.IsLocal(rel) {
+		return false
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		ctype := mime.TypeByExtension(filepath.Ext(p))
+		if ctype == "" {
+			var buf [512]byte
+			n, _ := io.ReadFull(f, buf[:])
+			ctype = http.DetectContentType(buf[:n])
+		}
+		w.Header().Set("Content-Type", ctype)
+	}
+
+	if o.location != "" {
+		// nginx decodes the URI, so names such as "a?b" reach the internal location intact
+		w.Header().Set(o.header, (&url.URL{Path: path.Join(o.location, filepath.ToSlash(rel))}).EscapedPath())
+	} else {
+		w.Header().Set(o.header, p)
+	}
+	w.WriteHeader(http.StatusOK)
+	return true
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// opaInput is the input document of the queries of OPA decisions on uploads.
+type opaInput struct {
+	Filename    string            `json:"filename"`
+	Extension   string            `json:"extension"` // Extension is the lower case extension of Filename, e.g. ".iso".
+	Size        int64             `json:"size"`
+	ContentType string            `json:"content_type"`
+	Identity    string            `json:"identity"` // Identity is the client IP address, or the source of ingested files.
+	Meta        map[string]string `json:"meta,omitempty"`
+	Encrypted   bool              `json:"encrypted"`
+	RequestID   string            `json:"request_id,omitempty"`
+}
+
+// opaDecision is the result of an OPA decision on an upload: either a boolean allowing it,
+// or an object with an "allow" boolean and an optional "reason" denials are explained with.
+type opaDecision struct {
+	Allow  bool
+	Reason string
+}
+
+func (d *opaDecision) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &d.Allow); err == nil {
+		return nil
+	}
+
+	var v struct {
+		Allow  *bool  `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil || v.Allow == nil {
+		return fmt.Errorf("decision %s is neither a boolean nor an object with an allow boolean", b)
+	}
+	d.Allow, d.Reason = *v.Allow, v.Reason
+	return nil
+}
+
+// opaValidator returns a [Validator] asking the OPA data API document at url, e.g.
+// "http://localhost:8181/v1/data/usrv/upload", whether to allow every upload, given an [opaInput].
+// OPA is queried with client. Uploads are rejected with 403 Forbidden if denied, and with 503 Service Unavailable
+// if OPA fails to decide within the timeout of client or the document is undefined.
+func opaValidator(url string, client *http.Client) Validator {
+	return ValidatorFunc(func(c *UploadCandidate) error {
+		body, err := json.Marshal(struct {
+			Input opaInput `json:"input"`
+		}{opaInput{
+			Filename:    c.Filename,
+			Extension:   strings.ToLower(filepath.Ext(c.Filename)),
+			Size:        c.Size,
+			ContentType: c.ContentType,
+			Identity:    c.Upload.Identity,
+			Meta:        c.Meta,
+			Encrypted:   c.Encryption != nil,
+			RequestID:   c.Upload.RequestID,
+		}})
+		if err != nil {
+			return err
+		}
+
+		decision, err := queryOPA(client, url, body)
+		if err != nil {
+			c.Upload.Logger.Printf("Error querying OPA for %s: %v", c.Filename, err)
+			return &RejectionError{http.StatusServiceUnavailable, "upload policy unavailable"}
+		}
+
+		if !decision.Allow {
+			reason := decision.Reason
+			if reason == "" {
+				reason = "denied by upload policy"
+			}
+			return &RejectionError{http.StatusForbidden, reason}
+		}
+		return nil
+	})
+}
+
+// queryOPA posts the query body to the OPA data API document at url and returns its decision.
+func queryOPA(client *http.Client, url string, body []byte) (opaDecision, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return opaDecision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return opaDecision{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return opaDecision{}, fmt.Errorf("opa: %s", resp.Status)
+	}
+
+	var result struct {
+		Result *opaDecision `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return opaDecision{}, fmt.Errorf("decoding opa response: %w", err)
+	}
+	if result.Result == nil {
+		return opaDecision{}, fmt.Errorf("opa: %s is undefined", req.URL.Path)
+	}
+	return *result.Result, nil
+}
@@ -0,0 +1,779 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	_ "crypto/sha256" // registers the SHA-224 and SHA-256 signature hashes
+	_ "crypto/sha512" // registers the SHA-384 and SHA-512 signature hashes
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// OpenPGP packet tags, see RFC 4880 section 4.3.
+const (
+	pgpTagSignature     = 2
+	pgpTagPublicKey     = 6
+	pgpTagUserID        = 13
+	pgpTagPublicSub     = 14
+	pgpTagUserAttribute = 17
+)
+
+// OpenPGP public key algorithms, see RFC 4880 section 9.1 and RFC 9580 section 9.1.
+const (
+	pgpAlgoRSA         = 1
+	pgpAlgoRSASignOnly = 3
+	pgpAlgoEdDSALegacy = 22
+	pgpAlgoEd25519     = 27
+)
+
+// OpenPGP signature types, see RFC 4880 section 5.2.1: those of documents, and those certifying keys.
+const (
+	pgpSigTypeBinary           = 0x00
+	pgpSigTypeText             = 0x01
+	pgpSigTypeCertGeneric      = 0x10
+	pgpSigTypeCertPositive     = 0x13
+	pgpSigTypeSubkeyBinding    = 0x18
+	pgpSigTypePrimaryBinding   = 0x19
+	pgpSigTypeDirectKey        = 0x1f
+	pgpSigTypeKeyRevocation    = 0x20
+	pgpSigTypeSubkeyRevocation = 0x28
+)
+
+// OpenPGP signature subpackets, see RFC 4880 section 5.2.3.1 and RFC 9580 section 5.2.3.7.
+const (
+	pgpSubpacketCreationTime      = 2
+	pgpSubpacketExpirationTime    = 3
+	pgpSubpacketKeyExpirationTime = 9
+	pgpSubpacketIssuer            = 16
+	pgpSubpacketKeyFlags          = 27
+	pgpSubpacketEmbeddedSignature = 32
+	pgpSubpacketIssuerFingerprint = 33
+)
+
+// pgpKeyFlagSign is the key flag allowing a key to sign data, see RFC 4880 section 5.2.3.21.
+const pgpKeyFlagSign = 0x02
+
+// pgpOIDEd25519 is the curve OID of legacy EdDSA Ed25519 keys.
+var pgpOIDEd25519 = []byte{0x2b, 0x06, 0x01, 0x04, 0x01, 0xda, 0x47, 0x0f, 0x01}
+
+// pgpHashes maps the accepted OpenPGP hash algorithms to their implementation, SHA-1 and MD5 are not accepted.
+var pgpHashes = map[byte]crypto.Hash{
+	8:  crypto.SHA256,
+	9:  crypto.SHA384,
+	10: crypto.SHA512,
+	11: crypto.SHA224,
+}
+
+// maxSignatureSize bounds the size of detached signatures, which are a few hundred bytes.
+const maxSignatureSize = 64 << 10
+
+// pgpKey is an OpenPGP v4 public key or subkey.
+type pgpKey struct {
+	fingerprint []byte
+	packet      []byte // packet is the body of the key packet, hashed by the signatures certifying the key.
+	created     time.Time
+	rsa         *rsa.PublicKey
+	ed25519     ed25519.PublicKey
+
+	primary   *pgpKey   // primary is the primary key of a subkey, nil for primary keys.
+	certified time.Time // certified is the creation time of the latest valid self-signature or binding signature, zero if there is none.
+	expires   time.Time // expires is when the key expires, never if zero, according to the latest valid self-signature.
+	canSign   bool      // canSign is set if the latest valid self-signature allows the key to sign data.
+	revoked   bool      // revoked is set if the key was revoked by its primary key.
+}
+
+// keyID returns the key ID of k, the low 64 bits of its fingerprint.
+func (k *pgpKey) keyID() []byte {
+	return k.fingerprint[len(k.fingerprint)-8:]
+}
+
+// hashPacket returns the key packet of k as hashed by signatures, see RFC 4880 section 5.2.4.
+func (k *pgpKey) hashPacket() []byte {
+	return append([]byte{0x99, byte(len(k.packet) >> 8), byte(len(k.packet))}, k.packet...)
+}
+
+// usable checks that k may verify signatures of data at now: that it is certified to sign by a self-signature,
+// or a binding signature for subkeys, and is neither revoked nor expired, nor is its primary key.
+func (k *pgpKey) usable(now time.Time) error {
+	for key := k; key != nil; key = key.primary {
+		switch {
+		case key.certified.IsZero() && key.primary == nil:
+			return fmt.Errorf("key %X has no valid self-signature", key.fingerprint)
+		case key.certified.IsZero():
+			return fmt.Errorf("subkey %X has no valid binding signature", key.fingerprint)
+		case key.revoked:
+			return fmt.Errorf("key %X is revoked", key.fingerprint)
+		case !key.expires.IsZero() && !now.Before(key.expires):
+			return fmt.Errorf("key %X expired on %s", key.fingerprint, key.expires.UTC().Format(time.DateOnly))
+		}
+	}
+	if !k.canSign {
+		return fmt.Errorf("key %X is not allowed to sign", k.fingerprint)
+	}
+	return nil
+}
+
+// verify checks that s was made by k over the data, followed by the trailer of s.
+func (k *pgpKey) verify(s *pgpSignature, data ...[]byte) error {
+	h := s.hash.New()
+	for _, b := range data {
+		h.Write(b)
+	}
+	h.Write(s.hashedTrailer)
+	return k.verifyDigest(s, h.Sum(nil))
+}
+
+// verifyDigest checks that s, of the digest, was made by k.
+func (k *pgpKey) verifyDigest(s *pgpSignature, digest []byte) error {
+	if !bytes.Equal(digest[:2], s.hashPrefix) {
+		return errors.New("invalid signature")
+	}
+
+	switch {
+	case k.rsa != nil && s.rsa != nil:
+		// Signatures are MPIs, which drop leading zeros
+		padded := make([]byte, k.rsa.Size())
+		if len(s.rsa) > len(padded) {
+			return errors.New("invalid signature")
+		}
+		copy(padded[len(padded)-len(s.rsa):], s.rsa)
+		if err := rsa.VerifyPKCS1v15(k.rsa, s.hash, digest, padded); err != nil {
+			return errors.New("invalid signature")
+		}
+	case k.ed25519 != nil && s.ed25519 != nil:
+		if !ed25519.Verify(k.ed25519, digest, s.ed25519) {
+			return errors.New("invalid signature")
+		}
+	default:
+		return errors.New("signature algorithm does not match the key")
+	}
+	return nil
+}
+
+// issued reports whether s names k as its issuer.
+func (k *pgpKey) issued(s *pgpSignature) bool {
+	return len(s.issuer) == len(k.fingerprint) && bytes.Equal(s.issuer, k.fingerprint) ||
+		len(s.issuer) == 8 && bytes.Equal(s.issuer, k.keyID())
+}
+
+// certify records the self-signature or binding signature s of k, if it is the latest, with the key usage it grants.
+func (k *pgpKey) certify(s *pgpSignature) {
+	if !k.certified.IsZero() && s.created.Before(k.certified) {
+		return
+	}
+	k.certified = s.created
+	k.canSign = s.keyFlags&pgpKeyFlagSign != 0
+	k.expires = time.Time{}
+	if s.keyExpiry > 0 {
+		k.expires = k.created.Add(s.keyExpiry)
+	}
+}
+
+// Keyring holds the OpenPGP public keys detached signatures are verified against.
+// Only v4 RSA and Ed25519 keys are supported. Keys sign with the signing key flag of their latest valid
+// self-signature, subkeys with that of their binding signature, which must be cross-certified by the subkey.
+// Revoked and expired keys, and keys without a valid self-signature, are rejected, and so are the subkeys of
+// such primary keys. Third-party certifications are ignored: keys are trusted by being in the keyring.
+type Keyring struct {
+	keys []*pgpKey
+}
+
+// loadKeyring reads the OpenPGP public keys at path, as exported by "gpg --export [--armor]".
+func loadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks, err := pgpDearmorAll(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	kr := &Keyring{}
+	for _, block := range blocks {
+		packets, err := pgpReadPackets(block)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		kr.keys = append(kr.keys, pgpReadKeys(packets)...)
+	}
+
+	if len(kr.keys) == 0 {
+		return nil, fmt.Errorf("%s: no supported public keys", path)
+	}
+	return kr, nil
+}
+
+// Verify checks that sig, an armored or binary detached OpenPGP signature, signs the content read from r
+// with one of the keyring's keys, returning the hex encoded fingerprint of the signing key.
+func (kr *Keyring) Verify(r io.Reader, sig []byte) (string, error) {
+	if len(sig) > maxSignatureSize {
+		return "", errors.New("signature too large")
+	}
+
+	blocks, err := pgpDearmorAll(sig)
+	if err != nil {
+		return "", err
+	}
+	if len(blocks) != 1 {
+		return "", errors.New("expected a single signature")
+	}
+	packets, err := pgpReadPackets(blocks[0])
+	if err != nil {
+		return "", err
+	}
+	if len(packets) != 1 || packets[0].tag != pgpTagSignature {
+		return "", errors.New("not a detached signature")
+	}
+
+	s, err := pgpParseSignature(packets[0].body)
+	if err != nil {
+		return "", err
+	}
+	if s.sigType != pgpSigTypeBinary && s.sigType != pgpSigTypeText {
+		return "", fmt.Errorf("unsupported signature type %#x", s.sigType)
+	}
+	if s.issuer == nil {
+		return "", errors.New("signature names no issuer")
+	}
+
+	key := kr.find(s)
+	if key == nil {
+		return "", fmt.Errorf("signed by unknown key %X", s.issuer)
+	}
+	now := time.Now()
+	if err := key.usable(now); err != nil {
+		return "", err
+	}
+	if s.expired(now) {
+		return "", errors.New("signature expired")
+	}
+
+	h := s.hash.New()
+	var w io.Writer = h
+	if s.sigType == pgpSigTypeText {
+		w = &crlfWriter{w: h}
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return "", err
+	}
+	h.Write(s.hashedTrailer)
+	if err := key.verifyDigest(s, h.Sum(nil)); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(key.fingerprint), nil
+}
+
+// find returns the key issuing s, nil if there is none.
+func (kr *Keyring) find(s *pgpSignature) *pgpKey {
+	for _, k := range kr.keys {
+		if k.issued(s) {
+			return k
+		}
+	}
+	return nil
+}
+
+// pgpReadKeys returns the keys and subkeys of packets, a sequence of transferable public keys, see RFC 4880
+// section 11.1, certified by the self-signatures, binding signatures and revocations that follow them. Keys of
+// unsupported algorithms, e.g. encryption subkeys, are skipped, and so are signatures that do not verify.
+func pgpReadKeys(packets []pgpPacket) []*pgpKey {
+	var keys []*pgpKey
+	var primary, subkey *pgpKey
+	var userID []byte // userID is the user ID or attribute, as hashed by certifications, signatures certify, if any.
+	skipped := false  // skipped is set while the signatures of an unsupported key or subkey follow.
+
+	for _, p := range packets {
+		switch p.tag {
+		case pgpTagPublicKey:
+			primary, subkey, userID = nil, nil, nil
+			key, err := pgpParsePublicKey(p.body)
+			if skipped = err != nil; !skipped {
+				primary = key
+				keys = append(keys, key)
+			}
+		case pgpTagPublicSub:
+			subkey, userID = nil, nil
+			key, err := pgpParsePublicKey(p.body)
+			if skipped = err != nil || primary == nil; !skipped {
+				key.primary = primary
+				subkey = key
+				keys = append(keys, key)
+			}
+		case pgpTagUserID, pgpTagUserAttribute:
+			prefix := byte(0xb4)
+			if p.tag == pgpTagUserAttribute {
+				prefix = 0xd1
+			}
+			userID = binary.BigEndian.AppendUint32([]byte{prefix}, uint32(len(p.body)))
+			userID = append(userID, p.body...)
+		case pgpTagSignature:
+			if skipped || primary == nil {
+				continue
+			}
+			s, err := pgpParseSignature(p.body)
+			if err != nil || !primary.issued(s) {
+				continue
+			}
+			if s.expired(time.Now()) {
+				continue
+			}
+			pgpCertify(primary, subkey, userID, s)
+		}
+	}
+	return keys
+}
+
+// pgpCertify applies s, a signature issued by the primary key following subkey, if not nil, or else userID, if
+// not nil, in a transferable public key, to the key it certifies or revokes, if it verifies.
+func pgpCertify(primary, subkey *pgpKey, userID []byte, s *pgpSignature) {
+	switch {
+	case s.sigType == pgpSigTypeKeyRevocation && subkey == nil && userID == nil:
+		if primary.verify(s, primary.hashPacket()) == nil {
+			primary.revoked = true
+		}
+	case s.sigType == pgpSigTypeDirectKey && subkey == nil && userID == nil:
+		if primary.verify(s, primary.hashPacket()) == nil {
+			primary.certify(s)
+		}
+	case s.sigType >= pgpSigTypeCertGeneric && s.sigType <= pgpSigTypeCertPositive && subkey == nil && userID != nil:
+		if primary.verify(s, primary.hashPacket(), userID) == nil {
+			primary.certify(s)
+		}
+	case s.sigType == pgpSigTypeSubkeyRevocation && subkey != nil:
+		if primary.verify(s, primary.hashPacket(), subkey.hashPacket()) == nil {
+			subkey.revoked = true
+		}
+	case s.sigType == pgpSigTypeSubkeyBinding && subkey != nil:
+		if primary.verify(s, primary.hashPacket(), subkey.hashPacket()) != nil {
+			return
+		}
+		// Signing subkeys cross-certify their binding, so that no one may claim another's subkey as theirs
+		if s.keyFlags&pgpKeyFlagSign != 0 {
+			embedded, err := pgpParseSignature(s.embedded)
+			if err != nil || embedded.sigType != pgpSigTypePrimaryBinding ||
+				subkey.verify(embedded, primary.hashPacket(), subkey.hashPacket()) != nil {
+				return
+			}
+		}
+		subkey.certify(s)
+	}
+}
+
+// pgpSignature is a parsed v4 signature packet.
+type pgpSignature struct {
+	sigType       byte
+	hash          crypto.Hash
+	hashPrefix    []byte // hashPrefix holds the leftmost 16 bits of the signed digest.
+	hashedTrailer []byte // hashedTrailer is hashed after the signed content.
+	issuer        []byte // issuer is the fingerprint or key ID of the signing key.
+	rsa           []byte
+	ed25519       []byte
+
+	// The following are read from the hashed subpackets, but for embedded, which authenticates itself.
+	created   time.Time
+	expiry    time.Duration // expiry is the validity of the signature after its creation, unlimited if 0.
+	keyExpiry time.Duration // keyExpiry is the validity of the signed key after its creation, unlimited if 0.
+	keyFlags  byte
+	embedded  []byte // embedded is the body of the embedded signature, the cross-certification of a signing subkey.
+}
+
+// expired reports whether s expired at now.
+func (s *pgpSignature) expired(now time.Time) bool {
+	return s.expiry > 0 && !now.Before(s.created.Add(s.expiry))
+}
+
+// pgpParseSignature parses the body of a v4 signature packet.
+func pgpParseSignature(b []byte) (*pgpSignature, error) {
+	errTruncated := errors.New("truncated signature packet")
+
+	if len(b) < 6 {
+		return nil, errTruncated
+	}
+	if b[0] != 4 {
+		return nil, fmt.Errorf("unsupported signature version %d", b[0])
+	}
+
+	s := &pgpSignature{sigType: b[1]}
+
+	algo := b[2]
+	var ok bool
+	if s.hash, ok = pgpHashes[b[3]]; !ok {
+		return nil, fmt.Errorf("unsupported signature hash algorithm %d", b[3])
+	}
+
+	hashedLen := int(binary.BigEndian.Uint16(b[4:]))
+	if len(b) < 6+hashedLen+2 {
+		return nil, errTruncated
+	}
+	hashed := b[6 : 6+hashedLen]
+
+	// The trailer hashes the version, type, algorithms and hashed subpackets, followed by their length
+	s.hashedTrailer = append([]byte{}, b[:6+hashedLen]...)
+	s.hashedTrailer = append(s.hashedTrailer, 4, 0xff)
+	s.hashedTrailer = binary.BigEndian.AppendUint32(s.hashedTrailer, uint32(6+hashedLen))
+
+	rest := b[6+hashedLen:]
+	unhashedLen := int(binary.BigEndian.Uint16(rest))
+	if len(rest) < 2+unhashedLen+2 {
+		return nil, errTruncated
+	}
+	unhashed := rest[2 : 2+unhashedLen]
+	rest = rest[2+unhashedLen:]
+
+	if err := pgpParseSubpackets(hashed, true, s); err != nil {
+		return nil, err
+	}
+	if err := pgpParseSubpackets(unhashed, false, s); err != nil {
+		return nil, err
+	}
+
+	s.hashPrefix = rest[:2]
+	rest = rest[2:]
+
+	switch algo {
+	case pgpAlgoRSA, pgpAlgoRSASignOnly:
+		mpi, _, err := pgpReadMPI(rest)
+		if err != nil {
+			return nil, err
+		}
+		s.rsa = mpi
+	case pgpAlgoEdDSALegacy:
+		r, rest, err := pgpReadMPI(rest)
+		if err != nil {
+			return nil, err
+		}
+		sv, _, err := pgpReadMPI(rest)
+		if err != nil {
+			return nil, err
+		}
+		if len(r) > 32 || len(sv) > 32 {
+			return nil, errors.New("invalid EdDSA signature")
+		}
+		s.ed25519 = make([]byte, 64)
+		copy(s.ed25519[32-len(r):32], r)
+		copy(s.ed25519[64-len(sv):], sv)
+	case pgpAlgoEd25519:
+		if len(rest) < 64 {
+			return nil, errTruncated
+		}
+		s.ed25519 = rest[:64]
+	default:
+		return nil, fmt.Errorf("unsupported signature algorithm %d", algo)
+	}
+
+	return s, nil
+}
+
+// pgpParseSubpackets records the subpackets b of s, hashed or not, in s, preferring fingerprints to name the issuer.
+// Only hashed subpackets are trusted, but for those naming the issuer and embedded signatures, which are verified.
+func pgpParseSubpackets(b []byte, hashed bool, s *pgpSignature) error {
+	for len(b) > 0 {
+		var n int
+		switch {
+		case b[0] < 192:
+			n, b = int(b[0]), b[1:]
+		case b[0] < 255:
+			if len(b) < 2 {
+				return errors.New("truncated signature subpacket")
+			}
+			n, b = (int(b[0])-192)<<8+int(b[1])+192, b[2:]
+		default:
+			if len(b) < 5 {
+				return errors.New("truncated signature subpacket")
+			}
+			n, b = int(binary.BigEndian.Uint32(b[1:])), b[5:]
+		}
+		if n == 0 || len(b) < n {
+			return errors.New("truncated signature subpacket")
+		}
+
+		critical, typ, data := b[0]&0x80 != 0, b[0]&0x7f, b[1:n]
+		seconds := func() time.Duration {
+			if len(data) != 4 {
+				return 0
+			}
+			return time.Duration(binary.BigEndian.Uint32(data)) * time.Second
+		}
+		switch {
+		case typ == pgpSubpacketIssuerFingerprint && len(data) == 21 && data[0] == 4:
+			s.issuer = data[1:]
+		case typ == pgpSubpacketIssuer && len(data) == 8:
+			if s.issuer == nil {
+				s.issuer = data
+			}
+		case typ == pgpSubpacketEmbeddedSignature:
+			s.embedded = data
+		case !hashed:
+		case typ == pgpSubpacketCreationTime && len(data) == 4:
+			s.created = time.Unix(int64(binary.BigEndian.Uint32(data)), 0)
+		case typ == pgpSubpacketExpirationTime:
+			s.expiry = seconds()
+		case typ == pgpSubpacketKeyExpirationTime:
+			s.keyExpiry = seconds()
+		case typ == pgpSubpacketKeyFlags && len(data) > 0:
+			s.keyFlags = data[0]
+		case critical:
+			return fmt.Errorf("unsupported critical signature subpacket %d", typ)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// pgpParsePublicKey parses the body of a v4 public key or subkey packet.
+func pgpParsePublicKey(b []byte) (*pgpKey, error) {
+	if len(b) < 6 || b[0] != 4 {
+		return nil, errors.New("unsupported public key version")
+	}
+
+	fp := sha1.New()
+	fp.Write([]byte{0x99, byte(len(b) >> 8), byte(len(b))})
+	fp.Write(b)
+	key := &pgpKey{fingerprint: fp.Sum(nil), packet: b, created: time.Unix(int64(binary.BigEndian.Uint32(b[1:])), 0)}
+
+	material := b[6:]
+	switch b[5] {
+	case pgpAlgoRSA, pgpAlgoRSASignOnly:
+		n, rest, err := pgpReadMPI(material)
+		if err != nil {
+			return nil, err
+		}
+		e, _, err := pgpReadMPI(rest)
+		if err != nil {
+			return nil, err
+		}
+		if len(e) > 4 {
+			return nil, errors.New("unsupported RSA exponent")
+		}
+		key.rsa = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case pgpAlgoEdDSALegacy:
+		if len(material) < 1 || len(material) < 1+int(material[0]) {
+			return nil, errors.New("truncated public key")
+		}
+		if !bytes.Equal(material[1:1+int(material[0])], pgpOIDEd25519) {
+			return nil, errors.New("unsupported EdDSA curve")
+		}
+		point, _, err := pgpReadMPI(material[1+int(material[0]):])
+		if err != nil {
+			return nil, err
+		}
+		// Points are prefixed with 0x40, marking their native encoding
+		if len(point) != 33 || point[0] != 0x40 {
+			return nil, errors.New("invalid Ed25519 public key")
+		}
+		key.ed25519 = ed25519.PublicKey(point[1:])
+	case pgpAlgoEd25519:
+		if len(material) < ed25519.PublicKeySize {
+			return nil, errors.New("truncated public key")
+		}
+		key.ed25519 = ed25519.PublicKey(material[:ed25519.PublicKeySize])
+	default:
+		return nil, fmt.Errorf("unsupported public key algorithm %d", b[5])
+	}
+
+	return key, nil
+}
+
+// pgpReadMPI reads a multiprecision integer from b, returning its big-endian bytes and the rest of b.
+func pgpReadMPI(b []byte) ([]byte, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, errors.New("truncated MPI")
+	}
+	n := (int(binary.BigEndian.Uint16(b)) + 7) / 8
+	if len(b) < 2+n {
+		return nil, nil, errors.New("truncated MPI")
+	}
+	return b[2 : 2+n], b[2+n:], nil
+}
+
+// pgpPacket is an OpenPGP packet.
+type pgpPacket struct {
+	tag  byte
+	body []byte
+}
+
+// pgpReadPackets splits b into OpenPGP packets.
+func pgpReadPackets(b []byte) ([]pgpPacket, error) {
+	errTruncated := errors.New("truncated OpenPGP packet")
+
+	var packets []pgpPacket
+	for len(b) > 0 {
+		header := b[0]
+		if header&0x80 == 0 {
+			return nil, errors.New("invalid OpenPGP packet header")
+		}
+		b = b[1:]
+
+		var p pgpPacket
+		if header&0x40 == 0 {
+			// Old format packet
+			p.tag = header >> 2 & 0x0f
+			var n int
+			switch header & 0x03 {
+			case 0:
+				if len(b) < 1 {
+					return nil, errTruncated
+				}
+				n, b = int(b[0]), b[1:]
+			case 1:
+				if len(b) < 2 {
+					return nil, errTruncated
+				}
+				n, b = int(binary.BigEndian.Uint16(b)), b[2:]
+			case 2:
+				if len(b) < 4 {
+					return nil, errTruncated
+				}
+				n, b = int(binary.BigEndian.Uint32(b)), b[4:]
+			default:
+				n = len(b)
+			}
+			if len(b) < n {
+				return nil, errTruncated
+			}
+			p.body, b = b[:n], b[n:]
+		} else {
+			// New format packet, whose body may come in partial lengths
+			p.tag = header & 0x3f
+			for {
+				if len(b) < 1 {
+					return nil, errTruncated
+				}
+				var n int
+				partial := false
+				switch {
+				case b[0] < 192:
+					n, b = int(b[0]), b[1:]
+				case b[0] < 224:
+					if len(b) < 2 {
+						return nil, errTruncated
+					}
+					n, b = (int(b[0])-192)<<8+int(b[1])+192, b[2:]
+				case b[0] < 255:
+					n, b, partial = 1<<(b[0]&0x1f), b[1:], true
+				default:
+					if len(b) < 5 {
+						return nil, errTruncated
+					}
+					n, b = int(binary.BigEndian.Uint32(b[1:])), b[5:]
+				}
+				if len(b) < n {
+					return nil, errTruncated
+				}
+				p.body, b = append(p.body, b[:n]...), b[n:]
+				if !partial {
+					break
+				}
+			}
+		}
+
+		packets = append(packets, p)
+	}
+	return packets, nil
+}
+
+// pgpDearmorAll returns the binary content of the ASCII armored blocks of data, or data itself if it is not armored.
+func pgpDearmorAll(data []byte) ([][]byte, error) {
+	if !bytes.Contains(data, []byte("-----BEGIN PGP ")) {
+		return [][]byte{data}, nil
+	}
+
+	var blocks [][]byte
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		if !strings.HasPrefix(sc.Text(), "-----BEGIN PGP ") {
+			continue
+		}
+
+		// Armor headers end with an empty line
+		for sc.Scan() && strings.TrimSpace(sc.Text()) != "" {
+		}
+
+		var b64 strings.Builder
+		var checksum string
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if strings.HasPrefix(line, "-----END PGP ") {
+				break
+			}
+			if strings.HasPrefix(line, "=") {
+				checksum = line[1:]
+				continue
+			}
+			b64.WriteString(line)
+		}
+
+		block, err := base64.StdEncoding.DecodeString(b64.String())
+		if err != nil {
+			return nil, fmt.Errorf("invalid armor: %w", err)
+		}
+		if checksum != "" {
+			want, err := base64.StdEncoding.DecodeString(checksum)
+			crc := pgpCRC24(block)
+			if err != nil || len(want) != 3 || !bytes.Equal(want, []byte{byte(crc >> 16), byte(crc >> 8), byte(crc)}) {
+				return nil, errors.New("invalid armor checksum")
+			}
+		}
+		blocks = append(blocks, block)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(blocks) == 0 {
+		return nil, errors.New("invalid armor")
+	}
+	return blocks, nil
+}
+
+// pgpCRC24 returns the CRC-24 checksum of armored data, see RFC 4880 section 6.1.
+func pgpCRC24(b []byte) uint32 {
+	crc := uint32(0xb704ce)
+	for _, c := range b {
+		crc ^= uint32(c) << 16
+		for range 8 {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= 0x1864cfb
+			}
+		}
+	}
+	return crc & 0xffffff
+}
+
+// crlfWriter canonicalizes the line endings of text signed by text signatures to CRLF as it writes to w.
+type crlfWriter struct {
+	w      io.Writer
+	lastCR bool
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	var buf []byte
+	for _, b := range p {
+		if b == '\n' && !c.lastCR {
+			buf = append(buf, '\r')
+		}
+		buf = append(buf, b)
+		c.lastCR = b == '\r'
+	}
+	if _, err := c.w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The keyrings and signatures of testdata/openpgp are generated by its gen.sh, which describes each case.
+
+func TestKeyringVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		vector  string // vector is the case of testdata/openpgp, whose signature <vector>.sig is verified.
+		keyring string // keyring is the file of testdata/openpgp holding the keyring, <vector>.asc if empty.
+		data    string // data is the signed content, that of data.txt if empty.
+		wantErr string // wantErr is expected in the error, the signature is expected to verify if empty.
+	}{
+		{name: "valid", vector: "valid"},
+		{name: "subkey", vector: "subkey"},
+		{name: "tampered content", vector: "valid", data: "hello, world\n", wantErr: "invalid signature"},
+		{name: "revoked", vector: "revoked", wantErr: "is revoked"},
+		{name: "expired", vector: "expired", wantErr: "expired on 2020-01-02"},
+		{name: "no signing flag", vector: "nosign", wantErr: "is not allowed to sign"},
+		{name: "revoked subkey", vector: "revoked-subkey", wantErr: "is revoked"},
+		{name: "invalid binding signature", vector: "bad-binding", keyring: "bad-binding.gpg", wantErr: "has no valid binding signature"},
+		{name: "unknown key", vector: "subkey", keyring: "valid.asc", wantErr: "signed by unknown key"},
+	}
+
+	dir := filepath.Join("testdata", "openpgp")
+	data, err := os.ReadFile(filepath.Join(dir, "data.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyring := tt.keyring
+			if keyring == "" {
+				keyring = tt.vector + ".asc"
+			}
+			kr, err := loadKeyring(filepath.Join(dir, keyring))
+			if err != nil {
+				t.Fatalf("loadKeyring() = %v", err)
+			}
+			sig, err := os.ReadFile(filepath.Join(dir, tt.vector+".sig"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			content := data
+			if tt.data != "" {
+				content = []byte(tt.data)
+			}
+
+			signer, err := kr.Verify(bytes.NewReader(content), sig)
+			if tt.wantErr == "" {
+				if err != nil || len(signer) != 40 {
+					t.Errorf("Verify() = %q, %v, want a fingerprint", signer, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Verify() = %q, %v, want an error containing %q", signer, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/Gabriel-Ladzaretti/go-multipart/internal/httpx"
+)
+
+// opsShutdownTimeout bounds the shutdown of the ops listener, which only serves short requests.
+const opsShutdownTimeout = 5 * time.Second
+
+// opsHandler returns the handler of the private ops listener, which serves the health checks, the metrics,
+// the status of background jobs, the pprof profiles and the admin API, without the authentication of the data
+// plane. The admin API still requires the admin token. Like the metrics, pprof leaves out the command line.
+func (s *Server) opsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", healthz(&s.healthy))
+	mux.Handle("/readyz", healthz(&s.healthy))
+	mux.Handle("/livez", livez())
+	mux.Handle("GET /debug/vars", vars())
+	mux.Handle("GET /statusz", statusz(s.backup))
+	mux.Handle("GET /internal/metrics", internalMetrics(s.metrics))
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	s.addAdminRoutes(mux, newBuckets(s.config.dir, s.logger))
+	return mux
+}
+
+// serveOps starts serving handler on the ops listener at addr on network until ctx is done, when it is shut down.
+// The listener is bound before serveOps returns, so a taken address fails startup.
+func serveOps(ctx context.Context, logger *log.Logger, network, addr string, handler http.Handler) (<-chan struct{}, error) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := &http.Server{Handler: handler, ErrorLog: logger, ReadHeaderTimeout: 10 * time.Second}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		logger.Printf("ops listening on %s\n", httpx.DescribeListener(network, ln.Addr()))
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			logger.Printf("Error serving ops listener: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), opsShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logger.Printf("Error shutting down ops listener: %v", err)
+		}
+	}()
+	return done, nil
+}
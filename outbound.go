@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// tlsVersions maps the values of -outbound-tls-min-version to TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// outboundDNSTimeout bounds connecting to the DNS server set by -outbound-dns.
+const outboundDNSTimeout = 5 * time.Second
+
+// outboundDialTimeout bounds the outbound connections made without a timeout of their own.
+const outboundDialTimeout = 30 * time.Second
+
+// Outbound holds the settings of the outbound connections of a [Server], set by the -outbound-* flags: the HTTP
+// transport of its outbound requests, e.g. webhooks, callbacks, remote fetches, OPA queries and S3, with their
+// proxy and TLS settings, and the resolver and host overrides of those and of its connections to Redis, NATS, MQTT
+// and the SFTP host. Each server has its own, the process-wide defaults of the net and net/http packages are left
+// as is. A nil *Outbound makes connections with those defaults.
+type Outbound struct {
+	transport *http.Transport
+	proxy     func(*http.Request) (*url.URL, error) // proxy returns the proxy of HTTP requests, see [outboundProxyFunc].
+	resolver  *net.Resolver
+	hosts     map[string]string // hosts maps host names to the addresses connections to them are made to instead of the ones they resolve to.
+}
+
+// newOutbound returns the settings of outbound connections configured by config.
+func newOutbound(config Config) (*Outbound, error) {
+	tlsConfig, err := outboundTLSConfig(config.outboundCAFile, config.outboundInsecureSkipVerify, config.outboundTLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := parseOutboundHosts(config.outboundHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	proxy, err := outboundProxyFunc(config.outboundProxy, noProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &Outbound{proxy: proxy, resolver: &net.Resolver{}, hosts: hosts}
+	if config.outboundDNS != "" {
+		var d net.Dialer
+		o.resolver.PreferGo = true
+		o.resolver.Dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			ctx, cancel := context.WithTimeout(ctx, outboundDNSTimeout)
+			defer cancel()
+			return d.DialContext(ctx, network, config.outboundDNS)
+		}
+	}
+
+	o.transport = http.DefaultTransport.(*http.Transport).Clone()
+	o.transport.Proxy = o.proxy
+	o.transport.TLSClientConfig = tlsConfig
+	o.transport.DialContext = o.dialContext
+	return o, nil
+}
+
+// client returns an HTTP client making requests with the transport of o, within timeout unless 0.
+func (o *Outbound) client(timeout time.Duration) *http.Client {
+	if o == nil {
+		return &http.Client{Timeout: timeout}
+	}
+	return &http.Client{Transport: o.transport, Timeout: timeout}
+}
+
+// httpTransport returns a copy of the transport of o, for clients changing its settings.
+func (o *Outbound) httpTransport() *http.Transport {
+	if o == nil {
+		return http.DefaultTransport.(*http.Transport).Clone()
+	}
+	return o.transport.Clone()
+}
+
+// proxyFunc returns the function choosing the proxy of the HTTP requests made with o.
+func (o *Outbound) proxyFunc() func(*http.Request) (*url.URL, error) {
+	if o == nil {
+		return http.ProxyFromEnvironment
+	}
+	return o.proxy
+}
+
+// netResolver returns the resolver of o.
+func (o *Outbound) netResolver() *net.Resolver {
+	if o == nil {
+		return net.DefaultResolver
+	}
+	return o.resolver
+}
+
+// dialer returns a dialer resolving hosts with the resolver of o, connecting within timeout.
+func (o *Outbound) dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second, Resolver: o.netResolver()}
+}
+
+// dialContext connects to addr, a host and port, with the resolver and host overrides of o.
+func (o *Outbound) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return o.dialer(outboundDialTimeout).DialContext(ctx, network, o.overrideHost(addr))
+}
+
+// dial connects to addr like dialContext, within timeout.
+func (o *Outbound) dial(network, addr string, timeout time.Duration) (net.Conn, error) {
+	return o.dialer(timeout).Dial(network, o.overrideHost(addr))
+}
+
+// lookupHost returns the address connections to host are made to instead of the ones it resolves to, if any.
+func (o *Outbound) lookupHost(host string) (string, bool) {
+	if o == nil {
+		return "", false
+	}
+	addr, ok := o.hosts[strings.ToLower(host)]
+	return addr, ok
+}
+
+// outboundTLSConfig returns the TLS configuration of outbound connections, trusting the certificates in the PEM
+// file caFile, if any, besides the system ones.
+func outboundTLSConfig(caFile string, insecureSkipVerify bool, minVersion string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown TLS version %q, expected one of 1.0, 1.1, 1.2 or 1.3", minVersion)
+	}
+	c := &tls.Config{MinVersion: version, InsecureSkipVerify: insecureSkipVerify}
+	if caFile == "" {
+		return c, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	if c.RootCAs, err = x509.SystemCertPool(); err != nil {
+		c.RootCAs = x509.NewCertPool()
+	}
+	if !c.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s holds no PEM encoded certificates", caFile)
+	}
+	return c, nil
+}
+
+// parseOutboundHosts parses the comma separated list of host=address overrides set by -outbound-hosts.
+func parseOutboundHosts(list string) (map[string]string, error) {
+	hosts := map[string]string{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		host, addr, ok := strings.Cut(entry, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		ip, err := netip.ParseAddr(strings.TrimSpace(addr))
+		if !ok || host == "" || err != nil {
+			return nil, fmt.Errorf("%q is not a host=address override", entry)
+		}
+		hosts[host] = ip.String()
+	}
+	return hosts, nil
+}
+
+// overrideHost returns addr, a host and port, with the host replaced by its override in o, if any.
+func (o *Outbound) overrideHost(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip, ok := o.lookupHost(host); ok {
+		return net.JoinHostPort(ip, port)
+	}
+	return addr
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultStepTimeout bounds the commands and webhook requests of pipeline steps without a timeout.
+const defaultStepTimeout = 30 * time.Second
+
+// Pipeline steps, see [pipelineStep].
+const (
+	stepChecksum  = "checksum"  // stepChecksum records additional checksums of the file in its metadata.
+	stepScan      = "scan"      // stepScan rejects the file if a command exits with a non-zero status.
+	stepThumbnail = "thumbnail" // stepThumbnail attaches a preview rendered by a command.
+	stepExtract   = "extract"   // stepExtract attaches content, e.g. text, extracted by a command.
+	stepWebhook   = "webhook"   // stepWebhook posts the metadata of the file to a URL.
+)
+
+// checksumAlgorithms are the hash functions of checksum steps, by name.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":         md5.New,
+	"sha1":        sha1.New,
+	"sha256":      sha256.New,
+	"sha512":      sha512.New,
+	"blake2b-512": newBLAKE2b512,
+}
+
+// pipelineStep is a step of a post-processing pipeline.
+type pipelineStep struct {
+	Step        string   `json:"step"`                   // Step is one of checksum, scan, thumbnail, extract or webhook.
+	Algorithms  []string `json:"algorithms,omitempty"`   // Algorithms are the checksums computed by checksum steps.
+	Command     string   `json:"command,omitempty"`      // Command is run by scan, thumbnail and extract steps, with {in} and {out} placeholders.
+	Kind        string   `json:"kind,omitempty"`         // Kind is the kind of the attachment of thumbnail and extract steps.
+	ContentType string   `json:"content_type,omitempty"` // ContentType is the content type of the attachment, sniffed if unset.
+	URL         string   `json:"url,omitempty"`          // URL is where webhook steps post the metadata.
+	Timeout     duration `json:"timeout,omitempty"`      // Timeout bounds the command or webhook request, defaultStepTimeout if unset.
+}
+
+// pipelineRule runs its steps, in order, on the stored files matching one of its patterns.
+type pipelineRule struct {
+	Match []string       `json:"match"` // Match are glob patterns, e.g. "*.pdf", matched case-insensitively against file names.
+	Steps []pipelineStep `json:"steps"`
+}
+
+// Pipelines are the post-processing pipelines of stored files, read from the JSON file it is set to, a list
+// of [pipelineRule]. It implements [flag.Value]. Files are processed by the first rule matching their name.
+// The zero Pipelines processes no file.
+type Pipelines struct {
+	path  string
+	rules []pipelineRule
+}
+
+func (p Pipelines) String() string {
+	return p.path
+}
+
+func (p *Pipelines) Set(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var rules []pipelineRule
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&rules); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	for i := range rules {
+		if err := rules[i].check(); err != nil {
+			return fmt.Errorf("%s: rule %d: %w", path, i+1, err)
+		}
+	}
+
+	*p = Pipelines{path: path, rules: rules}
+	return nil
+}
+
+// check validates r and fills in the defaults of its steps.
+func (r *pipelineRule) check() error {
+	if len(r.Match) == 0 {
+		return errors.New("no patterns to match")
+	}
+	for i, pattern := range r.Match {
+		r.Match[i] = strings.ToLower(pattern)
+		if _, err := filepath.Match(r.Match[i], ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	for i := range r.Steps {
+		s := &r.Steps[i]
+		if s.Timeout == 0 {
+			s.Timeout = duration(defaultStepTimeout)
+		}
+
+		switch s.Step {
+		case stepChecksum:
+			if len(s.Algorithms) == 0 {
+				return errors.New("checksum step without algorithms")
+			}
+			for _, alg := range s.Algorithms {
+				if checksumAlgorithms[alg] == nil {
+					return fmt.Errorf("unknown checksum algorithm %q", alg)
+				}
+			}
+		case stepScan, stepThumbnail, stepExtract:
+			if len(strings.Fields(s.Command)) == 0 {
+				return fmt.Errorf("%s step without command", s.Step)
+			}
+			if s.Step == stepThumbnail && s.Kind == "" {
+				s.Kind = "thumbnail"
+			}
+			if s.Step == stepExtract && s.Kind == "" {
+				s.Kind = "text"
+			}
+			if s.Step != stepScan && !validFileName(s.Kind) {
+				return fmt.Errorf("invalid attachment kind %q", s.Kind)
+			}
+		case stepWebhook:
+			if u, err := url.Parse(s.URL); err != nil || u.Scheme != "http" && u.Scheme != "https" {
+				return fmt.Errorf("invalid webhook URL %q", s.URL)
+			}
+		default:
+			return fmt.Errorf("unknown step %q", s.Step)
+		}
+	}
+	return nil
+}
+
+// steps returns the steps of the first rule matching the file name, nil if none does.
+func (p Pipelines) steps(name string) []pipelineStep {
+	name = strings.ToLower(name)
+	for _, r := range p.rules {
+		for _, pattern := range r.Match {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return r.Steps
+			}
+		}
+	}
+	return nil
+}
+
+// run runs the pipeline of the file m of the upload uc, stored at path, updating m with the checksums and
+// attachments recorded by its steps. Scans rejecting the file return a [*RejectionError]. Thumbnail, extract
+// and webhook steps failing are logged and skipped. Commands are not run on files encrypted by the client.
+func (p Pipelines) run(uc *UploadContext, path string, m *Metadata) error {
+	for _, s := range p.steps(m.Name) {
+		if m.Encryption != nil && s.Command != "" {
+			continue
+		}
+
+		var err error
+		switch s.Step {
+		case stepChecksum:
+			err = s.checksum(path, m)
+		case stepScan:
+			if err := runSanitizer(strings.Fields(s.Command), path, "", time.Duration(s.Timeout)); err != nil {
+				uc.Logger.Printf("Scan of %s failed: %v", m.Name, err)
+				return &RejectionError{http.StatusUnprocessableEntity, "rejected by scan"}
+			}
+		case stepThumbnail, stepExtract:
+			if err := s.attach(uc, path, m); err != nil {
+				uc.Logger.Printf("Error running %s step on %s: %v", s.Step, m.Name, err)
+			}
+		case stepWebhook:
+			if err := s.post(uc.Storage.Outbound.client(0), *m); err != nil {
+				uc.Logger.Printf("Error posting %s to webhook: %v", m.Name, err)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s step: %w", s.Step, err)
+		}
+	}
+	return nil
+}
+
+// checksum records the checksums of the file at path in m.
+func (s pipelineStep) checksum(path string, m *Metadata) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hashes := make([]hash.Hash, len(s.Algorithms))
+	writers := make([]io.Writer, len(s.Algorithms))
+	for i, alg := range s.Algorithms {
+		hashes[i] = checksumAlgorithms[alg]()
+		writers[i] = hashes[i]
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return err
+	}
+
+	if m.Checksums == nil {
+		m.Checksums = make(map[string]string)
+	}
+	for i, alg := range s.Algorithms {
+		m.Checksums[alg] = hex.EncodeToString(hashes[i].Sum(nil))
+	}
+	return nil
+}
+
+// attach runs the command of s on the file at path and stores its output as the attachment of kind s.Kind of m.
+func (s pipelineStep) attach(uc *UploadContext, path string, m *Metadata) error {
+	dir := attachmentsPath(uc.Storage.Dir, m.Name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+s.Kind+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := runSanitizer(strings.Fields(s.Command), path, tmp.Name(), time.Duration(s.Timeout)); err != nil {
+		return err
+	}
+
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(tmp, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(h, tmp)
+	if err != nil {
+		return err
+	}
+	if err := uc.Storage.Fsync.sync(tmp, dir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, s.Kind)); err != nil {
+		return err
+	}
+
+	contentType := s.ContentType
+	if contentType == "" {
+		contentType = http.DetectContentType(head[:n])
+	}
+	if m.Attachments == nil {
+		m.Attachments = make(map[string]Attachment)
+	}
+	m.Attachments[s.Kind] = Attachment{
+		Size:        size,
+		ContentType: contentType,
+		SHA256:      hex.EncodeToString(h.Sum(nil)),
+		UploadedAt:  time.Now().UTC(),
+	}
+	return nil
+}
+
+// post posts m as JSON to the URL of s with client.
+func (s pipelineStep) post(client *http.Client, m Metadata) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.Timeout))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s: %s", s.URL, resp.Status)
+	}
+	return nil
+}
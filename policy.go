@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// policySizeUnits are the multipliers of the size suffixes of policy rules, e.g. "1GB".
+var policySizeUnits = map[string]int64{"": 1, "b": 1, "kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30, "tb": 1 << 40}
+
+// policyClause compares a property of uploads with a value, e.g. "size > 1GB".
+type policyClause struct {
+	field string   // field is one of name, ext, type, size, identity or meta.<key>.
+	op    string   // op is one of ==, !=, <, <=, >, >=, in or matches.
+	value string   // value is the operand of string comparisons and globs.
+	size  int64    // size is the operand of size comparisons.
+	list  []string // list is the operand of in, the members of a group if it names one.
+	group bool     // group reports whether list holds the members of a group, CIDR ranges or globs.
+}
+
+// policyRule allows or denies the uploads matching all of its when clauses, unless they also match all of
+// its unless clauses.
+type policyRule struct {
+	line   int // line is the line of the rule in the policy file.
+	allow  bool
+	when   []policyClause
+	unless []policyClause
+	reason string // reason is sent to clients whose uploads the rule denies.
+}
+
+// Policy authorizes uploads with the rules read from the file it is set to. It implements [flag.Value] and
+// [Validator]. Rules are evaluated in order and the first matching one decides, uploads matching none are
+// allowed. A rule is a line of the form
+//
+//	allow|deny [if <clause> [and <clause>...]] [unless <clause> [and <clause>...]] ["reason"]
+//
+// and groups of identities are declared with
+//
+//	group <name> <IP, CIDR range or glob>...
+//
+// See the readme for the fields and operators of clauses. The zero Policy allows every upload.
+type Policy struct {
+	path  string
+	rules []policyRule
+}
+
+func (p Policy) String() string {
+	return p.path
+}
+
+func (p *Policy) Set(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	groups := make(map[string][]string)
+	var rules []policyRule
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if fields[0] == "group" {
+			if len(fields) < 3 {
+				return fmt.Errorf("%s:%d: group without members", path, line)
+			}
+			groups[fields[1]] = append(groups[fields[1]], fields[2:]...)
+			continue
+		}
+
+		rule, err := parsePolicyRule(text, groups)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		rule.line = line
+		rules = append(rules, rule)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	*p = Policy{path: path, rules: rules}
+	return nil
+}
+
+// parsePolicyRule parses the rule text, resolving the groups it refers to in groups.
+func parsePolicyRule(text string, groups map[string][]string) (policyRule, error) {
+	var rule policyRule
+	if i := strings.IndexByte(text, '"'); i >= 0 {
+		reason, err := strconv.Unquote(strings.TrimSpace(text[i:]))
+		if err != nil {
+			return rule, fmt.Errorf("invalid reason %s", text[i:])
+		}
+		text, rule.reason = text[:i], reason
+	}
+
+	tokens := strings.Fields(text)
+	if len(tokens) == 0 {
+		return rule, fmt.Errorf("missing action, expected allow, deny or group")
+	}
+	switch tokens[0] {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return rule, fmt.Errorf("unknown action %q, expected allow, deny or group", tokens[0])
+	}
+	tokens = tokens[1:]
+
+	for len(tokens) > 0 {
+		keyword := tokens[0]
+		if keyword != "if" && keyword != "unless" || keyword == "if" && (rule.when != nil || rule.unless != nil) {
+			return rule, fmt.Errorf("unexpected %q", keyword)
+		}
+
+		var clauses []policyClause
+		for tokens = tokens[1:]; ; tokens = tokens[1:] {
+			clause, rest, err := parsePolicyClause(tokens, groups)
+			if err != nil {
+				return rule, err
+			}
+			clauses, tokens = append(clauses, clause), rest
+			if len(tokens) == 0 || tokens[0] != "and" {
+				break
+			}
+		}
+
+		if keyword == "if" {
+			rule.when = clauses
+		} else if rule.unless == nil {
+			rule.unless = clauses
+		} else {
+			return rule, fmt.Errorf("unexpected %q", keyword)
+		}
+	}
+	return rule, nil
+}
+
+// parsePolicyClause parses the clause at the start of tokens, returning the tokens after it.
+func parsePolicyClause(tokens []string, groups map[string][]string) (policyClause, []string, error) {
+	if len(tokens) < 3 {
+		return policyClause{}, nil, fmt.Errorf("incomplete clause %q", strings.Join(tokens, " "))
+	}
+
+	c := policyClause{field: tokens[0], op: tokens[1], value: tokens[2]}
+	rest := tokens[3:]
+	switch {
+	case c.field == "name", c.field == "ext", c.field == "type", c.field == "identity", strings.HasPrefix(c.field, "meta."):
+	case c.field == "size":
+		if c.op == "in" || c.op == "matches" {
+			return c, nil, fmt.Errorf("size cannot be compared with %s", c.op)
+		}
+	default:
+		return c, nil, fmt.Errorf("unknown field %q, expected name, ext, type, size, identity or meta.<key>", c.field)
+	}
+	if c.field == "ext" || c.field == "type" {
+		c.value = strings.ToLower(c.value)
+	}
+
+	switch c.op {
+	case "==", "!=":
+	case "<", "<=", ">", ">=":
+		if c.field != "size" {
+			return c, nil, fmt.Errorf("%s cannot be compared with %s", c.field, c.op)
+		}
+	case "in":
+		if c.value != "group" {
+			c.list = strings.Split(c.value, ",")
+			break
+		}
+		if len(rest) == 0 {
+			return c, nil, fmt.Errorf("missing group name")
+		}
+		members, ok := groups[rest[0]]
+		if !ok {
+			return c, nil, fmt.Errorf("unknown group %q, groups must be declared before use", rest[0])
+		}
+		c.list, c.group, rest = members, true, rest[1:]
+	case "matches":
+		if _, err := path.Match(c.value, ""); err != nil {
+			return c, nil, fmt.Errorf("invalid pattern %q: %w", c.value, err)
+		}
+	default:
+		return c, nil, fmt.Errorf("unknown operator %q", c.op)
+	}
+
+	if c.field == "size" {
+		digits := strings.TrimRight(c.value, "BbKkMmGgTt")
+		n, err := strconv.ParseInt(digits, 10, 64)
+		unit, ok := policySizeUnits[strings.ToLower(c.value[len(digits):])]
+		if err != nil || !ok || n < 0 || n > math.MaxInt64/unit {
+			return c, nil, fmt.Errorf("invalid size %q", c.value)
+		}
+		c.size = n * unit
+	}
+	return c, rest, nil
+}
+
+// matches reports whether the upload c matches the clause.
+func (p policyClause) matches(c *UploadCandidate) bool {
+	var v string
+	switch p.field {
+	case "name":
+		v = c.Filename
+	case "ext":
+		v = strings.ToLower(filepath.Ext(c.Filename))
+	case "type":
+		v, _, _ = mime.ParseMediaType(c.ContentType)
+	case "identity":
+		v = c.Upload.Identity
+	case "size":
+		switch p.op {
+		case "==":
+			return c.Size == p.size
+		case "!=":
+			return c.Size != p.size
+		case "<":
+			return c.Size < p.size
+		case "<=":
+			return c.Size <= p.size
+		case ">":
+			return c.Size > p.size
+		default:
+			return c.Size >= p.size
+		}
+	default:
+		v = c.Meta[strings.TrimPrefix(p.field, "meta.")]
+	}
+
+	switch p.op {
+	case "==":
+		return v == p.value
+	case "!=":
+		return v != p.value
+	case "matches":
+		ok, _ := path.Match(p.value, v)
+		return ok
+	}
+
+	for _, member := range p.list {
+		if !p.group {
+			if v == member {
+				return true
+			}
+			continue
+		}
+		if _, cidr, err := net.ParseCIDR(member); err == nil {
+			if ip := net.ParseIP(v); ip != nil && cidr.Contains(ip) {
+				return true
+			}
+		} else if ok, _ := path.Match(member, v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAll reports whether the upload c matches all of clauses, which an empty list always does.
+func matchesAll(clauses []policyClause, c *UploadCandidate) bool {
+	for _, clause := range clauses {
+		if !clause.matches(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate rejects c with 403 Forbidden if the first rule it matches denies it.
+func (p Policy) Validate(c *UploadCandidate) error {
+	for _, r := range p.rules {
+		if !matchesAll(r.when, c) || r.unless != nil && matchesAll(r.unless, c) {
+			continue
+		}
+		if r.allow {
+			return nil
+		}
+
+		reason := r.reason
+		if reason == "" {
+			reason = fmt.Sprintf("denied by policy rule on line %d", r.line)
+		}
+		return &RejectionError{http.StatusForbidden, reason}
+	}
+	return nil
+}
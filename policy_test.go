@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readPolicy returns the policy of the rules in text.
+func readPolicy(t *testing.T, text string) (Policy, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "policy")
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var p Policy
+	err := p.Set(path)
+	return p, err
+}
+
+// policyCandidate returns the upload of the file name of size bytes and content type, sent by identity with meta.
+func policyCandidate(name string, size int64, contentType, identity string, meta map[string]string) *UploadCandidate {
+	return &UploadCandidate{Filename: name, Size: size, ContentType: contentType, Meta: meta, Upload: &UploadContext{Identity: identity}}
+}
+
+func TestPolicyPrecedence(t *testing.T) {
+	p, err := readPolicy(t, `# Identities are client IP addresses, or the source of ingested files
+group ci 10.20.0.0/16 192.168.1.10 mqtt:builds/*
+
+deny if size > 1GB and ext == .iso unless identity in group ci "ISO images over 1GB are reserved to CI"
+deny if ext in .exe,.msi,.bat "executables are not accepted"
+allow if meta.project == apollo
+deny if size > 100MB
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apollo := map[string]string{"project": "apollo"}
+	tests := []struct {
+		name   string
+		c      *UploadCandidate
+		reason string // reason is the reason of the rejection, empty if allowed.
+	}{
+		{name: "no rule", c: policyCandidate("notes.txt", 10, "text/plain", "203.0.113.5", nil)},
+		{name: "first rule", c: policyCandidate("disk.ISO", 2<<30, "application/octet-stream", "203.0.113.5", nil), reason: "ISO images over 1GB are reserved to CI"},
+		{name: "unless cidr", c: policyCandidate("disk.iso", 2<<30, "application/octet-stream", "10.20.3.4", nil), reason: "denied by policy rule on line 7"},
+		{name: "unless address", c: policyCandidate("disk.iso", 2<<30, "application/octet-stream", "192.168.1.10", nil), reason: "denied by policy rule on line 7"},
+		{name: "unless glob", c: policyCandidate("disk.iso", 2<<30, "application/octet-stream", "mqtt:builds/nightly", nil), reason: "denied by policy rule on line 7"},
+		{name: "deny before allow", c: policyCandidate("setup.exe", 10, "application/octet-stream", "203.0.113.5", apollo), reason: "executables are not accepted"},
+		{name: "allow before deny", c: policyCandidate("data.bin", 500<<20, "application/octet-stream", "203.0.113.5", apollo)},
+		{name: "size boundary", c: policyCandidate("data.bin", 100<<20, "application/octet-stream", "203.0.113.5", nil)},
+		{name: "size over boundary", c: policyCandidate("data.bin", 100<<20+1, "application/octet-stream", "203.0.113.5", nil), reason: "denied by policy rule on line 7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := p.Validate(tt.c)
+			if tt.reason == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want the upload allowed", err)
+				}
+				return
+			}
+
+			var rejection *RejectionError
+			if !errors.As(err, &rejection) || rejection.Status != http.StatusForbidden || rejection.Reason != tt.reason {
+				t.Errorf("Validate() = %v, want a 403 rejection %q", err, tt.reason)
+			}
+		})
+	}
+}
+
+func TestPolicyUnless(t *testing.T) {
+	p, err := readPolicy(t, `group ci 10.20.0.0/16
+deny if ext == .iso unless size < 1MB and meta.signed == yes
+deny unless identity in group ci
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := map[string]string{"signed": "yes"}
+	tests := []struct {
+		name  string
+		c     *UploadCandidate
+		allow bool
+	}{
+		{name: "all unless clauses", c: policyCandidate("a.iso", 10, "", "10.20.0.1", signed), allow: true},
+		{name: "some unless clauses", c: policyCandidate("a.iso", 2<<20, "", "10.20.0.1", signed), allow: false},
+		{name: "no unless clause", c: policyCandidate("a.iso", 10, "", "10.20.0.1", nil), allow: false},
+		{name: "unless only", c: policyCandidate("a.txt", 10, "", "10.20.0.1", nil), allow: true},
+		{name: "unless only not matched", c: policyCandidate("a.txt", 10, "", "203.0.113.5", nil), allow: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := p.Validate(tt.c); (err == nil) != tt.allow {
+				t.Errorf("Validate() = %v, want allowed %t", err, tt.allow)
+			}
+		})
+	}
+}
+
+func TestPolicySizeUnits(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{value: "0", want: 0},
+		{value: "512", want: 512},
+		{value: "512B", want: 512},
+		{value: "1KB", want: 1 << 10},
+		{value: "1kb", want: 1 << 10},
+		{value: "2MB", want: 2 << 20},
+		{value: "1GB", want: 1 << 30},
+		{value: "3Tb", want: 3 << 40},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c, _, err := parsePolicyClause([]string{"size", ">", tt.value}, nil)
+			if err != nil || c.size != tt.want {
+				t.Errorf("size of %q = %d, %v, want %d", tt.value, c.size, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		want string
+	}{
+		{name: "unknown action", rule: `permit if size > 1`, want: "unknown action"},
+		{name: "reason only", rule: `"no action"`, want: "missing action"},
+		{name: "invalid reason", rule: `deny if name == a "unterminated`, want: "invalid reason"},
+		{name: "clause without if", rule: `deny name == a`, want: `unexpected "name"`},
+		{name: "if after unless", rule: `deny unless name == a if size > 1`, want: `unexpected "if"`},
+		{name: "unless twice", rule: `deny if name == a unless size > 1 unless size < 5`, want: `unexpected "unless"`},
+		{name: "incomplete clause", rule: `deny if name ==`, want: "incomplete clause"},
+		{name: "dangling and", rule: `deny if name == a and`, want: "incomplete clause"},
+		{name: "unknown field", rule: `deny if color == red`, want: "unknown field"},
+		{name: "unknown operator", rule: `deny if name ~ a`, want: "unknown operator"},
+		{name: "ordered string", rule: `deny if name > a`, want: "name cannot be compared with >"},
+		{name: "size in list", rule: `deny if size in 1,2`, want: "size cannot be compared with in"},
+		{name: "unknown unit", rule: `deny if size > 1XB`, want: "invalid size"},
+		{name: "negative size", rule: `deny if size > -1MB`, want: "invalid size"},
+		{name: "size overflow", rule: `deny if size > 99999999999TB`, want: "invalid size"},
+		{name: "invalid pattern", rule: `deny if name matches [`, want: "invalid pattern"},
+		{name: "missing group", rule: `deny if identity in group`, want: "missing group name"},
+		{name: "unknown group", rule: `deny if identity in group ci`, want: "unknown group"},
+		{name: "group without members", rule: `group ci`, want: "group without members"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readPolicy(t, "# rules\n"+tt.rule+"\n")
+			if err == nil || !strings.Contains(err.Error(), tt.want) || !strings.Contains(err.Error(), ":2: ") {
+				t.Errorf("Set() = %v, want an error on line 2 containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyZeroAllows(t *testing.T) {
+	var p Policy
+	if err := p.Validate(policyCandidate("a.exe", 1<<40, "", "203.0.113.5", nil)); err != nil {
+		t.Errorf("Validate() = %v, want the upload allowed", err)
+	}
+}
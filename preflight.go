@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// preflightRequest describes an upload a client intends to send, see [preflightUpload].
+type preflightRequest struct {
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`         // Size is the size of the file in bytes.
+	ContentType string `json:"content_type"` // ContentType is the content type of the file, derived from Filename if empty.
+}
+
+// preflightResult describes an upload that would be accepted.
+type preflightResult struct {
+	XMLName     xml.Name `json:"-" xml:"preflight"`
+	RequestID   string   `json:"request_id" xml:"request_id"`
+	Filename    string   `json:"filename" xml:"filename"` // Filename is the name the file would be stored under, once validators renamed it.
+	Size        int64    `json:"size" xml:"size"`
+	ContentType string   `json:"content_type" xml:"content_type"`
+}
+
+// preflightMaxBody bounds the bytes of a preflight request body.
+const preflightMaxBody = 4 << 10
+
+// preflightUpload handles dry runs of uploads, described by a JSON [preflightRequest] body along with the
+// metadata and encryption headers the upload will have. The description goes through the checks made before
+// an upload is accepted: the free disk space, tracked by disk if enabled, the upload quota of the client, counted
+// in quotas if enabled, and the validators of the [UploadContext] of requests. Nothing is stored nor charged to the
+// quota. Checks needing the content, i.e. content type sniffing and external filters, only run on the upload itself.
+func preflightUpload(config Config, quotas CounterStore, disk *DiskMonitor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uc := uploadContextFrom(r.Context())
+		logger := uc.Logger
+
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+			uc.respondError(w, "Content type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var req preflightRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, preflightMaxBody)).Decode(&req); err != nil {
+			uc.respondError(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if !validFileName(req.Filename) {
+			uc.respondError(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+		if req.Size < 0 {
+			uc.respondError(w, "Invalid file size", http.StatusBadRequest)
+			return
+		}
+
+		meta, err := parseMetaHeaders(r.Header, uc.Limits.MaxMetaHeaders, uc.Limits.MaxMetaSize)
+		if err != nil {
+			uc.respondError(w, fmt.Sprintf("Invalid upload metadata: %v", err), http.StatusBadRequest)
+			return
+		}
+		enc, err := parseEncryptionHeaders(r.Header)
+		if err != nil {
+			uc.respondError(w, fmt.Sprintf("Invalid upload encryption: %v", err), http.StatusBadRequest)
+			return
+		}
+		uc.Meta, uc.Encryption = meta, enc
+
+		if disk != nil && disk.available()-req.Size < config.minFreeSpace {
+			uc.respondError(w, "Insufficient storage", http.StatusInsufficientStorage)
+			return
+		}
+		if config.quota > 0 {
+			used, reset, err := quotas.Add(quotaPrefix+clientKey(r), 0, config.quotaWindow)
+			if err != nil {
+				logger.Printf("Error reading upload quota: %v", err)
+			} else if used >= config.quota || used+req.Size > config.quota {
+				retryAfter(w, reset)
+				uc.respondError(w, fmt.Sprintf("Upload quota of %d bytes exceeded", config.quota), http.StatusTooManyRequests)
+				return
+			}
+		}
+
+		candidate := &UploadCandidate{
+			Filename:    req.Filename,
+			Size:        req.Size,
+			ContentType: declaredContentType(req, enc),
+			Meta:        meta,
+			Encryption:  enc,
+			Upload:      uc,
+		}
+		for _, v := range uc.Storage.Validators {
+			if _, ok := v.(execFilter); ok {
+				continue
+			}
+			if err := v.Validate(candidate); err != nil {
+				debugf(logger, "Preflight of %s rejected: %v", req.Filename, err)
+				status := http.StatusBadRequest
+				if rejection, ok := err.(*RejectionError); ok {
+					status = rejection.Status
+				}
+				uc.respondError(w, fmt.Sprintf("Upload rejected: %v", err), status)
+				return
+			}
+		}
+
+		result := preflightResult{RequestID: uc.RequestID, Filename: candidate.Filename, Size: req.Size, ContentType: candidate.ContentType}
+		writeNegotiated(w, r, result, result)
+	})
+}
+
+// declaredContentType returns the content type an upload described by req is validated with: the one declared,
+// or else the one configured or registered for the extension of its file name, application/octet-stream if
+// there is none or the upload is encrypted by the client, matching what sniffing its content would yield.
+func declaredContentType(req preflightRequest, enc *Encryption) string {
+	if enc != nil {
+		return "application/octet-stream"
+	}
+	if req.ContentType != "" {
+		return req.ContentType
+	}
+
+	ext := strings.ToLower(filepath.Ext(req.Filename))
+	if t, ok := customMIMETypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Gabriel-Ladzaretti/go-multipart/internal/httpx"
+)
+
+// progressRetention is how long the progress of a finished upload remains available,
+// so clients polling for it observe its completion.
+const progressRetention = time.Minute
+
+// uploadProgress is the receive progress of an upload.
+type uploadProgress struct {
+	received atomic.Int64
+	total    int64 // total is the expected number of bytes, -1 if unknown.
+	status   atomic.Int32
+	finished atomic.Int64 // finished is the time the upload finished at, in Unix nanoseconds, 0 while in progress.
+}
+
+// ProgressTracker tracks how much of the request body of in-flight uploads has been received.
+type ProgressTracker struct {
+	mu      sync.Mutex
+	uploads map[string]*uploadProgress
+}
+
+func NewProgressTracker() *ProgressTracker {
+	return &ProgressTracker{uploads: make(map[string]*uploadProgress)}
+}
+
+// start begins tracking the upload id of total bytes, replacing any upload with the same id.
+func (t *ProgressTracker) start(id string, total int64) *uploadProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for k, p := range t.uploads {
+		if finished := p.finished.Load(); finished != 0 && time.Since(time.Unix(0, finished)) > progressRetention {
+			delete(t.uploads, k)
+		}
+	}
+
+	p := &uploadProgress{total: total}
+	t.uploads[id] = p
+	return p
+}
+
+// get returns the progress of upload id, if known.
+func (t *ProgressTracker) get(id string) (*uploadProgress, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.uploads[id]
+	return p, ok
+}
+
+// progressReader counts the bytes read through it into p.
+type progressReader struct {
+	io.ReadCloser
+	p *uploadProgress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.p.received.Add(int64(n))
+	return n, err
+}
+
+// progressID returns the ID the progress of r is tracked under: the upload_id query parameter,
+// which browsers can set without a CORS preflight, or else the request ID.
+func progressID(r *http.Request) string {
+	if id := r.URL.Query().Get("upload_id"); id != "" {
+		return id
+	}
+	return httpx.RequestIDFromContext(r.Context())
+}
+
+// NewProgressMiddleware creates a middleware tracking the receive progress of requests in t.
+func NewProgressMiddleware(t *ProgressTracker) httpx.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			total := r.ContentLength
+			if total < 0 {
+				total = -1
+			}
+
+			p := t.start(progressID(r), total)
+			r.Body = &progressReader{ReadCloser: r.Body, p: p}
+
+			rec := httpx.NewStatusRecorder(w)
+			defer func() {
+				p.status.Store(int32(rec.Status))
+				p.finished.Store(time.Now().UnixNano())
+			}()
+
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
+
+// progressResponse is the JSON document served by [uploadProgressHandler].
+type progressResponse struct {
+	ID       string `json:"id"`
+	Received int64  `json:"received"`
+	Total    int64  `json:"total"`            // Total is -1 if the client did not send a Content-Length.
+	Done     bool   `json:"done"`             // Done reports whether the upload finished, successfully or not.
+	Status   int    `json:"status,omitempty"` // Status is the HTTP status the upload was answered with, once done.
+}
+
+// uploadProgressHandler handles GET <upload endpoint>/progress/{id}, serving the receive progress of the upload id.
+func uploadProgressHandler(t *ProgressTracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		p, ok := t.get(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		resp := progressResponse{
+			ID:       id,
+			Received: p.received.Load(),
+			Total:    p.total,
+			Done:     p.finished.Load() != 0,
+		}
+		if resp.Done {
+			resp.Status = int(p.status.Load())
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// ndjsonContentType is the media type of progress streams, see [NewProgressStreamMiddleware].
+const ndjsonContentType = "application/x-ndjson"
+
+// minProgressStep is the fewest bytes received between the progress events of a stream.
+const minProgressStep = 64 << 10
+
+// unknownProgressStep is the bytes received between the progress events of a stream of unknown length.
+const unknownProgressStep = 8 << 20
+
+// progressEvent is a line of a progress stream, reporting the bytes of the upload received so far.
+type progressEvent struct {
+	Event    string `json:"event"` // Event is "progress".
+	Received int64  `json:"received"`
+	Total    int64  `json:"total"` // Total is -1 if the client did not send a Content-Length.
+}
+
+// resultEvent is the last line of a progress stream, reporting the outcome of the upload.
+type resultEvent struct {
+	Event     string         `json:"event"` // Event is "result".
+	RequestID string         `json:"request_id"`
+	Status    int            `json:"status"` // Status is the HTTP status the upload would have been answered with.
+	Files     []Metadata     `json:"files,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Batch     *batchManifest `json:"batch,omitempty"`
+}
+
+// progressStream answers an upload with newline-delimited JSON events while its body is received: a
+// [progressEvent] every tenth of the body, or every 8 MiB if its length is unknown, and a [resultEvent] once
+// answered. It implements [uploadResponder].
+type progressStream struct {
+	w     http.ResponseWriter
+	rc    *http.ResponseController
+	total int64
+	step  int64
+
+	mu       sync.Mutex
+	received int64
+	next     int64 // next is the number of bytes received the next progress event is sent at.
+	started  bool  // started reports whether the response header was sent.
+}
+
+// progressStreamReader counts the bytes read through it into the progress stream s.
+type progressStreamReader struct {
+	io.ReadCloser
+	s *progressStream
+}
+
+func (r *progressStreamReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.s.advance(int64(n))
+	return n, err
+}
+
+// advance adds n bytes to the bytes received, sending a progress event if they reach the next step.
+func (s *progressStream) advance(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.received += n
+	if s.received < s.next {
+		return
+	}
+	s.next = (s.received/s.step + 1) * s.step
+	s.send(http.StatusOK, progressEvent{Event: "progress", Received: s.received, Total: s.total})
+}
+
+// respond sends the result of the upload as the last event of the stream. Uploads answered before any progress
+// event was sent are answered with their own status, the others were already answered with 200 OK.
+func (s *progressStream) respond(w http.ResponseWriter, data uploadResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.send(data.Status, resultEvent{Event: "result", RequestID: data.RequestID, Status: data.Status, Files: data.Files, Error: data.Error, Batch: data.Batch})
+}
+
+// send writes v as a line of the stream, sending the response header with status first if not sent yet.
+// Must be called with s.mu held.
+func (s *progressStream) send(status int, v any) {
+	if !s.started {
+		s.w.Header().Set("Content-Type", ndjsonContentType)
+		s.w.Header().Set("Cache-Control", "no-store")
+		s.w.Header().Set("X-Content-Type-Options", "nosniff")
+		s.w.WriteHeader(status)
+		s.started = true
+	}
+	json.NewEncoder(s.w).Encode(v)
+	s.rc.Flush()
+}
+
+// acceptsNDJSON reports whether the client of r asks for a progress stream.
+func acceptsNDJSON(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accepted); err == nil && mediaType == ndjsonContentType {
+			return true
+		}
+	}
+	return false
+}
+
+// NewProgressStreamMiddleware creates a middleware answering the uploads of clients accepting
+// application/x-ndjson with a [progressStream], letting command line clients show the progress of an upload
+// without polling for it. Requests must carry an [UploadContext]. Streams need the request body to be read
+// while the response is written, which HTTP/1.1 connections are switched to, uploads falling back to the
+// built-in responses if that fails.
+func NewProgressStreamMiddleware() httpx.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !acceptsNDJSON(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			uc := uploadContextFrom(r.Context())
+			rc := http.NewResponseController(w)
+			if r.ProtoMajor == 1 {
+				if err := rc.EnableFullDuplex(); err != nil {
+					debugf(uc.Logger, "Progress stream of upload %s unavailable: %v", uc.RequestID, err)
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			s := &progressStream{w: w, rc: rc, total: r.ContentLength, step: unknownProgressStep}
+			if s.total < 0 {
+				s.total = -1
+			} else {
+				s.step = max(s.total/10, minProgressStep)
+			}
+			s.next = s.step
+			r.Body = &progressStreamReader{ReadCloser: r.Body, s: s}
+			uc.Responder = s
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// NewCORSMiddleware creates a middleware allowing browsers on origins, or any origin if it contains "*",
+// to call the wrapped handler cross-origin with methods. Preflight requests of allowed origins are answered directly.
+func NewCORSMiddleware(origins, methods []string) httpx.Middleware {
+	for i := range origins {
+		origins[i] = strings.TrimSpace(origins[i])
+	}
+	anyOrigin := slices.Contains(origins, "*")
+	allowMethods := strings.Join(methods, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Origin")
+
+			origin := r.Header.Get("Origin")
+			if origin == "" || (!anyOrigin && !slices.Contains(origins, origin)) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", "X-Request-Id, Location, "+uploadDurationHeader+", "+uploadBytesHeader+", "+checksumHeader)
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, X-Request-Id, "+encryptionAlgorithmHeader+", "+encryptionKeyIDHeader+", "+encryptionIVHeader)
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/Gabriel-Ladzaretti/go-multipart/internal/httpx"
+)
+
+// outboundProxySchemes are the schemes of the proxies outbound HTTP requests may go through.
+var outboundProxySchemes = []string{"http", "https", "socks5"}
+
+// outboundProxyFunc returns the function choosing the proxy of the outbound HTTP requests of a server, e.g.
+// webhooks, callbacks, remote fetches and S3: proxy, set by -outbound-proxy, but for requests to localhost and to
+// the hosts listed in noProxy, as in NO_PROXY, see [bypassProxy]. Without proxy, the HTTPS_PROXY, HTTP_PROXY and
+// NO_PROXY environment variables are honored.
+func outboundProxyFunc(proxy, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	if proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := parseOutboundProxy(proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	viaProxy := http.ProxyURL(u)
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL, noProxy) {
+			return nil, nil
+		}
+		return viaProxy(req)
+	}, nil
+}
+
+// bypassProxy reports whether requests to u are made directly rather than through the proxy: those to localhost
+// and loopback addresses, and those matching one of the comma separated entries of noProxy. "*" matches every
+// host, an IP address or CIDR range the addresses in it, and a domain name, with or without a leading dot, itself
+// and its subdomains. Entries with a port only match requests to that port.
+func bypassProxy(u *url.URL, noProxy string) bool {
+	host := strings.ToLower(u.Hostname())
+	addr, addrErr := netip.ParseAddr(host)
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || addrErr == nil && addr.IsLoopback() {
+		return true
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "*" {
+			return true
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			if addrErr == nil && prefix.Contains(addr.Unmap()) {
+				return true
+			}
+			continue
+		}
+
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+		if ip, err := netip.ParseAddr(entry); err == nil {
+			if addrErr == nil && ip.Unmap() == addr.Unmap() {
+				return true
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(strings.TrimPrefix(entry, "*"), ".")
+		if domain != "" && (host == domain || strings.HasSuffix(host, "."+domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOutboundProxy parses the URL of the proxy set by -outbound-proxy.
+func parseOutboundProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" || !slices.Contains(outboundProxySchemes, u.Scheme) {
+		return nil, fmt.Errorf("%q is not an http, https or socks5 URL", redactURL(proxy))
+	}
+	return u, nil
+}
+
+// parseTrustedProxies parses the comma separated list of the addresses and CIDR ranges of the reverse proxies
+// set by -trusted-proxies, an address being the range of itself alone.
+func parseTrustedProxies(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(s); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// forwardedOriginKey is the context key of the origin a request was sent to, as forwarded by a trusted proxy.
+type forwardedOriginKey struct{}
+
+// NewForwardedMiddleware creates a middleware taking the scheme and host requests were sent to from the
+// Forwarded header, or the X-Forwarded-Proto and X-Forwarded-Host headers, of those from the comma separated
+// list of trusted proxies, for [requestOrigin] to address stored files under. Of several forwarded values, the
+// first is taken, set by the proxy the client connected to. The headers of other clients are ignored.
+func NewForwardedMiddleware(trusted string) httpx.Middleware {
+	prefixes, _ := parseTrustedProxies(trusted) // validated with the config
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !trustedProxy(prefixes, r.RemoteAddr) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if origin := forwardedOrigin(r); origin != "" {
+				r = r.WithContext(context.WithValue(r.Context(), forwardedOriginKey{}, origin))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// trustedProxy reports whether remoteAddr, the address a request came from, is in one of prefixes.
+func trustedProxy(prefixes []netip.Prefix, remoteAddr string) bool {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedOrigin returns the origin r was sent to according to its forwarding headers, the scheme and host r
+// was received with standing in for those it does not forward, empty if it forwards neither.
+func forwardedOrigin(r *http.Request) string {
+	var proto, host string
+	if forwarded := r.Header.Get("Forwarded"); forwarded != "" {
+		element, _, _ := strings.Cut(forwarded, ",")
+		for _, pair := range strings.Split(element, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			value = strings.Trim(value, `"`)
+			switch strings.ToLower(key) {
+			case "proto":
+				proto = value
+			case "host":
+				host = value
+			}
+		}
+	} else {
+		proto = firstHeaderValue(r, "X-Forwarded-Proto")
+		host = firstHeaderValue(r, "X-Forwarded-Host")
+	}
+
+	proto = strings.ToLower(proto)
+	if proto != "" && proto != "http" && proto != "https" || strings.ContainsAny(host, "/?#@ ") {
+		return ""
+	}
+	if proto == "" && host == "" {
+		return ""
+	}
+	if proto == "" {
+		proto = "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+	}
+	if host == "" {
+		host = r.Host
+	}
+	return proto + "://" + host
+}
+
+// firstHeaderValue returns the first of the comma separated values of the header key of r, trimmed.
+func firstHeaderValue(r *http.Request, key string) string {
+	value, _, _ := strings.Cut(r.Header.Get(key), ",")
+	return strings.TrimSpace(value)
+}
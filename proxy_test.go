@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+)
+
+func TestForwardedMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "192.0.2.1:1234", want: "http://usrv.internal"},
+		{name: "untrusted client", remoteAddr: "192.0.2.1:1234", headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example"}, want: "http://usrv.internal"},
+		{name: "x-forwarded", remoteAddr: "10.1.2.3:1234", headers: map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "files.example.com"}, want: "https://files.example.com"},
+		{name: "x-forwarded proto only", remoteAddr: "10.1.2.3:1234", headers: map[string]string{"X-Forwarded-Proto": "HTTPS"}, want: "https://usrv.internal"},
+		{name: "x-forwarded chain", remoteAddr: "10.1.2.3:1234", headers: map[string]string{"X-Forwarded-Proto": "https, http", "X-Forwarded-Host": "files.example.com, usrv.internal"}, want: "https://files.example.com"},
+		{name: "forwarded", remoteAddr: "10.1.2.3:1234", headers: map[string]string{"Forwarded": `for=192.0.2.1;proto=https;host="files.example.com:8443", for=10.0.0.1`}, want: "https://files.example.com:8443"},
+		{name: "forwarded over x-forwarded", remoteAddr: "10.1.2.3:1234", headers: map[string]string{"Forwarded": "proto=https", "X-Forwarded-Host": "evil.example"}, want: "https://usrv.internal"},
+		{name: "invalid proto", remoteAddr: "10.1.2.3:1234", headers: map[string]string{"X-Forwarded-Proto": "javascript"}, want: "http://usrv.internal"},
+		{name: "invalid host", remoteAddr: "10.1.2.3:1234", headers: map[string]string{"X-Forwarded-Host": "evil.example/path"}, want: "http://usrv.internal"},
+		{name: "trusted address", remoteAddr: "[2001:db8::1]:1234", headers: map[string]string{"X-Forwarded-Proto": "https"}, want: "https://usrv.internal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := NewForwardedMiddleware("10.0.0.0/8, 2001:db8::1")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = requestOrigin(r)
+			}))
+
+			r := httptest.NewRequest(http.MethodPost, "http://usrv.internal/upload", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), r)
+
+			if got != tt.want {
+				t.Errorf("requestOrigin() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutboundProxyFunc(t *testing.T) {
+	proxy, err := outboundProxyFunc("http://proxy.internal:3128", "minio.internal, .corp.example, 10.0.0.0/8, 192.0.2.7, opa.internal:8181")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://hooks.example.com/alert", want: "http://proxy.internal:3128"},
+		{url: "http://localhost:8080/", want: ""},
+		{url: "http://127.0.0.1/", want: ""},
+		{url: "http://[::1]/", want: ""},
+		{url: "https://minio.internal:9000/bucket", want: ""},
+		{url: "https://eu.minio.internal/bucket", want: ""},
+		{url: "https://notminio.internal/bucket", want: "http://proxy.internal:3128"},
+		{url: "https://corp.example/", want: ""},
+		{url: "https://files.corp.example/", want: ""},
+		{url: "http://10.1.2.3/", want: ""},
+		{url: "http://192.0.2.7/", want: ""},
+		{url: "http://192.0.2.8/", want: "http://proxy.internal:3128"},
+		{url: "http://opa.internal:8181/v1/data", want: ""},
+		{url: "http://opa.internal/v1/data", want: "http://proxy.internal:3128"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := proxy(&http.Request{URL: u})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var s string
+			if got != nil {
+				s = got.String()
+			}
+			if s != tt.want {
+				t.Errorf("proxy = %q, want %q", s, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutboundProxyPerServer(t *testing.T) {
+	s, _ := newTestServer(t, "-outbound-proxy", "http://proxy.internal:3128")
+	other, _ := newTestServer(t)
+
+	req := &http.Request{URL: &url.URL{Scheme: "https", Host: "hooks.example.com"}}
+	if got, _ := s.outbound.transport.Proxy(req); got == nil || got.Host != "proxy.internal:3128" {
+		t.Errorf("proxy = %v, want proxy.internal:3128", got)
+	}
+	got, _ := other.outbound.transport.Proxy(req)
+	if want, _ := http.ProxyFromEnvironment(req); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("proxy of other server = %v, want the one of the environment, %v", got, want)
+	}
+	if v := os.Getenv("HTTPS_PROXY"); v == "http://proxy.internal:3128" {
+		t.Errorf("HTTPS_PROXY = %q, want the environment left as is", v)
+	}
+}
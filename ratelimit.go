@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Gabriel-Ladzaretti/go-multipart/internal/httpx"
+)
+
+// Prefixes of the counter keys of rate limits and quotas.
+const (
+	rateLimitPrefix = "usrv:rate:"
+	quotaPrefix     = "usrv:quota:"
+)
+
+// redisCounterScript increments a counter, starting its window if it has none, and returns its total and TTL.
+const redisCounterScript = `local n = redis.call("incrby", KEYS[1], ARGV[1])
+if redis.call("pttl", KEYS[1]) < 0 then redis.call("pexpire", KEYS[1], ARGV[2]) end
+return {n, redis.call("pttl", KEYS[1])}`
+
+// CounterStore keeps fixed window counters, e.g. of requests or bytes per client.
+type CounterStore interface {
+	// Add increments the counter key by n, starting a window of length window if none is running,
+	// and returns its total within the window along with the time left until the window resets.
+	Add(key string, n int64, window time.Duration) (total int64, reset time.Duration, err error)
+}
+
+// memoryCounterStore is a [CounterStore] local to the process.
+type memoryCounterStore struct {
+	mu        sync.Mutex
+	counters  map[string]*memoryCounter
+	lastSweep time.Time
+}
+
+type memoryCounter struct {
+	total   int64
+	expires time.Time
+}
+
+func newMemoryCounterStore() *memoryCounterStore {
+	return &memoryCounterStore{counters: make(map[string]*memoryCounter)}
+}
+
+func (s *memoryCounterStore) Add(key string, n int64, window time.Duration) (int64, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	// Expired counters are swept at most once a minute, so idle clients do not accumulate
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, c := range s.counters {
+			if !now.Before(c.expires) {
+				delete(s.counters, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	c, ok := s.counters[key]
+	if !ok || !now.Before(c.expires) {
+		c = &memoryCounter{expires: now.Add(window)}
+		s.counters[key] = c
+	}
+	c.total += n
+
+	return c.total, c.expires.Sub(now), nil
+}
+
+// redisCounterStore is a [CounterStore] shared by all server replicas using the same Redis server.
+type redisCounterStore struct {
+	client *redisClient
+}
+
+func (s *redisCounterStore) Add(key string, n int64, window time.Duration) (int64, time.Duration, error) {
+	reply, err := s.client.Do("EVAL", redisCounterScript, "1", key, strconv.FormatInt(n, 10), strconv.FormatInt(window.Milliseconds(), 10))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	values, ok := reply.([]any)
+	if !ok || len(values) != 2 {
+		return 0, 0, fmt.Errorf("unexpected redis counter reply %v", reply)
+	}
+	total, ok1 := values[0].(int64)
+	ttl, ok2 := values[1].(int64)
+	if !ok1 || !ok2 {
+		return 0, 0, fmt.Errorf("unexpected redis counter reply %v", reply)
+	}
+
+	return total, time.Duration(ttl) * time.Millisecond, nil
+}
+
+// clientKey identifies the client of r by its IP address.
+func clientKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// retryAfter sets the Retry-After header of w to reset, rounded up to whole seconds.
+func retryAfter(w http.ResponseWriter, reset time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+}
+
+// NewRateLimitMiddleware creates a middleware allowing each client at most limit requests per window,
+// counted in store. Requests over the limit are rejected with 429 Too Many Requests.
+// Requests to skipPaths are not limited. If store fails, requests are let through.
+func NewRateLimitMiddleware(logger *log.Logger, store CounterStore, limit int64, window time.Duration, skipPaths ...string) httpx.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(skipPaths, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			total, reset, err := store.Add(rateLimitPrefix+clientKey(r), 1, window)
+			if err != nil {
+				logger.Printf("Error counting request for rate limiting: %v", err)
+			} else if total > limit {
+				retryAfter(w, reset)
+				http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// NewQuotaMiddleware creates a middleware allowing each client to send at most quota request body bytes
+// per window, counted in store. Requests of clients that used up their quota are rejected with
+// 429 Too Many Requests. If store fails, requests are let through.
+func NewQuotaMiddleware(logger *log.Logger, store CounterStore, quota int64, window time.Duration) httpx.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := quotaPrefix + clientKey(r)
+
+			used, reset, err := store.Add(key, 0, window)
+			if err != nil {
+				logger.Printf("Error reading upload quota: %v", err)
+			} else if used >= quota || used+max(r.ContentLength, 0) > quota {
+				retryAfter(w, reset)
+				http.Error(w, fmt.Sprintf("Upload quota of %d bytes exceeded", quota), http.StatusTooManyRequests)
+				return
+			}
+
+			body := &countingReader{ReadCloser: r.Body}
+			r.Body = body
+
+			next.ServeHTTP(w, r)
+
+			if _, _, err := store.Add(key, body.n, window); err != nil {
+				logger.Printf("Error charging upload quota: %v", err)
+			}
+		})
+	}
+}
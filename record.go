@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/Gabriel-Ladzaretti/go-multipart/internal/httpx"
+)
+
+// recordTruncatedHeader marks recorded requests whose body exceeded the recording cap.
+const recordTruncatedHeader = "X-Usrv-Record-Truncated"
+
+// cappedBuffer is an [io.Writer] keeping the first max bytes written to it
+// and silently discarding the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	max       int64
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.max - int64(b.Len()); int64(len(p)) > room {
+		p = p[:max(room, 0)]
+		b.truncated = true
+	}
+	b.Buffer.Write(p)
+	return n, nil
+}
+
+// NewRecordingMiddleware creates a middleware that records the raw requests of failed
+// (4xx/5xx) responses into dir, one file per request named after its request ID.
+// Request bodies are recorded up to maxBodySize bytes. Records can be re-sent using the replay subcommand.
+func NewRecordingMiddleware(logger *log.Logger, dir string, maxBodySize int64) httpx.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body := &cappedBuffer{max: maxBodySize}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, body), r.Body}
+
+			rec := httpx.NewStatusRecorder(w)
+			next.ServeHTTP(rec, r)
+
+			if rec.Status < http.StatusBadRequest {
+				return
+			}
+
+			// Capture the part of the body the handler did not read before failing
+			io.Copy(io.Discard, io.LimitReader(r.Body, maxBodySize-int64(body.Len())+1))
+
+			// Request IDs may be client supplied, never let them escape dir
+			name := filepath.Base(httpx.RequestIDFromContext(r.Context())) + ".http"
+			path := filepath.Join(dir, name)
+			if err := writeRecord(path, r, body); err != nil {
+				logger.Printf("Error recording failed request: %v", err)
+				return
+			}
+
+			logger.Printf("Recorded failed request to %s", path)
+		})
+	}
+}
+
+// writeRecord writes r with the captured body to path in HTTP/1.1 wire format.
+// The Authorization header is not recorded.
+func writeRecord(path string, r *http.Request, body *cappedBuffer) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	h := r.Header.Clone()
+	h.Del("Authorization")
+	h.Del("Transfer-Encoding")
+	h.Set("Content-Length", strconv.Itoa(body.Len()))
+	if body.truncated {
+		h.Set(recordTruncatedHeader, "true")
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", r.Method, r.URL.RequestURI())
+	fmt.Fprintf(&b, "Host: %s\r\n", r.Host)
+	h.Write(&b)
+	b.WriteString("\r\n")
+	b.Write(body.Bytes())
+
+	return os.WriteFile(path, b.Bytes(), 0o600)
+}
+
+// replayMain implements the replay subcommand, re-sending recorded requests to a running server.
+func replayMain(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := fs.String("target", "http://localhost:3000", "Base URL of the server to replay requests to (default: 'http://localhost:3000').")
+	authToken := fs.String("auth-token", "", "Bearer token sent with replayed requests (default: none).")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [flags] record...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	base, err := url.Parse(*target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid target: %v\n", err)
+		return 2
+	}
+
+	status := 0
+	for _, path := range fs.Args() {
+		if err := replay(base, *authToken, path); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			status = 1
+		}
+	}
+
+	return status
+}
+
+// replay re-sends the request recorded at path to base.
+func replay(base *url.URL, authToken, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	req, err := http.ReadRequest(bufio.NewReader(f))
+	if err != nil {
+		return fmt.Errorf("reading record: %w", err)
+	}
+
+	if req.Header.Get(recordTruncatedHeader) != "" {
+		fmt.Fprintf(os.Stderr, "%s: warning: recorded body was truncated\n", path)
+	}
+
+	req.RequestURI = ""
+	req.Host = ""
+	req.URL = base.ResolveReference(&url.URL{Path: req.URL.Path, RawQuery: req.URL.RawQuery})
+	if authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	fmt.Printf("%s: %s\n%s\n", path, resp.Status, bytes.TrimSpace(respBody))
+
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisDialTimeout bounds connecting to the Redis server and authenticating.
+const redisDialTimeout = 5 * time.Second
+
+// redisCommandTimeout bounds sending a command and reading its reply.
+const redisCommandTimeout = 5 * time.Second
+
+// redisError is an error reply of the Redis server.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisClient speaks the Redis serialization protocol (RESP2) over a single connection.
+// Only the subset needed for simple request/reply commands is implemented;
+// commands are serialized, which is plenty for locks and counters.
+type redisClient struct {
+	server   string
+	outbound *Outbound // outbound connects to the server.
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// newRedisClient creates a client that connects lazily, with outbound, to server,
+// given as "redis://[:password@]host:port[/db]" or "host:port".
+func newRedisClient(server string, outbound *Outbound) (*redisClient, error) {
+	if !strings.Contains(server, "://") {
+		server = "redis://" + server
+	}
+
+	if _, err := url.Parse(server); err != nil {
+		return nil, fmt.Errorf("parsing redis server %q: %w", server, err)
+	}
+
+	return &redisClient{server: server, outbound: outbound}, nil
+}
+
+// Do sends the command args and returns its reply, reconnecting once if the connection was lost.
+// Replies are decoded as string, int64, nil or []any; error replies are returned as [redisError].
+func (c *redisClient) Do(args ...string) (any, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if c.conn == nil {
+			if err := c.connect(); err != nil {
+				return nil, err
+			}
+		}
+
+		reply, err := c.roundTrip(args)
+		var replyErr redisError
+		if err == nil || errors.As(err, &replyErr) {
+			return reply, err
+		}
+
+		c.conn.Close()
+		c.conn = nil
+
+		if attempt > 0 {
+			return nil, fmt.Errorf("redis %s: %w", args[0], err)
+		}
+	}
+}
+
+// Close closes the underlying connection, if any.
+func (c *redisClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// connect dials the server, authenticating and selecting the database if configured.
+// Must be called with c.mu held.
+func (c *redisClient) connect() error {
+	u, _ := url.Parse(c.server)
+
+	conn, err := c.outbound.dial("tcp", u.Host, redisDialTimeout)
+	if err != nil {
+		return fmt.Errorf("connecting to redis: %w", err)
+	}
+	c.conn, c.r = conn, bufio.NewReader(conn)
+
+	var setup [][]string
+	if pass, ok := u.User.Password(); ok {
+		if user := u.User.Username(); user != "" {
+			setup = append(setup, []string{"AUTH", user, pass})
+		} else {
+			setup = append(setup, []string{"AUTH", pass})
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		setup = append(setup, []string{"SELECT", db})
+	}
+
+	for _, args := range setup {
+		if _, err := c.roundTrip(args); err != nil {
+			conn.Close()
+			c.conn = nil
+			return fmt.Errorf("redis %s: %w", args[0], err)
+		}
+	}
+
+	return nil
+}
+
+// roundTrip writes args as a command and reads its reply. Must be called with c.mu held.
+func (c *redisClient) roundTrip(args []string) (any, error) {
+	c.conn.SetDeadline(time.Now().Add(redisCommandTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	cmd := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd = fmt.Appendf(cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := c.conn.Write(cmd); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(c.r)
+}
+
+// readRedisReply reads a single RESP2 reply from r.
+func readRedisReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis bulk length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis array length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				var replyErr redisError
+				if !errors.As(err, &replyErr) {
+					return nil, err
+				}
+				items[i] = replyErr
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected redis reply %q", line)
+	}
+}
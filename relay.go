@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SFTP relay metrics, published through [expvar].
+var (
+	sftpRelayedFiles = expvar.NewInt("sftp_relayed_files") // sftpRelayedFiles counts the files copied to the SFTP host.
+	sftpRelayErrors  = expvar.NewInt("sftp_relay_errors")  // sftpRelayErrors counts the files that could not be copied.
+	sftpRelayPending = expvar.NewInt("sftp_relay_pending") // sftpRelayPending is the number of files waiting to be copied.
+)
+
+// sftpRelayDir is the directory, within the upload directory, where the files waiting to be relayed are
+// recorded until copied, so they are copied once the SFTP host is reachable again, or the server restarted.
+const sftpRelayDir = ".relay"
+
+const (
+	sftpRelayAttempts      = 3           // sftpRelayAttempts is the number of times copying a file is tried, reconnecting in between.
+	sftpRelayRetryInterval = time.Minute // sftpRelayRetryInterval is how long relaying pauses for once the SFTP host is unreachable.
+)
+
+// SFTPRelay copies the files stored in the upload directory to a directory of a remote SFTP host as they are
+// uploaded, one at a time over a single connection, mirroring their path within the upload directory. Each
+// stored file is recorded in the [sftpRelayDir] before being copied, in the order stored, and its record removed
+// once copied, or rejected by the SFTP host. A nil *SFTPRelay relays nothing.
+type SFTPRelay struct {
+	baseDir string
+	target  sftpTarget
+	dir     string // dir is the remote directory files are copied to.
+	fsync   FsyncPolicy
+	logger  *log.Logger
+	wake    chan struct{} // wake signals the relay that files were recorded.
+	seq     atomic.Uint64 // seq orders the files recorded within the same nanosecond.
+}
+
+// newSFTPRelay returns the relay of the files of the upload directory configured by config, connecting to the
+// SFTP host by its override in outbound, if any, or nil if relaying is disabled. The host is resolved by ssh.
+func newSFTPRelay(config Config, outbound *Outbound, logger *log.Logger) (*SFTPRelay, error) {
+	if config.sftpHost == "" {
+		return nil, nil
+	}
+
+	target, err := parseSFTPTarget(config.sftpHost, config.sftpKey, config.sftpKnownHosts)
+	if err != nil {
+		return nil, err
+	}
+	target.address, _ = outbound.lookupHost(target.host)
+	if err := os.MkdirAll(filepath.Join(config.dir, sftpRelayDir), 0o755); err != nil {
+		return nil, err
+	}
+
+	return &SFTPRelay{
+		baseDir: config.dir,
+		target:  target,
+		dir:     config.sftpDir,
+		fsync:   config.fsync,
+		logger:  logger,
+		wake:    make(chan struct{}, 1),
+	}, nil
+}
+
+// enqueue records the file stored at p to be copied, flushed to disk according to the fsync policy of stored
+// files, and wakes up the relay. Files outside of the upload directory are copied under their base name.
+func (r *SFTPRelay) enqueue(p string) {
+	if r == nil {
+		return
+	}
+
+	rel, err := filepath.Rel(r.baseDir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		rel = filepath.Base(p)
+	}
+	if err := r.record(filepath.ToSlash(rel)); err != nil {
+		sftpRelayErrors.Add(1)
+		r.logger.Printf("Error relaying %s to %s: %v", rel, r.target, err)
+		return
+	}
+	sftpRelayPending.Add(1)
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// record writes the record of the file at rel, named after the time it is recorded at, to the [sftpRelayDir],
+// renaming it into place once written so the relay never reads a partial record.
+func (r *SFTPRelay) record(rel string) error {
+	spool := filepath.Join(r.baseDir, sftpRelayDir)
+	name := fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), r.seq.Add(1)%1e6)
+
+	return createIn(spool, func() error {
+		f, err := os.CreateTemp(spool, ".tmp-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		if _, err := f.WriteString(rel); err != nil {
+			return err
+		}
+		if err := r.fsync.sync(f, spool); err != nil {
+			return err
+		}
+		return os.Rename(f.Name(), filepath.Join(spool, name))
+	})
+}
+
+// pending returns the names of the records of the files waiting to be copied, oldest first.
+func (r *SFTPRelay) pending() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(r.baseDir, sftpRelayDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), ".") && e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// run copies the recorded files until ctx is done. Once the SFTP host is unreachable, it pauses for
+// [sftpRelayRetryInterval] before trying again, the files recorded in the meantime waiting for it.
+func (r *SFTPRelay) run(ctx context.Context) {
+	var client *sftpClient
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+
+	for {
+		var err error
+		client, err = r.drain(ctx, client)
+		if ctx.Err() != nil {
+			if n := sftpRelayPending.Value(); n > 0 {
+				r.logger.Printf("SFTP relay stopped with %d files left to copy, copied once restarted", n)
+			}
+			return
+		}
+
+		var retry <-chan time.Time
+		wake := r.wake
+		if err != nil {
+			r.logger.Printf("Error relaying to %s, retrying in %v: %v", r.target, sftpRelayRetryInterval, err)
+			retry, wake = time.After(sftpRelayRetryInterval), nil
+		}
+		select {
+		case <-ctx.Done():
+		case <-wake:
+		case <-retry:
+		}
+	}
+}
+
+// drain copies the recorded files with client, connecting first if client is nil, until none is left. It
+// returns the client to copy the next files with, and the error the SFTP host was unreachable with, if it was.
+func (r *SFTPRelay) drain(ctx context.Context, client *sftpClient) (*sftpClient, error) {
+	spool := filepath.Join(r.baseDir, sftpRelayDir)
+	for {
+		names, err := r.pending()
+		if err != nil {
+			return client, err
+		}
+		sftpRelayPending.Set(int64(len(names)))
+		if len(names) == 0 {
+			return client, nil
+		}
+
+		for _, name := range names {
+			if ctx.Err() != nil {
+				return client, ctx.Err()
+			}
+
+			record := filepath.Join(spool, name)
+			rel, err := os.ReadFile(record)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err == nil {
+				client, err = r.relay(ctx, client, string(rel))
+			}
+			// The connection failing leaves the file recorded, to be copied once it is back
+			var status *sftpStatusError
+			if err != nil && !errors.As(err, &status) && !errors.Is(err, fs.ErrNotExist) {
+				return client, err
+			}
+			if err := os.Remove(record); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return client, err
+			}
+			sftpRelayPending.Add(-1)
+		}
+	}
+}
+
+// relay copies the file stored at rel, relative to the upload directory, with client, connecting first if client
+// is nil, and retrying with a new connection if the connection fails. It returns the client to copy the next file
+// with, and an error if the file could not be copied, a [*sftpStatusError] if the SFTP host rejected it.
+func (r *SFTPRelay) relay(ctx context.Context, client *sftpClient, rel string) (*sftpClient, error) {
+	p := filepath.Join(r.baseDir, filepath.FromSlash(rel))
+	remote := path.Join(r.dir, rel)
+
+	for attempt := 1; ; attempt++ {
+		var err error
+		if client == nil {
+			client, err = dialSFTP(ctx, r.target)
+		}
+		if client != nil {
+			err = client.put(ctx, p, remote)
+		}
+		if err == nil {
+			sftpRelayedFiles.Add(1)
+			debugf(r.logger, "File relayed to %s: %s", r.target, remote)
+			return client, nil
+		}
+		// Files deleted, or renamed, before their turn are not retried
+		if errors.Is(err, fs.ErrNotExist) {
+			debugf(r.logger, "File not relayed to %s, no longer stored: %v", r.target, err)
+			return client, err
+		}
+
+		// The server answering with an error leaves the connection usable
+		var status *sftpStatusError
+		if client != nil && !errors.As(err, &status) {
+			client.Close()
+			client = nil
+		}
+		if attempt == sftpRelayAttempts || ctx.Err() != nil {
+			if status != nil {
+				sftpRelayErrors.Add(1)
+				r.logger.Printf("Error relaying %s to %s: %v", rel, r.target, err)
+			}
+			return client, err
+		}
+
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second):
+		case <-ctx.Done():
+		}
+	}
+}
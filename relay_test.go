@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestFakeSSH is not a test, but the fake ssh command run by the relay in the tests below, serving the sftp
+// subsystem over its standard input and output from the directory USRV_FAKE_SFTP_ROOT, see [fakeSSH]. It exits
+// with 255, like ssh failing to connect, while the file USRV_FAKE_SFTP_DOWN exists.
+func TestFakeSSH(t *testing.T) {
+	root := os.Getenv("USRV_FAKE_SFTP_ROOT")
+	if root == "" {
+		return
+	}
+
+	args := os.Args[slices.Index(os.Args, "--")+1:]
+	if len(args) < 2 || args[0] != "-s" || args[len(args)-1] != "sftp" {
+		fmt.Fprintf(os.Stderr, "ssh: not asked for the sftp subsystem: %q\n", args)
+		os.Exit(255)
+	}
+	if _, err := os.Stat(os.Getenv("USRV_FAKE_SFTP_DOWN")); err == nil {
+		fmt.Fprintln(os.Stderr, "ssh: connect to host sftp.example.com port 22: Connection refused")
+		os.Exit(255)
+	}
+	if err := serveFakeSFTP(root, os.Stdin, os.Stdout); err != nil && !errors.Is(err, io.EOF) {
+		fmt.Fprintf(os.Stderr, "fake sftp: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// fakeSSH puts a fake ssh command, serving the sftp subsystem from a temporary directory, first in the PATH
+// for the rest of t, and returns the directory along with the file whose existence makes it fail to connect.
+func fakeSSH(t *testing.T) (root, down string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake ssh command is a shell script")
+	}
+
+	bin, root := t.TempDir(), t.TempDir()
+	down = filepath.Join(bin, "down")
+	script := fmt.Sprintf("#!/bin/sh\nUSRV_FAKE_SFTP_ROOT=%q USRV_FAKE_SFTP_DOWN=%q exec %q -test.run='^TestFakeSSH$' -- \"$@\"\n", root, down, os.Args[0])
+	if err := os.WriteFile(filepath.Join(bin, "ssh"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return root, down
+}
+
+// serveFakeSFTP serves the requests of version 3 of SFTP the relay sends, read from r, on the files of root,
+// writing the replies to w, until r ends.
+func serveFakeSFTP(root string, r io.Reader, w io.Writer) error {
+	typ, _, err := readSFTPPacket(r)
+	if err != nil {
+		return err
+	}
+	if typ != sftpInit {
+		return fmt.Errorf("unexpected packet type %d instead of init", typ)
+	}
+	var version sftpBuffer
+	version.u32(3)
+	version.str(sftpPosixRename)
+	version.str("1")
+	if err := writeSFTPPacket(w, sftpVersion, version.b); err != nil {
+		return err
+	}
+
+	local := func(name string) string { return filepath.Join(root, filepath.FromSlash(name)) }
+	handles := make(map[string]*os.File)
+	for {
+		typ, payload, err := readSFTPPacket(r)
+		if err != nil {
+			return err
+		}
+		req := &sftpReader{b: payload}
+		id := req.u32()
+
+		var reply sftpBuffer
+		reply.u32(id)
+		status := func(err error) error {
+			code, msg := uint32(sftpOK), ""
+			switch {
+			case errors.Is(err, fs.ErrNotExist):
+				code, msg = sftpNoSuchFile, "No such file"
+			case err != nil:
+				code, msg = 4, err.Error()
+			}
+			reply.u32(code)
+			reply.str(msg)
+			reply.str("")
+			return writeSFTPPacket(w, sftpStatus, reply.b)
+		}
+
+		switch typ {
+		case sftpOpen:
+			name, pflags := req.str(), req.u32()
+			flags := os.O_RDONLY
+			if pflags&sftpFlagWrite != 0 {
+				flags = os.O_WRONLY
+			}
+			if pflags&sftpFlagCreat != 0 {
+				flags |= os.O_CREATE
+			}
+			if pflags&sftpFlagTrunc != 0 {
+				flags |= os.O_TRUNC
+			}
+			f, err := os.OpenFile(local(name), flags, 0o644)
+			if err != nil {
+				err = status(err)
+				break
+			}
+			h := fmt.Sprint(len(handles) + 1)
+			handles[h] = f
+			reply.str(h)
+			err = writeSFTPPacket(w, sftpHandle, reply.b)
+		case sftpClose:
+			h := req.str()
+			err = handles[h].Close()
+			delete(handles, h)
+			err = status(err)
+		case sftpWrite:
+			f, off, data := handles[req.str()], req.u64(), req.str()
+			_, err = f.WriteAt([]byte(data), int64(off))
+			err = status(err)
+		case sftpStat:
+			fi, statErr := os.Stat(local(req.str()))
+			if statErr != nil {
+				err = status(statErr)
+				break
+			}
+			perms := uint32(fi.Mode().Perm())
+			if fi.IsDir() {
+				perms |= 0o040000
+			}
+			reply.u32(sftpAttrSize | sftpAttrPermissions)
+			reply.u64(uint64(fi.Size()))
+			reply.u32(perms)
+			err = writeSFTPPacket(w, sftpAttrs, reply.b)
+		case sftpMkdir:
+			err = status(os.Mkdir(local(req.str()), 0o755))
+		case sftpRemove:
+			err = status(os.Remove(local(req.str())))
+		case sftpExtended:
+			if ext := req.str(); ext != sftpPosixRename {
+				err = status(fmt.Errorf("unsupported extension %s", ext))
+				break
+			}
+			from, to := req.str(), req.str()
+			err = status(os.Rename(local(from), local(to)))
+		default:
+			err = status(fmt.Errorf("unsupported request type %d", typ))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// newTestSFTPRelay returns a relay of the files of baseDir to the directory "incoming" of the fake SFTP host.
+func newTestSFTPRelay(t *testing.T, baseDir string) *SFTPRelay {
+	t.Helper()
+	config, err := newConfig([]string{"-dir", baseDir, "-sftp-host", "upload@sftp.example.com:22", "-sftp-dir", "incoming"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newSFTPRelay(config, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// relayRecords returns the paths of the files recorded to be relayed from baseDir, oldest first.
+func relayRecords(t *testing.T, r *SFTPRelay) []string {
+	t.Helper()
+	names, err := r.pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []string
+	for _, name := range names {
+		b, err := os.ReadFile(filepath.Join(r.baseDir, sftpRelayDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, string(b))
+	}
+	return records
+}
+
+func TestSFTPRelay(t *testing.T) {
+	root, _ := fakeSSH(t)
+	baseDir := t.TempDir()
+	files := map[string]string{"a.txt": "first", ".buckets/docs/b.txt": "second"}
+	for name, content := range files {
+		p := filepath.Join(baseDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Files recorded by a relay that stopped before copying them are copied by the next one
+	stopped := newTestSFTPRelay(t, baseDir)
+	stopped.enqueue(filepath.Join(baseDir, "a.txt"))
+	stopped.enqueue(filepath.Join(baseDir, "gone.txt"))
+	stopped.enqueue(filepath.Join(baseDir, ".buckets", "docs", "b.txt"))
+	if got, want := relayRecords(t, stopped), []string{"a.txt", "gone.txt", ".buckets/docs/b.txt"}; !slices.Equal(got, want) {
+		t.Fatalf("recorded %q, want %q", got, want)
+	}
+
+	r := newTestSFTPRelay(t, baseDir)
+	client, err := r.drain(context.Background(), nil)
+	if client != nil {
+		defer client.Close()
+	}
+	if err != nil {
+		t.Fatalf("drain() = %v", err)
+	}
+
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(root, "incoming", filepath.FromSlash(name)))
+		if err != nil || string(got) != want {
+			t.Errorf("relayed %s = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "incoming", "gone.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("file deleted before its turn relayed: %v", err)
+	}
+	if records := relayRecords(t, r); len(records) != 0 {
+		t.Errorf("records left after relaying = %q, want none", records)
+	}
+}
+
+func TestSFTPRelayHostDown(t *testing.T) {
+	root, down := fakeSSH(t)
+	if err := os.WriteFile(down, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	baseDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(baseDir, "a.txt"), []byte("content"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestSFTPRelay(t, baseDir)
+	r.enqueue(filepath.Join(baseDir, "a.txt"))
+	if _, err := r.drain(context.Background(), nil); err == nil || !strings.Contains(err.Error(), "Connection refused") {
+		t.Fatalf("drain() = %v with the host down, want the error of ssh", err)
+	}
+	if got, want := relayRecords(t, r), []string{"a.txt"}; !slices.Equal(got, want) {
+		t.Fatalf("recorded %q with the host down, want %q", got, want)
+	}
+
+	if err := os.Remove(down); err != nil {
+		t.Fatal(err)
+	}
+	client, err := r.drain(context.Background(), nil)
+	if client != nil {
+		defer client.Close()
+	}
+	if err != nil {
+		t.Fatalf("drain() = %v with the host back", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(root, "incoming", "a.txt")); err != nil || string(got) != "content" {
+		t.Errorf("relayed a.txt = %q, %v, want %q", got, err, "content")
+	}
+}
+
+func TestStoreUploadRecordsRelay(t *testing.T) {
+	s, url := newTestServer(t, "-sftp-host", "sftp.example.com")
+
+	var body strings.Builder
+	mw := multipart.NewWriter(&body)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		fw, err := mw.CreateFormFile("upload", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, name)
+	}
+	mw.Close()
+
+	resp, err := http.Post(url+"/upload?transaction=true", mw.FormDataContentType(), strings.NewReader(body.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusCreated)
+	}
+
+	// Files stored in a transaction are recorded once committed, at their final path
+	if got, want := relayRecords(t, s.sftpRelay), []string{"a.txt", "b.txt"}; !slices.Equal(got, want) {
+		t.Errorf("recorded %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// ResourceLimits are the CPU and memory limits of the container the server runs in, see [detectResourceLimits].
+type ResourceLimits struct {
+	CPUs   float64 // CPUs is the CPU quota in CPUs, e.g. 1.5, 0 if unlimited.
+	Memory int64   // Memory is the memory limit in bytes, 0 if unlimited.
+	Source string  // Source names where the limits were read from, e.g. "cgroup v2", empty if none were found.
+}
+
+func (l ResourceLimits) String() string {
+	cpus, memory := "unlimited", "unlimited"
+	if l.CPUs > 0 {
+		cpus = fmt.Sprintf("%g", l.CPUs)
+	}
+	if l.Memory > 0 {
+		memory = fmt.Sprintf("%dMB", l.Memory>>20)
+	}
+	source := l.Source
+	if source == "" {
+		source = "no cgroup limits found"
+	}
+	return fmt.Sprintf("CPUs: %s, memory: %s (%s)", cpus, memory, source)
+}
+
+// applyResourceLimits sizes the runtime and the defaults of config to limits, rather than to the host:
+//   - GOMAXPROCS is set to the CPU quota, rounded down, unless the GOMAXPROCS environment variable is set,
+//   - the soft memory limit of the runtime is set to 90% of the memory limit, unless GOMEMLIMIT is set,
+//   - -memory-budget, if not set, defaults to a quarter of the memory limit, and at least -max-size,
+//   - -background-concurrency, if not set, defaults to GOMAXPROCS under a CPU quota.
+//
+// It logs the limits found and the effective settings.
+func applyResourceLimits(logger *log.Logger, config *Config, limits ResourceLimits) {
+	if limits.CPUs > 0 {
+		if os.Getenv("GOMAXPROCS") == "" {
+			runtime.GOMAXPROCS(max(1, int(math.Floor(limits.CPUs))))
+		}
+		if !config.options.isSet("background-concurrency") {
+			config.backgroundConcurrency = runtime.GOMAXPROCS(0)
+			config.options.derive("background-concurrency", strconv.Itoa(config.backgroundConcurrency))
+		}
+	}
+
+	if limits.Memory > 0 {
+		if os.Getenv("GOMEMLIMIT") == "" {
+			debug.SetMemoryLimit(limits.Memory / 10 * 9)
+		}
+		if !config.options.isSet("memory-budget") {
+			config.memoryBudget = max(config.maxInMemorySize, limits.Memory/4)
+			config.options.derive("memory-budget", strconv.FormatInt(config.memoryBudget>>20, 10))
+		}
+	}
+
+	settings := []string{fmt.Sprintf("GOMAXPROCS: %d", runtime.GOMAXPROCS(0))}
+	if memLimit := debug.SetMemoryLimit(-1); memLimit != math.MaxInt64 {
+		settings = append(settings, fmt.Sprintf("GOMEMLIMIT: %dMB", memLimit>>20))
+	}
+	if config.memoryBudget > 0 {
+		settings = append(settings, fmt.Sprintf("memory budget: %dMB", config.memoryBudget>>20))
+	}
+	if config.backgroundConcurrency > 0 {
+		settings = append(settings, fmt.Sprintf("background concurrency: %d", config.backgroundConcurrency))
+	}
+	logger.Printf("Resource limits: %s; %s", limits, strings.Join(settings, ", "))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup filesystems are mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// maxCgroupV1Memory is the threshold above which cgroup v1 memory limits mean unlimited, which they report as
+// the largest page aligned int64.
+const maxCgroupV1Memory = 1 << 62
+
+// detectResourceLimits reads the CPU quota and memory limit of the cgroup of the process, cgroup v2 or v1.
+// The paths of /proc/self/cgroup are looked up under the cgroup mounts, then the mounts themselves are, as
+// they are the cgroup of the container itself with a cgroup namespace.
+func detectResourceLimits() ResourceLimits {
+	groups, err := readProcCgroups("/proc/self/cgroup")
+	if err != nil {
+		return ResourceLimits{}
+	}
+
+	if path, ok := groups[""]; ok {
+		if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err == nil {
+			return cgroupV2Limits(path)
+		}
+	}
+	return cgroupV1Limits(groups)
+}
+
+// readProcCgroups maps the controllers of the cgroups listed in the /proc/<pid>/cgroup file at path to their
+// paths, the unified hierarchy of cgroup v2 being keyed by the empty string and v1 hierarchies by their
+// comma separated controllers, e.g. "cpu,cpuacct".
+func readProcCgroups(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	groups := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		// Lines are of the form hierarchy-ID:controller-list:cgroup-path
+		fields := strings.SplitN(sc.Text(), ":", 3)
+		if len(fields) == 3 {
+			groups[fields[1]] = fields[2]
+		}
+	}
+	return groups, sc.Err()
+}
+
+// readCgroupFile reads the file name of the cgroup at path within mount, or of mount itself if the cgroup is not
+// visible there, returning its trimmed content.
+func readCgroupFile(mount, path, name string) (string, bool) {
+	for _, p := range []string{filepath.Join(mount, path, name), filepath.Join(mount, name)} {
+		if b, err := os.ReadFile(p); err == nil {
+			return strings.TrimSpace(string(b)), true
+		}
+	}
+	return "", false
+}
+
+// cgroupV2Limits reads the limits of the cgroup v2 at path, from its cpu.max and memory.max files.
+func cgroupV2Limits(path string) ResourceLimits {
+	limits := ResourceLimits{Source: "cgroup v2"}
+
+	// cpu.max holds the quota and period in microseconds, the quota being "max" if unlimited
+	if s, ok := readCgroupFile(cgroupRoot, path, "cpu.max"); ok {
+		if fields := strings.Fields(s); len(fields) == 2 {
+			quota, qerr := strconv.ParseFloat(fields[0], 64)
+			period, perr := strconv.ParseFloat(fields[1], 64)
+			if qerr == nil && perr == nil && quota > 0 && period > 0 {
+				limits.CPUs = quota / period
+			}
+		}
+	}
+
+	if s, ok := readCgroupFile(cgroupRoot, path, "memory.max"); ok {
+		if n, err := strconv.ParseInt(s, 10, 64); err == nil && n > 0 {
+			limits.Memory = n
+		}
+	}
+	return limits
+}
+
+// cgroupV1Limits reads the limits of the cgroups v1 of groups, from the CFS quota of their cpu controller and
+// the limit of their memory controller.
+func cgroupV1Limits(groups map[string]string) ResourceLimits {
+	limits := ResourceLimits{}
+	controller := func(name string) (mount, path string, ok bool) {
+		for controllers, path := range groups {
+			for _, c := range strings.Split(controllers, ",") {
+				if c == name {
+					return filepath.Join(cgroupRoot, controllers), path, true
+				}
+			}
+		}
+		return "", "", false
+	}
+
+	if mount, path, ok := controller("cpu"); ok {
+		limits.Source = "cgroup v1"
+		quota, qok := readCgroupFile(mount, path, "cpu.cfs_quota_us")
+		period, pok := readCgroupFile(mount, path, "cpu.cfs_period_us")
+		if qok && pok {
+			q, qerr := strconv.ParseFloat(quota, 64)
+			p, perr := strconv.ParseFloat(period, 64)
+			// The quota is -1 if unlimited
+			if qerr == nil && perr == nil && q > 0 && p > 0 {
+				limits.CPUs = q / p
+			}
+		}
+	}
+
+	if mount, path, ok := controller("memory"); ok {
+		limits.Source = "cgroup v1"
+		if s, ok := readCgroupFile(mount, path, "memory.limit_in_bytes"); ok {
+			if n, err := strconv.ParseInt(s, 10, 64); err == nil && n > 0 && n < maxCgroupV1Memory {
+				limits.Memory = n
+			}
+		}
+	}
+	return limits
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// detectResourceLimits finds no limits on this platform, where containers are not limited through cgroups.
+func detectResourceLimits() ResourceLimits {
+	return ResourceLimits{}
+}
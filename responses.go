@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"text/template"
+)
+
+// Headers of successful upload responses, reporting the transfer to client tooling, see [UploadContext.transferHeaders].
+const (
+	uploadDurationHeader = "X-Upload-Duration" // uploadDurationHeader is the time the upload took, in seconds.
+	uploadBytesHeader    = "X-Upload-Bytes"    // uploadBytesHeader is the number of request body bytes received.
+	checksumHeader       = "X-Checksum-SHA256" // checksumHeader is the hex SHA-256 of the first stored file.
+)
+
+// responseFuncs are the functions available to response templates, in addition to the built-in ones.
+var responseFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// ResponseTemplate is a [text/template] rendering the response bodies of uploads, read from the file it is set to.
+// It implements [flag.Value]. Responses are sent with the content type of the file's extension, e.g.
+// "application/json" for ".json", or as plain text. The zero ResponseTemplate leaves the built-in responses in place.
+type ResponseTemplate struct {
+	path        string
+	contentType string
+	tmpl        *template.Template
+}
+
+func (t ResponseTemplate) String() string {
+	return t.path
+}
+
+func (t *ResponseTemplate) Set(path string) error {
+	tmpl, err := template.New(filepath.Base(path)).Funcs(responseFuncs).ParseFiles(path)
+	if err != nil {
+		return err
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	*t = ResponseTemplate{path: path, contentType: contentType, tmpl: tmpl}
+	return nil
+}
+
+// UploadResponses are the templates of the responses to uploads.
+type UploadResponses struct {
+	Success ResponseTemplate // Success renders the responses to stored uploads.
+	Failure ResponseTemplate // Failure renders the responses to uploads that were not stored.
+	Compat  Compat           // Compat shapes the responses for a browser upload library, if no template is set.
+}
+
+// newUploadResponses returns the response templates set by config.
+func newUploadResponses(config Config) UploadResponses {
+	return UploadResponses{Success: config.successTemplate, Failure: config.failureTemplate, Compat: config.compat}
+}
+
+// uploadResponse is the data response templates are executed with.
+type uploadResponse struct {
+	RequestID string
+	Status    int               // Status is the HTTP status code of the response.
+	File      Metadata          // File is the stored file, the first one of transactions, zero on failure.
+	Files     []Metadata        // Files are the stored files, more than one for transactions, empty on failure.
+	Error     string            // Error is the reason the upload failed, empty on success.
+	Meta      map[string]string // Meta is the user metadata sent with the upload, if parsed by then.
+	Batch     *batchManifest    // Batch is the outcome of every file of a batch upload, nil for other uploads.
+}
+
+// uploadResponder answers uploads in place of the templates and built-in responses, e.g. as the last event
+// of a [progressStream].
+type uploadResponder interface {
+	respond(w http.ResponseWriter, data uploadResponse)
+}
+
+// write renders data with t and writes it as the response, returning false without writing anything
+// if t is unset or fails to render, so the caller falls back to the built-in response.
+func (t ResponseTemplate) write(w http.ResponseWriter, data uploadResponse) (bool, error) {
+	if t.tmpl == nil {
+		return false, nil
+	}
+
+	var b bytes.Buffer
+	if err := t.tmpl.Execute(&b, data); err != nil {
+		return false, fmt.Errorf("rendering response template %s: %w", t.path, err)
+	}
+
+	w.Header().Set("Content-Type", t.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(data.Status)
+	w.Write(b.Bytes())
+	return true, nil
+}
+
+// respond answers the upload storing files, with the success template if set, as expected by the library of
+// the compatibility preset, or in XML if the client prefers it. Responses are 201 Created, with a Location
+// header pointing at the URL of the first file, and the transfer headers.
+func (u *UploadContext) respond(w http.ResponseWriter, files ...Metadata) {
+	data := uploadResponse{RequestID: u.RequestID, Status: http.StatusCreated, Files: files, Meta: u.Meta}
+	if len(files) > 0 {
+		data.File = files[0]
+		w.Header().Set("Location", u.fileURL(files[0].Name))
+	}
+	u.transferHeaders(w, files)
+	if u.Responder != nil {
+		u.Responder.respond(w, data)
+		return
+	}
+
+	ok, err := u.Responses.Success.write(w, data)
+	if err != nil {
+		u.Logger.Printf("Error writing upload response: %v", err)
+	}
+	if ok || u.Responses.Compat.write(w, u.Storage, files, data.Status) {
+		return
+	}
+
+	if u.XML {
+		writeXML(w, data.Status, xmlUpload{RequestID: u.RequestID, Files: files})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(data.Status)
+	for _, f := range files {
+		fmt.Fprintf(w, "File uploaded successfully: %s\n", f.Name)
+	}
+}
+
+// transferHeaders sets the headers reporting how long the upload took, the bytes of its body received so far,
+// and the checksum of the first of files, so clients can log transfer statistics without computing them.
+func (u *UploadContext) transferHeaders(w http.ResponseWriter, files []Metadata) {
+	w.Header().Set(uploadDurationHeader, strconv.FormatFloat(u.Stages.elapsed().Seconds(), 'f', 3, 64))
+	if u.Body != nil {
+		w.Header().Set(uploadBytesHeader, strconv.FormatInt(u.Body.n, 10))
+	}
+	if len(files) > 0 && files[0].SHA256 != "" {
+		w.Header().Set(checksumHeader, files[0].SHA256)
+	}
+}
+
+// respondError answers the upload failing with message and status, with the failure template if set, as
+// expected by the library of the compatibility preset, or in XML if the client prefers it.
+func (u *UploadContext) respondError(w http.ResponseWriter, message string, status int) {
+	data := uploadResponse{RequestID: u.RequestID, Status: status, Error: message, Meta: u.Meta}
+	if u.Responder != nil {
+		u.Responder.respond(w, data)
+		return
+	}
+
+	ok, err := u.Responses.Failure.write(w, data)
+	if err != nil {
+		u.Logger.Printf("Error writing upload response: %v", err)
+	}
+	if ok || u.Responses.Compat.writeError(w, message, status) {
+		return
+	}
+
+	if u.XML {
+		writeXML(w, status, xmlError{RequestID: u.RequestID, Status: status, Message: message})
+		return
+	}
+
+	http.Error(w, message, status)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// RootMode configures what the root path, and any other path without a route, serves. It implements [flag.Value].
+// It is one of "not-found", "ui", "dir:<path>" or "redirect:<url>".
+type RootMode string
+
+const (
+	RootNotFound RootMode = "not-found" // RootNotFound answers 404 to everything.
+	RootUI       RootMode = "ui"        // RootUI serves the built-in upload page at the root path.
+
+	rootDirPrefix      = "dir:"      // rootDirPrefix precedes the directory of a static landing page.
+	rootRedirectPrefix = "redirect:" // rootRedirectPrefix precedes the URL the root path redirects to.
+)
+
+func (m *RootMode) String() string {
+	return string(*m)
+}
+
+func (m *RootMode) Set(v string) error {
+	switch mode := RootMode(v); {
+	case mode == RootNotFound, mode == RootUI:
+	case strings.HasPrefix(v, rootDirPrefix) && len(v) > len(rootDirPrefix):
+	case strings.HasPrefix(v, rootRedirectPrefix):
+		if u, err := url.Parse(strings.TrimPrefix(v, rootRedirectPrefix)); err != nil || u.Path == "" && u.Host == "" {
+			return fmt.Errorf("invalid redirect URL in %q", v)
+		}
+	default:
+		return fmt.Errorf("unknown root mode %q, expected one of not-found, ui, dir:<path> or redirect:<url>", v)
+	}
+	*m = RootMode(v)
+	return nil
+}
+
+// dir returns the directory of the landing page, if m serves one.
+func (m RootMode) dir() (string, bool) {
+	return strings.CutPrefix(string(m), rootDirPrefix)
+}
+
+// rootNotFoundPage is the page, within the landing page directory, served with 404 responses, if present.
+const rootNotFoundPage = "404.html"
+
+// uiPage is the built-in upload page.
+var uiPage = template.Must(template.New("ui").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Upload</title>
+<style>body{font-family:sans-serif;max-width:32rem;margin:4rem auto;padding:0 1rem}input,button{margin:.5rem 0}</style>
+</head>
+<body>
+<h1>Upload files</h1>
+<form method="post" action="{{.Endpoint}}" enctype="multipart/form-data">
+<input type="file" name="{{.Field}}" required>
+<button type="submit">Upload</button>
+</form>
+</body>
+</html>
+`))
+
+// rootHandler returns an HTTP handler serving the paths without a route according to mode:
+// 404 responses, the built-in upload page posting the form field to the upload endpoint, a redirect
+// of the root path, or the static landing page found in a directory. Landing pages only serve regular
+// files, index.html for directories, and their 404.html, if any, with 404 responses.
+func rootHandler(logger *log.Logger, mode RootMode, endpoint, field string) http.Handler {
+	dir, isDir := mode.dir()
+	target, isRedirect := strings.CutPrefix(string(mode), rootRedirectPrefix)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch {
+		case mode == RootUI && r.URL.Path == "/":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			if err := uiPage.Execute(w, struct{ Endpoint, Field string }{endpoint, field}); err != nil {
+				logger.Printf("Error rendering upload page: %v", err)
+			}
+		case isRedirect && r.URL.Path == "/":
+			http.Redirect(w, r, target, http.StatusFound)
+		case isDir:
+			serveLandingPage(logger, w, r, dir)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// serveLandingPage serves the file of the landing page in dir requested by r.
+func serveLandingPage(logger *log.Logger, w http.ResponseWriter, r *http.Request, dir string) {
+	f, fi, err := openDirFile(dir, r.URL.Path, true)
+	if errors.Is(err, fs.ErrNotExist) {
+		landingPageNotFound(w, r, dir)
+		return
+	}
+	if err != nil {
+		logger.Printf("Error opening landing page: %v", err)
+		http.Error(w, "Could not open page", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
+
+// openDirFile opens the regular file at the slash separated name within dir, or its index.html if name
+// is a directory and index is set. Dot files and directories, such as .git, are reported as not existing.
+func openDirFile(dir, name string, index bool) (*os.File, fs.FileInfo, error) {
+	name = path.Clean("/" + name)
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return nil, nil, fs.ErrNotExist
+		}
+	}
+
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	if fi, err := os.Stat(p); err == nil && fi.IsDir() && index {
+		p = filepath.Join(p, "index.html")
+	}
+
+	f, err := os.Open(p)
+	if errors.Is(err, syscall.ENOTDIR) {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fi, err := f.Stat()
+	if err == nil && !fi.Mode().IsRegular() {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, fi, nil
+}
+
+// landingPageNotFound answers 404, with the 404.html page of the landing page in dir if present.
+func landingPageNotFound(w http.ResponseWriter, r *http.Request, dir string) {
+	page, err := os.ReadFile(filepath.Join(dir, rootNotFoundPage))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	if r.Method != http.MethodHead {
+		w.Write(page)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Client is a minimal client of the S3 object API, signing requests with AWS Signature Version 4.
+// Objects are addressed path-style, which is also understood by S3 compatible stores
+// such as MinIO and Google Cloud Storage's XML API.
+type s3Client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+// newS3Client creates a client of bucket at endpoint, e.g. "https://s3.eu-west-1.amazonaws.com".
+// Credentials are taken from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables. Requests are
+// made with outbound.
+func newS3Client(endpoint, region, bucket string, outbound *Outbound) (*s3Client, error) {
+	return newS3ClientFromEnv(endpoint, region, bucket, "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", outbound)
+}
+
+// newS3ClientFromEnv creates a client of bucket at endpoint, taking credentials from the
+// accessKeyEnv and secretKeyEnv environment variables.
+func newS3ClientFromEnv(endpoint, region, bucket, accessKeyEnv, secretKeyEnv string, outbound *Outbound) (*s3Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing s3 endpoint: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", endpoint)
+	}
+
+	c := &s3Client{
+		endpoint:  u,
+		region:    region,
+		bucket:    bucket,
+		accessKey: os.Getenv(accessKeyEnv),
+		secretKey: os.Getenv(secretKeyEnv),
+		client:    outbound.client(0),
+	}
+
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, fmt.Errorf("s3 credentials missing, set %s and %s", accessKeyEnv, secretKeyEnv)
+	}
+
+	return c, nil
+}
+
+// objectURL returns the path-style URL of the object key.
+func (c *s3Client) objectURL(key string) *url.URL {
+	u := *c.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket + "/" + key
+	u.RawPath = ""
+	return &u
+}
+
+// put uploads the file at path as the object key.
+func (c *s3Client) put(ctx context.Context, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.objectURL(key).String(), io.NopCloser(f))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	resp, err := c.do(req, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// get returns the content of the object key. The caller must close it.
+func (c *s3Client) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.objectURL(key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// delete removes the object key.
+func (c *s3Client) delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.objectURL(key).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req, emptySHA256)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// s3Object is an entry of a bucket listing.
+type s3Object struct {
+	Key  string
+	Size int64
+	ETag string // ETag is the entity tag of the object, the hex encoded MD5 of its content if it was uploaded in one piece.
+}
+
+// list calls fn with the objects whose key starts with prefix, in key order, until fn returns an error.
+func (c *s3Client) list(ctx context.Context, prefix string, fn func(s3Object) error) error {
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+
+		u := *c.endpoint
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + c.bucket
+		u.RawPath = ""
+		u.RawQuery = s3EncodeQuery(q)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := c.do(req, emptySHA256)
+		if err != nil {
+			return err
+		}
+
+		var result struct {
+			Contents              []s3Object
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("decoding s3 listing: %w", err)
+		}
+
+		for _, obj := range result.Contents {
+			obj.ETag = strings.Trim(obj.ETag, `"`)
+			if err := fn(obj); err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// head returns the description of the object key.
+func (c *s3Client) head(ctx context.Context, key string) (s3Object, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.objectURL(key).String(), nil)
+	if err != nil {
+		return s3Object{}, err
+	}
+
+	resp, err := c.do(req, emptySHA256)
+	if err != nil {
+		return s3Object{}, err
+	}
+	resp.Body.Close()
+
+	return s3Object{Key: key, Size: resp.ContentLength, ETag: strings.Trim(resp.Header.Get("ETag"), `"`)}, nil
+}
+
+// emptySHA256 is the hex encoded SHA-256 of an empty payload.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// do signs and sends req, whose payload hashes to payloadHash.
+// Responses with a non 2xx status are returned as errors.
+func (c *s3Client) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	c.sign(req, payloadHash, time.Now().UTC())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 headers to req.
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	signV4(req, "s3", c.region, c.accessKey, c.secretKey, payloadHash, now)
+}
+
+// signV4 adds the AWS Signature Version 4 headers for service in region to req, whose payload hashes to payloadHash.
+func signV4(req *http.Request, service, region, accessKey, secretKey, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		s3EncodeQuery(req.URL.Query()),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	signature := hex.EncodeToString(hmacSHA256(v4SigningKey(secretKey, date, region, service), stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// presign returns a URL of the object key that grants method to anyone holding it for expires, signed with
+// AWS Signature Version 4 in the query string. query adds parameters such as response-content-disposition,
+// which are covered by the signature.
+func (c *s3Client) presign(method, key string, query url.Values, expires time.Duration, now time.Time) string {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+
+	u := c.objectURL(key)
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", c.accessKey+"/"+scope)
+	q.Set("X-Amz-Date", amzDate)
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	q.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		method,
+		s3EscapePath(u.Path),
+		s3EncodeQuery(q),
+		"host:" + u.Host,
+		"",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	q.Set("X-Amz-Signature", hex.EncodeToString(hmacSHA256(v4SigningKey(c.secretKey, date, c.region, "s3"), stringToSign)))
+
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3EncodeQuery(q)
+	return u.String()
+}
+
+// v4SigningKey derives the Signature Version 4 key of secretKey for service in region on date.
+func v4SigningKey(secretKey, date, region, service string) []byte {
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+// s3EncodeQuery encodes q as required by Signature Version 4, sorted by key and with spaces as %20.
+func s3EncodeQuery(q url.Values) string {
+	return strings.ReplaceAll(q.Encode(), "+", "%20")
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data using key.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath URI-encodes path as required by Signature Version 4,
+// escaping everything but unreserved characters and the path separators.
+func s3EscapePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
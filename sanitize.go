@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// quarantineDir is the directory, relative to the upload directory, where the originals of sanitized uploads are kept.
+const quarantineDir = ".quarantine"
+
+// tempDirFile is an [*os.File] within a temporary directory, which is removed when the file is closed.
+type tempDirFile struct {
+	*os.File
+	dir string
+}
+
+func (f *tempDirFile) Close() error {
+	err := f.File.Close()
+	os.RemoveAll(f.dir)
+	return err
+}
+
+// sanitizer returns a [Transformer] running uploads with one of extensions through the sanitizer command,
+// e.g. "dangerzone-cli {in} --output-filename {out}", where {in} is replaced with the path of the
+// original content and {out} with the path the sanitized content must be written to.
+// The sanitized content is stored in place of the original, which is moved to the
+// [quarantineDir] of baseDir. Uploads failing sanitization are rejected.
+func sanitizer(baseDir, command string, extensions []string, timeout time.Duration) Transformer {
+	args := strings.Fields(command)
+
+	match := make(map[string]bool, len(extensions))
+	for _, ext := range extensions {
+		match[strings.ToLower(strings.TrimSpace(ext))] = true
+	}
+
+	return TransformerFunc(func(c *UploadCandidate, src io.Reader) (io.Reader, error) {
+		if !match[strings.ToLower(filepath.Ext(c.Filename))] {
+			return src, nil
+		}
+
+		quarantine := filepath.Join(baseDir, quarantineDir)
+		if err := os.MkdirAll(quarantine, 0o755); err != nil {
+			return nil, err
+		}
+
+		in, err := os.CreateTemp(quarantine, c.Filename+".*")
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(in.Name())
+
+		_, err = io.Copy(in, src)
+		if closeErr := in.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		outDir, err := os.MkdirTemp("", "usrv-sanitize-*")
+		if err != nil {
+			return nil, err
+		}
+		out := filepath.Join(outDir, c.Filename)
+
+		if err := runSanitizer(args, in.Name(), out, timeout); err != nil {
+			os.RemoveAll(outDir)
+			c.Upload.Logger.Printf("Sanitizing %s failed: %v", c.Filename, err)
+			return nil, &RejectionError{http.StatusUnprocessableEntity, "document could not be sanitized"}
+		}
+
+		f, err := os.Open(out)
+		if err != nil {
+			os.RemoveAll(outDir)
+			return nil, fmt.Errorf("opening sanitized document: %w", err)
+		}
+
+		if err := os.Rename(in.Name(), filepath.Join(quarantine, c.Filename)); err != nil {
+			f.Close()
+			os.RemoveAll(outDir)
+			return nil, fmt.Errorf("quarantining original document: %w", err)
+		}
+
+		return &tempDirFile{File: f, dir: outDir}, nil
+	})
+}
+
+// runSanitizer runs the sanitizer command args, with {in} and {out} placeholders replaced.
+func runSanitizer(args []string, in, out string, timeout time.Duration) error {
+	argv := make([]string, len(args))
+	for i, arg := range args {
+		argv[i] = strings.NewReplacer("{in}", in, "{out}", out).Replace(arg)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxScrubReportedFiles is the number of corrupted files named in scrub alerts.
+const maxScrubReportedFiles = 10
+
+// Scrubbing metrics, published through [expvar].
+var (
+	scrubPasses    = expvar.NewInt("scrub_passes")    // scrubPasses counts completed scrub passes.
+	scrubFiles     = expvar.NewInt("scrub_files")     // scrubFiles counts files verified against their checksum.
+	scrubBytes     = expvar.NewInt("scrub_bytes")     // scrubBytes counts the bytes read by the scrubber.
+	scrubCorrupted = expvar.NewInt("scrub_corrupted") // scrubCorrupted counts files found not to match their checksum.
+	scrubRepaired  = expvar.NewInt("scrub_repaired")  // scrubRepaired counts corrupted files repaired from the backup replica.
+)
+
+// Scrubber slowly re-reads the stored files of the upload directory and its buckets, verifying them
+// against the SHA-256 recorded in their metadata, to catch bit rot before the files are needed.
+// Files stored without a checksum get one recorded on their first scrub.
+type Scrubber struct {
+	baseDir  string
+	interval time.Duration // interval is the time between the starts of scrub passes.
+	rate     int64         // rate is the maximum number of bytes read per second, 0 means unlimited.
+	repair   bool          // repair enables repairing corrupted files from the backup replica.
+	backup   *Backup       // backup holds the replica corrupted files are repaired from.
+	alerter  *Alerter      // alerter is notified of corrupted files, which are only logged if nil.
+	indexes  *FileIndexes  // indexes record the metadata of the files scrubbed.
+	logger   *log.Logger
+}
+
+// newScrubber creates the scrubber configured by config, repairing files from backup, alerting alerter and
+// recording metadata in indexes, or nil if scrubbing is disabled.
+func newScrubber(config Config, backup *Backup, alerter *Alerter, indexes *FileIndexes, logger *log.Logger) (*Scrubber, error) {
+	if config.scrubInterval == 0 {
+		return nil, nil
+	}
+	if config.scrubRepair && (config.backupInterval == 0 || config.backupS3Bucket == "") {
+		return nil, errors.New("repairing scrubbed files requires backups synced to -backup-s3-bucket")
+	}
+
+	return &Scrubber{
+		baseDir:  config.dir,
+		interval: config.scrubInterval,
+		rate:     config.scrubRate,
+		repair:   config.scrubRepair,
+		backup:   backup,
+		alerter:  alerter,
+		indexes:  indexes,
+		logger:   logger,
+	}, nil
+}
+
+// run scrubs periodically, in passes run by jobs, until ctx is done.
+func (s *Scrubber) run(ctx context.Context, jobs *JobRunner) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		jobs.Do(func() { s.scrub(ctx) })
+	}
+}
+
+// scrub verifies every stored file once, reporting the corrupted ones.
+func (s *Scrubber) scrub(ctx context.Context) {
+	dirs := []string{s.baseDir}
+	buckets := newBuckets(s.baseDir, s.logger)
+	list, err := buckets.list()
+	if err != nil {
+		s.logger.Printf("Error listing buckets: %v", err)
+	}
+	for _, b := range list {
+		dirs = append(dirs, buckets.path(b.Name))
+	}
+
+	var corrupted []string
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			s.logger.Printf("Error scrubbing %s: %v", dir, err)
+			continue
+		}
+
+		for _, e := range entries {
+			if ctx.Err() != nil {
+				return
+			}
+			if !e.Type().IsRegular() || !validFileName(e.Name()) {
+				continue
+			}
+
+			ok, err := s.verify(ctx, dir, e.Name())
+			if err != nil {
+				s.logger.Printf("Error scrubbing %s: %v", filepath.Join(dir, e.Name()), err)
+				continue
+			}
+			if !ok {
+				rel, _ := filepath.Rel(s.baseDir, filepath.Join(dir, e.Name()))
+				corrupted = append(corrupted, rel)
+			}
+		}
+	}
+
+	scrubPasses.Add(1)
+	if len(corrupted) == 0 {
+		return
+	}
+
+	details := corrupted[:min(len(corrupted), maxScrubReportedFiles)]
+	summary := fmt.Sprintf("The scrubber found %d corrupted files", len(corrupted))
+	if s.alerter == nil {
+		s.logger.Printf("Alert corruption: %s: %s", summary, strings.Join(details, ", "))
+		return
+	}
+	s.alerter.event(ctx, "corruption", summary, details)
+}
+
+// verify checks the file name stored in dir against its recorded checksum, repairing it if enabled.
+// It reports false if the file is corrupted and could not be repaired.
+func (s *Scrubber) verify(ctx context.Context, dir, name string) (bool, error) {
+	path := filepath.Join(dir, name)
+	before, err := os.Stat(path)
+	if err != nil {
+		return true, ignoreNotExist(err)
+	}
+
+	sum, err := s.checksum(ctx, path)
+	if err != nil {
+		return true, ignoreNotExist(err)
+	}
+	scrubFiles.Add(1)
+
+	meta, err := readMetadata(dir, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		meta = Metadata{Name: name, Size: before.Size(), UploadedAt: before.ModTime().UTC()}
+	} else if err != nil {
+		return true, err
+	}
+
+	if meta.SHA256 == "" {
+		meta.SHA256 = sum
+		infof(s.logger, "Recorded checksum of %s", path)
+		return true, writeMetadata(dir, meta, s.indexes)
+	}
+	if meta.SHA256 == sum {
+		return true, nil
+	}
+
+	// The file may have been written since it was read
+	if after, err := os.Stat(path); err != nil || !after.ModTime().Equal(before.ModTime()) || after.Size() != before.Size() {
+		return true, ignoreNotExist(err)
+	}
+	if m, err := readMetadata(dir, name); err != nil || m.SHA256 != meta.SHA256 {
+		return true, ignoreNotExist(err)
+	}
+
+	scrubCorrupted.Add(1)
+	s.logger.Printf("Corrupted file %s: sha256 %s, expected %s", path, sum, meta.SHA256)
+
+	if !s.repair {
+		return false, nil
+	}
+	if err := s.restore(ctx, path, meta.SHA256, before.ModTime()); err != nil {
+		s.logger.Printf("Error repairing %s: %v", path, err)
+		return false, nil
+	}
+
+	scrubRepaired.Add(1)
+	s.logger.Printf("Repaired corrupted file %s from the backup replica", path)
+	return true, nil
+}
+
+// checksum returns the hex encoded SHA-256 of the file at path, read at no more than the scrub rate.
+func (s *Scrubber) checksum(ctx context.Context, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, &throttledReader{r: f, ctx: ctx, rate: s.rate, start: time.Now()})
+	scrubBytes.Add(n)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// restore replaces the file at path with its copy in the backup replica, provided the copy matches sum.
+// The modification time of the file is kept, so the next backup does not sync it again.
+func (s *Scrubber) restore(ctx context.Context, path, sum string, modTime time.Time) error {
+	rel, err := filepath.Rel(s.baseDir, path)
+	if err != nil {
+		return err
+	}
+
+	src, err := s.backup.replica(ctx, rel)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".scrub-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), src); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+		return fmt.Errorf("replica has sha256 %s, expected %s", got, sum)
+	}
+
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), modTime, modTime); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// throttledReader reads from r at no more than rate bytes per second on average, until ctx is done.
+type throttledReader struct {
+	r     io.Reader
+	ctx   context.Context
+	rate  int64 // rate is the maximum number of bytes read per second, 0 means unlimited.
+	start time.Time
+	n     int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if err := t.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+	if t.rate > 0 {
+		due := time.Duration(float64(t.n) / float64(t.rate) * float64(time.Second))
+		if wait := due - time.Since(t.start); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-t.ctx.Done():
+				return n, t.ctx.Err()
+			}
+		}
+	}
+	return n, err
+}
+
+// ignoreNotExist returns err, or nil if it reports a missing file, e.g. one deleted while being scrubbed.
+func ignoreNotExist(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
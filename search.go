@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultSearchLimit is the number of search results returned if the client does not ask otherwise.
+const defaultSearchLimit = 100
+
+// searchIndexMaxAge is how long a search index is used for before it is rebuilt from disk, picking up the files
+// changed outside of the server, e.g. by other replicas sharing the upload directory.
+const searchIndexMaxAge = 5 * time.Minute
+
+// FileIndexes holds the in-memory indexes of the metadata of the files stored in the directories served by a
+// [Server], by directory, kept up to date as metadata is written and removed, see [writeMetadata] and
+// [removeMetadata]: their search indexes and cached manifests. A nil *FileIndexes indexes nothing.
+type FileIndexes struct {
+	mu        sync.Mutex
+	search    map[string]*searchIndex   // search holds the indexes of the directories searched so far.
+	manifests map[string]*manifestCache // manifests holds the manifests of the directories served so far.
+}
+
+// newFileIndexes returns empty indexes, filled in as directories are searched and their manifests served.
+func newFileIndexes() *FileIndexes {
+	return &FileIndexes{search: make(map[string]*searchIndex), manifests: make(map[string]*manifestCache)}
+}
+
+// searchIndex returns the index of the files stored in baseDir, nil if baseDir was not searched yet unless create
+// is set.
+func (ix *FileIndexes) searchIndex(baseDir string, create bool) *searchIndex {
+	if ix == nil {
+		return nil
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	baseDir = filepath.Clean(baseDir)
+	idx := ix.search[baseDir]
+	if idx == nil && create {
+		idx = &searchIndex{}
+		ix.search[baseDir] = idx
+	}
+	return idx
+}
+
+// manifest returns the cached manifest of the files stored in baseDir. Without indexes, the manifest is not cached.
+func (ix *FileIndexes) manifest(baseDir string) *manifestCache {
+	if ix == nil {
+		return &manifestCache{}
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	baseDir = filepath.Clean(baseDir)
+	c := ix.manifests[baseDir]
+	if c == nil {
+		c = &manifestCache{}
+		ix.manifests[baseDir] = c
+	}
+	return c
+}
+
+// cachedManifest returns the cached manifest of baseDir, nil if none was served yet.
+func (ix *FileIndexes) cachedManifest(baseDir string) *manifestCache {
+	if ix == nil {
+		return nil
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return ix.manifests[filepath.Clean(baseDir)]
+}
+
+// indexFile records the metadata m of a file stored in baseDir in its indexes, once written to disk.
+func (ix *FileIndexes) indexFile(baseDir string, m Metadata) {
+	if idx := ix.searchIndex(baseDir, false); idx != nil {
+		idx.update(m.Name, &m)
+	}
+	if c := ix.cachedManifest(baseDir); c != nil {
+		c.invalidate()
+	}
+}
+
+// unindexFile removes the file name of baseDir from its indexes, once removed from disk.
+func (ix *FileIndexes) unindexFile(baseDir, name string) {
+	if idx := ix.searchIndex(baseDir, false); idx != nil {
+		idx.update(name, nil)
+	}
+	if c := ix.cachedManifest(baseDir); c != nil {
+		c.invalidate()
+	}
+}
+
+// reset discards the indexes of baseDir, rebuilt from disk when next used, for changes of files that cannot be
+// followed one by one.
+func (ix *FileIndexes) reset(baseDir string) {
+	if idx := ix.searchIndex(baseDir, false); idx != nil {
+		idx.reset()
+	}
+	if c := ix.cachedManifest(baseDir); c != nil {
+		c.invalidate()
+	}
+}
+
+// searchIndex is the in-memory index of the metadata of the files stored in a directory, searched instead of the
+// disk. It is built from disk by the first search of the directory, and kept up to date as files are stored and
+// deleted, see [FileIndexes.indexFile] and [FileIndexes.unindexFile].
+//
+// The index is built without holding mu, so that storing and deleting files is not held up by the listing of the
+// directory: the changes made meanwhile are recorded in pending and replayed on the listing once it completes.
+type searchIndex struct {
+	build sync.Mutex // build is held while the index is built, so that it is built once at a time.
+
+	mu      sync.Mutex           // mu guards the fields below.
+	files   map[string]Metadata  // files holds the metadata of the files, by name, nil until built.
+	names   []string             // names holds the names of the files, sorted.
+	builtAt time.Time            // builtAt is when files was listed from disk.
+	pending map[string]*Metadata // pending holds the changes made while the index is built, nil for removals.
+	resets  int                  // resets counts the resets of the index, discarding the builds they interrupt.
+}
+
+// update records the metadata m of the file name, or its removal if m is nil.
+func (idx *searchIndex) update(name string, m *Metadata) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.pending != nil {
+		idx.pending[name] = m
+	}
+	if idx.files != nil {
+		idx.apply(name, m)
+	}
+}
+
+// apply records the metadata m of the file name in files, or its removal if m is nil. idx.mu must be held.
+func (idx *searchIndex) apply(name string, m *Metadata) {
+	i, found := slices.BinarySearch(idx.names, name)
+	switch {
+	case m == nil && found:
+		idx.names = slices.Delete(idx.names, i, i+1)
+		delete(idx.files, name)
+	case m != nil && !found:
+		idx.names = slices.Insert(idx.names, i, name)
+		fallthrough
+	case m != nil:
+		idx.files[name] = *m
+	}
+}
+
+// reset discards the index, rebuilt from disk by the next search.
+func (idx *searchIndex) reset() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.files, idx.names = nil, nil
+	idx.resets++
+}
+
+// refresh builds the index from disk if it is missing or older than [searchIndexMaxAge].
+func (idx *searchIndex) refresh(logger *log.Logger, baseDir string) error {
+	idx.build.Lock()
+	defer idx.build.Unlock()
+
+	idx.mu.Lock()
+	if idx.files != nil && time.Since(idx.builtAt) <= searchIndexMaxAge {
+		idx.mu.Unlock()
+		return nil
+	}
+	idx.pending = make(map[string]*Metadata)
+	resets := idx.resets
+	idx.mu.Unlock()
+
+	files := make(map[string]Metadata)
+	builtAt := time.Now()
+	err := listFiles(logger, baseDir, func(m Metadata) bool {
+		files[m.Name] = m
+		return true
+	})
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	pending := idx.pending
+	idx.pending = nil
+	if err != nil || idx.resets != resets {
+		return err
+	}
+
+	idx.files, idx.builtAt = files, builtAt
+	idx.names = make([]string, 0, len(files))
+	for name := range files {
+		idx.names = append(idx.names, name)
+	}
+	slices.Sort(idx.names)
+	for name, m := range pending {
+		idx.apply(name, m)
+	}
+	return nil
+}
+
+// each calls fn with the metadata of every file of the index of baseDir, sorted by name, until it returns false,
+// building the index from disk first if it is missing or older than [searchIndexMaxAge].
+func (idx *searchIndex) each(logger *log.Logger, baseDir string, fn func(Metadata) bool) error {
+	if err := idx.refresh(logger, baseDir); err != nil {
+		return err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	for _, name := range idx.names {
+		if !fn(idx.files[name]) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// listFiles returns the metadata of all files stored in baseDir, including those archived to the
+// cold tier. Files stored without metadata are described by their file info.
+// fn is called for every file until it returns false.
+func listFiles(logger *log.Logger, baseDir string, fn func(Metadata) bool) error {
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !validFileName(name) {
+			continue
+		}
+
+		meta, err := readMetadata(baseDir, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			fi, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			meta = Metadata{Name: name, Size: fi.Size(), UploadedAt: fi.ModTime().UTC()}
+		} else if err != nil {
+			logger.Printf("Error reading metadata of %s: %v", name, err)
+			continue
+		}
+
+		if !fn(meta) {
+			return nil
+		}
+	}
+
+	return listColdFiles(baseDir, fn)
+}
+
+// listColdFiles returns the metadata of the files of baseDir archived to the cold tier.
+// fn is called for every file until it returns false.
+func listColdFiles(baseDir string, fn func(Metadata) bool) error {
+	entries, err := os.ReadDir(filepath.Join(baseDir, metadataDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok || !validFileName(name) {
+			continue
+		}
+
+		meta, err := readMetadata(baseDir, name)
+		if err != nil || meta.Tier != tierCold {
+			continue
+		}
+
+		// Files still on the local disk were listed already
+		if _, err := os.Stat(filepath.Join(baseDir, name)); err == nil {
+			continue
+		}
+
+		if !fn(meta) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// matchesTerms reports whether every term is found, case-insensitively, in the
+// file name or the user metadata keys and values of m. Terms must be lower-case.
+func matchesTerms(m Metadata, terms []string) bool {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(m.Name))
+	for k, v := range m.Meta {
+		b.WriteString("\x00" + strings.ToLower(k) + "\x00" + strings.ToLower(v))
+	}
+	text := b.String()
+
+	for _, term := range terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// search handles GET /search?q=<terms>[&limit=<n>], responding with a JSON array of the
+// [Metadata] of files whose name or user metadata contain all of the whitespace separated terms,
+// or an XML <files> document for clients preferring XML.
+//
+// Files are looked up in the in-memory [searchIndex] of baseDir, from indexes, rather than on disk. The index is
+// scanned in name order and every file matched against the terms, so searches take time linear in the number of
+// files of the directory, until limit files are found.
+func search(logger *log.Logger, baseDir string, indexes *FileIndexes) http.Handler {
+	index := indexes.searchIndex(baseDir, true)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		terms := strings.Fields(strings.ToLower(r.URL.Query().Get("q")))
+		if len(terms) == 0 {
+			http.Error(w, "Missing search query", http.StatusBadRequest)
+			return
+		}
+
+		limit := defaultSearchLimit
+		if l := r.URL.Query().Get("limit"); l != "" {
+			var err error
+			limit, err = strconv.Atoi(l)
+			if err != nil || limit <= 0 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+
+		results := []Metadata{}
+		err := index.each(logger, baseDir, func(m Metadata) bool {
+			if matchesTerms(m, terms) {
+				results = append(results, m)
+			}
+			return len(results) < limit
+		})
+		if err != nil {
+			logger.Printf("Error searching files: %v", err)
+			http.Error(w, "Could not search files", http.StatusInternalServerError)
+			return
+		}
+
+		writeNegotiated(w, r, results, xmlFiles{Files: results})
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// searchNames returns the names of the files of the server at url matching the search query q.
+func searchNames(t *testing.T, url, q string) []string {
+	t.Helper()
+	resp, err := http.Get(url + "/search?q=" + q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var results []Metadata
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		t.Fatalf("decoding search results: %v", err)
+	}
+	var names []string
+	for _, m := range results {
+		names = append(names, m.Name)
+	}
+	return names
+}
+
+func TestSearchIndex(t *testing.T) {
+	_, url := newTestServer(t, "-trash-retention", "0")
+
+	upload := func(name, project string) {
+		t.Helper()
+		var body strings.Builder
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("upload", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(name))
+		mw.Close()
+
+		req, err := http.NewRequest(http.MethodPost, url+"/upload", strings.NewReader(body.String()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set(metaHeaderPrefix+"Project", project)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("uploading %s: status %d", name, resp.StatusCode)
+		}
+	}
+
+	upload("report.pdf", "apollo")
+	// The first search builds the index, which later uploads and deletes update
+	if got, want := searchNames(t, url, "apollo"), []string{"report.pdf"}; !slices.Equal(got, want) {
+		t.Fatalf("search = %q, want %q", got, want)
+	}
+
+	upload("notes.txt", "apollo")
+	upload("other.txt", "gemini")
+	if got, want := searchNames(t, url, "apollo"), []string{"notes.txt", "report.pdf"}; !slices.Equal(got, want) {
+		t.Errorf("search after uploads = %q, want %q", got, want)
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, url+"/files/report.pdf", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got, want := searchNames(t, url, "apollo"), []string{"notes.txt"}; !slices.Equal(got, want) {
+		t.Errorf("search after delete = %q, want %q", got, want)
+	}
+}
+
+func TestMatchesTerms(t *testing.T) {
+	m := Metadata{Name: "Report.PDF", Meta: map[string]string{"Project": "Apollo"}}
+
+	tests := []struct {
+		terms []string
+		want  bool
+	}{
+		{[]string{"report"}, true},
+		{[]string{"report", "apollo"}, true},
+		{[]string{"project"}, true},
+		{[]string{"apollo", "gemini"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := matchesTerms(m, tt.terms); got != tt.want {
+			t.Errorf("matchesTerms(%q) = %t, want %t", tt.terms, got, tt.want)
+		}
+	}
+}
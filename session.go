@@ -0,0 +1,504 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionsDir is the directory, relative to the upload directory, where chunked upload sessions are kept.
+const sessionsDir = ".uploads"
+
+// uploadSession is a chunked upload in progress. It is persisted as <id>.json in the [sessionsDir],
+// next to the <id>.part file the content is assembled in, which is preallocated to the length of the upload.
+// Chunks may arrive in any order and in parallel; each is written at its offset, and once it reached the part
+// file an empty <id>.<start>-<end>.chunk marker records its byte range. Sessions thereby survive server restarts
+// and resume from whatever reached the disk.
+type uploadSession struct {
+	ID           string            `json:"id"`
+	Filename     string            `json:"filename"`
+	Length       int64             `json:"length"`
+	Meta         map[string]string `json:"meta,omitempty"`
+	Encryption   *Encryption       `json:"encryption,omitempty"`
+	Expiry       duration          `json:"expiry,omitempty"`
+	MaxDownloads int64             `json:"max_downloads,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+}
+
+// uploadSessions are the chunked upload sessions of an upload directory.
+// Sessions are claimed through locker while being written to, which must be shared by
+// all server replicas if the upload directory is.
+type uploadSessions struct {
+	dir    string
+	locker Locker
+}
+
+func newUploadSessions(baseDir string, locker Locker) *uploadSessions {
+	return &uploadSessions{dir: filepath.Join(baseDir, sessionsDir), locker: locker}
+}
+
+// path returns the path of the file of session id with extension ext.
+func (s *uploadSessions) path(id, ext string) string {
+	return filepath.Join(s.dir, id+ext)
+}
+
+// create persists a new session, failing with [fs.ErrExist] if it exists already.
+func (s *uploadSessions) create(sess uploadSession) error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+
+	part, err := os.OpenFile(s.path(sess.ID, ".part"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	err = part.Truncate(sess.Length)
+	if closeErr := part.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path(sess.ID, ".json.tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(sess.ID, ".json"))
+}
+
+// load returns session id and the byte ranges received so far, merged and in order.
+func (s *uploadSessions) load(id string) (uploadSession, []byteRange, error) {
+	var sess uploadSession
+
+	b, err := os.ReadFile(s.path(id, ".json"))
+	if err != nil {
+		return sess, nil, err
+	}
+	if err := json.Unmarshal(b, &sess); err != nil {
+		return sess, nil, err
+	}
+
+	fi, err := os.Stat(s.path(id, ".part"))
+	if err != nil {
+		return sess, nil, err
+	}
+
+	markers, err := filepath.Glob(s.path(id, ".*.chunk"))
+	if err != nil {
+		return sess, nil, err
+	}
+
+	var ranges []byteRange
+	for _, m := range markers {
+		var r byteRange
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), id+"."), ".chunk")
+		if _, err := fmt.Sscanf(name, "%d-%d", &r.Start, &r.End); err == nil {
+			ranges = append(ranges, r)
+		}
+	}
+
+	// Sessions created before chunks could be sent out of order were appended to rather than preallocated,
+	// and hold the bytes up to the size of their part file
+	if fi.Size() < sess.Length {
+		ranges = append(ranges, byteRange{Start: 0, End: fi.Size()})
+	}
+
+	return sess, mergeRanges(ranges), nil
+}
+
+// record marks the byte range r of session id as received.
+func (s *uploadSessions) record(id string, r byteRange, fsync FsyncPolicy) error {
+	f, err := os.Create(s.path(id, fmt.Sprintf(".%d-%d.chunk", r.Start, r.End)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return fsync.sync(f, s.dir)
+}
+
+// remove deletes session id and its content.
+func (s *uploadSessions) remove(id string) error {
+	markers, _ := filepath.Glob(s.path(id, ".*.chunk"))
+	for _, m := range markers {
+		os.Remove(m)
+	}
+
+	err := os.Remove(s.path(id, ".json"))
+	if partErr := os.Remove(s.path(id, ".part")); err == nil || errors.Is(err, fs.ErrNotExist) {
+		err = partErr
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// acquire claims session id for writing, reporting false if it is claimed already.
+func (s *uploadSessions) acquire(id string) (Lock, bool, error) {
+	return s.locker.TryLock("session:" + id)
+}
+
+// byteRange is the range of bytes [Start, End) of an upload.
+type byteRange struct {
+	Start, End int64
+}
+
+// mergeRanges returns the disjoint ranges covered by ranges, in order.
+func mergeRanges(ranges []byteRange) []byteRange {
+	slices.SortFunc(ranges, func(a, b byteRange) int {
+		return cmp.Compare(a.Start, b.Start)
+	})
+
+	var merged []byteRange
+	for _, r := range ranges {
+		if r.Start >= r.End {
+			continue
+		}
+		if n := len(merged); n > 0 && r.Start <= merged[n-1].End {
+			merged[n-1].End = max(merged[n-1].End, r.End)
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// contiguousOffset returns the number of bytes received without gaps from the beginning of the upload.
+func contiguousOffset(ranges []byteRange) int64 {
+	if len(ranges) == 0 || ranges[0].Start != 0 {
+		return 0
+	}
+	return ranges[0].End
+}
+
+// formatRanges formats ranges as in Range headers, e.g. "0-1023,4096-8191".
+func formatRanges(ranges []byteRange) string {
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = fmt.Sprintf("%d-%d", r.Start, r.End-1)
+	}
+	return strings.Join(parts, ",")
+}
+
+// validSessionID reports whether id has the form of the IDs generated by [createSession].
+func validSessionID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// createSession handles POST /uploads?name=<filename>, starting a chunked upload of Upload-Length bytes.
+// X-Upload-Meta-* and X-Upload-Encryption-* headers are kept as the upload's metadata, as with regular uploads.
+// The session is addressed by the returned Location. Uploads are bounded by the limits of the [UploadContext] of requests.
+func createSession(logger *log.Logger, sessions *uploadSessions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uc := uploadContextFrom(r.Context())
+		maxFileSize := uc.Limits.MaxSize
+		name := r.URL.Query().Get("name")
+		if !validFileName(name) {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+			return
+		}
+
+		if maxFileSize > 0 && length > maxFileSize {
+			http.Error(w, fmt.Sprintf("Upload rejected: file exceeds %d bytes", maxFileSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		meta, err := parseMetaHeaders(r.Header, uc.Limits.MaxMetaHeaders, uc.Limits.MaxMetaSize)
+		if err != nil {
+			logger.Printf("Error parsing upload metadata: %v", err)
+			http.Error(w, fmt.Sprintf("Invalid upload metadata: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		enc, err := parseEncryptionHeaders(r.Header)
+		if err != nil {
+			logger.Printf("Error parsing upload encryption: %v", err)
+			http.Error(w, fmt.Sprintf("Invalid upload encryption: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		expiry, err := parseExpiresAfter(r.Header.Get(expiresAfterHeader))
+		if err != nil {
+			logger.Printf("Error parsing upload expiry: %v", err)
+			http.Error(w, fmt.Sprintf("Invalid upload expiry: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		maxDownloads, err := parseMaxDownloads(r.Header.Get(maxDownloadsHeader))
+		if err != nil {
+			logger.Printf("Error parsing upload download limit: %v", err)
+			http.Error(w, fmt.Sprintf("Invalid upload download limit: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			logger.Printf("Error generating session id: %v", err)
+			http.Error(w, "Could not create upload session", http.StatusInternalServerError)
+			return
+		}
+
+		sess := uploadSession{
+			ID:           hex.EncodeToString(id),
+			Filename:     name,
+			Length:       length,
+			Meta:         meta,
+			Encryption:   enc,
+			Expiry:       duration(expiry),
+			MaxDownloads: maxDownloads,
+			CreatedAt:    time.Now().UTC(),
+		}
+
+		if err := sessions.create(sess); err != nil {
+			logger.Printf("Error creating upload session: %v", err)
+			http.Error(w, "Could not create upload session", http.StatusInternalServerError)
+			return
+		}
+
+		uc.publish(Event{Type: EventUploadStarted, Filename: name})
+
+		infof(logger, "Upload session created: %s for %s, %d bytes\n", sess.ID, name, length)
+		w.Header().Set("Location", "/uploads/"+sess.ID)
+		w.Header().Set("Upload-Offset", "0")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "Upload session created: %s\n", sess.ID)
+	})
+}
+
+// sessionStatus handles HEAD /uploads/{id}, reporting the Upload-Offset up to which the session was received
+// without gaps, and all byte ranges received so far in Upload-Received.
+func sessionStatus(logger *log.Logger, sessions *uploadSessions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !validSessionID(id) {
+			http.NotFound(w, r)
+			return
+		}
+
+		sess, ranges, err := sessions.load(id)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error loading upload session: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(contiguousOffset(ranges), 10))
+		w.Header().Set("Upload-Received", formatRanges(ranges))
+		w.Header().Set("Upload-Length", strconv.FormatInt(sess.Length, 10))
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// appendSession handles PATCH /uploads/{id}, writing the request body to the session at Upload-Offset.
+// Chunks may be sent in any order and in parallel. The request completing the upload stores it like a regular
+// one, see [storeUpload], within the [UploadContext] of the request, and ends the session; requests racing it
+// answer with 204 No Content like any other chunk.
+func appendSession(logger *log.Logger, sessions *uploadSessions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uc := uploadContextFrom(r.Context())
+		fsync := uc.Storage.Fsync
+		id := r.PathValue("id")
+		if !validSessionID(id) {
+			http.NotFound(w, r)
+			return
+		}
+
+		sess, _, err := sessions.load(id)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error loading upload session: %v", err)
+			http.Error(w, "Could not load upload session", http.StatusInternalServerError)
+			return
+		}
+
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 || offset > sess.Length {
+			http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+			return
+		}
+
+		part, err := os.OpenFile(sessions.path(id, ".part"), os.O_RDWR, 0)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error opening upload session: %v", err)
+			http.Error(w, "Could not load upload session", http.StatusInternalServerError)
+			return
+		}
+		defer part.Close()
+
+		// Part files of sessions created before chunks could be sent out of order only grow sequentially
+		if fi, err := part.Stat(); err == nil && fi.Size() < sess.Length && offset != fi.Size() {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(fi.Size(), 10))
+			http.Error(w, fmt.Sprintf("Upload-Offset does not match the session offset %d", fi.Size()), http.StatusConflict)
+			return
+		}
+
+		n, err := io.Copy(io.NewOffsetWriter(part, offset), io.LimitReader(r.Body, sess.Length-offset))
+		if err == nil {
+			err = fsync.sync(part, sessions.dir)
+		}
+		if err == nil && n > 0 {
+			err = sessions.record(id, byteRange{Start: offset, End: offset + n}, fsync)
+		}
+		if err != nil {
+			logger.Printf("Error writing upload session chunk: %v", err)
+			http.Error(w, "Could not write chunk", http.StatusInternalServerError)
+			return
+		}
+
+		if extra, _ := io.Copy(io.Discard, io.LimitReader(r.Body, 1)); extra != 0 {
+			http.Error(w, "Chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		sess, ranges, err := sessions.load(id)
+		if errors.Is(err, fs.ErrNotExist) {
+			// The session was aborted or completed by another request meanwhile
+			sessions.remove(id)
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error loading upload session: %v", err)
+			http.Error(w, "Could not load upload session", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Upload-Offset", strconv.FormatInt(contiguousOffset(ranges), 10))
+		if contiguousOffset(ranges) < sess.Length {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if !completeSession(logger, w, uc, sessions, sess, part) {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
+
+// completeSession stores the fully received session sess, assembled in part, like a regular upload, see
+// [storeUpload], within uc, and ends it. It reports false without answering if another request completes the session.
+func completeSession(logger *log.Logger, w http.ResponseWriter, uc *UploadContext, sessions *uploadSessions, sess uploadSession, part *os.File) bool {
+	stages := uc.Stages
+
+	lock, ok, err := sessions.acquire(sess.ID)
+	if err != nil {
+		logger.Printf("Error locking upload session: %v", err)
+		http.Error(w, "Could not lock upload session", http.StatusInternalServerError)
+		return true
+	}
+	if !ok {
+		// Another request is completing the upload
+		return false
+	}
+	defer lock.Unlock()
+
+	if _, err := os.Stat(sessions.path(sess.ID, ".json")); errors.Is(err, fs.ErrNotExist) {
+		// Another request completed the upload already
+		return false
+	}
+
+	f := &spooledFile{Filename: sess.Filename, Size: sess.Length, tmp: part}
+	stages.mark(stageParse)
+	uc.Meta, uc.Encryption, uc.Expiry, uc.MaxDownloads = sess.Meta, sess.Encryption, time.Duration(sess.Expiry), sess.MaxDownloads
+	stored, err := storeUpload(uc, f)
+	if err != nil {
+		se := err.(*storeError)
+		// Keep the session around for retrying, unless the upload was rejected
+		if se.Status < 500 {
+			sessions.remove(sess.ID)
+		}
+		uc.respondError(w, se.Message, se.Status)
+		uc.publish(Event{Type: EventUploadFailed, Filename: se.Filename, Error: err.Error()})
+		return true
+	}
+
+	if err := sessions.remove(sess.ID); err != nil {
+		logger.Printf("Error removing completed upload session: %v", err)
+	}
+
+	stages.record(stored.Name)
+	infof(logger, "File uploaded successfully: %s\n", stored.Name)
+	uc.respond(w, stored)
+	uc.notifyCallback(stored)
+	uc.publish(Event{Type: EventUploadCompleted, Filename: stored.Name, Size: stored.Size})
+	return true
+}
+
+// abortSession handles DELETE /uploads/{id}, discarding the session and the content received so far.
+func abortSession(logger *log.Logger, sessions *uploadSessions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+		if !validSessionID(id) {
+			http.NotFound(w, r)
+			return
+		}
+
+		lock, ok, err := sessions.acquire(id)
+		if err != nil {
+			logger.Printf("Error locking upload session: %v", err)
+			http.Error(w, "Could not lock upload session", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Upload session is busy", http.StatusConflict)
+			return
+		}
+		defer lock.Unlock()
+
+		if _, err := os.Stat(sessions.path(id, ".json")); errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if err := sessions.remove(id); err != nil {
+			logger.Printf("Error removing upload session: %v", err)
+			http.Error(w, "Could not remove upload session", http.StatusInternalServerError)
+			return
+		}
+
+		infof(logger, "Upload session aborted: %s\n", id)
+		fmt.Fprintf(w, "Upload session aborted: %s\n", id)
+	})
+}
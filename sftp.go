@@ -0,0 +1,746 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SFTP version 3 packet types, see draft-ietf-secsh-filexfer-02.
+const (
+	sftpInit          = 1
+	sftpVersion       = 2
+	sftpOpen          = 3
+	sftpClose         = 4
+	sftpRead          = 5
+	sftpWrite         = 6
+	sftpOpendir       = 11
+	sftpReaddir       = 12
+	sftpRemove        = 13
+	sftpMkdir         = 14
+	sftpStat          = 17
+	sftpRename        = 18
+	sftpStatus        = 101
+	sftpHandle        = 102
+	sftpData          = 103
+	sftpName          = 104
+	sftpAttrs         = 105
+	sftpExtended      = 200
+	sftpExtendedReply = 201
+)
+
+// SFTP open flags, status codes and attribute flags.
+const (
+	sftpFlagRead  = 0x01
+	sftpFlagWrite = 0x02
+	sftpFlagCreat = 0x08
+	sftpFlagTrunc = 0x10
+
+	sftpOK         = 0
+	sftpEOF        = 1
+	sftpNoSuchFile = 2
+
+	sftpAttrSize        = 0x01
+	sftpAttrUIDGID      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrACModTime   = 0x08
+	sftpAttrExtended    = 0x80000000
+)
+
+// sftpChunkSize is the size of the data of read and write requests, and sftpMaxInFlight the number of writes
+// sent ahead of their replies, as the sftp command does.
+const (
+	sftpChunkSize   = 32 << 10
+	sftpMaxInFlight = 64
+)
+
+// sftpPosixRename is the OpenSSH extension renaming files over existing ones, which SFTP version 3 does not.
+const sftpPosixRename = "posix-rename@openssh.com"
+
+// sftpTarget is a remote SFTP host, as set by -sftp-host, and the ssh options to reach it with.
+type sftpTarget struct {
+	user       string
+	host       string
+	port       string
+	key        string // key is the private key file to authenticate with, the default identities of ssh if empty.
+	knownHosts string // knownHosts is the file of the trusted host keys, the default ones of ssh if empty.
+	address    string // address is the address connected to instead of the one host resolves to, if set by -outbound-hosts.
+}
+
+// parseSFTPTarget parses a remote host in the form "[user@]host[:port]".
+func parseSFTPTarget(s, key, knownHosts string) (sftpTarget, error) {
+	t := sftpTarget{key: key, knownHosts: knownHosts}
+	if user, host, ok := strings.Cut(s, "@"); ok {
+		t.user, s = user, host
+	}
+	t.host = s
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		t.host, t.port = host, port
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return t, fmt.Errorf("invalid port %q", port)
+		}
+	}
+	if t.host == "" || strings.ContainsAny(t.host, " /") || strings.HasPrefix(t.host, "-") || strings.HasPrefix(t.user, "-") {
+		return t, fmt.Errorf("%q is not a [user@]host[:port] address", s)
+	}
+	return t, nil
+}
+
+// sshArgs returns the arguments of the ssh command running the sftp subsystem of t. Authentication is
+// non-interactive, and unknown host keys are rejected rather than trusted.
+func (t sftpTarget) sshArgs() []string {
+	args := []string{"-s", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=yes", "-o", "ConnectTimeout=10", "-o", "ServerAliveInterval=30"}
+	if t.port != "" {
+		args = append(args, "-p", t.port)
+	}
+	if t.key != "" {
+		args = append(args, "-i", t.key, "-o", "IdentitiesOnly=yes")
+	}
+	if t.knownHosts != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+t.knownHosts)
+	}
+	if t.user != "" {
+		args = append(args, "-l", t.user)
+	}
+	if t.address != "" {
+		// The host key is still looked up by host name
+		args = append(args, "-o", "HostName="+t.address, "-o", "HostKeyAlias="+t.host)
+	}
+	return append(args, "--", t.host, "sftp")
+}
+
+func (t sftpTarget) String() string {
+	s := t.host
+	if t.port != "" {
+		s = net.JoinHostPort(t.host, t.port)
+	}
+	if t.user != "" {
+		s = t.user + "@" + s
+	}
+	return s
+}
+
+// sftpStatusError is a request failing with an SFTP status.
+type sftpStatusError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *sftpStatusError) Error() string {
+	return fmt.Sprintf("sftp: %s (status %d)", e.Message, e.Code)
+}
+
+// Is matches [fs.ErrNotExist] to files that do not exist.
+func (e *sftpStatusError) Is(target error) bool {
+	return target == fs.ErrNotExist && e.Code == sftpNoSuchFile
+}
+
+// sftpPacket is a reply of the server: its type and its payload following the request ID.
+type sftpPacket struct {
+	typ  byte
+	data []byte
+}
+
+// sftpBuffer builds the payload of a request.
+type sftpBuffer struct {
+	b []byte
+}
+
+func (b *sftpBuffer) u32(v uint32)   { b.b = binary.BigEndian.AppendUint32(b.b, v) }
+func (b *sftpBuffer) u64(v uint64)   { b.b = binary.BigEndian.AppendUint64(b.b, v) }
+func (b *sftpBuffer) str(s string)   { b.u32(uint32(len(s))); b.b = append(b.b, s...) }
+func (b *sftpBuffer) bytes(p []byte) { b.u32(uint32(len(p))); b.b = append(b.b, p...) }
+func (b *sftpBuffer) noAttrs()       { b.u32(0) }
+func (b *sftpBuffer) perms(m uint32) { b.u32(sftpAttrPermissions); b.u32(m) }
+
+// sftpReader parses the payload of a reply, recording the first read past its end in err.
+type sftpReader struct {
+	b   []byte
+	err error
+}
+
+func (r *sftpReader) u32() uint32 {
+	if len(r.b) < 4 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *sftpReader) u64() uint64 {
+	if len(r.b) < 8 {
+		r.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *sftpReader) str() string {
+	n := r.u32()
+	if uint32(len(r.b)) < n {
+		r.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+// attrs reads file attributes, returning the size of the file, -1 if absent, and whether it is a directory.
+func (r *sftpReader) attrs() (size int64, dir bool) {
+	flags := r.u32()
+	size = -1
+	if flags&sftpAttrSize != 0 {
+		size = int64(r.u64())
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		r.u32()
+		r.u32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		dir = fs.FileMode(r.u32()&0o170000) == 0o040000
+	}
+	if flags&sftpAttrACModTime != 0 {
+		r.u32()
+		r.u32()
+	}
+	if flags&sftpAttrExtended != 0 {
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			r.str()
+			r.str()
+		}
+	}
+	return size, dir
+}
+
+// sftpClient is a client of version 3 of SFTP, spoken with the sftp subsystem of a remote host over an ssh
+// command, like the sftp command does, so that ssh_config, agents and known hosts apply as they do to ssh.
+// Requests may be sent concurrently, their replies being matched to them by ID.
+type sftpClient struct {
+	cmd        *exec.Cmd
+	stderr     *stderrTail
+	extensions map[string]string
+
+	mu      sync.Mutex // mu guards the fields below and serializes writing requests.
+	w       io.WriteCloser
+	nextID  uint32
+	pending map[uint32]chan sftpPacket
+	err     error // err is why the connection failed, once it has.
+}
+
+// dialSFTP starts an ssh command running the sftp subsystem of t, stopped once ctx is done, and initializes
+// the session.
+func dialSFTP(ctx context.Context, t sftpTarget) (*sftpClient, error) {
+	cmd := exec.CommandContext(ctx, "ssh", t.sshArgs()...)
+	w, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	c := &sftpClient{cmd: cmd, stderr: &stderrTail{}, w: w, pending: make(map[uint32]chan sftpPacket)}
+	cmd.Stderr = c.stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var init sftpBuffer
+	init.u32(3)
+	if err := writeSFTPPacket(w, sftpInit, init.b); err != nil {
+		return nil, c.fail(err)
+	}
+	typ, payload, err := readSFTPPacket(r)
+	if err != nil {
+		return nil, c.fail(err)
+	}
+	if typ != sftpVersion {
+		return nil, c.fail(fmt.Errorf("unexpected packet type %d instead of version", typ))
+	}
+	pr := &sftpReader{b: payload}
+	if v := pr.u32(); v != 3 {
+		return nil, c.fail(fmt.Errorf("unsupported SFTP version %d", v))
+	}
+	c.extensions = make(map[string]string)
+	for len(pr.b) > 0 && pr.err == nil {
+		name, data := pr.str(), pr.str()
+		c.extensions[name] = data
+	}
+
+	go c.receive(r)
+	return c, nil
+}
+
+// fail stops the ssh command, returning err along with what ssh reported, e.g. an authentication failure.
+func (c *sftpClient) fail(err error) error {
+	c.w.Close()
+	c.cmd.Wait()
+	if msg := strings.TrimSpace(c.stderr.String()); msg != "" {
+		return fmt.Errorf("ssh: %s (%w)", msg, err)
+	}
+	return err
+}
+
+// Close ends the session and waits for the ssh command to exit.
+func (c *sftpClient) Close() error {
+	c.w.Close()
+	return c.cmd.Wait()
+}
+
+// receive dispatches the replies read from r to the requests waiting for them, until r fails.
+func (c *sftpClient) receive(r io.Reader) {
+	for {
+		typ, payload, err := readSFTPPacket(r)
+		if err == nil && len(payload) < 4 {
+			err = fmt.Errorf("short packet of type %d", typ)
+		}
+		if err != nil {
+			if msg := strings.TrimSpace(c.stderr.String()); msg != "" {
+				err = fmt.Errorf("ssh: %s (%w)", msg, err)
+			}
+			c.mu.Lock()
+			c.err = fmt.Errorf("sftp connection to remote host lost: %w", err)
+			for id, ch := range c.pending {
+				close(ch)
+				delete(c.pending, id)
+			}
+			c.mu.Unlock()
+			return
+		}
+
+		id := binary.BigEndian.Uint32(payload)
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if ok {
+			ch <- sftpPacket{typ: typ, data: payload[4:]}
+		}
+	}
+}
+
+// start sends a request of type typ with payload, returning the channel its reply is sent on, closed
+// without a reply if the connection fails.
+func (c *sftpClient) start(typ byte, payload func(b *sftpBuffer)) (<-chan sftpPacket, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	c.nextID++
+	id := c.nextID
+	var b sftpBuffer
+	b.u32(id)
+	payload(&b)
+
+	ch := make(chan sftpPacket, 1)
+	c.pending[id] = ch
+	if err := writeSFTPPacket(c.w, typ, b.b); err != nil {
+		delete(c.pending, id)
+		c.err = fmt.Errorf("sftp connection to remote host lost: %w", err)
+		return nil, c.err
+	}
+	return ch, nil
+}
+
+// wait returns the reply sent on ch.
+func (c *sftpClient) wait(ch <-chan sftpPacket) (sftpPacket, error) {
+	p, ok := <-ch
+	if !ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return p, c.err
+	}
+	return p, nil
+}
+
+// call sends a request and waits for its reply.
+func (c *sftpClient) call(typ byte, payload func(b *sftpBuffer)) (sftpPacket, error) {
+	ch, err := c.start(typ, payload)
+	if err != nil {
+		return sftpPacket{}, err
+	}
+	return c.wait(ch)
+}
+
+// sftpStatusOf returns the error of p, a status reply, nil if it reports success.
+func sftpStatusOf(p sftpPacket) error {
+	if p.typ != sftpStatus {
+		return fmt.Errorf("sftp: unexpected packet type %d instead of status", p.typ)
+	}
+	r := &sftpReader{b: p.data}
+	code, msg := r.u32(), r.str()
+	if code == sftpOK {
+		return nil
+	}
+	if msg == "" {
+		msg = "request failed"
+	}
+	return &sftpStatusError{Code: code, Message: msg}
+}
+
+// callStatus sends a request answered with a status, returning its error.
+func (c *sftpClient) callStatus(typ byte, payload func(b *sftpBuffer)) error {
+	p, err := c.call(typ, payload)
+	if err != nil {
+		return err
+	}
+	return sftpStatusOf(p)
+}
+
+// open opens the remote file name with flags, returning its handle.
+func (c *sftpClient) open(name string, flags uint32) (string, error) {
+	p, err := c.call(sftpOpen, func(b *sftpBuffer) {
+		b.str(name)
+		b.u32(flags)
+		if flags&sftpFlagCreat != 0 {
+			b.perms(0o644)
+		} else {
+			b.noAttrs()
+		}
+	})
+	return c.handleOf(p, err)
+}
+
+// handleOf returns the handle of p, a reply to an open request.
+func (c *sftpClient) handleOf(p sftpPacket, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	if p.typ != sftpHandle {
+		return "", sftpStatusOf(p)
+	}
+	r := &sftpReader{b: p.data}
+	h := r.str()
+	return h, r.err
+}
+
+// closeHandle closes the handle h of a file or directory.
+func (c *sftpClient) closeHandle(h string) error {
+	return c.callStatus(sftpClose, func(b *sftpBuffer) { b.str(h) })
+}
+
+// stat returns the size of the remote file name and whether it is a directory.
+func (c *sftpClient) stat(name string) (int64, bool, error) {
+	p, err := c.call(sftpStat, func(b *sftpBuffer) { b.str(name) })
+	if err != nil {
+		return 0, false, err
+	}
+	if p.typ != sftpAttrs {
+		return 0, false, sftpStatusOf(p)
+	}
+	r := &sftpReader{b: p.data}
+	size, dir := r.attrs()
+	return size, dir, r.err
+}
+
+// mkdirAll creates the remote directory dir along with its missing parents.
+func (c *sftpClient) mkdirAll(dir string) error {
+	if dir == "." || dir == "/" || dir == "" {
+		return nil
+	}
+	if _, isDir, err := c.stat(dir); err == nil {
+		if !isDir {
+			return fmt.Errorf("sftp: %s is not a directory", dir)
+		}
+		return nil
+	}
+	if err := c.mkdirAll(path.Dir(dir)); err != nil {
+		return err
+	}
+	err := c.callStatus(sftpMkdir, func(b *sftpBuffer) { b.str(dir); b.perms(0o755) })
+	if err != nil {
+		// Created concurrently, e.g. by another replica
+		if _, isDir, statErr := c.stat(dir); statErr == nil && isDir {
+			return nil
+		}
+	}
+	return err
+}
+
+// remove removes the remote file name.
+func (c *sftpClient) remove(name string) error {
+	return c.callStatus(sftpRemove, func(b *sftpBuffer) { b.str(name) })
+}
+
+// rename renames the remote file from to to, replacing to if it exists. Servers without the posix-rename
+// extension cannot replace files atomically, to is removed first there.
+func (c *sftpClient) rename(from, to string) error {
+	if _, ok := c.extensions[sftpPosixRename]; ok {
+		return c.callStatus(sftpExtended, func(b *sftpBuffer) { b.str(sftpPosixRename); b.str(from); b.str(to) })
+	}
+	if err := c.remove(to); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return c.callStatus(sftpRename, func(b *sftpBuffer) { b.str(from); b.str(to) })
+}
+
+// put uploads the local file at localPath as the remote file name, creating its directory if missing. The file
+// is written to a temporary file next to it first, and renamed into place once complete.
+func (c *sftpClient) put(ctx context.Context, localPath, name string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tmp := path.Join(path.Dir(name), "."+path.Base(name)+".tmp")
+	h, err := c.open(tmp, sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err = c.mkdirAll(path.Dir(name)); err == nil {
+			h, err = c.open(tmp, sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	err = c.write(ctx, h, f)
+	if closeErr := c.closeHandle(h); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = c.rename(tmp, name)
+	}
+	if err != nil {
+		c.remove(tmp)
+	}
+	return err
+}
+
+// write writes the content of src to the remote file of handle h, keeping up to sftpMaxInFlight writes of
+// sftpChunkSize sent ahead of their replies.
+func (c *sftpClient) write(ctx context.Context, h string, src io.Reader) error {
+	var inFlight []<-chan sftpPacket
+	var firstErr error
+	reap := func() {
+		p, err := c.wait(inFlight[0])
+		inFlight = inFlight[1:]
+		if err == nil {
+			err = sftpStatusOf(p)
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	buf := make([]byte, sftpChunkSize)
+	var off uint64
+	for firstErr == nil {
+		if err := ctx.Err(); err != nil {
+			firstErr = err
+			break
+		}
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			ch, sendErr := c.start(sftpWrite, func(b *sftpBuffer) { b.str(h); b.u64(off); b.bytes(buf[:n]) })
+			if sendErr != nil {
+				firstErr = sendErr
+				break
+			}
+			inFlight = append(inFlight, ch)
+			off += uint64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			firstErr = err
+			break
+		}
+		if len(inFlight) >= sftpMaxInFlight {
+			reap()
+		}
+	}
+	for len(inFlight) > 0 {
+		reap()
+	}
+	return firstErr
+}
+
+// readDir returns the names of the entries of the remote directory dir, with their sizes and whether they
+// are directories.
+func (c *sftpClient) readDir(dir string, fn func(name string, size int64, isDir bool) error) error {
+	h, err := c.handleOf(c.call(sftpOpendir, func(b *sftpBuffer) { b.str(dir) }))
+	if err != nil {
+		return err
+	}
+	defer c.closeHandle(h)
+
+	for {
+		p, err := c.call(sftpReaddir, func(b *sftpBuffer) { b.str(h) })
+		if err != nil {
+			return err
+		}
+		if p.typ != sftpName {
+			if err := sftpStatusOf(p); err != nil && err.(*sftpStatusError).Code != sftpEOF {
+				return err
+			}
+			return nil
+		}
+
+		r := &sftpReader{b: p.data}
+		for n := r.u32(); n > 0 && r.err == nil; n-- {
+			name := r.str()
+			r.str() // longname
+			size, isDir := r.attrs()
+			if r.err != nil || name == "." || name == ".." {
+				continue
+			}
+			if err := fn(name, size, isDir); err != nil {
+				return err
+			}
+		}
+		if r.err != nil {
+			return r.err
+		}
+	}
+}
+
+// sftpFile reads a remote file sequentially.
+type sftpFile struct {
+	c   *sftpClient
+	h   string
+	off uint64
+}
+
+func (f *sftpFile) Read(b []byte) (int, error) {
+	p, err := f.c.call(sftpRead, func(buf *sftpBuffer) { buf.str(f.h); buf.u64(f.off); buf.u32(uint32(min(len(b), sftpChunkSize))) })
+	if err != nil {
+		return 0, err
+	}
+	if p.typ != sftpData {
+		err := sftpStatusOf(p)
+		if se, ok := err.(*sftpStatusError); ok && se.Code == sftpEOF {
+			return 0, io.EOF
+		}
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	r := &sftpReader{b: p.data}
+	data := r.str()
+	n := copy(b, data)
+	f.off += uint64(n)
+	return n, r.err
+}
+
+func (f *sftpFile) Close() error {
+	return f.c.closeHandle(f.h)
+}
+
+// writeSFTPPacket writes a packet of type typ with payload to w.
+func writeSFTPPacket(w io.Writer, typ byte, payload []byte) error {
+	b := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(1+len(payload)))
+	b[4] = typ
+	_, err := w.Write(append(b, payload...))
+	return err
+}
+
+// readSFTPPacket reads a packet from r, returning its type and payload.
+func readSFTPPacket(r io.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n < 1 || n > 1<<20 {
+		return 0, nil, fmt.Errorf("invalid SFTP packet length %d", n)
+	}
+	payload := make([]byte, n-1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[4], payload, nil
+}
+
+// stderrTail keeps the first 4 KiB written to the standard error of the ssh command, for error messages.
+type stderrTail struct {
+	mu sync.Mutex
+	b  []byte
+}
+
+func (t *stderrTail) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.b = append(t.b, p[:min(len(p), max(0, 4096-len(t.b)))]...)
+	return len(p), nil
+}
+
+func (t *stderrTail) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.b)
+}
+
+// sftpBackend is a [storageBackend] in a directory of a remote SFTP host.
+type sftpBackend struct {
+	client *sftpClient
+	dir    string
+}
+
+func (b *sftpBackend) walk(ctx context.Context, fn func(rel string, size int64) error) error {
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		return b.client.readDir(path.Join(b.dir, rel), func(name string, size int64, isDir bool) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			child := path.Join(rel, name)
+			if isDir {
+				return walk(child)
+			}
+			if !exportable(child, true) {
+				return nil
+			}
+			return fn(child, size)
+		})
+	}
+	return walk("")
+}
+
+func (b *sftpBackend) open(ctx context.Context, rel string) (io.ReadCloser, error) {
+	h, err := b.client.open(path.Join(b.dir, rel), sftpFlagRead)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpFile{c: b.client, h: h}, nil
+}
+
+func (b *sftpBackend) store(ctx context.Context, rel, localPath string) error {
+	return b.client.put(ctx, localPath, path.Join(b.dir, rel))
+}
+
+func (b *sftpBackend) checksum(ctx context.Context, rel string) (string, error) {
+	f, err := b.open(ctx, rel)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ShutdownHooks are the cleanup functions subsystems register to be run once the HTTP server shut down,
+// e.g. to stop their background jobs, flush buffers or close connections. Hooks are run in the reverse order of
+// their registration, like deferred calls, so subsystems are torn down before those they depend on, which were
+// set up, and registered, earlier.
+type ShutdownHooks struct {
+	mu    sync.Mutex
+	hooks []shutdownHook
+}
+
+// shutdownHook is a cleanup function registered under name.
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// register registers fn, named name in logs, to be run on shutdown. fn should return once ctx is done.
+func (h *ShutdownHooks) register(name string, fn func(ctx context.Context) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.hooks = append(h.hooks, shutdownHook{name: name, fn: fn})
+}
+
+// run runs the registered hooks in reverse order of registration, given timeout to complete altogether, and
+// returns the errors they failed with. A hook failing does not keep the following ones from running.
+func (h *ShutdownHooks) run(logger *log.Logger, timeout time.Duration) error {
+	h.mu.Lock()
+	hooks := h.hooks
+	h.hooks = nil
+	h.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var errs []error
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hook := hooks[i]
+		start := time.Now()
+		if err := hook.fn(ctx); err != nil {
+			logger.Printf("Error shutting down %s: %v", hook.name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", hook.name, err))
+			continue
+		}
+		debugf(logger, "Shut down %s in %v", hook.name, time.Since(start).Round(time.Millisecond))
+	}
+	return errors.Join(errs...)
+}
+
+// waitDone waits for done to be closed, or for ctx to be done, whichever happens first.
+func waitDone(ctx context.Context, done <-chan struct{}) error {
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// signatureSuffix is the extension of detached signatures, uploaded and stored alongside the file they sign.
+const signatureSuffix = ".asc"
+
+// verifyUploadSignature checks the detached signature uploaded along with the file of form against keyring,
+// returning the signature and the fingerprint of the signing key, or a [*RejectionError] if the signature is
+// missing while required, or invalid. It returns a nil signature if none was sent and none is required.
+func verifyUploadSignature(keyring *Keyring, form *uploadForm, required bool) ([]byte, string, error) {
+	if form.Signature == nil {
+		if required {
+			return nil, "", &RejectionError{http.StatusUnprocessableEntity, fmt.Sprintf("a detached %s signature is required", signatureSuffix)}
+		}
+		return nil, "", nil
+	}
+
+	if keyring == nil {
+		return nil, "", &RejectionError{http.StatusBadRequest, "signature verification is not enabled"}
+	}
+	if form.Signature.Filename != form.File.Filename+signatureSuffix {
+		return nil, "", &RejectionError{http.StatusBadRequest, fmt.Sprintf("signature %q does not match file %q", form.Signature.Filename, form.File.Filename)}
+	}
+
+	r, err := form.Signature.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	sig, err := io.ReadAll(io.LimitReader(r, maxSignatureSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+
+	content, err := form.File.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	signer, err := keyring.Verify(content, sig)
+	if err != nil {
+		return nil, "", &RejectionError{http.StatusUnprocessableEntity, fmt.Sprintf("signature verification failed: %v", err)}
+	}
+
+	return sig, signer, nil
+}
+
+// storeSignature stores the detached signature sig of the file name stored in baseDir alongside it,
+// and records the fingerprint of the signing key in the file's metadata m, and in indexes.
+func storeSignature(baseDir string, m Metadata, sig []byte, signer string, fsync FsyncPolicy, indexes *FileIndexes) error {
+	path := filepath.Join(baseDir, m.Name+signatureSuffix)
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, bytes.NewReader(sig))
+	if err == nil {
+		err = fsync.sync(dst, baseDir)
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	m.SignedBy = strings.ToUpper(signer)
+	return writeMetadata(baseDir, m, indexes)
+}
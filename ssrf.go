@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errFetchForbidden reports a fetch of an ingested URL the [FetchGuard] does not allow.
+var errFetchForbidden = errors.New("fetch forbidden")
+
+// internalPrefixes are the address ranges, beyond private, loopback, link-local and multicast ones, that are not
+// reachable on the internet and are denied to fetches unless private destinations are allowed.
+var internalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, and broadcast
+	netip.MustParsePrefix("100::/64"),       // discard-only
+	netip.MustParsePrefix("2001::/23"),      // IETF protocol assignments, including Teredo
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+	netip.MustParsePrefix("2002::/16"),      // 6to4, which may embed internal IPv4 addresses
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("fec0::/10"),      // deprecated site-local
+}
+
+// nat64Prefix is the well-known NAT64 prefix, whose addresses are checked by the IPv4 address they embed.
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// FetchGuard keeps the fetches of ingested URLs, whose hosts senders choose, from reaching internal services
+// (server-side request forgery). It allows URLs with allowed schemes and ports only, and connections to public
+// addresses only, unless private ones are allowed. Host names are resolved once and the connection is made to
+// the address checked, so a host re-resolving to an internal address in between (DNS rebinding) is caught.
+// Redirects are followed up to a limit, each checked like the URL itself.
+//
+// Fetches going through a proxy are sent to the address checked as well, see [pinnedTransport], so the proxy
+// does not resolve their hosts again.
+type FetchGuard struct {
+	schemes      []string
+	ports        []int
+	allowPrivate bool
+	maxRedirects int
+
+	outbound *Outbound
+	resolver hostResolver
+	dialer   *net.Dialer
+	proxy    func(*http.Request) (*url.URL, error)
+}
+
+// hostResolver resolves host names to addresses, as [net.Resolver] does.
+type hostResolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// newFetchGuard returns the guard of fetches configured by config, connecting with the resolver, host overrides and
+// TLS settings of outbound.
+func newFetchGuard(config Config, outbound *Outbound) (*FetchGuard, error) {
+	schemes, ports, err := parseFetchAllowlists(config.ingestSchemes, config.ingestPorts)
+	if err != nil {
+		return nil, err
+	}
+	return &FetchGuard{
+		schemes:      schemes,
+		ports:        ports,
+		allowPrivate: config.ingestAllowPrivate,
+		maxRedirects: config.ingestMaxRedirects,
+		outbound:     outbound,
+		resolver:     outbound.netResolver(),
+		dialer:       outbound.dialer(outboundDialTimeout),
+		proxy:        outbound.proxyFunc(),
+	}, nil
+}
+
+// parseFetchAllowlists parses the comma separated lists of the schemes and ports fetched URLs may have.
+func parseFetchAllowlists(schemeList, portList string) ([]string, []int, error) {
+	var schemes []string
+	for _, s := range strings.Split(schemeList, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s != "http" && s != "https" {
+			return nil, nil, fmt.Errorf("scheme %q is neither http nor https", s)
+		}
+		schemes = append(schemes, s)
+	}
+
+	if strings.TrimSpace(portList) == "" {
+		return schemes, nil, nil // any port
+	}
+	var ports []int
+	for _, p := range strings.Split(portList, ",") {
+		p = strings.TrimSpace(p)
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 65535 {
+			return nil, nil, fmt.Errorf("port %q is not a number between 1 and 65535", p)
+		}
+		ports = append(ports, n)
+	}
+	return schemes, ports, nil
+}
+
+// client returns an HTTP client fetching through the guard, within timeout.
+func (g *FetchGuard) client(timeout time.Duration) *http.Client {
+	transport := g.outbound.httpTransport()
+	transport.Proxy = g.proxy
+	transport.DialContext = g.dial
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &pinnedTransport{guard: g, base: transport},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > g.maxRedirects {
+				return fmt.Errorf("%w: more than %d redirects", errFetchForbidden, g.maxRedirects)
+			}
+			return g.check(req)
+		},
+	}
+}
+
+// check checks the URL of req against the scheme and port allowlists. The addresses of its host are checked as
+// the request is sent, see [pinnedTransport].
+func (g *FetchGuard) check(req *http.Request) error {
+	u := req.URL
+	if !slices.Contains(g.schemes, u.Scheme) {
+		return fmt.Errorf("%w: scheme of %s is not allowed", errFetchForbidden, u.Redacted())
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	if n, _ := strconv.Atoi(port); g.ports != nil && !slices.Contains(g.ports, n) {
+		return fmt.Errorf("%w: port of %s is not allowed", errFetchForbidden, u.Redacted())
+	}
+	return nil
+}
+
+// pinnedTransport sends the fetches going through a proxy to the address their host was checked at, rather than
+// to their host, which the proxy would resolve again, possibly to an internal address (DNS rebinding). Requests
+// for http URLs are sent to the proxy with the address in their URL and the host in their Host header, and those
+// for https URLs tunneled to the address, verifying the certificate of the host. Other fetches are sent as is,
+// their connections being made to checked addresses by [FetchGuard.dial].
+type pinnedTransport struct {
+	guard *FetchGuard
+	base  *http.Transport
+}
+
+func (t *pinnedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if proxy, err := t.guard.proxy(req); err != nil || proxy == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	host, port := req.URL.Hostname(), req.URL.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[req.URL.Scheme]
+	}
+	addrs, err := t.guard.resolve(req.Context(), host)
+	if err != nil {
+		return nil, err
+	}
+
+	pinned := req.Clone(req.Context())
+	pinned.URL.Host = net.JoinHostPort(addrs[0].String(), port)
+	if pinned.Host == "" {
+		pinned.Host = req.URL.Host
+	}
+	if req.URL.Scheme == "http" {
+		// Requests to proxies are otherwise sent with the URL of their Host header
+		pinned.URL.Opaque = "//" + pinned.URL.Host + req.URL.EscapedPath()
+	}
+
+	// Connections are to the address, not the host, so they are not shared with the fetches of other hosts
+	transport := t.base.Clone()
+	transport.DisableKeepAlives = true
+	if req.URL.Scheme == "https" {
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.ServerName = host
+	}
+
+	resp, err := transport.RoundTrip(pinned)
+	if err != nil {
+		return nil, err
+	}
+	resp.Request = req
+	return resp, nil
+}
+
+// resolve resolves host to the addresses connections may be made to, failing if it has none.
+func (g *FetchGuard) resolve(ctx context.Context, host string) ([]netip.Addr, error) {
+	var addrs []netip.Addr
+	if override, ok := g.outbound.lookupHost(host); ok {
+		host = override
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else {
+		if addrs, err = g.resolver.LookupNetIP(ctx, "ip", host); err != nil {
+			return nil, err
+		}
+	}
+
+	var allowed []netip.Addr
+	for _, addr := range addrs {
+		if g.allowed(addr) {
+			allowed = append(allowed, addr)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("%w: %s resolves to internal addresses only", errFetchForbidden, host)
+	}
+	return allowed, nil
+}
+
+// allowed reports whether connections may be made to addr.
+func (g *FetchGuard) allowed(addr netip.Addr) bool {
+	if g.allowPrivate {
+		return true
+	}
+
+	addr = addr.Unmap()
+	if nat64Prefix.Contains(addr) {
+		b := addr.As16()
+		addr = netip.AddrFrom4([4]byte(b[12:]))
+	}
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return false
+	}
+	for _, p := range internalPrefixes {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// dial connects to addr, a host and port. Hosts are resolved and connected to by the checked address, unless
+// addr is the proxy, whose requests are pinned to checked addresses by [pinnedTransport]. Connections are made to
+// the allowed addresses of the host in turn until one succeeds.
+func (g *FetchGuard) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if g.isProxy(addr) {
+		return g.dialer.DialContext(ctx, network, g.outbound.overrideHost(addr))
+	}
+
+	addrs, err := g.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, ip := range addrs {
+		conn, err := g.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// isProxy reports whether addr is the address of the proxy fetches of http or https URLs go through.
+func (g *FetchGuard) isProxy(addr string) bool {
+	for _, scheme := range []string{"http", "https"} {
+		proxy, err := g.proxy(&http.Request{URL: &url.URL{Scheme: scheme, Host: "example.com"}})
+		if err != nil || proxy == nil {
+			continue
+		}
+
+		port := proxy.Port()
+		if port == "" {
+			port = map[string]string{"http": "80", "https": "443", "socks5": "1080"}[proxy.Scheme]
+		}
+		if net.JoinHostPort(proxy.Hostname(), port) == addr {
+			return true
+		}
+	}
+	return false
+}
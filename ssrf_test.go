@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/textproto"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchGuardAllowed(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{addr: "8.8.8.8", want: true},
+		{addr: "203.0.113.10", want: true},
+		{addr: "2606:4700::1111", want: true},
+		{addr: "127.0.0.1", want: false},
+		{addr: "10.1.2.3", want: false},
+		{addr: "172.16.0.1", want: false},
+		{addr: "192.168.1.1", want: false},
+		{addr: "169.254.169.254", want: false},
+		{addr: "224.0.0.1", want: false},
+		{addr: "::1", want: false},
+		{addr: "fc00::1", want: false},
+		{addr: "fe80::1", want: false},
+		{addr: "ff02::1", want: false},
+		{addr: "::", want: false},
+
+		// IPv4-mapped addresses are checked by the IPv4 address they map
+		{addr: "::ffff:8.8.8.8", want: true},
+		{addr: "::ffff:127.0.0.1", want: false},
+		{addr: "::ffff:169.254.169.254", want: false},
+
+		// So are NAT64 addresses
+		{addr: "64:ff9b::808:808", want: true},
+		{addr: "64:ff9b::7f00:1", want: false},
+		{addr: "64:ff9b::a9fe:a9fe", want: false},
+		{addr: "64:ff9b::a01:203", want: false},
+
+		// Internal prefixes
+		{addr: "0.1.2.3", want: false},
+		{addr: "100.64.0.1", want: false},
+		{addr: "192.0.0.8", want: false},
+		{addr: "198.18.0.1", want: false},
+		{addr: "240.0.0.1", want: false},
+		{addr: "255.255.255.255", want: false},
+		{addr: "100::1", want: false},
+		{addr: "2001::1", want: false},
+		{addr: "2001:db8::1", want: false},
+		{addr: "2002:7f00:1::1", want: false},
+		{addr: "64:ff9b:1::1", want: false},
+		{addr: "fec0::1", want: false},
+	}
+
+	g := &FetchGuard{}
+	private := &FetchGuard{allowPrivate: true}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			addr := netip.MustParseAddr(tt.addr)
+			if got := g.allowed(addr); got != tt.want {
+				t.Errorf("allowed(%s) = %t, want %t", addr, got, tt.want)
+			}
+			if !private.allowed(addr) {
+				t.Errorf("allowed(%s) = false with private addresses allowed", addr)
+			}
+		})
+	}
+}
+
+func TestFetchGuardRedirects(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		wantErr  bool
+	}{
+		{name: "public host", location: "http://other.example/file", wantErr: false},
+		{name: "private host", location: "http://internal.example/file", wantErr: true},
+		{name: "metadata service", location: "http://metadata.example/latest/meta-data", wantErr: true},
+		{name: "loopback address", location: "http://127.0.0.1/file", wantErr: true},
+		{name: "ipv4-mapped address", location: "http://[::ffff:10.0.0.5]/file", wantErr: true},
+		{name: "disallowed port", location: "http://other.example:22/file", wantErr: true},
+		{name: "disallowed scheme", location: "ftp://other.example/file", wantErr: true},
+	}
+
+	// Requests are sent to the proxy with the addresses hosts are pinned to, once checked
+	var reached []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = append(reached, r.URL.Host)
+		if r.URL.Hostname() == "203.0.113.10" {
+			http.Redirect(w, r, r.URL.Query().Get("to"), http.StatusFound)
+		}
+	}))
+	defer proxy.Close()
+
+	config, err := newConfig([]string{
+		"-outbound-proxy", proxy.URL,
+		"-outbound-hosts", "public.example=203.0.113.10,other.example=203.0.113.11,internal.example=10.0.0.5,metadata.example=169.254.169.254",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbound, err := newOutbound(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := newFetchGuard(config, outbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := g.client(0)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached = nil
+			req, err := http.NewRequest(http.MethodGet, "http://public.example/file?to="+tt.location, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := g.check(req); err != nil {
+				t.Fatalf("check() = %v", err)
+			}
+
+			resp, err := client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if tt.wantErr {
+				if !errors.Is(err, errFetchForbidden) {
+					t.Errorf("Do() = %v, want %v", err, errFetchForbidden)
+				}
+				if len(reached) != 1 {
+					t.Errorf("proxy reached %q, want the first host only", reached)
+				}
+			} else if err != nil {
+				t.Errorf("Do() = %v", err)
+			}
+		})
+	}
+}
+
+func TestFetchGuardTooManyRedirects(t *testing.T) {
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://public.example/again", http.StatusFound)
+	}))
+	defer proxy.Close()
+
+	config, err := newConfig([]string{"-outbound-proxy", proxy.URL, "-outbound-hosts", "public.example=203.0.113.10", "-ingest-max-redirects", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbound, err := newOutbound(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := newFetchGuard(config, outbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := g.client(0).Get("http://public.example/file"); !errors.Is(err, errFetchForbidden) {
+		t.Errorf("Get() = %v, want %v", err, errFetchForbidden)
+	}
+}
+
+func TestFetchGuardDeniesInternalHosts(t *testing.T) {
+	// Without a proxy, hosts are checked as they are connected to
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("internal host reached")
+	}))
+	defer server.Close()
+
+	config, err := newConfig([]string{"-ingest-ports", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := newFetchGuard(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.proxy = func(*http.Request) (*url.URL, error) { return nil, nil }
+
+	if _, err := g.client(0).Get(server.URL); !errors.Is(err, errFetchForbidden) {
+		t.Errorf("Get(%s) = %v, want %v", server.URL, err, errFetchForbidden)
+	}
+}
+
+// rebindingResolver resolves hosts to a public address the first time, and to an internal one from then on.
+type rebindingResolver struct {
+	mu      sync.Mutex
+	lookups int
+}
+
+func (r *rebindingResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lookups++
+	if r.lookups == 1 {
+		return []netip.Addr{netip.MustParseAddr("203.0.113.10")}, nil
+	}
+	return []netip.Addr{netip.MustParseAddr("10.0.0.5")}, nil
+}
+
+// proxiedRequest is the request line and Host header of a request a fake proxy received.
+type proxiedRequest struct {
+	line, host string
+}
+
+// fakeProxy serves a proxy recording the requests it receives, which it answers itself, and tunneling CONNECT
+// requests to the TLS server at tunnel. Requests are read raw, as servers take their host from absolute URLs.
+func fakeProxy(t *testing.T, tunnel string) (proxyURL string, requests func() []proxiedRequest) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	var received []proxiedRequest
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tp := textproto.NewReader(bufio.NewReader(conn))
+				line, err := tp.ReadLine()
+				if err != nil {
+					return
+				}
+				header, err := tp.ReadMIMEHeader()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				received = append(received, proxiedRequest{line: line, host: header.Get("Host")})
+				mu.Unlock()
+
+				if !strings.HasPrefix(line, http.MethodConnect+" ") {
+					io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+					return
+				}
+				upstream, err := net.Dial("tcp", tunnel)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return "http://" + ln.Addr().String(), func() []proxiedRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(received)
+	}
+}
+
+func TestFetchGuardPinsProxiedFetches(t *testing.T) {
+	var serverName atomic.Value
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	origin.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		serverName.Store(hello.ServerName)
+		return nil, nil
+	}}
+	origin.StartTLS()
+	defer origin.Close()
+
+	proxyURL, requests := fakeProxy(t, origin.Listener.Addr().String())
+	config, err := newConfig([]string{"-outbound-proxy", proxyURL, "-outbound-insecure-skip-verify"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbound, err := newOutbound(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url  string
+		want proxiedRequest
+	}{
+		{url: "http://rebind.example/file?v=1", want: proxiedRequest{line: "GET http://203.0.113.10:80/file?v=1 HTTP/1.1", host: "rebind.example"}},
+		{url: "https://rebind.example/file", want: proxiedRequest{line: "CONNECT 203.0.113.10:443 HTTP/1.1", host: "203.0.113.10:443"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			g, err := newFetchGuard(config, outbound)
+			if err != nil {
+				t.Fatal(err)
+			}
+			g.resolver = &rebindingResolver{}
+			client := g.client(5 * time.Second)
+			before := len(requests())
+
+			resp, err := client.Get(tt.url)
+			if err != nil {
+				t.Fatalf("Get() = %v", err)
+			}
+			resp.Body.Close()
+			got := requests()[before:]
+			if len(got) != 1 || got[0] != tt.want {
+				t.Errorf("proxy received %q, want %q", got, tt.want)
+			}
+			if strings.HasPrefix(tt.url, "https:") && serverName.Load() != "rebind.example" {
+				t.Errorf("server name = %v, want %q", serverName.Load(), "rebind.example")
+			}
+
+			// The host now resolves to an internal address, which is caught before the proxy is reached
+			if _, err := client.Get(tt.url); !errors.Is(err, errFetchForbidden) {
+				t.Errorf("Get() after rebinding = %v, want %v", err, errFetchForbidden)
+			}
+			if n := len(requests()) - before; n != 1 {
+				t.Errorf("proxy received %d requests, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// uploadStage is a named stage of the upload pipeline.
+type uploadStage int
+
+const (
+	stageParse       uploadStage = iota // stageParse reads the request body, spooling the file.
+	stageValidate                       // stageValidate sniffs the file and runs the built-in and registered validators.
+	stageScan                           // stageScan runs the external filter commands.
+	stageWrite                          // stageWrite copies the file to disk, along with streaming transformations.
+	stageFsync                          // stageFsync flushes the file to stable storage.
+	stagePostProcess                    // stagePostProcess runs the transformers, signs the file and writes its metadata.
+	numStages
+)
+
+var stageNames = [numStages]string{"parse", "validate", "scan", "write", "fsync", "post-process"}
+
+func (s uploadStage) String() string {
+	return stageNames[s]
+}
+
+// Upload pipeline metrics, published through [expvar].
+var (
+	uploadStageSeconds = expvar.NewMap("upload_stage_seconds") // uploadStageSeconds sums the time spent in each stage by stored uploads.
+	uploadStageUploads = expvar.NewInt("upload_stage_uploads") // uploadStageUploads counts the stored uploads timed in uploadStageSeconds.
+)
+
+// uploadStages times the stages of an upload, telling slow disks from slow hooks. The time
+// elapsed since the previous mark is attributed to the stage marked, so stages entered more
+// than once add up. Its methods are no-ops on a nil *uploadStages.
+type uploadStages struct {
+	start     time.Time
+	last      time.Time
+	durations [numStages]time.Duration
+	logger    *log.Logger
+}
+
+// newUploadStages starts timing an upload.
+func newUploadStages(logger *log.Logger) *uploadStages {
+	now := time.Now()
+	return &uploadStages{start: now, last: now, logger: logger}
+}
+
+// mark ends the current run of stage.
+func (s *uploadStages) mark(stage uploadStage) {
+	if s == nil {
+		return
+	}
+	now := time.Now()
+	s.durations[stage] += now.Sub(s.last)
+	s.last = now
+}
+
+// elapsed returns the time elapsed since the upload started, 0 on a nil *uploadStages.
+func (s *uploadStages) elapsed() time.Duration {
+	if s == nil {
+		return 0
+	}
+	return time.Since(s.start)
+}
+
+// record logs the stage durations of the upload stored as name and adds them to the metrics.
+func (s *uploadStages) record(name string) {
+	if s == nil {
+		return
+	}
+
+	var b strings.Builder
+	for stage, d := range s.durations {
+		fmt.Fprintf(&b, " %s=%v", uploadStage(stage), d.Round(time.Microsecond))
+		uploadStageSeconds.AddFloat(uploadStage(stage).String(), d.Seconds())
+	}
+	uploadStageUploads.Add(1)
+
+	infof(s.logger, "Upload stages of %s:%s total=%v", name, b.String(), time.Since(s.start).Round(time.Microsecond))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// startupError is an error the server failed to start with, by the stage of the startup it failed at.
+type startupError struct {
+	Stage    string   // Stage names what was being set up, e.g. "config" or "redis".
+	Message  string   // Message describes the failure for humans, e.g. "Error configuring redis".
+	Err      error    // Err is the cause of the failure, nil if Problems lists them.
+	Problems []string // Problems are the problems of an invalid configuration, see [Config.validate].
+}
+
+func (e *startupError) Error() string {
+	if len(e.Problems) > 0 {
+		return fmt.Sprintf("%s:\n  - %s", e.Message, strings.Join(e.Problems, "\n  - "))
+	}
+	return fmt.Sprintf("%s: %v", e.Message, e.Err)
+}
+
+func (e *startupError) Unwrap() error {
+	return e.Err
+}
+
+// startupListener is an address the server listens on, as reported by the startup event.
+type startupListener struct {
+	Name    string `json:"name"` // Name is "http" for the data plane, "ops" for the ops listener.
+	Network string `json:"network"`
+	Addr    string `json:"addr"`
+}
+
+// startupStorage is where the server stores files, as reported by the startup event.
+type startupStorage struct {
+	Backend  string `json:"backend"` // Backend is "local", files being stored in Dir.
+	Dir      string `json:"dir"`
+	ColdTier string `json:"cold_tier,omitempty"` // ColdTier is the S3 location files are archived to, if tiering is enabled.
+	Backup   string `json:"backup,omitempty"`    // Backup is the S3 location files are backed up to, if enabled.
+}
+
+// startupEvent is logged once the server is initialized, and fatalEvent if it fails to, each as a single line
+// of JSON, so orchestration tooling can tell a server that booted, and with what, from one that did not.
+type startupEvent struct {
+	Event      string            `json:"event"` // Event is "startup".
+	Time       time.Time         `json:"time"`
+	Version    string            `json:"version"`
+	ConfigHash string            `json:"config_hash"` // ConfigHash is the SHA-256 of the configuration, with secrets redacted.
+	Listeners  []startupListener `json:"listeners"`
+	Storage    startupStorage    `json:"storage"`
+}
+
+// fatalEvent is logged when the server fails to start, see [startupEvent].
+type fatalEvent struct {
+	Event    string    `json:"event"` // Event is "fatal".
+	Time     time.Time `json:"time"`
+	Version  string    `json:"version"`
+	Stage    string    `json:"stage"`
+	Error    string    `json:"error"`
+	Problems []string  `json:"problems,omitempty"`
+}
+
+// newStartupEvent returns the startup event of the server configured by config, archiving to tier if not nil.
+func newStartupEvent(config Config, tier *ColdTier) startupEvent {
+	sum := sha256.Sum256([]byte(config.String()))
+	e := startupEvent{
+		Event:      "startup",
+		Time:       time.Now().UTC(),
+		Version:    version,
+		ConfigHash: hex.EncodeToString(sum[:]),
+		Listeners:  []startupListener{{Name: "http", Network: config.listenNetwork, Addr: config.listenAddr}},
+		Storage:    startupStorage{Backend: "local", Dir: config.dir},
+	}
+	if config.opsAddr != "" {
+		e.Listeners = append(e.Listeners, startupListener{Name: "ops", Network: config.listenNetwork, Addr: config.opsAddr})
+	}
+	if tier != nil {
+		e.Storage.ColdTier = "s3://" + strings.TrimSuffix(config.tierS3Bucket+"/"+config.tierS3Prefix, "/")
+	}
+	if config.backupS3Bucket != "" {
+		e.Storage.Backup = "s3://" + strings.TrimSuffix(config.backupS3Bucket+"/"+config.backupS3Prefix, "/")
+	}
+	return e
+}
+
+// newFatalEvent returns the event of the server failing to start with err.
+func newFatalEvent(err error) fatalEvent {
+	e := fatalEvent{Event: "fatal", Time: time.Now().UTC(), Version: version, Stage: "unknown", Error: err.Error()}
+	if se, ok := err.(*startupError); ok {
+		e.Stage, e.Problems = se.Stage, se.Problems
+		if len(se.Problems) > 0 {
+			e.Error = se.Message
+		}
+	}
+	return e
+}
+
+// reportStartupFailure logs err, then its fatal event, which is also written to the termination log.
+func reportStartupFailure(logger *log.Logger, terminationLog string, err error) {
+	logger.Print(err)
+	event := newFatalEvent(err)
+	logEvent(logger, event)
+	if b, err := json.Marshal(event); err == nil {
+		writeTerminationLog(logger, terminationLog, string(b))
+	}
+}
+
+// logEvent writes v to the output of logger as a single line of JSON, without the prefix of its other lines.
+func logEvent(logger *log.Logger, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logger.Printf("Error encoding event: %v", err)
+		return
+	}
+	logger.Writer().Write(append(b, '\n'))
+}
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin)
+
+package main
+
+import "errors"
+
+// freeSpace is not supported on this platform.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("free disk space monitoring is not supported on this platform")
+}
+
+// diskUsage is not supported on this platform.
+func diskUsage(dir string) (used, total int64, err error) {
+	return 0, 0, errors.New("disk usage monitoring is not supported on this platform")
+}
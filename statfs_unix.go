@@ -0,0 +1,25 @@
+//go:build linux || darwin
+
+package main
+
+import "syscall"
+
+// freeSpace returns the number of bytes available to unprivileged users on the filesystem of dir.
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// diskUsage returns the number of bytes used on the filesystem of dir and its size, as reported by df,
+// leaving out the blocks reserved for privileged users.
+func diskUsage(dir string) (used, total int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	used = int64(st.Blocks-st.Bfree) * int64(st.Bsize)
+	return used, used + int64(st.Bavail)*int64(st.Bsize), nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"time"
+)
+
+// staticPrefix is the path the public directory is served under.
+const staticPrefix = "/static/"
+
+// staticFiles returns an HTTP handler serving the regular files of the public directory dir, read-only,
+// under [staticPrefix]. Responses may be cached for maxAge, and revalidated by their ETag and modification
+// time afterwards. Directories and dot files are not served.
+func staticFiles(logger *log.Logger, dir string, maxAge time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, fi, err := openDirFile(dir, r.PathValue("path"), false)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			logger.Printf("Error opening static file: %v", err)
+			http.Error(w, "Could not open file", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+		w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size()))
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+	})
+}
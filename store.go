@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// clonedFiles counts the files stored as clones of their spooled file, published through [expvar].
+var clonedFiles = expvar.NewInt("cloned_files")
+
+// storeError is a failure to store an upload, along with the response sent to the client.
+type storeError struct {
+	Status   int    // Status is the HTTP status code of the response.
+	Message  string // Message is the response body.
+	Filename string // Filename is the name of the upload at the time it failed.
+	Err      error
+}
+
+func (e *storeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *storeError) Unwrap() error {
+	return e.Err
+}
+
+// storeUpload validates the uploaded file f of the upload uc and stores it in the directory of its storage
+// under the file name validators settle on, with its content rewritten by transformers and flushed to disk
+// according to the storage's fsync policy, then runs its pipeline and queues it to be relayed. Files encrypted by
+// the client are stored as is.
+// It returns the [Metadata] of the stored file, or a [*storeError] describing why it was not stored.
+func storeUpload(uc *UploadContext, f *spooledFile) (Metadata, error) {
+	baseDir, logger, stages := uc.Storage.Dir, uc.Logger, uc.Stages
+	transformers, fsync, enc := uc.Storage.Transformers, uc.Storage.Fsync, uc.Encryption
+	fail := func(status int, message, filename string, err error) (Metadata, error) {
+		return Metadata{}, &storeError{Status: status, Message: message, Filename: filename, Err: err}
+	}
+
+	if !validFileName(f.Filename) {
+		err := fmt.Errorf("invalid file name %q", f.Filename)
+		logger.Printf("Upload rejected: %v", err)
+		return fail(http.StatusBadRequest, "Invalid file name", f.Filename, err)
+	}
+
+	candidate, err := newCandidate(f, uc)
+	stages.mark(stageValidate)
+	if err != nil {
+		logger.Printf("Error reading uploaded file: %v", err)
+		return fail(http.StatusInternalServerError, "Could not read uploaded file", f.Filename, err)
+	}
+
+	err = validateCandidate(uc.Storage.Validators, candidate, stages)
+	if err != nil {
+		logger.Printf("Upload of %s rejected: %v", f.Filename, err)
+		status := http.StatusBadRequest
+		if rejection, ok := err.(*RejectionError); ok {
+			status = rejection.Status
+		}
+		return fail(status, fmt.Sprintf("Upload rejected: %v", err), f.Filename, err)
+	}
+
+	var warnings []string
+	if declared := f.Header.Get("Content-Type"); enc == nil && uc.Storage.TypeMismatch != MismatchIgnore && contentTypeMismatch(declared, candidate.ContentType) {
+		err := fmt.Errorf("declared content type %q does not match the content, sniffed as %q", declared, candidate.ContentType)
+		logger.Printf("Content type mismatch in upload of %s from %s: %v", f.Filename, uc.Identity, err)
+		if uc.Storage.TypeMismatch == MismatchReject {
+			return fail(http.StatusUnsupportedMediaType, fmt.Sprintf("Upload rejected: %v", err), f.Filename, err)
+		}
+		warnings = append(warnings, err.Error())
+	}
+
+	filename := candidate.Filename
+	if filename != f.Filename && !validFileName(filename) {
+		err := fmt.Errorf("validator renamed %q to invalid file name %q", f.Filename, filename)
+		logger.Printf("Error validating upload: %v", err)
+		return fail(http.StatusInternalServerError, "Could not validate upload", f.Filename, err)
+	}
+
+	file, err := f.Open()
+	if err != nil {
+		logger.Printf("Error opening uploaded file: %v", err)
+		return fail(http.StatusInternalServerError, "Could not read uploaded file", filename, err)
+	}
+
+	// Create a new file in the uploads directory
+	path := filepath.Join(baseDir, filename)
+	dst, err := os.Create(path)
+	if err != nil {
+		logger.Printf("Error creating file on disk: %v", err)
+		return fail(http.StatusInternalServerError, "Could not create file on disk", filename, err)
+	}
+	defer func() { dst.Close() }()
+
+	if enc != nil {
+		transformers = nil
+	}
+
+	stages.mark(stageWrite)
+	content, err := transformContent(transformers, candidate, file)
+	stages.mark(stagePostProcess)
+	if err != nil {
+		logger.Printf("Error transforming file: %v", err)
+		os.Remove(path)
+		if rejection, ok := err.(*RejectionError); ok {
+			return fail(rejection.Status, fmt.Sprintf("Upload rejected: %v", err), filename, err)
+		}
+		return fail(http.StatusInternalServerError, "Could not process file", filename, err)
+	}
+	defer content.Close()
+
+	// Copy the uploaded file to the new file, or clone the spooled file if left untransformed and the
+	// filesystem supports it, then only reading it back for its checksum
+	h := sha256.New()
+	var n int64
+	spool, spooled := file.(*os.File) // spooled to a temporary file rather than held in memory
+	cloned := spooled && len(transformers) == 0
+	if cloned {
+		if dst, err = cloneFile(dst, spool); err != nil {
+			cloned = false
+		}
+	}
+	if cloned {
+		clonedFiles.Add(1)
+		n, err = io.Copy(h, spool)
+	} else {
+		src := io.TeeReader(content, h)
+		if uc.Storage.HashOffload {
+			hashed := hashStream(h, content)
+			defer hashed.Close()
+			src = hashed
+		}
+		n, err = uc.Storage.writeContent(dst, src, f.Size)
+	}
+	stages.mark(stageWrite)
+	if err != nil {
+		logger.Printf("Error saving file: %v", err)
+		os.Remove(path)
+		return fail(http.StatusInternalServerError, "Could not save file", filename, err)
+	}
+
+	err = fsync.sync(dst, baseDir)
+	stages.mark(stageFsync)
+	if err != nil {
+		logger.Printf("Error syncing file: %v", err)
+		os.Remove(path)
+		return fail(http.StatusInternalServerError, "Could not save file", filename, err)
+	}
+
+	contentType := f.Header.Get("Content-Type")
+	// A generic client supplied type is no better than one configured for the extension, and a mismatched one is not trusted
+	if contentType == "" || warnings != nil || genericContentType(contentType) && customMIMETypes[strings.ToLower(filepath.Ext(filename))] == candidate.ContentType {
+		contentType = candidate.ContentType
+	}
+
+	m := Metadata{
+		Name:         filename,
+		Size:         n,
+		ContentType:  contentType,
+		SHA256:       hex.EncodeToString(h.Sum(nil)),
+		UploadedAt:   time.Now().UTC(),
+		RequestID:    uc.RequestID,
+		Meta:         candidate.Meta,
+		Encryption:   enc,
+		MaxDownloads: uc.MaxDownloads,
+		Warnings:     warnings,
+	}
+	if uc.Expiry > 0 {
+		expiresAt := m.UploadedAt.Add(uc.Expiry)
+		m.ExpiresAt = &expiresAt
+	}
+
+	err = uc.Storage.Pipelines.run(uc, path, &m)
+	stages.mark(stagePostProcess)
+	if err != nil {
+		logger.Printf("Error post-processing file: %v", err)
+		os.Remove(path)
+		if rejection, ok := err.(*RejectionError); ok {
+			return fail(rejection.Status, fmt.Sprintf("Upload rejected: %v", err), filename, err)
+		}
+		return fail(http.StatusInternalServerError, "Could not process file", filename, err)
+	}
+
+	if uc.Storage.Signer != nil {
+		m.Minisig, err = uc.Storage.Signer.signFile(path, filename)
+		if err != nil {
+			logger.Printf("Error signing file: %v", err)
+			os.Remove(path)
+			return fail(http.StatusInternalServerError, "Could not sign file", filename, err)
+		}
+	}
+
+	err = writeMetadata(baseDir, m, uc.Storage.Indexes)
+	stages.mark(stagePostProcess)
+	if err != nil {
+		logger.Printf("Error saving file metadata: %v", err)
+		os.Remove(path)
+		return fail(http.StatusInternalServerError, "Could not save file metadata", filename, err)
+	}
+
+	uc.Storage.Relay.enqueue(path)
+	return m, nil
+}
+
+// hashStream returns a reader of src, hashing what it reads into h in a goroutine of its own, so that the next
+// chunk is read and hashed while the previous one is written to disk. Single-threaded, hashing and writing cap
+// copies at the speed of the hash. h holds the sum of src once the reader returns [io.EOF]. Closing the reader
+// before then stops the goroutine.
+func hashStream(h hash.Hash, src io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := io.Copy(io.MultiWriter(h, pw), src)
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
@@ -0,0 +1,84 @@
+#!/usr/bin/env bash
+# Generates the OpenPGP keyrings and detached signatures of data.txt the tests of openpgp.go verify, with GnuPG.
+# Each case is a keyring <case>.asc and a signature <case>.sig made by its signing key:
+#   valid            an Ed25519 key allowed to sign
+#   subkey           an RSA certification-only key with an Ed25519 signing subkey
+#   revoked          a key revoked after signing
+#   expired          a key that expired after signing, a day after its creation in 2020
+#   nosign           a key whose signing capability was withdrawn after signing
+#   revoked-subkey   a signing subkey revoked after signing
+#   bad-binding      the subkey case, with the binding signature of its subkey corrupted
+set -euo pipefail
+
+cd "$(dirname "$0")"
+export GNUPGHOME=$(mktemp -d)
+trap 'rm -rf "$GNUPGHOME"' EXIT
+gpg=(gpg --batch --quiet --pinentry-mode loopback --passphrase '')
+
+printf 'hello\n' >data.txt
+
+fingerprint() {
+	gpg --list-keys --with-colons "<$1>" | awk -F: '/^fpr/ { print $10; exit }'
+}
+
+# new_key case algo usage [gpg options...] creates a key with the user ID <case@example.com>.
+new_key() {
+	local name=$1 algo=$2 usage=$3
+	shift 3
+	"${gpg[@]}" "$@" --quick-gen-key "$name <$name@example.com>" "$algo" "$usage" never
+}
+
+# sign case [gpg options...] signs data.txt with the key of case.
+sign() {
+	local name=$1
+	shift
+	"${gpg[@]}" "$@" --yes --armor --local-user "<$name@example.com>" --output "$name.sig" --detach-sign data.txt
+}
+
+export_key() {
+	gpg --yes --armor --output "$1.asc" --export "<$1@example.com>"
+}
+
+# edit_key case commands... runs the commands of the --edit-key menu on the key of case.
+edit_key() {
+	local name=$1
+	shift
+	printf '%s\n' "$@" | "${gpg[@]}" --expert --command-fd 0 --edit-key "$(fingerprint "$name@example.com")"
+}
+
+new_key valid ed25519 sign
+sign valid
+export_key valid
+
+new_key subkey rsa2048 cert
+"${gpg[@]}" --quick-add-key "$(fingerprint subkey@example.com)" ed25519 sign never
+sign subkey
+export_key subkey
+
+new_key revoked ed25519 sign
+sign revoked
+"${gpg[@]}" --import <(sed 's/^://' "$GNUPGHOME/openpgp-revocs.d/$(fingerprint revoked@example.com).rev")
+export_key revoked
+
+"${gpg[@]}" --faked-system-time 20200101T000000! --quick-gen-key "expired <expired@example.com>" ed25519 sign 1d
+sign expired --faked-system-time 20200101T120000!
+export_key expired
+
+new_key nosign ed25519 cert,sign
+sign nosign
+edit_key nosign change-usage S Q save
+export_key nosign
+
+new_key revoked-subkey rsa2048 cert
+"${gpg[@]}" --quick-add-key "$(fingerprint revoked-subkey@example.com)" ed25519 sign never
+sign revoked-subkey
+edit_key revoked-subkey "key 1" revkey y 0 "" y save
+export_key revoked-subkey
+
+# The binding signature of the subkey, the last packet, ends with its RSA signature
+gpg --export "<subkey@example.com>" | python3 -c '
+import sys
+b = bytearray(sys.stdin.buffer.read())
+b[-1] ^= 0xff
+sys.stdout.buffer.write(b)' >bad-binding.gpg
+cp subkey.sig bad-binding.sig
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Storage tiers of a stored file, see [Metadata].
+const (
+	tierHot  = ""     // tierHot files are stored on the local disk.
+	tierCold = "cold" // tierCold files are archived to the cold tier, with only their metadata kept locally.
+)
+
+// maxTierMigrationInterval is the maximum interval between migrations of idle files to the cold tier.
+const maxTierMigrationInterval = time.Hour
+
+// Tiering metrics, published through [expvar].
+var (
+	tierHotHits         = expvar.NewInt("tier_hot_hits")         // tierHotHits counts downloads served from the local disk.
+	tierColdHits        = expvar.NewInt("tier_cold_hits")        // tierColdHits counts downloads restored from the cold tier.
+	tierRedirects       = expvar.NewInt("tier_redirects")        // tierRedirects counts downloads redirected to the cold tier.
+	tierMigrations      = expvar.NewInt("tier_migrations")       // tierMigrations counts files archived to the cold tier.
+	tierMigrationErrors = expvar.NewInt("tier_migration_errors") // tierMigrationErrors counts files that failed to be archived.
+)
+
+// ColdTier archives files of an upload directory that have not been accessed for a while to an
+// S3 compatible bucket, and restores them to the local disk when they are accessed again.
+// A nil *ColdTier is valid and keeps every file on the local disk.
+type ColdTier struct {
+	baseDir   string
+	store     *s3Client
+	prefix    string        // prefix is prepended to the names of archived files to form their object keys.
+	coldAfter time.Duration // coldAfter is how long a file must be idle for before it is archived.
+	presign   time.Duration // presign is how long the URLs downloads of archived files are redirected to are valid, 0 restores them instead.
+	indexes   *FileIndexes  // indexes record the metadata of the files archived and restored.
+	logger    *log.Logger
+
+	mu sync.Mutex // mu serializes archiving and restoring.
+}
+
+// newColdTier returns the cold tier of baseDir configured by config, reaching S3 with outbound and recording
+// metadata in indexes, or nil if tiering is disabled.
+func newColdTier(config Config, outbound *Outbound, indexes *FileIndexes, logger *log.Logger) (*ColdTier, error) {
+	if config.tierColdAfter == 0 {
+		return nil, nil
+	}
+
+	if config.tierS3Bucket == "" {
+		return nil, errors.New("tiering requires an s3 bucket")
+	}
+
+	store, err := newS3Client(config.tierS3Endpoint, config.tierS3Region, config.tierS3Bucket, outbound)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ColdTier{
+		baseDir:   config.dir,
+		store:     store,
+		prefix:    config.tierS3Prefix,
+		coldAfter: config.tierColdAfter,
+		presign:   config.tierPresignTTL,
+		indexes:   indexes,
+		logger:    logger,
+	}, nil
+}
+
+// lastAccess returns the time m was last downloaded, or uploaded if it never was.
+func lastAccess(m Metadata) time.Time {
+	if m.AccessedAt != nil {
+		return *m.AccessedAt
+	}
+	return m.UploadedAt
+}
+
+// migrate archives the files that have been idle for longer than coldAfter.
+func (t *ColdTier) migrate(ctx context.Context) error {
+	var idle []Metadata
+	err := listFiles(t.logger, t.baseDir, func(m Metadata) bool {
+		if m.Tier == tierHot && time.Since(lastAccess(m)) > t.coldAfter {
+			idle = append(idle, m)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, m := range idle {
+		if ctx.Err() != nil {
+			break
+		}
+
+		if err := t.archive(ctx, m); err != nil {
+			tierMigrationErrors.Add(1)
+			errs = append(errs, fmt.Errorf("archiving %s: %w", m.Name, err))
+			continue
+		}
+
+		tierMigrations.Add(1)
+		infof(t.logger, "Archived idle file to cold tier: %s", m.Name)
+	}
+
+	return errors.Join(errs...)
+}
+
+// archive uploads the file described by m to the cold tier and removes it from the local disk.
+func (t *ColdTier) archive(ctx context.Context, m Metadata) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	path := filepath.Join(t.baseDir, m.Name)
+	if err := t.store.put(ctx, t.prefix+m.Name, path); err != nil {
+		return err
+	}
+
+	m.Tier = tierCold
+	if err := writeMetadata(t.baseDir, m, t.indexes); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// restore brings the file name back to the local disk if it was archived,
+// reporting whether it was. Files unknown to the cold tier are left alone.
+func (t *ColdTier) restore(ctx context.Context, name string) (bool, error) {
+	if t == nil {
+		return false, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	path := filepath.Join(t.baseDir, name)
+	if _, err := os.Stat(path); err == nil {
+		return false, nil
+	}
+
+	m, err := readMetadata(t.baseDir, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if m.Tier != tierCold {
+		return false, nil
+	}
+
+	body, err := t.store.get(ctx, t.prefix+name)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+
+	tmp, err := os.CreateTemp(t.baseDir, "."+name+".*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	m.Tier = tierHot
+	m.AccessedAt = &now
+	if err := writeMetadata(t.baseDir, m, t.indexes); err != nil {
+		return false, err
+	}
+
+	if err := t.store.delete(ctx, t.prefix+name); err != nil {
+		t.logger.Printf("Error removing restored file %s from cold tier: %v", name, err)
+	}
+
+	infof(t.logger, "Restored file from cold tier: %s", name)
+	return true, nil
+}
+
+// remove removes the archived file name from the cold tier, leaving its metadata to the caller.
+func (t *ColdTier) remove(ctx context.Context, name string) error {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.store.delete(ctx, t.prefix+name)
+}
+
+// presignedURL returns a presigned URL of the archived file name, with the response parameters params such as
+// response-content-disposition, reporting false if presigning is disabled or name is not archived. Encrypted files
+// are never presigned, as the bucket would not send their encryption headers.
+func (t *ColdTier) presignedURL(name string, params url.Values) (string, bool) {
+	if t == nil || t.presign == 0 {
+		return "", false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, err := os.Stat(filepath.Join(t.baseDir, name)); err == nil {
+		return "", false
+	}
+
+	m, err := readMetadata(t.baseDir, name)
+	if err != nil || m.Tier != tierCold || m.Encryption != nil {
+		return "", false
+	}
+
+	return t.store.presign(http.MethodGet, t.prefix+name, params, t.presign, time.Now().UTC()), true
+}
+
+// touch records an access of the file name, postponing its archiving.
+func (t *ColdTier) touch(name string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m, err := readMetadata(t.baseDir, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		fi, statErr := os.Stat(filepath.Join(t.baseDir, name))
+		if statErr != nil {
+			return
+		}
+		m, err = Metadata{Name: name, Size: fi.Size(), UploadedAt: fi.ModTime().UTC()}, nil
+	}
+	if err != nil {
+		t.logger.Printf("Error reading metadata of %s: %v", name, err)
+		return
+	}
+
+	now := time.Now().UTC()
+	m.AccessedAt = &now
+	if err := writeMetadata(t.baseDir, m, t.indexes); err != nil {
+		t.logger.Printf("Error saving file metadata: %v", err)
+	}
+}
+
+// run migrates idle files periodically, in passes run by jobs, until ctx is done.
+func (t *ColdTier) run(ctx context.Context, jobs *JobRunner) {
+	ticker := time.NewTicker(min(t.coldAfter, maxTierMigrationInterval))
+	defer ticker.Stop()
+
+	for {
+		jobs.Do(func() {
+			if err := t.migrate(ctx); err != nil {
+				t.logger.Printf("Error migrating files to cold tier: %v", err)
+			}
+		})
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// transactionsDir is the directory, within the upload directory and the directories of buckets,
+// where the files of transactions are staged until committed.
+const transactionsDir = ".transactions"
+
+// transactionReplacedDir is the directory, within the staging directory of a transaction, where the files
+// replaced by the transaction are kept until it is committed, so it can be rolled back.
+const transactionReplacedDir = ".replaced"
+
+// transactionStaleAfter is the age of staging directories past which they are considered left over by a crash.
+const transactionStaleAfter = 24 * time.Hour
+
+// storeTransaction stores files, all part of the upload uc, atomically: every file is validated,
+// transformed and written to a staging directory, see [storeUpload], before any is moved into place.
+// Should one be rejected or fail, none is stored. Files replaced by the transaction are restored should
+// moving the files into place fail. It returns the [Metadata] of the stored files, or a [*storeError].
+func storeTransaction(uc *UploadContext, files []*spooledFile) ([]Metadata, error) {
+	baseDir, logger := uc.Storage.Dir, uc.Logger
+	fail := func(status int, message, filename string, err error) ([]Metadata, error) {
+		return nil, &storeError{Status: status, Message: message, Filename: filename, Err: err}
+	}
+
+	staging := filepath.Join(baseDir, transactionsDir)
+	if err := os.MkdirAll(staging, 0o755); err != nil {
+		logger.Printf("Error creating transaction directory: %v", err)
+		return fail(http.StatusInternalServerError, "Could not stage files", "", err)
+	}
+	dir, err := os.MkdirTemp(staging, uc.RequestID+"-*")
+	if err != nil {
+		logger.Printf("Error creating transaction directory: %v", err)
+		return fail(http.StatusInternalServerError, "Could not stage files", "", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var stored []Metadata
+	names := make(map[string]bool, len(files))
+	for _, f := range files {
+		staged := uc.in(dir)
+		staged.Storage.Relay = nil // files are relayed once committed, not from the staging directory
+		m, err := storeUpload(staged, f)
+		if err != nil {
+			return nil, err
+		}
+		if names[m.Name] {
+			err := fmt.Errorf("file name %q sent twice", m.Name)
+			logger.Printf("Transaction rejected: %v", err)
+			return fail(http.StatusBadRequest, fmt.Sprintf("Transaction rejected: %v", err), m.Name, err)
+		}
+		names[m.Name] = true
+		stored = append(stored, m)
+	}
+
+	if err := commitTransaction(logger, baseDir, dir, stored, uc.Storage.Fsync, uc.Storage.Indexes); err != nil {
+		logger.Printf("Error committing transaction: %v", err)
+		return fail(http.StatusInternalServerError, "Could not store files", "", err)
+	}
+	uc.Stages.mark(stagePostProcess)
+
+	for _, m := range stored {
+		uc.Storage.Relay.enqueue(filepath.Join(baseDir, m.Name))
+	}
+	return stored, nil
+}
+
+// commitTransaction moves the files staged in dir, along with their metadata, into baseDir, rolling back
+// the files already moved should one fail. Metadata is moved before its file, so files appear complete, and
+// recorded in indexes once it is.
+func commitTransaction(logger *log.Logger, baseDir, dir string, stored []Metadata, fsync FsyncPolicy, indexes *FileIndexes) error {
+	replaced := filepath.Join(dir, transactionReplacedDir)
+	if err := os.MkdirAll(filepath.Join(replaced, metadataDir), 0o755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(baseDir, metadataDir), 0o755); err != nil {
+		return err
+	}
+
+	for i, m := range stored {
+		if err := commitFile(baseDir, dir, m.Name); err != nil {
+			for j := i; j >= 0; j-- {
+				rollbackFile(logger, baseDir, dir, stored[j].Name)
+			}
+			// The files restored are those replaced, whose metadata the index no longer has
+			indexes.reset(baseDir)
+			return fmt.Errorf("%s: %w", m.Name, err)
+		}
+		indexes.indexFile(baseDir, m)
+	}
+
+	if fsync != FsyncAlways {
+		return nil
+	}
+	for _, d := range []string{baseDir, filepath.Join(baseDir, metadataDir)} {
+		if err := syncDir(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// transactionPaths returns the paths of the file name and its metadata, as pairs of their path in baseDir,
+// their path staged in dir and the path the files they replace are kept at.
+func transactionPaths(baseDir, dir, name string) [2][3]string {
+	replaced := filepath.Join(dir, transactionReplacedDir)
+	return [2][3]string{
+		{metadataPath(baseDir, name), metadataPath(dir, name), metadataPath(replaced, name)},
+		{filepath.Join(baseDir, name), filepath.Join(dir, name), filepath.Join(replaced, name)},
+	}
+}
+
+// commitFile moves the staged file name and its metadata from dir into baseDir, keeping those they replace.
+func commitFile(baseDir, dir, name string) error {
+	for _, p := range transactionPaths(baseDir, dir, name) {
+		dst, staged, replaced := p[0], p[1], p[2]
+		if err := os.Rename(dst, replaced); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := createIn(filepath.Dir(dst), func() error { return os.Rename(staged, dst) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollbackFile undoes what [commitFile] did of moving name into baseDir, restoring the files it replaced.
+func rollbackFile(logger *log.Logger, baseDir, dir, name string) {
+	for _, p := range transactionPaths(baseDir, dir, name) {
+		dst, staged, replaced := p[0], p[1], p[2]
+		var err error
+		if _, statErr := os.Lstat(replaced); statErr == nil {
+			err = os.Rename(replaced, dst)
+		} else if _, statErr := os.Lstat(staged); errors.Is(statErr, fs.ErrNotExist) {
+			err = os.Remove(dst)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			logger.Printf("Error rolling back %s: %v", dst, err)
+		}
+	}
+}
+
+// removeStaleTransactions removes the staging directories of the transactions in baseDir left over by crashes.
+func removeStaleTransactions(baseDir string) error {
+	staging := filepath.Join(baseDir, transactionsDir)
+	entries, err := os.ReadDir(staging)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil || time.Since(fi.ModTime()) < transactionStaleAfter {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(staging, e.Name())); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
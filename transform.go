@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io"
+	"strings"
+)
+
+// Transformer rewrites the content of an accepted upload before it is stored.
+// Transform returns a reader of the transformed content of src, or src itself
+// if the transformation does not apply to c. Errors that occur while transforming
+// are returned by the reader.
+type Transformer interface {
+	Transform(c *UploadCandidate, src io.Reader) (io.Reader, error)
+}
+
+// TransformerFunc adapts a function to the [Transformer] interface.
+type TransformerFunc func(c *UploadCandidate, src io.Reader) (io.Reader, error)
+
+func (f TransformerFunc) Transform(c *UploadCandidate, src io.Reader) (io.Reader, error) {
+	return f(c, src)
+}
+
+// transformContent chains transformers over src, in order. The returned reader
+// must be closed to release the transformations if it is not read to completion.
+func transformContent(transformers []Transformer, c *UploadCandidate, src io.Reader) (io.ReadCloser, error) {
+	r := src
+	for _, t := range transformers {
+		var err error
+		if r, err = t.Transform(c, r); err != nil {
+			return nil, err
+		}
+	}
+
+	if rc, ok := r.(io.ReadCloser); ok {
+		return rc, nil
+	}
+	return io.NopCloser(r), nil
+}
+
+// streamTransform runs fn in a goroutine, returning a reader of what it writes to w.
+// If src is closable, e.g. the output of a previous transformation, it is closed once fn returns.
+func streamTransform(fn func(w io.Writer, src io.Reader) error, src io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		err := fn(pw, src)
+		pw.CloseWithError(err)
+		if upstream, ok := src.(io.Closer); ok {
+			upstream.Close()
+		}
+	}()
+	return pr
+}
+
+// newTransformers returns the content transformers enabled by config.
+func newTransformers(config Config) []Transformer {
+	var transformers []Transformer
+
+	if config.sanitizeCmd != "" {
+		transformers = append(transformers, sanitizer(config.dir, config.sanitizeCmd, strings.Split(config.sanitizeExtensions, ","), config.sanitizeTimeout))
+	}
+	if config.stripEXIF {
+		transformers = append(transformers, TransformerFunc(stripImageMetadata))
+	}
+
+	return transformers
+}
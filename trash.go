@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// trashDir is the directory, relative to the upload directory, where deleted files are kept.
+// It is laid out like the upload directory itself, with metadata in its own [metadataDir].
+const trashDir = ".trash"
+
+// maxTrashPurgeInterval is the maximum interval between purges of expired trash.
+const maxTrashPurgeInterval = time.Hour
+
+// moveFile renames the file name, its metadata and attachments, if any, from the fromDir to the toDir upload directory.
+// The metadata is passed through update before being written to its new location, and the move recorded in indexes.
+func moveFile(fromDir, toDir, name string, update func(*Metadata), indexes *FileIndexes) error {
+	meta, err := readMetadata(fromDir, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		fi, statErr := os.Stat(filepath.Join(fromDir, name))
+		if statErr != nil {
+			return statErr
+		}
+		meta = Metadata{Name: name, Size: fi.Size(), UploadedAt: fi.ModTime().UTC()}
+	} else if err != nil {
+		return err
+	}
+
+	err = createIn(toDir, func() error { return os.Rename(filepath.Join(fromDir, name), filepath.Join(toDir, name)) })
+	if err != nil {
+		return err
+	}
+
+	if err := moveAttachments(fromDir, toDir, name); err != nil {
+		return err
+	}
+
+	update(&meta)
+	if err := writeMetadata(toDir, meta, indexes); err != nil {
+		return err
+	}
+
+	return removeMetadata(fromDir, name, indexes)
+}
+
+// deleteFile handles DELETE /files/{name}. Files are moved to the [trashDir],
+// from where they can be restored until they are purged, unless retention is 0
+// in which case they are removed immediately. Files archived to the cold tier are restored first.
+// The directories the file leaves empty are pruned by pruner, and the file removed from indexes.
+func deleteFile(logger *log.Logger, baseDir string, retention time.Duration, tier *ColdTier, pruner *DirPruner, indexes *FileIndexes) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !validFileName(name) {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := tier.restore(r.Context(), name); err != nil {
+			logger.Printf("Error restoring file from cold tier: %v", err)
+			http.Error(w, "Could not delete file", http.StatusInternalServerError)
+			return
+		}
+
+		path := filepath.Join(baseDir, name)
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+
+		var err error
+		if retention == 0 {
+			err = os.Remove(path)
+			if err == nil {
+				err = removeMetadata(baseDir, name, indexes)
+			}
+			if err == nil {
+				err = os.RemoveAll(attachmentsPath(baseDir, name))
+			}
+		} else {
+			err = moveFile(baseDir, filepath.Join(baseDir, trashDir), name, func(m *Metadata) {
+				now := time.Now().UTC()
+				m.DeletedAt = &now
+			}, indexes)
+		}
+
+		if err != nil {
+			logger.Printf("Error deleting file: %v", err)
+			http.Error(w, "Could not delete file", http.StatusInternalServerError)
+			return
+		}
+		pruner.prune(storedFileDirs(baseDir)...)
+
+		infof(logger, "File deleted successfully: %s\n", name)
+		fmt.Fprintf(w, "File deleted successfully: %s\n", name)
+	})
+}
+
+// restoreFile handles POST /files/{name}/restore, moving a deleted file back out of the [trashDir], which pruner
+// prunes once emptied, and into indexes.
+func restoreFile(logger *log.Logger, baseDir string, pruner *DirPruner, indexes *FileIndexes) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !validFileName(name) {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+
+		trash := filepath.Join(baseDir, trashDir)
+		if _, err := os.Stat(filepath.Join(trash, name)); errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if _, err := os.Stat(filepath.Join(baseDir, name)); err == nil {
+			http.Error(w, "A file with the same name exists", http.StatusConflict)
+			return
+		}
+
+		err := moveFile(trash, baseDir, name, func(m *Metadata) {
+			m.DeletedAt = nil
+		}, indexes)
+		if err != nil {
+			logger.Printf("Error restoring file: %v", err)
+			http.Error(w, "Could not restore file", http.StatusInternalServerError)
+			return
+		}
+		pruner.prune(storedFileDirs(trash)...)
+
+		infof(logger, "File restored successfully: %s\n", name)
+		fmt.Fprintf(w, "File restored successfully: %s\n", name)
+	})
+}
+
+// purgeTrash permanently removes the files deleted more than retention ago from the [trashDir] of baseDir, which
+// pruner prunes once emptied.
+func purgeTrash(logger *log.Logger, baseDir string, retention time.Duration, pruner *DirPruner) error {
+	trash := filepath.Join(baseDir, trashDir)
+
+	entries, err := os.ReadDir(trash)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, entry := range entries {
+		name := entry.Name()
+		if !validFileName(name) {
+			continue
+		}
+
+		deletedAt := time.Time{}
+		if meta, err := readMetadata(trash, name); err == nil && meta.DeletedAt != nil {
+			deletedAt = *meta.DeletedAt
+		} else if fi, err := entry.Info(); err == nil {
+			deletedAt = fi.ModTime()
+		}
+
+		if time.Since(deletedAt) < retention {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(trash, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, err)
+			continue
+		}
+
+		// The trash is not indexed
+		if err := removeMetadata(trash, name, nil); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if err := os.RemoveAll(attachmentsPath(trash, name)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		infof(logger, "Purged deleted file: %s", name)
+	}
+	pruner.prune(storedFileDirs(trash)...)
+
+	return errors.Join(errs...)
+}
+
+// runTrashPurger purges expired trash of baseDir periodically, in passes run by jobs, until ctx is done.
+func runTrashPurger(ctx context.Context, logger *log.Logger, jobs *JobRunner, baseDir string, retention time.Duration, pruner *DirPruner) {
+	ticker := time.NewTicker(min(retention, maxTrashPurgeInterval))
+	defer ticker.Stop()
+
+	for {
+		jobs.Do(func() {
+			if err := purgeTrash(logger, baseDir, retention, pruner); err != nil {
+				logger.Printf("Error purging trash: %v", err)
+			}
+		})
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+)
+
+// MismatchPolicy controls what happens to uploads whose declared content type does not match
+// the content type sniffed from their content. It implements [flag.Value].
+type MismatchPolicy string
+
+const (
+	MismatchIgnore MismatchPolicy = "ignore" // MismatchIgnore stores uploads without checking their declared type.
+	MismatchWarn   MismatchPolicy = "warn"   // MismatchWarn stores uploads, logging the mismatch and recording a warning in their metadata.
+	MismatchReject MismatchPolicy = "reject" // MismatchReject rejects uploads with 415 Unsupported Media Type.
+)
+
+func (p *MismatchPolicy) String() string {
+	return string(*p)
+}
+
+func (p *MismatchPolicy) Set(v string) error {
+	switch MismatchPolicy(v) {
+	case MismatchIgnore, MismatchWarn, MismatchReject:
+		*p = MismatchPolicy(v)
+		return nil
+	default:
+		return fmt.Errorf("unknown content type mismatch policy %q, expected one of ignore, warn or reject", v)
+	}
+}
+
+// sniffedAliases maps sniffed content types to the patterns of the declared types they are consistent with,
+// besides themselves: the formats built on a container sniffed as the container, and the alternative names
+// of a format.
+var sniffedAliases = map[string][]string{
+	"application/zip": {
+		"application/x-zip-compressed", "application/*+zip", "application/java-archive",
+		"application/vnd.openxmlformats-officedocument.*", "application/vnd.oasis.opendocument.*",
+		"application/vnd.android.package-archive", "application/vnd.ms-*",
+	},
+	"application/x-gzip":           {"application/gzip", "application/x-compressed-tar", "application/x-tgz"},
+	"application/ogg":              {"audio/ogg", "video/ogg"},
+	"application/x-rar-compressed": {"application/vnd.rar"},
+	"audio/wave":                   {"audio/wav", "audio/x-wav", "audio/vnd.wave"},
+	"audio/mpeg":                   {"audio/mp3"},
+	"font/ttf":                     {"application/x-font-ttf", "font/sfnt"},
+	"image/bmp":                    {"image/x-ms-bmp"},
+	"image/jpeg":                   {"image/jpg", "image/pjpeg"},
+	"image/x-icon":                 {"image/vnd.microsoft.icon"},
+	"text/html":                    {"application/xhtml+xml"},
+	"text/xml":                     {"application/xml", "application/*+xml", "image/svg+xml"},
+	"video/avi":                    {"video/x-msvideo"},
+	"video/mp4":                    {"audio/mp4"},
+	"video/webm":                   {"audio/webm"},
+}
+
+// contentTypeMismatch reports whether the content type declared by the client, e.g. in the header of a
+// multipart part, names another format than the one sniffed from the content. Generic types, on either side,
+// match anything, as do declared types that do not parse.
+func contentTypeMismatch(declared, sniffed string) bool {
+	declaredType, _, err := mime.ParseMediaType(declared)
+	if err != nil || genericContentType(declaredType) || genericContentType(sniffed) {
+		return false
+	}
+	sniffedType, _, _ := strings.Cut(sniffed, ";")
+	sniffedType = strings.ToLower(strings.TrimSpace(sniffedType))
+
+	if declaredType == sniffedType {
+		return false
+	}
+	for _, p := range sniffedAliases[sniffedType] {
+		if ok, _ := path.Match(p, declaredType); ok {
+			return false
+		}
+	}
+	return true
+}
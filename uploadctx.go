@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/Gabriel-Ladzaretti/go-multipart/internal/httpx"
+)
+
+// UploadLimits bounds what an upload may send.
+type UploadLimits struct {
+	MaxMemory      int64           // MaxMemory is the number of bytes of a file held in memory, the rest is spooled to disk.
+	MaxSize        int64           // MaxSize is the maximum size of a file in bytes, 0 for no limit.
+	MaxMetaHeaders int             // MaxMetaHeaders is the maximum number of X-Upload-Meta-* headers.
+	MaxMetaSize    int             // MaxMetaSize is the maximum combined size in bytes of the metadata keys and values.
+	Multipart      MultipartLimits // Multipart bounds the structure of multipart payloads.
+	Memory         *MemoryBudget   // Memory bounds the memory of all uploads together holding files, nil if unbounded.
+}
+
+// UploadStorage describes where and how uploads are stored.
+type UploadStorage struct {
+	Dir          string         // Dir is the directory files are stored in.
+	Validators   []Validator    // Validators accept or reject files before they are stored.
+	Transformers []Transformer  // Transformers rewrite the content of files as they are stored.
+	Pipelines    Pipelines      // Pipelines post-process files once stored, by name.
+	Fsync        FsyncPolicy    // Fsync is when stored files are flushed to stable storage.
+	IOUring      bool           // IOUring writes large files with io_uring, see [UploadStorage.writeContent].
+	HashOffload  bool           // HashOffload hashes files in a goroutine of their own as they are written, see [hashStream].
+	TypeMismatch MismatchPolicy // TypeMismatch is what happens to files whose declared content type does not match their content.
+	URL          string         // URL is the path stored files are downloaded under, e.g. "/files/".
+	Signer       *Minisigner    // Signer signs stored files, nil if signing is disabled.
+	Dedup        *Deduplicator  // Dedup coalesces identical uploads, nil if disabled.
+	Relay        *SFTPRelay     // Relay copies stored files to an SFTP host, nil if disabled.
+	Indexes      *FileIndexes   // Indexes are the in-memory indexes stored files are recorded in.
+	Outbound     *Outbound      // Outbound makes the outbound requests of uploads, e.g. callbacks, webhooks and OPA queries.
+}
+
+// UploadContext carries the state of a single upload through its handler, [storeUpload] and the
+// validators and transformers it runs, which find it in [UploadCandidate.Upload].
+type UploadContext struct {
+	RequestID    string            // RequestID identifies the upload in logs and events.
+	Identity     string            // Identity is the client the upload comes from: its IP address, or the source of ingested files.
+	Origin       string            // Origin is the scheme and host the upload was sent to, e.g. "https://example.com", empty for ingested files.
+	Limits       UploadLimits      // Limits bounds what the upload may send.
+	Meta         map[string]string // Meta holds the user metadata of the upload, once parsed.
+	Encryption   *Encryption       // Encryption describes the client-side encryption of the upload, nil if it is not encrypted.
+	Storage      *UploadStorage    // Storage is where and how the upload is stored.
+	Responses    UploadResponses   // Responses are the templates of the responses to the upload, the built-in ones if unset.
+	XML          bool              // XML reports whether the client prefers XML responses, see [prefersXML].
+	Responder    uploadResponder   // Responder, if set, answers the upload instead of Responses, see [NewProgressStreamMiddleware].
+	Events       EventPublisher    // Events receives the lifecycle events of the upload.
+	Logger       *log.Logger       // Logger logs the errors of the upload.
+	Stages       *uploadStages     // Stages times the stages of the upload.
+	Body         *countingReader   // Body counts the bytes of the request body received, nil for ingested files.
+	Callback     string            // Callback is the URL notified once the upload is stored, see [NewCallbackMiddleware].
+	Expiry       time.Duration     // Expiry is how long the stored files are kept for, forever if 0.
+	MaxDownloads int64             // MaxDownloads is the number of downloads the stored files are deleted after, unlimited if 0.
+}
+
+// publish publishes e, stamped with the time and the request ID of the upload.
+func (u *UploadContext) publish(e Event) {
+	e.Time = time.Now()
+	e.RequestID = u.RequestID
+	if err := u.Events.Publish(e); err != nil {
+		u.Logger.Printf("Error publishing %s event: %v", e.Type, err)
+	}
+}
+
+// in returns a copy of u storing to dir, with its own copy of the metadata, which validators may change.
+func (u *UploadContext) in(dir string) *UploadContext {
+	c := *u
+	storage := *u.Storage
+	storage.Dir = dir
+	c.Storage = &storage
+	c.Meta = maps.Clone(u.Meta)
+	return &c
+}
+
+// fileURL returns the canonical URL of the stored file name, absolute if the origin of u is known.
+func (u *UploadContext) fileURL(name string) string {
+	return u.Origin + u.Storage.URL + url.PathEscape(name)
+}
+
+// uploadContextKey is the context key of the [UploadContext] of a request.
+type uploadContextKey struct{}
+
+// NewUploadContextMiddleware creates a middleware attaching a new [UploadContext] to the requests
+// passed to next, storing to storage within limits, answering with responses, publishing to events and
+// logging to logger. Handlers fill in the metadata and encryption of the upload once parsed.
+func NewUploadContextMiddleware(storage *UploadStorage, limits UploadLimits, responses UploadResponses, events EventPublisher, logger *log.Logger) httpx.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body := &countingReader{ReadCloser: r.Body}
+			r.Body = body
+			uc := &UploadContext{
+				RequestID: httpx.RequestIDFromContext(r.Context()),
+				Identity:  clientKey(r),
+				Origin:    requestOrigin(r),
+				Limits:    limits,
+				Storage:   storage,
+				Responses: responses,
+				XML:       prefersXML(r),
+				Events:    events,
+				Logger:    logger,
+				Stages:    newUploadStages(logger),
+				Body:      body,
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), uploadContextKey{}, uc)))
+		})
+	}
+}
+
+// requestOrigin returns the scheme and host r was sent to, which stored files are addressed under, as forwarded
+// by a trusted proxy if [NewForwardedMiddleware] found it did.
+func requestOrigin(r *http.Request) string {
+	if origin, ok := r.Context().Value(forwardedOriginKey{}).(string); ok {
+		return origin
+	}
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+// uploadContextFrom returns the [UploadContext] attached to ctx by [NewUploadContextMiddleware], nil if none is.
+func uploadContextFrom(ctx context.Context) *UploadContext {
+	uc, _ := ctx.Value(uploadContextKey{}).(*UploadContext)
+	return uc
+}
+
+// newUploadLimits returns the limits of uploads set by config, files of which may be up to maxSize bytes.
+func newUploadLimits(config Config, maxSize int64) UploadLimits {
+	return UploadLimits{
+		MaxMemory:      config.maxInMemorySize,
+		MaxSize:        maxSize,
+		MaxMetaHeaders: config.maxMetaHeaders,
+		MaxMetaSize:    config.maxMetaSize,
+		Multipart:      config.multipartLimits,
+	}
+}
+
+// uploadLimits returns the limits of the uploads of s, files of which may be up to maxSize bytes.
+func (s *Server) uploadLimits(maxSize int64) UploadLimits {
+	limits := newUploadLimits(s.config, maxSize)
+	limits.Memory = s.memoryBudget
+	return limits
+}
+
+// uploadStorage returns the storage of the uploads of s to dir, like [newUploadStorage], signing, coalescing and
+// relaying the files stored as enabled for s.
+func (s *Server) uploadStorage(dir string) *UploadStorage {
+	storage := newUploadStorage(s.config, s.outbound, dir)
+	storage.Signer, storage.Dedup, storage.Relay, storage.Indexes = s.fileSigner, s.dedup, s.sftpRelay, s.indexes
+	return storage
+}
+
+// newUploadStorage returns the storage of uploads to dir, with the validators, transformers and pipelines enabled by
+// config, making outbound requests with outbound.
+func newUploadStorage(config Config, outbound *Outbound, dir string) *UploadStorage {
+	return &UploadStorage{
+		Dir:          dir,
+		Validators:   newValidators(config, outbound),
+		Transformers: newTransformers(config),
+		Pipelines:    config.pipelines,
+		Fsync:        config.fsync,
+		IOUring:      config.ioUring,
+		HashOffload:  config.hashOffload,
+		TypeMismatch: config.typeMismatch,
+		URL:          "/files/",
+		Outbound:     outbound,
+	}
+}
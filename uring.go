@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// uringMinSize is the size from which files are written with io_uring, when enabled. Smaller files are
+// written faster than an io_uring is set up.
+const uringMinSize = 4 << 20
+
+// errUringUnavailable is returned by uringCopy, having read nothing, if the io_uring write path is not built
+// into the binary or the kernel does not allow it, e.g. under the default seccomp profile of containers.
+var errUringUnavailable = errors.New("io_uring unavailable")
+
+// writeContent copies src, the content of a file of size bytes as received, to dst, a newly created file, with
+// io_uring if enabled and the file is large enough, with the standard write path otherwise.
+func (s *UploadStorage) writeContent(dst *os.File, src io.Reader, size int64) (int64, error) {
+	if s.IOUring && size >= uringMinSize {
+		n, err := uringCopy(dst, src)
+		if !errors.Is(err, errUringUnavailable) {
+			return n, err
+		}
+	}
+	return io.Copy(dst, src)
+}
+
+// probeUring reports why io_uring writes to dir are unavailable, nil if they are not.
+func probeUring(dir string) error {
+	f, err := os.CreateTemp(dir, ".uring-probe-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = uringCopy(f, strings.NewReader(""))
+	return err
+}
@@ -0,0 +1,283 @@
+//go:build linux && uring
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// uringSupported reports whether the binary was built with the io_uring write path.
+const uringSupported = true
+
+// io_uring system calls, opcodes, flags and mmap offsets, see io_uring_setup(2) and io_uring_enter(2).
+const (
+	sysIOUringSetup = 425
+	sysIOUringEnter = 426
+
+	ioringOpWrite         = 23
+	ioringEnterGetEvents  = 1
+	ioringOffSQRing       = 0
+	ioringOffCQRing       = 0x8000000
+	ioringOffSQEs         = 0x10000000
+	uringSQESize          = 64
+	uringCQESize          = 16
+	uringParamsSQOffset   = 40 // uringParamsSQOffset is the offset of sq_off in struct io_uring_params.
+	uringParamsCQOffset   = 80 // uringParamsCQOffset is the offset of cq_off in struct io_uring_params.
+	uringParamsStructSize = 120
+)
+
+// uringDepth is the number of writes a copy keeps in flight, and uringBufferSize the size of each.
+const (
+	uringDepth      = 8
+	uringBufferSize = 1 << 20
+)
+
+// uringSQE is struct io_uring_sqe, of which writes use the first fields.
+type uringSQE struct {
+	opcode   uint8
+	flags    uint8
+	ioprio   uint16
+	fd       int32
+	off      uint64
+	addr     uint64
+	len      uint32
+	rwFlags  uint32
+	userData uint64
+	_        [24]byte
+}
+
+// uringCQE is struct io_uring_cqe.
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uring is an io_uring instance: the submission and completion rings shared with the kernel.
+type uring struct {
+	fd     int
+	sqRing []byte
+	cqRing []byte
+	sqes   []byte
+
+	sqHead, sqTail, sqMask *uint32
+	sqArray                unsafe.Pointer
+	cqHead, cqTail, cqMask *uint32
+	cqes                   unsafe.Pointer
+}
+
+// newUring sets up an io_uring of entries submission queue entries, mapping its rings.
+func newUring(entries uint32) (*uring, error) {
+	var params [uringParamsStructSize]byte
+	fd, _, errno := syscall.Syscall(sysIOUringSetup, uintptr(entries), uintptr(unsafe.Pointer(&params[0])), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup: %w", errno)
+	}
+	u := &uring{fd: int(fd)}
+
+	u32 := func(off int) uint32 { return *(*uint32)(unsafe.Pointer(&params[off])) }
+	sqEntries, cqEntries := u32(0), u32(4)
+	// struct io_sqring_offsets: head, tail, ring_mask, ring_entries, flags, dropped, array
+	sqOff := func(field int) uint32 { return u32(uringParamsSQOffset + 4*field) }
+	// struct io_cqring_offsets: head, tail, ring_mask, ring_entries, overflow, cqes
+	cqOff := func(field int) uint32 { return u32(uringParamsCQOffset + 4*field) }
+
+	mmap := func(offset int64, size int) ([]byte, error) {
+		return syscall.Mmap(u.fd, offset, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED|syscall.MAP_POPULATE)
+	}
+	var err error
+	if u.sqRing, err = mmap(ioringOffSQRing, int(sqOff(6)+sqEntries*4)); err != nil {
+		u.close()
+		return nil, fmt.Errorf("mapping submission ring: %w", err)
+	}
+	if u.cqRing, err = mmap(ioringOffCQRing, int(cqOff(5)+cqEntries*uringCQESize)); err != nil {
+		u.close()
+		return nil, fmt.Errorf("mapping completion ring: %w", err)
+	}
+	if u.sqes, err = mmap(ioringOffSQEs, int(sqEntries*uringSQESize)); err != nil {
+		u.close()
+		return nil, fmt.Errorf("mapping submission entries: %w", err)
+	}
+
+	u.sqHead = (*uint32)(unsafe.Pointer(&u.sqRing[sqOff(0)]))
+	u.sqTail = (*uint32)(unsafe.Pointer(&u.sqRing[sqOff(1)]))
+	u.sqMask = (*uint32)(unsafe.Pointer(&u.sqRing[sqOff(2)]))
+	u.sqArray = unsafe.Pointer(&u.sqRing[sqOff(6)])
+	u.cqHead = (*uint32)(unsafe.Pointer(&u.cqRing[cqOff(0)]))
+	u.cqTail = (*uint32)(unsafe.Pointer(&u.cqRing[cqOff(1)]))
+	u.cqMask = (*uint32)(unsafe.Pointer(&u.cqRing[cqOff(2)]))
+	u.cqes = unsafe.Pointer(&u.cqRing[cqOff(5)])
+	return u, nil
+}
+
+// close unmaps the rings and closes the io_uring.
+func (u *uring) close() {
+	for _, m := range [][]byte{u.sqes, u.cqRing, u.sqRing} {
+		if m != nil {
+			syscall.Munmap(m)
+		}
+	}
+	syscall.Close(u.fd)
+}
+
+// queueWrite queues a write of b to fd at off, tagged with userData. The submission ring must have room.
+func (u *uring) queueWrite(fd int, b []byte, off int64, userData uint64) {
+	tail := atomic.LoadUint32(u.sqTail)
+	i := tail & *u.sqMask
+	sqe := (*uringSQE)(unsafe.Pointer(&u.sqes[i*uringSQESize]))
+	*sqe = uringSQE{opcode: ioringOpWrite, fd: int32(fd), off: uint64(off), addr: uint64(uintptr(unsafe.Pointer(&b[0]))), len: uint32(len(b)), userData: userData}
+	*(*uint32)(unsafe.Add(u.sqArray, 4*i)) = i
+	atomic.StoreUint32(u.sqTail, tail+1)
+}
+
+// enter submits the queued writes and waits for minComplete of them to complete.
+func (u *uring) enter(toSubmit, minComplete uint32) error {
+	for {
+		_, _, errno := syscall.Syscall6(sysIOUringEnter, uintptr(u.fd), uintptr(toSubmit), uintptr(minComplete), ioringEnterGetEvents, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return fmt.Errorf("io_uring_enter: %w", errno)
+		}
+		return nil
+	}
+}
+
+// reap calls fn with each completed write, consuming it.
+func (u *uring) reap(fn func(cqe uringCQE)) {
+	head := atomic.LoadUint32(u.cqHead)
+	for ; head != atomic.LoadUint32(u.cqTail); head++ {
+		fn(*(*uringCQE)(unsafe.Add(u.cqes, uringCQESize*(head&*u.cqMask))))
+	}
+	atomic.StoreUint32(u.cqHead, head)
+}
+
+// drain waits for the n writes queued or in flight to complete, submitting those still queued, and reports
+// whether they did, after which the kernel no longer reads their buffers.
+func (u *uring) drain(n int) bool {
+	for n > 0 {
+		queued := atomic.LoadUint32(u.sqTail) - atomic.LoadUint32(u.sqHead)
+		if err := u.enter(queued, 1); err != nil {
+			return false
+		}
+		u.reap(func(uringCQE) { n-- })
+	}
+	return true
+}
+
+// uringWrite is a write in flight: a buffer and the part of it left to write at off.
+type uringWrite struct {
+	buf  []byte
+	off  int64
+	done int // done is the number of bytes of buf written.
+}
+
+// uringCopy copies src to dst, a newly created file, with io_uring writes, keeping uringDepth writes of
+// uringBufferSize in flight while the next buffers are read from src, and returns the number of bytes written.
+// It returns an error wrapping errUringUnavailable, having read nothing, if no io_uring can be set up.
+func uringCopy(dst *os.File, src io.Reader) (int64, error) {
+	u, err := newUring(uringDepth)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", errUringUnavailable, err)
+	}
+	defer u.close()
+
+	// Buffers are mapped outside the Go heap, as the kernel reads them after the system call returns
+	mem, err := syscall.Mmap(-1, 0, uringDepth*uringBufferSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS)
+	if err != nil {
+		return 0, fmt.Errorf("%w: mapping buffers: %v", errUringUnavailable, err)
+	}
+	leak := false
+	defer func() {
+		if !leak {
+			syscall.Munmap(mem)
+		}
+	}()
+
+	fd := int(dst.Fd())
+	writes := make([]uringWrite, uringDepth)
+	free := make([]int, 0, uringDepth)
+	for i := range writes {
+		free = append(free, i)
+	}
+
+	var written, off int64
+	var readErr, writeErr error
+	inFlight, queued := 0, uint32(0)
+	eof := false
+	for {
+		for len(free) > 0 && !eof && readErr == nil && writeErr == nil {
+			i := free[len(free)-1]
+			buf := mem[i*uringBufferSize : (i+1)*uringBufferSize]
+			n, err := io.ReadFull(src, buf)
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				eof = true
+			} else if err != nil {
+				readErr = err
+			}
+			if n == 0 {
+				break
+			}
+			free = free[:len(free)-1]
+			writes[i] = uringWrite{buf: buf[:n], off: off}
+			u.queueWrite(fd, writes[i].buf, off, uint64(i))
+			off += int64(n)
+			inFlight++
+			queued++
+		}
+		if inFlight == 0 {
+			break
+		}
+
+		// Wait for a write only once there is nothing left to read ahead
+		var wait uint32
+		if len(free) == 0 || eof || readErr != nil || writeErr != nil {
+			wait = 1
+		}
+		if err := u.enter(queued, wait); err != nil {
+			// The kernel may still read the buffers of the writes queued or in flight, which are only unmapped
+			// once they complete, and left mapped for good if they cannot be waited for
+			leak = !u.drain(inFlight)
+			return written, err
+		}
+		queued = 0
+
+		u.reap(func(cqe uringCQE) {
+			i := int(cqe.userData)
+			w := &writes[i]
+			switch {
+			case cqe.res < 0:
+				if writeErr == nil {
+					writeErr = &os.PathError{Op: "write", Path: dst.Name(), Err: syscall.Errno(-cqe.res)}
+				}
+			case cqe.res == 0:
+				if writeErr == nil {
+					writeErr = io.ErrShortWrite
+				}
+			default:
+				w.done += int(cqe.res)
+				written += int64(cqe.res)
+				if w.done < len(w.buf) && writeErr == nil {
+					// Short writes are resubmitted for the rest of the buffer
+					u.queueWrite(fd, w.buf[w.done:], w.off+int64(w.done), cqe.userData)
+					queued++
+					return
+				}
+			}
+			inFlight--
+			free = append(free, i)
+		})
+	}
+
+	if writeErr != nil {
+		return written, writeErr
+	}
+	return written, readErr
+}
@@ -0,0 +1,109 @@
+//go:build linux && uring
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestUring returns an io_uring of uringDepth entries, closed at the end of t, skipping t if the kernel
+// does not allow it.
+func newTestUring(t *testing.T) *uring {
+	t.Helper()
+	u, err := newUring(uringDepth)
+	if err != nil {
+		t.Skipf("io_uring unavailable: %v", err)
+	}
+	t.Cleanup(u.close)
+	return u
+}
+
+func TestUringCopy(t *testing.T) {
+	newTestUring(t)
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "empty", size: 0},
+		{name: "partial buffer", size: 1000},
+		{name: "one buffer", size: uringBufferSize},
+		{name: "more buffers than in flight", size: (2*uringDepth+1)*uringBufferSize + 123},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := bytes.Repeat([]byte("0123456789abcdef"), tt.size/16+1)[:tt.size]
+			dst, err := os.Create(filepath.Join(t.TempDir(), "file"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dst.Close()
+
+			n, err := uringCopy(dst, bytes.NewReader(content))
+			if err != nil || n != int64(tt.size) {
+				t.Fatalf("uringCopy() = %d, %v, want %d", n, err, tt.size)
+			}
+			got, err := os.ReadFile(dst.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("copied %d bytes differing from the %d bytes of the source", len(got), len(content))
+			}
+		})
+	}
+}
+
+func TestUringCopyWriteError(t *testing.T) {
+	newTestUring(t)
+
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Writes to a file opened for reading only fail
+	dst, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	content := make([]byte, 3*uringBufferSize)
+	if _, err := uringCopy(dst, bytes.NewReader(content)); err == nil || errors.Is(err, errUringUnavailable) {
+		t.Errorf("uringCopy() = %v, want a write error", err)
+	}
+}
+
+func TestUringDrain(t *testing.T) {
+	u := newTestUring(t)
+
+	dst, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	// Writes left queued, as when submitting them failed, are submitted and waited for
+	bufs := [][]byte{[]byte("first "), []byte("second "), []byte("third")}
+	var off int64
+	for i, b := range bufs {
+		u.queueWrite(int(dst.Fd()), b, off, uint64(i))
+		off += int64(len(b))
+	}
+	if !u.drain(len(bufs)) {
+		t.Fatal("drain() = false, want true")
+	}
+
+	got, err := os.ReadFile(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "first second third"; string(got) != want {
+		t.Errorf("written %q, want %q", got, want)
+	}
+}
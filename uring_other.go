@@ -0,0 +1,17 @@
+//go:build !linux || !uring
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// uringSupported reports whether the binary was built with the io_uring write path, which needs Linux and
+// the uring build tag.
+const uringSupported = false
+
+// uringCopy is not supported by this binary, files are written with the standard write path.
+func uringCopy(dst *os.File, src io.Reader) (int64, error) {
+	return 0, errUringUnavailable
+}
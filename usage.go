@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StorageUsage is the storage used by a set of files.
+type StorageUsage struct {
+	Files      int64 `json:"files" xml:"files"`
+	Bytes      int64 `json:"bytes" xml:"bytes"`
+	ColdFiles  int64 `json:"cold_files" xml:"cold_files"`   // ColdFiles counts the files archived to the cold tier, included in Files.
+	ColdBytes  int64 `json:"cold_bytes" xml:"cold_bytes"`   // ColdBytes is the size of the files archived to the cold tier, included in Bytes.
+	TrashFiles int64 `json:"trash_files" xml:"trash_files"` // TrashFiles counts the deleted files kept for restoring, not included in Files.
+	TrashBytes int64 `json:"trash_bytes" xml:"trash_bytes"` // TrashBytes is the size of the deleted files kept for restoring, not included in Bytes.
+}
+
+// add counts the file described by m, deleted if trashed.
+func (u *StorageUsage) add(m Metadata, trashed bool) {
+	switch {
+	case trashed:
+		u.TrashFiles++
+		u.TrashBytes += m.Size
+	case m.Tier == tierCold:
+		u.ColdFiles++
+		u.ColdBytes += m.Size
+		fallthrough
+	default:
+		u.Files++
+		u.Bytes += m.Size
+	}
+}
+
+// plus returns the sum of u and v.
+func (u StorageUsage) plus(v StorageUsage) StorageUsage {
+	return StorageUsage{
+		Files: u.Files + v.Files, Bytes: u.Bytes + v.Bytes,
+		ColdFiles: u.ColdFiles + v.ColdFiles, ColdBytes: u.ColdBytes + v.ColdBytes,
+		TrashFiles: u.TrashFiles + v.TrashFiles, TrashBytes: u.TrashBytes + v.TrashBytes,
+	}
+}
+
+// GroupUsage is the storage used by the files of one group: a bucket, or the files sharing a user metadata value.
+type GroupUsage struct {
+	Name string `json:"name" xml:"name,attr"` // Name is the bucket, or the metadata value, empty for the files outside of buckets or without the metadata.
+	StorageUsage
+}
+
+// UsageReport is the storage used by the upload directory, per bucket and per value of the usage metadata key.
+type UsageReport struct {
+	XMLName     xml.Name     `json:"-" xml:"usage"`
+	ComputedAt  time.Time    `json:"computed_at" xml:"computed_at"`
+	Total       StorageUsage `json:"total" xml:"total"`
+	Buckets     []GroupUsage `json:"buckets" xml:"buckets>bucket"`                        // Buckets are the usage of each bucket, the upload directory itself being the one with no name.
+	MetaKey     string       `json:"meta_key,omitempty" xml:"meta_key,omitempty"`         // MetaKey is the user metadata key files are grouped by in Groups.
+	Groups      []GroupUsage `json:"groups,omitempty" xml:"groups>group,omitempty"`       // Groups are the usage of each value of MetaKey across buckets.
+	Unreadable  int          `json:"unreadable,omitempty" xml:"unreadable,omitempty"`     // Unreadable counts the directories that could not be listed, whose files are missing from the report.
+	RefreshedIn string       `json:"refreshed_in,omitempty" xml:"refreshed_in,omitempty"` // RefreshedIn is how long computing the report took.
+}
+
+// UsageIndex keeps a report of the storage used by the upload directory, per bucket and per tenant,
+// recomputed periodically from the metadata of the stored files so reads are cheap.
+type UsageIndex struct {
+	logger  *log.Logger
+	dir     string
+	buckets *Buckets
+	metaKey string // metaKey is the user metadata key files are grouped by, e.g. "tenant", not grouped if empty.
+
+	refreshMu sync.Mutex // refreshMu serializes refreshes.
+	mu        sync.Mutex
+	report    *UsageReport // report is the latest report, nil until the first refresh.
+}
+
+// newUsageIndex returns the usage index of the upload directory set by config.
+func newUsageIndex(logger *log.Logger, config Config) *UsageIndex {
+	return &UsageIndex{logger: logger, dir: config.dir, buckets: newBuckets(config.dir, logger), metaKey: strings.ToLower(config.usageMetaKey)}
+}
+
+// latest returns the latest report, computing it first if none was.
+func (x *UsageIndex) latest() UsageReport {
+	x.mu.Lock()
+	report := x.report
+	x.mu.Unlock()
+
+	if report == nil {
+		return x.refresh()
+	}
+	return *report
+}
+
+// refresh recomputes the report, keeping and returning it.
+func (x *UsageIndex) refresh() UsageReport {
+	x.refreshMu.Lock()
+	defer x.refreshMu.Unlock()
+
+	start := time.Now()
+	report := UsageReport{ComputedAt: start.UTC(), MetaKey: x.metaKey}
+	groups := make(map[string]*StorageUsage)
+
+	scan := func(bucket, dir string) {
+		var usage StorageUsage
+		for _, trashed := range []bool{false, true} {
+			d := dir
+			if trashed {
+				d = filepath.Join(dir, trashDir)
+			}
+
+			err := listFiles(x.logger, d, func(m Metadata) bool {
+				usage.add(m, trashed)
+				if x.metaKey != "" {
+					value := m.Meta[x.metaKey]
+					if groups[value] == nil {
+						groups[value] = &StorageUsage{}
+					}
+					groups[value].add(m, trashed)
+				}
+				return true
+			})
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				x.logger.Printf("Error computing storage usage of %s: %v", d, err)
+				report.Unreadable++
+			}
+		}
+
+		report.Buckets = append(report.Buckets, GroupUsage{Name: bucket, StorageUsage: usage})
+		report.Total = report.Total.plus(usage)
+	}
+
+	scan("", x.dir)
+	list, err := x.buckets.list()
+	if err != nil {
+		x.logger.Printf("Error listing buckets: %v", err)
+		report.Unreadable++
+	}
+	for _, bucket := range list {
+		scan(bucket.Name, x.buckets.path(bucket.Name))
+	}
+
+	for value, usage := range groups {
+		report.Groups = append(report.Groups, GroupUsage{Name: value, StorageUsage: *usage})
+	}
+	slices.SortFunc(report.Groups, func(a, b GroupUsage) int { return strings.Compare(a.Name, b.Name) })
+	report.RefreshedIn = time.Since(start).Round(time.Millisecond).String()
+
+	x.mu.Lock()
+	x.report = &report
+	x.mu.Unlock()
+	return report
+}
+
+// run refreshes the report every interval, in passes run by jobs, until ctx is done.
+func (x *UsageIndex) run(ctx context.Context, jobs *JobRunner, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		jobs.Do(func() {
+			report := x.refresh()
+			debugf(x.logger, "Storage usage refreshed in %s: %d files, %d bytes", report.RefreshedIn, report.Total.Files, report.Total.Bytes)
+		})
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// usageHandler handles GET /admin/usage, responding with the latest [UsageReport] of usage as JSON,
+// or XML for clients preferring it. With refresh=true, the report is recomputed first.
+func usageHandler(usage *UsageIndex) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report UsageReport
+		if r.URL.Query().Get("refresh") == "true" {
+			report = usage.refresh()
+		} else {
+			report = usage.latest()
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		writeNegotiated(w, r, report, report)
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// sniffSize is the number of leading content bytes passed to validators.
+const sniffSize = 512
+
+// UploadCandidate describes an upload awaiting validation, before it is stored.
+type UploadCandidate struct {
+	Filename    string            // Filename is the name the upload is stored under.
+	Size        int64             // Size is the size of the upload in bytes.
+	Head        []byte            // Head holds the first bytes of the content, up to sniffSize.
+	ContentType string            // ContentType is the content type sniffed from Head, or configured for the extension of Filename if sniffing is inconclusive, application/octet-stream if Encryption is set.
+	Meta        map[string]string // Meta holds the user metadata of the upload.
+	Encryption  *Encryption       // Encryption describes the client-side encryption of the upload, nil if it is not encrypted.
+	Upload      *UploadContext    // Upload is the upload the file is part of.
+}
+
+// Validator inspects uploads before they are stored. It rejects an upload by
+// returning an error, preferably a [*RejectionError], and may transform it by modifying c,
+// e.g. renaming it by changing c.Filename.
+type Validator interface {
+	Validate(c *UploadCandidate) error
+}
+
+// ValidatorFunc adapts a function to the [Validator] interface.
+type ValidatorFunc func(c *UploadCandidate) error
+
+func (f ValidatorFunc) Validate(c *UploadCandidate) error {
+	return f(c)
+}
+
+// RejectionError is returned by a [Validator] rejecting an upload.
+type RejectionError struct {
+	Status int    // Status is the HTTP status code of the response.
+	Reason string // Reason is the explanation sent to the client.
+}
+
+func (e *RejectionError) Error() string {
+	return e.Reason
+}
+
+// newCandidate describes the uploaded file f of the upload uc for validation.
+func newCandidate(f *spooledFile, uc *UploadContext) (*UploadCandidate, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	// Sniffing encrypted content would only yield noise
+	contentType := "application/octet-stream"
+	if uc.Encryption == nil {
+		contentType = http.DetectContentType(head)
+		if t, ok := customMIMETypes[strings.ToLower(filepath.Ext(f.Filename))]; ok && genericContentType(contentType) {
+			contentType = t
+		}
+	}
+
+	return &UploadCandidate{
+		Filename:    f.Filename,
+		Size:        f.Size,
+		Head:        head,
+		ContentType: contentType,
+		Meta:        uc.Meta,
+		Encryption:  uc.Encryption,
+		Upload:      uc,
+	}, nil
+}
+
+// registeredValidators are the validators registered using [RegisterValidator].
+var registeredValidators []Validator
+
+// RegisterValidator registers v to run on every upload, after the built-in checks.
+// It is meant for custom builds and must be called during program initialization.
+func RegisterValidator(v Validator) {
+	registeredValidators = append(registeredValidators, v)
+}
+
+// validateCandidate runs c through validators in order, stopping at the first rejection.
+// External filters are timed in the scan stage of stages, other validators in the validate stage.
+func validateCandidate(validators []Validator, c *UploadCandidate, stages *uploadStages) error {
+	for _, v := range validators {
+		err := v.Validate(c)
+		if _, ok := v.(execFilter); ok {
+			stages.mark(stageScan)
+		} else {
+			stages.mark(stageValidate)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newValidators returns the built-in validators enabled by config, followed by
+// the external filters and the registered validators. OPA is queried with outbound.
+func newValidators(config Config, outbound *Outbound) []Validator {
+	var validators []Validator
+
+	if config.maxFilenameLength > 0 || config.filenameChars != "" || config.filenameNormalization != NormalizationNone {
+		validators = append(validators, filenameValidator(config.maxFilenameLength, config.filenameChars, config.filenameExtraChars, config.filenameNormalization))
+	}
+	if config.maxFileSize > 0 {
+		validators = append(validators, maxSizeValidator(config.maxFileSize))
+	}
+	if config.allowedExtensions != "" {
+		validators = append(validators, extensionValidator(strings.Split(config.allowedExtensions, ",")))
+	}
+	if config.allowedTypes != "" {
+		validators = append(validators, contentTypeValidator(strings.Split(config.allowedTypes, ",")))
+	}
+	if len(config.policy.rules) > 0 {
+		validators = append(validators, config.policy)
+	}
+	if config.opaURL != "" {
+		validators = append(validators, opaValidator(config.opaURL, outbound.client(config.opaTimeout)))
+	}
+	for _, filter := range config.filterCmds {
+		args := strings.Fields(filter)
+		validators = append(validators, execValidator(config.filterTimeout, args[0], args[1:]...))
+	}
+
+	return append(validators, registeredValidators...)
+}
+
+// maxSizeValidator rejects uploads larger than maxSize bytes. Multipart and batch uploads stop reading files
+// as soon as they exceed it, see [spool], the validator covers the other ways files arrive, e.g. ingestion.
+func maxSizeValidator(maxSize int64) Validator {
+	return ValidatorFunc(func(c *UploadCandidate) error {
+		if c.Size > maxSize {
+			return &RejectionError{http.StatusRequestEntityTooLarge, fmt.Sprintf("file exceeds %d bytes", maxSize)}
+		}
+		return nil
+	})
+}
+
+// extensionValidator rejects uploads whose file name extension is not one of extensions, e.g. ".png".
+func extensionValidator(extensions []string) Validator {
+	allowed := make(map[string]bool, len(extensions))
+	for _, ext := range extensions {
+		allowed[strings.ToLower(strings.TrimSpace(ext))] = true
+	}
+
+	return ValidatorFunc(func(c *UploadCandidate) error {
+		ext := strings.ToLower(filepath.Ext(c.Filename))
+		if !allowed[ext] {
+			return &RejectionError{http.StatusUnsupportedMediaType, fmt.Sprintf("file extension %q is not allowed", ext)}
+		}
+		return nil
+	})
+}
+
+// contentTypeValidator rejects uploads whose sniffed content type does not match
+// any of patterns, e.g. "image/png" or "image/*".
+func contentTypeValidator(patterns []string) Validator {
+	for i, p := range patterns {
+		patterns[i] = strings.TrimSpace(p)
+	}
+
+	return ValidatorFunc(func(c *UploadCandidate) error {
+		mediaType, _, _ := strings.Cut(c.ContentType, ";")
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, mediaType); ok {
+				return nil
+			}
+		}
+		return &RejectionError{http.StatusUnsupportedMediaType, fmt.Sprintf("content type %q is not allowed", mediaType)}
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// prefersXML reports whether the Accept header of r ranks an XML media type above JSON, for legacy clients
+// sending "Accept: application/xml". Wildcards count for JSON, which stays the default.
+func prefersXML(r *http.Request) bool {
+	var xmlQ, jsonQ float64
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accepted)
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+
+		switch mediaType {
+		case "application/xml", "text/xml":
+			xmlQ = max(xmlQ, q)
+		case "application/json", "application/*", "*/*":
+			jsonQ = max(jsonQ, q)
+		}
+	}
+	return xmlQ > 0 && xmlQ > jsonQ
+}
+
+// writeNegotiated writes v as JSON, or x as XML if r prefers it, see [prefersXML].
+func writeNegotiated(w http.ResponseWriter, r *http.Request, v, x any) {
+	w.Header().Add("Vary", "Accept")
+
+	if !prefersXML(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+
+	writeXML(w, http.StatusOK, x)
+}
+
+// writeXML writes x as an XML document with status.
+func writeXML(w http.ResponseWriter, status int, x any) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(x)
+	w.Write([]byte("\n"))
+}
+
+// xmlEntry is an entry of a string map, encoded in XML as <entry key="k">v</entry>.
+type xmlEntry struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+// xmlMap is the XML form of a string map, its entries sorted by key.
+type xmlMap struct {
+	Entries []xmlEntry `xml:"entry"`
+}
+
+// newXMLMap returns the XML form of m, nil if m is empty.
+func newXMLMap(m map[string]string) *xmlMap {
+	if len(m) == 0 {
+		return nil
+	}
+
+	entries := make([]xmlEntry, 0, len(m))
+	for k, v := range m {
+		entries = append(entries, xmlEntry{k, v})
+	}
+	slices.SortFunc(entries, func(a, b xmlEntry) int { return strings.Compare(a.Key, b.Key) })
+	return &xmlMap{entries}
+}
+
+// xmlAttachment is an [Attachment] along with its kind, which keys attachments in JSON.
+type xmlAttachment struct {
+	Kind string `xml:"kind,attr"`
+	Attachment
+}
+
+// xmlAttachmentList is the XML form of the attachments of a file, sorted by kind.
+type xmlAttachmentList struct {
+	XMLName     xml.Name        `xml:"attachments"`
+	Attachments []xmlAttachment `xml:"attachment"`
+}
+
+// newXMLAttachmentList returns the XML form of the attachments m, nil if m is empty.
+func newXMLAttachmentList(m map[string]Attachment) *xmlAttachmentList {
+	if len(m) == 0 {
+		return nil
+	}
+
+	attachments := make([]xmlAttachment, 0, len(m))
+	for kind, a := range m {
+		attachments = append(attachments, xmlAttachment{Kind: kind, Attachment: a})
+	}
+	slices.SortFunc(attachments, func(a, b xmlAttachment) int { return strings.Compare(a.Kind, b.Kind) })
+	return &xmlAttachmentList{Attachments: attachments}
+}
+
+// MarshalXML encodes m with the element names of its JSON encoding, the user metadata as <meta> entries
+// and the attachments as an <attachments> list.
+func (m Metadata) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	return e.EncodeElement(struct {
+		Name        string             `xml:"name"`
+		Size        int64              `xml:"size"`
+		ContentType string             `xml:"content_type,omitempty"`
+		SHA256      string             `xml:"sha256,omitempty"`
+		Checksums   *xmlMap            `xml:"checksums,omitempty"`
+		UploadedAt  time.Time          `xml:"uploaded_at"`
+		RequestID   string             `xml:"request_id,omitempty"`
+		Meta        *xmlMap            `xml:"meta,omitempty"`
+		DeletedAt   *time.Time         `xml:"deleted_at,omitempty"`
+		AccessedAt  *time.Time         `xml:"accessed_at,omitempty"`
+		Tier        string             `xml:"tier,omitempty"`
+		Encryption  *Encryption        `xml:"encryption,omitempty"`
+		Minisig     string             `xml:"minisig,omitempty"`
+		SignedBy    string             `xml:"signed_by,omitempty"`
+		Attachments *xmlAttachmentList `xml:"attachments,omitempty"`
+	}{
+		m.Name, m.Size, m.ContentType, m.SHA256, newXMLMap(m.Checksums), m.UploadedAt, m.RequestID, newXMLMap(m.Meta), m.DeletedAt,
+		m.AccessedAt, m.Tier, m.Encryption, m.Minisig, m.SignedBy, newXMLAttachmentList(m.Attachments),
+	}, start)
+}
+
+// xmlFiles is the XML form of a list of files.
+type xmlFiles struct {
+	XMLName xml.Name   `xml:"files"`
+	Files   []Metadata `xml:"file"`
+}
+
+// xmlBuckets is the XML form of a list of buckets.
+type xmlBuckets struct {
+	XMLName xml.Name `xml:"buckets"`
+	Buckets []Bucket `xml:"bucket"`
+}
+
+// xmlUpload is the XML form of the response to a stored upload.
+type xmlUpload struct {
+	XMLName   xml.Name   `xml:"upload"`
+	RequestID string     `xml:"request_id,attr,omitempty"`
+	Files     []Metadata `xml:"file"`
+}
+
+// xmlError is the XML form of the response to a failed request.
+type xmlError struct {
+	XMLName   xml.Name `xml:"error"`
+	RequestID string   `xml:"request_id,attr,omitempty"`
+	Status    int      `xml:"status,attr"`
+	Message   string   `xml:",chardata"`
+}